@@ -184,8 +184,32 @@ And lastly, here is how we call the function to handle cancellation with context
 
 [/cwl:p]
 
+[cwl:p 50]
+## 5. Reporting Progress
+
+Long operations often need to tell the caller how far along they are, not only when they complete. Operations that
+can report their progress implement an additional, optional interface:
+
+```go
+type progressReporter interface {
+	Progress() <-chan float64
+}
+```
+
+The wrapper checks if the operation implements `progressReporter` with a type assertion and forwards the updates to
+the caller's `progress` channel, while still handling cancellation:
+
+[cwl:l runWithProgress fullSrc=true]
+
+For operations that don't report progress, the `updates` channel is left `nil`. Receiving from a `nil` channel blocks
+forever, so the `select` simply never activates that `case`.
+
+Note that the `mockComplexOp` drops progress updates when the previous one wasn't consumed yet: a slow reader should
+never block the operation it is observing.
+[/cwl:p]
+
 [cwl:p 99]
-## 5. Conclusion
+## 6. Conclusion
 
 In this article, we learned different ways to gracefully cancel long-running operations running Go subroutines.
 
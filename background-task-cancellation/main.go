@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -12,34 +14,91 @@ import (
 // like a complex computation, a database transaction or an HTTP request
 type mockComplexOp struct {
 	Duration time.Duration
-	timer    *time.Timer
+	// ProgressInterval is the interval between progress updates.
+	// Progress is not reported when zero.
+	ProgressInterval time.Duration
+
+	initOnce sync.Once
+	stopOnce sync.Once
+	progress chan float64
+	stopCh   chan struct{}
+}
+
+func (op *mockComplexOp) init() {
+	op.initOnce.Do(func() {
+		op.progress = make(chan float64, 1)
+		op.stopCh = make(chan struct{})
+	})
 }
 
 // Do performs the uninterruptible operation.
-// This mock implementation just sleeps for a set Duration
+// This mock implementation just sleeps for a set Duration, reporting the
+// fraction of Duration elapsed every ProgressInterval.
 func (op *mockComplexOp) Do() error {
-	op.timer = time.NewTimer(op.Duration)
-	// reading from timer's channel is uninterruptible
-	<-op.timer.C
-	return nil
+	op.init()
+	defer close(op.progress)
+
+	timer := time.NewTimer(op.Duration)
+	defer timer.Stop()
+
+	var ticks <-chan time.Time
+	if op.ProgressInterval > 0 {
+		ticker := time.NewTicker(op.ProgressInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	start := time.Now()
+	for {
+		select {
+		case <-timer.C:
+			op.report(1)
+			return nil
+		case <-ticks:
+			op.report(min(float64(time.Since(start))/float64(op.Duration), 1))
+		case <-op.stopCh:
+			return errOpStopped
+		}
+	}
+}
+
+// report sends a progress update, dropping it if the previous one wasn't
+// consumed yet so that the operation is never blocked by slow readers.
+func (op *mockComplexOp) report(p float64) {
+	select {
+	case op.progress <- p:
+	default:
+	}
+}
+
+// Progress returns the channel receiving the progress updates of the operation.
+// The channel is closed when the operation completes or is stopped.
+func (op *mockComplexOp) Progress() <-chan float64 {
+	op.init()
+	return op.progress
 }
 
 // Stop will gracefully terminate the long-running operation
 func (op *mockComplexOp) Stop() {
-	if op.timer != nil {
-		if !op.timer.Stop() {
-			<-op.timer.C
-		}
-	}
+	op.init()
+	op.stopOnce.Do(func() { close(op.stopCh) })
 }
 
 // [/cwl:b]
 
+var errOpStopped = errors.New("operation stopped")
+
 type longRunningOp interface {
 	Do() error
 	Stop()
 }
 
+// progressReporter is optionally implemented by long-running operations that
+// report their progress while running, as a fraction between 0 and 1.
+type progressReporter interface {
+	Progress() <-chan float64
+}
+
 // [cwl:b runOnce]
 
 // runOpOnce is just an example of how to execute a long-running operation in the
@@ -128,6 +187,85 @@ func runOpWithContext(
 
 // [/cwl:b]
 
+// [cwl:b runWithProgress]
+
+// runOpWithProgress executes the long-running operation like runOpWithContext,
+// forwarding its progress updates to the progress channel until the operation
+// completes or the Context is Done. Both progress and completed are closed
+// before returning.
+//
+// Operations that don't implement progressReporter don't send any update.
+func runOpWithProgress(
+	ctx context.Context,
+	op longRunningOp,
+	progress chan<- float64,
+	completed chan struct{}) {
+
+	defer close(completed)
+	defer close(progress)
+
+	fnCompleted := make(chan struct{})
+	go func() {
+		op.Do()
+		close(fnCompleted)
+	}()
+
+	// receiving from a nil channel blocks forever, so the select below
+	// never picks updates for operations that don't report progress
+	var updates <-chan float64
+	if reporter, ok := op.(progressReporter); ok {
+		updates = reporter.Progress()
+	}
+
+	for {
+		select {
+		case p, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			select {
+			case progress <- p:
+			case <-ctx.Done():
+				op.Stop()
+				return
+			}
+
+		case <-fnCompleted:
+			forwardPending(ctx, updates, progress)
+			return
+
+		case <-ctx.Done():
+			// Context timed-out or cancelled before operation could
+			// complete. Requesting termination and dropping any further update.
+			op.Stop()
+			return
+		}
+	}
+}
+
+// forwardPending forwards the progress updates reported before the operation
+// completed and not yet received.
+func forwardPending(ctx context.Context, updates <-chan float64, progress chan<- float64) {
+	for {
+		select {
+		case p, ok := <-updates:
+			if !ok {
+				return
+			}
+			select {
+			case progress <- p:
+			case <-ctx.Done():
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// [/cwl:b]
+
 func main() {
 	fmt.Println("Usage: Run with `go test ./... -v`")
 }
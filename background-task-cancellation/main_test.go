@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"testing"
 	"time"
 )
@@ -80,3 +81,93 @@ func TestBackgroundTaskWithContext(t *testing.T) {
 		t.Fatal("task execution was not cancelled timely")
 	}
 } // [/cwl:b]
+
+func TestBackgroundTaskProgress(t *testing.T) {
+	op := &mockComplexOp{Duration: 200 * time.Millisecond, ProgressInterval: 20 * time.Millisecond}
+
+	progress := make(chan float64)
+	completedCh := make(chan struct{})
+	go runOpWithProgress(context.Background(), op, progress, completedCh)
+
+	var updates []float64
+	for p := range progress {
+		updates = append(updates, p)
+	}
+	<-completedCh
+
+	if len(updates) < 2 {
+		t.Fatalf("expected progress updates while running, found %v", updates)
+	}
+	for i, p := range updates {
+		if p < 0 || p > 1 || (i > 0 && p < updates[i-1]) {
+			t.Fatalf("expected increasing progress between 0 and 1, found %v", updates)
+		}
+	}
+	if last := updates[len(updates)-1]; last != 1 {
+		t.Fatalf("expected final progress %v, found %v", 1.0, last)
+	}
+}
+
+func TestBackgroundTaskProgressCancel(t *testing.T) {
+	op := &mockComplexOp{Duration: 5 * time.Second, ProgressInterval: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progress := make(chan float64)
+	completedCh := make(chan struct{})
+	go runOpWithProgress(ctx, op, progress, completedCh)
+
+	// receiving a few updates before cancelling the operation
+	for i := 0; i < 3; i++ {
+		select {
+		case <-progress:
+		case <-time.After(time.Second):
+			t.Fatal("progress updates were not received")
+		}
+	}
+	cancel()
+
+	select {
+	case <-completedCh:
+	case <-time.After(time.Second):
+		t.Fatal("task execution was not cancelled timely")
+	}
+	if _, ok := <-progress; ok {
+		t.Fatal("progress channel should be closed after cancellation")
+	}
+
+	// the operation stops reporting progress once stopped: its channel is
+	// closed after any update still buffered
+	drained := make(chan struct{})
+	go func() {
+		for range op.Progress() {
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("operation should stop reporting progress")
+	}
+}
+
+func TestBackgroundTaskProgressWithoutReporter(t *testing.T) {
+	op := &webServerOp{Server: &http.Server{Addr: "127.0.0.1:0"}, ForceShutdownAfter: time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	progress := make(chan float64)
+	completedCh := make(chan struct{})
+	go runOpWithProgress(ctx, op, progress, completedCh)
+
+	if _, ok := <-progress; ok {
+		t.Fatal("operations without progress reporting should not send updates")
+	}
+	select {
+	case <-completedCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("task execution was not cancelled timely")
+	}
+}
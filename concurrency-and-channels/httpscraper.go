@@ -6,12 +6,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mcastellin/golang-mastery/concurrency-and-channels/workerpool"
 )
 
 // requestDoer is an interface that wraps Do method of the http client
@@ -24,28 +28,24 @@ func defaultRequestDoer() requestDoer {
 	return &http.Client{}
 }
 
-// httpWorker handles scraping request submitted to the reqCh channel.
-//
-// This function allows task cancellation with graceful termination of in-flight requests
-// using the sigExit channel.
-func httpWorker(wg *sync.WaitGroup, reqDoer requestDoer, handler scrapeResponseHandler,
-	reqCh <-chan http.Request, sigExit <-chan struct{}, postFn func()) {
+// decoratedDoer applies the request decorator before every call to the
+// wrapped requestDoer, so that retried requests are decorated as well.
+type decoratedDoer struct {
+	requestDoer
+	decorate requestDecoratorFn
+}
 
-	defer wg.Done()
+func (d *decoratedDoer) Do(req *http.Request) (*http.Response, error) {
+	// decorating a clone, as headers are shared with the request submitted to Scrape
+	req = req.Clone(req.Context())
+	d.decorate(req)
+	return d.requestDoer.Do(req)
+}
 
-	for {
-		select {
-		case <-sigExit:
-			return
-		case req, ok := <-reqCh:
-			if !ok {
-				return // channel closed
-			}
-			resp, err := reqDoer.Do(&req)
-			handler(&req, resp, err)
-			postFn()
-		}
-	}
+// scrapeResult is the outcome of a scrape request, collected into the scraper metrics
+type scrapeResult struct {
+	res *http.Response
+	err error
 }
 
 // Dummy scrape response handler to use if none is provider to the scraper
@@ -63,6 +63,7 @@ func defaultScrapeResponseHandler(req *http.Request, res *http.Response, err err
 
 type httpClientProviderFn func() requestDoer
 type scrapeResponseHandler func(*http.Request, *http.Response, error)
+type requestDecoratorFn func(*http.Request)
 
 // The HTTPScraper is capable of making HTTP requests in parallel using goroutines
 // and then call custom handler logic defined by the ResponseHandler function.
@@ -75,13 +76,29 @@ type HTTPScraper struct {
 	PageLoadTimeout      time.Duration
 	HttpClientProviderFn httpClientProviderFn
 	ResponseHandler      scrapeResponseHandler
+	// RequestDecorator is called on every request before it's sent, to set
+	// headers like User-Agent or authentication tokens uniformly
+	RequestDecorator requestDecoratorFn
+	// MaxDepth enables the crawler mode when positive: the ResponseHandler can
+	// submit the links found in a page with Follow, up to MaxDepth links away
+	// from the pages submitted with Scrape.
+	MaxDepth int
+	// MaxPages caps the number of pages visited in crawler mode, including the
+	// ones submitted with Scrape. Crawls are only bound by MaxDepth when zero.
+	MaxPages int
+
+	crawl crawlState
 
 	scrapedPages int64
-	reqCh        chan http.Request
-	sigExit      chan struct{}
-	closeOnce    sync.Once
-	exitOnce     sync.Once
-	wg           *sync.WaitGroup
+	successes    int64
+	errors       int64
+	statusMu     sync.Mutex
+	statusCodes  map[int]int64
+
+	pool   *workerpool.WorkerPool[http.Request, scrapeResult]
+	cancel context.CancelFunc
+	// collected is closed once all the scrape results are tallied
+	collected chan struct{}
 }
 
 // Starts scraper's workers.
@@ -104,67 +121,272 @@ func (sc *HTTPScraper) Start(ctx context.Context) {
 		sc.ResponseHandler = defaultScrapeResponseHandler
 	}
 
-	incrementerFn := func() {
-		atomic.AddInt64(&sc.scrapedPages, 1)
-	}
+	sc.statusCodes = map[int]int64{}
 
 	bufSize := sc.Buffer
 	if bufSize <= 0 {
 		bufSize = sc.Workers * 2
 	}
-	sc.reqCh = make(chan http.Request, bufSize)
-	sc.sigExit = make(chan struct{})
 
-	sc.wg = &sync.WaitGroup{}
+	// every worker borrows one of the clients for the duration of a request
+	clients := make(chan requestDoer, sc.Workers)
 	for i := 0; i < sc.Workers; i++ {
-		sc.wg.Add(1)
-		go httpWorker(sc.wg, sc.HttpClientProviderFn(), sc.ResponseHandler,
-			sc.reqCh, sc.sigExit, incrementerFn)
+		doer := sc.HttpClientProviderFn()
+		if sc.RequestDecorator != nil {
+			doer = &decoratedDoer{requestDoer: doer, decorate: sc.RequestDecorator}
+		}
+		clients <- doer
 	}
+	scrapeFn := func(_ context.Context, req http.Request) scrapeResult {
+		doer := <-clients
+		defer func() { clients <- doer }()
 
-	var exitHandler = func() {
-		select {
-		case <-ctx.Done():
-			sc.exitOnce.Do(func() { close(sc.sigExit) })
+		resp, err := doer.Do(&req)
+		sc.ResponseHandler(&req, resp, err)
+		if sc.crawling() {
+			// links followed by the handler are already pending
+			sc.crawl.handled()
 		}
+		return scrapeResult{res: resp, err: err}
 	}
-	go exitHandler()
+	sc.crawl = crawlState{visited: map[string]struct{}{}, drained: make(chan struct{})}
+
+	var poolCtx context.Context
+	poolCtx, sc.cancel = context.WithCancel(ctx)
+	sc.pool = workerpool.New(poolCtx, sc.Workers, bufSize, scrapeFn)
+
+	// fan-in of the scrape results into the scraper metrics
+	sc.collected = make(chan struct{})
+	go func() {
+		defer close(sc.collected)
+		for r := range sc.pool.Results() {
+			atomic.AddInt64(&sc.scrapedPages, 1)
+			sc.collectMetrics(r.res, r.err)
+		}
+	}()
 }
 
-// Add a new page scraping request into the queue
+// Add a new page scraping request into the queue.
+//
+// Scrape is safe to call concurrently with Done: requests submitted after the
+// scraper input is closed are rejected with an error.
+//
+// In crawler mode, pages already visited are not scraped again and pages past
+// MaxPages are rejected.
 func (sc *HTTPScraper) Scrape(req http.Request) error {
-	select {
-	case <-sc.sigExit:
-		return fmt.Errorf("scraper closed or not yet started.")
-	default:
-		sc.reqCh <- req
+	if sc.pool == nil {
+		return errScraperClosed
+	}
+	if sc.crawling() {
+		if err := sc.crawl.visit(req.URL, sc.MaxPages, false); err != nil {
+			return err
+		}
+	}
+	if err := sc.pool.Submit(req); err != nil {
+		if sc.crawling() {
+			sc.crawl.handled()
+		}
+		return errScraperClosed
 	}
 	return nil
 }
 
-// Closes the scraper input and blocks until all requests are completed.
+// Follow submits a GET request for a link found in the page of the parent request,
+// resolving relative links against the parent URL. It's meant to be called by the
+// ResponseHandler in crawler mode, see MaxDepth.
 //
-// After Done() is called, the scraper will be unable to receive further requests.
-// Attempting to do so will result in a panic.
-func (sc *HTTPScraper) Done(ctx context.Context) {
-	sc.closeOnce.Do(func() { close(sc.reqCh) })
+// Links more than MaxDepth away from the pages submitted with Scrape, pages already
+// visited and pages past MaxPages are rejected with an error. Follow never blocks
+// waiting for a worker: requests are submitted in the background, so that handlers
+// can follow links while all workers are busy.
+func (sc *HTTPScraper) Follow(parent *http.Request, link string) error {
+	if !sc.crawling() {
+		return errCrawlDisabled
+	}
+	target, err := parent.URL.Parse(link)
+	if err != nil {
+		return err
+	}
+	target.Fragment = ""
+
+	depth := crawlDepth(parent.Context()) + 1
+	if depth > sc.MaxDepth {
+		return errMaxDepth
+	}
+	ctx := context.WithValue(parent.Context(), crawlDepthKey{}, depth)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := sc.crawl.visit(req.URL, sc.MaxPages, true); err != nil {
+		return err
+	}
 
-	done := make(chan struct{})
 	go func() {
-		sc.wg.Wait()
-		close(done)
+		if err := sc.pool.Submit(*req); err != nil {
+			sc.crawl.handled()
+		}
 	}()
+	return nil
+}
+
+// crawling returns true if the scraper runs in crawler mode
+func (sc *HTTPScraper) crawling() bool {
+	return sc.MaxDepth > 0
+}
+
+// crawlDepthKey is the request context key of the number of links followed
+// to reach a page from the pages submitted with Scrape
+type crawlDepthKey struct{}
+
+func crawlDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(crawlDepthKey{}).(int)
+	return depth
+}
+
+// crawlState tracks the pages visited in crawler mode and the requests that
+// were submitted but not handled yet, so that the scraper input is only closed
+// once there are no more links to follow.
+type crawlState struct {
+	mu      sync.Mutex
+	visited map[string]struct{}
+	pending int
+	// draining is set by Done, drained is closed once no requests are pending
+	draining bool
+	drained  chan struct{}
+	finished bool
+}
+
+// visit records the page as visited and pending. Once Done is called, only
+// links followed by the handlers of pending requests are accepted.
+func (cs *crawlState) visit(u *url.URL, maxPages int, followed bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.finished || (cs.draining && !followed) {
+		return errScraperClosed
+	}
+	key := u.String()
+	if _, ok := cs.visited[key]; ok {
+		return errAlreadyVisited
+	}
+	if maxPages > 0 && len(cs.visited) >= maxPages {
+		return errMaxPages
+	}
+	cs.visited[key] = struct{}{}
+	cs.pending++
+	return nil
+}
+
+// handled records a pending request was handled or dropped
+func (cs *crawlState) handled() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.pending--
+	if cs.pending == 0 && cs.draining {
+		cs.finish()
+	}
+}
+
+// finish marks the crawl as completed. Callers must hold the lock.
+func (cs *crawlState) finish() {
+	if !cs.finished {
+		cs.finished = true
+		close(cs.drained)
+	}
+}
+
+// drain returns a channel that's closed once no requests are pending
+func (cs *crawlState) drain() <-chan struct{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.draining = true
+	if cs.pending == 0 {
+		cs.finish()
+	}
+	return cs.drained
+}
+
+// Closes the scraper input and blocks until all requests are completed.
+//
+// After Done() is called, the scraper will be unable to receive further requests.
+// Attempting to do so will result in an error.
+//
+// In crawler mode, Done waits for the crawl to complete: the input is closed
+// once the handlers of all pages have followed their links.
+func (sc *HTTPScraper) Done(ctx context.Context) {
+	if sc.crawling() {
+		select {
+		case <-sc.crawl.drain():
+		case <-sc.pool.Done():
+			// the Start context was cancelled: buffered requests are dropped
+			// without being handled and the crawl can't complete
+		case <-ctx.Done():
+		}
+	}
+	sc.pool.Close()
 
 	select {
-	case <-done:
+	case <-sc.pool.Done():
 		// graceful termination
+		<-sc.collected
 	case <-ctx.Done():
 		// context cancelled or timed-out
 	}
-	sc.exitOnce.Do(func() { close(sc.sigExit) })
+	sc.cancel()
 }
 
+var (
+	errScraperClosed  = fmt.Errorf("scraper closed or not yet started.")
+	errCrawlDisabled  = errors.New("crawler mode disabled: MaxDepth is not set")
+	errMaxDepth       = errors.New("link exceeds the maximum crawl depth")
+	errMaxPages       = errors.New("crawl reached the maximum number of pages")
+	errAlreadyVisited = errors.New("page already visited")
+)
+
 // Returns the total number of pages scraped including failed requests
 func (sc *HTTPScraper) ScrapedPages() int64 {
 	return atomic.LoadInt64(&sc.scrapedPages)
 }
+
+// ScraperMetrics is a snapshot of the aggregate results of a scrape run.
+//
+// Successes counts the requests that received a response, regardless of the status
+// code, while Errors counts requests that failed without a response.
+type ScraperMetrics struct {
+	Successes   int64
+	Errors      int64
+	StatusCodes map[int]int64
+}
+
+// Tally the result of a scrape request
+func (sc *HTTPScraper) collectMetrics(res *http.Response, err error) {
+	if err != nil || res == nil {
+		atomic.AddInt64(&sc.errors, 1)
+		return
+	}
+	atomic.AddInt64(&sc.successes, 1)
+
+	sc.statusMu.Lock()
+	defer sc.statusMu.Unlock()
+	sc.statusCodes[res.StatusCode]++
+}
+
+// Returns a snapshot of the scraper metrics.
+// The snapshot is safe to use while the scraper is still running.
+func (sc *HTTPScraper) Metrics() ScraperMetrics {
+	sc.statusMu.Lock()
+	codes := make(map[int]int64, len(sc.statusCodes))
+	for code, n := range sc.statusCodes {
+		codes[code] = n
+	}
+	sc.statusMu.Unlock()
+
+	return ScraperMetrics{
+		Successes:   atomic.LoadInt64(&sc.successes),
+		Errors:      atomic.LoadInt64(&sc.errors),
+		StatusCodes: codes,
+	}
+}
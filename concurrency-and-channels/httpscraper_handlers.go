@@ -7,6 +7,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -58,3 +59,31 @@ func (sc *ScrapeStatsHandler) Stats() ScrapeStats {
 	defer sc.mu.RUnlock()
 	return sc.stats
 }
+
+// JsonResponseHandler returns a scrape response handler that decodes the JSON response
+// body into a new value of type T and passes it to the handler function.
+//
+// The response body is always closed. Request errors, body read errors and decoding
+// errors are passed to the handler with a nil value.
+func JsonResponseHandler[T any](handler func(*http.Request, *T, error)) scrapeResponseHandler {
+	return func(req *http.Request, res *http.Response, err error) {
+		if err != nil {
+			handler(req, nil, err)
+			return
+		}
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			handler(req, nil, fmt.Errorf("error reading response body for %s: %w", req.URL, err))
+			return
+		}
+
+		v := new(T)
+		if err := json.Unmarshal(b, v); err != nil {
+			handler(req, nil, fmt.Errorf("error decoding response body for %s: %w", req.URL, err))
+			return
+		}
+		handler(req, v, nil)
+	}
+}
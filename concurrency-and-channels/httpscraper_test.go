@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -165,6 +166,406 @@ func TestHTTPScraperGracefulShutdownShouldCancelWithTimeout(t *testing.T) {
 
 }
 
+func TestHTTPScraperScrapeAfterDone(t *testing.T) {
+	scraper := &HTTPScraper{
+		HttpClientProviderFn: func() requestDoer {
+			return &mockHTTPClient{}
+		},
+		ResponseHandler: func(*http.Request, *http.Response, error) {},
+	}
+	scraper.Start(context.Background())
+	scraper.Done(context.TODO())
+
+	req, err := http.NewRequest("GET", "http://example.com/products/1", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := scraper.Scrape(*req); err == nil {
+			t.Fatal("expected error scraping after Done, found nil")
+		}
+	}
+}
+
+func TestHTTPScraperConcurrentScrapeAndDone(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		scraper := &HTTPScraper{
+			Workers: 2,
+			Buffer:  1,
+			HttpClientProviderFn: func() requestDoer {
+				return &mockHTTPClient{}
+			},
+			ResponseHandler: func(*http.Request, *http.Response, error) {},
+		}
+		scraper.Start(context.Background())
+
+		req, err := http.NewRequest("GET", "http://example.com/products/1", nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if err := scraper.Scrape(*req); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		scraper.Done(context.TODO())
+		wg.Wait()
+
+		if err := scraper.Scrape(*req); err == nil {
+			t.Fatal("expected error scraping after Done, found nil")
+		}
+	}
+}
+
+func TestJsonResponseHandler(t *testing.T) {
+	type product struct {
+		ProductId string `json:"productId"`
+		Stock     int    `json:"stock"`
+	}
+
+	var mu sync.Mutex
+	products := []*product{}
+	handler := JsonResponseHandler(func(req *http.Request, p *product, err error) {
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", req.URL, err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		products = append(products, p)
+	})
+
+	scraper := &HTTPScraper{
+		Workers: 2,
+		HttpClientProviderFn: func() requestDoer {
+			return &mockHTTPClient{}
+		},
+		ResponseHandler: handler,
+	}
+	scraper.Start(context.Background())
+
+	for _, data := range getUrls(2) {
+		req, err := http.NewRequest(data[0], data[1], nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		scraper.Scrape(*req)
+	}
+	scraper.Done(context.TODO())
+
+	if len(products) != 2 {
+		t.Fatalf("wrong number of decoded responses: expected %d, found %d", 2, len(products))
+	}
+	for _, p := range products {
+		if p.ProductId != "1234" || p.Stock != 99 {
+			t.Fatalf("wrong decoded response: %+v", *p)
+		}
+	}
+}
+
+func TestJsonResponseHandlerDecodeError(t *testing.T) {
+	var decodeErr error
+	handler := JsonResponseHandler(func(req *http.Request, v *map[string]any, err error) {
+		if v != nil {
+			t.Errorf("expected nil value on error, found %v", *v)
+		}
+		decodeErr = err
+	})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	handler(req, &http.Response{Body: io.NopCloser(strings.NewReader("not json"))}, nil)
+	if decodeErr == nil {
+		t.Fatal("expected decoding error, found nil")
+	}
+}
+
+func TestHTTPScraperMetrics(t *testing.T) {
+	index := getUrls(0)
+
+	scraper := &HTTPScraper{
+		Workers: 4,
+		Buffer:  len(index),
+		HttpClientProviderFn: func() requestDoer {
+			return &mockStatusHTTPClient{}
+		},
+		ResponseHandler: func(*http.Request, *http.Response, error) {},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scraper.Start(ctx)
+
+	for _, data := range index {
+		req, err := http.NewRequest(data[0], data[1], nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		scraper.Scrape(*req)
+	}
+	scraper.Done(context.TODO())
+
+	// acme.com pages fail, products 1-5 alternate 200 and 404
+	m := scraper.Metrics()
+	if m.Successes != 5 {
+		t.Fatalf("wrong successes count: expected %d, found %d", 5, m.Successes)
+	}
+	if m.Errors != 3 {
+		t.Fatalf("wrong errors count: expected %d, found %d", 3, m.Errors)
+	}
+	if m.StatusCodes[http.StatusOK] != 3 || m.StatusCodes[http.StatusNotFound] != 2 || len(m.StatusCodes) != 2 {
+		t.Fatalf("wrong status codes tally: %v", m.StatusCodes)
+	}
+}
+
+func TestHTTPScraperRequestDecorator(t *testing.T) {
+	index := getUrls(0)
+	client := &mockRecordingHTTPClient{}
+
+	scraper := &HTTPScraper{
+		Workers: 4,
+		Buffer:  len(index),
+		HttpClientProviderFn: func() requestDoer {
+			return client
+		},
+		ResponseHandler: func(*http.Request, *http.Response, error) {},
+		RequestDecorator: func(req *http.Request) {
+			req.Header.Set("User-Agent", "scraper/1.0")
+			req.Header.Set("Authorization", "Bearer token")
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scraper.Start(ctx)
+
+	shared, err := http.NewRequest(http.MethodGet, index[0][1], nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	for range index {
+		scraper.Scrape(*shared)
+	}
+	scraper.Done(context.TODO())
+
+	received := client.Requests()
+	if len(received) != len(index) {
+		t.Fatalf("wrong number of requests: expected %d, found %d", len(index), len(received))
+	}
+	for _, req := range received {
+		if ua := req.Header.Get("User-Agent"); ua != "scraper/1.0" {
+			t.Fatalf("wrong user agent: expected %s, found %q", "scraper/1.0", ua)
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Fatalf("wrong authorization: expected %s, found %q", "Bearer token", auth)
+		}
+	}
+	if len(shared.Header) != 0 {
+		t.Fatalf("submitted request should not be modified, found headers %v", shared.Header)
+	}
+}
+
+// mockSiteHTTPClient serves the pages of a site graph: the body of every page
+// lists the links to other pages, one per line.
+type mockSiteHTTPClient struct {
+	pages map[string][]string
+}
+
+func (c *mockSiteHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	links, ok := c.pages[req.URL.Path]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	time.Sleep(time.Millisecond)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(strings.Join(links, "\n"))),
+	}, nil
+}
+
+// crawlTestSite is a site graph whose pages link back to their ancestors
+// and to themselves, so that pages are discovered multiple times.
+var crawlTestSite = map[string][]string{
+	"/":           {"/a", "/b", "/a#top", "/"},
+	"/a":          {"/a/1", "/a/2", "/"},
+	"/b":          {"b/1", "/a", "/missing"},
+	"/a/1":        {"/a/1/deep", "/a", "/a/1"},
+	"/a/2":        {"/"},
+	"/b/1":        {"/b/1/deep"},
+	"/a/1/deep":   {"/a/1/deep/x"},
+	"/b/1/deep":   {"/"},
+	"/a/1/deep/x": {},
+}
+
+// crawl runs the scraper in crawler mode from the root of crawlTestSite and
+// returns the number of times every page was visited, by depth.
+func crawl(t *testing.T, maxDepth, maxPages int) map[string][]int {
+	t.Helper()
+
+	var mu sync.Mutex
+	visits := map[string][]int{}
+	scraper := &HTTPScraper{Workers: 3, MaxDepth: maxDepth, MaxPages: maxPages}
+	scraper.HttpClientProviderFn = func() requestDoer {
+		return &mockSiteHTTPClient{pages: crawlTestSite}
+	}
+	scraper.ResponseHandler = func(req *http.Request, res *http.Response, err error) {
+		if err != nil {
+			t.Errorf("unexpected error scraping %s: %v", req.URL, err)
+			return
+		}
+		defer res.Body.Close()
+		mu.Lock()
+		visits[req.URL.Path] = append(visits[req.URL.Path], crawlDepth(req.Context()))
+		mu.Unlock()
+
+		b, _ := io.ReadAll(res.Body)
+		for _, link := range strings.Fields(string(b)) {
+			scraper.Follow(req, link)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scraper.Start(ctx)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err := scraper.Scrape(*req); err != nil {
+		t.Fatal(err)
+	}
+	scraper.Done(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("crawl did not complete")
+	}
+	if err := scraper.Scrape(*req); err != errScraperClosed {
+		t.Fatalf("expected error %v scraping after Done, found %v", errScraperClosed, err)
+	}
+	return visits
+}
+
+func TestHTTPScraperCrawlDepth(t *testing.T) {
+	visits := crawl(t, 2, 0)
+
+	expected := map[string]int{
+		"/": 0, "/a": 1, "/b": 1, "/missing": 2,
+		"/a/1": 2, "/a/2": 2, "/b/1": 2,
+	}
+	if len(visits) != len(expected) {
+		t.Fatalf("expected %d pages visited, found %v", len(expected), visits)
+	}
+	for page, depth := range expected {
+		if d := visits[page]; len(d) != 1 || d[0] != depth {
+			t.Fatalf("expected %s to be visited once at depth %d, found %v", page, depth, d)
+		}
+	}
+}
+
+func TestHTTPScraperCrawlMaxPages(t *testing.T) {
+	visits := crawl(t, 10, 4)
+	if len(visits) != 4 {
+		t.Fatalf("expected %d pages visited, found %v", 4, visits)
+	}
+	for page, d := range visits {
+		if len(d) != 1 {
+			t.Fatalf("expected %s to be visited once, found %d visits", page, len(d))
+		}
+	}
+}
+
+func TestHTTPScraperFollowRequiresCrawlerMode(t *testing.T) {
+	scraper := &HTTPScraper{}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err := scraper.Follow(req, "/a"); err != errCrawlDisabled {
+		t.Fatalf("expected error %v, found %v", errCrawlDisabled, err)
+	}
+}
+
+// mockBlockingHTTPClient blocks requests until released
+type mockBlockingHTTPClient struct {
+	release chan struct{}
+}
+
+func (c *mockBlockingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	<-c.release
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestHTTPScraperCrawlDoneAfterCancel(t *testing.T) {
+	client := &mockBlockingHTTPClient{release: make(chan struct{})}
+	scraper := &HTTPScraper{Workers: 1, Buffer: 5, MaxDepth: 1}
+	scraper.HttpClientProviderFn = func() requestDoer { return client }
+	scraper.ResponseHandler = func(*http.Request, *http.Response, error) {}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scraper.Start(ctx)
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/%d", i), nil)
+		if err := scraper.Scrape(*req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// requests still queued are dropped once the Start context is cancelled
+	cancel()
+	close(client.release)
+
+	done := make(chan struct{})
+	go func() {
+		scraper.Done(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Done blocked after the Start context was cancelled")
+	}
+}
+
+// mockRecordingHTTPClient records the requests it receives
+type mockRecordingHTTPClient struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (c *mockRecordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func (c *mockRecordingHTTPClient) Requests() []*http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*http.Request{}, c.requests...)
+}
+
+// mockStatusHTTPClient fails requests to acme.com and replies to odd product
+// pages with 200 OK, even ones with 404 Not Found.
+type mockStatusHTTPClient struct{}
+
+func (c *mockStatusHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "acme.com" {
+		return nil, fmt.Errorf("connection refused")
+	}
+
+	status := http.StatusOK
+	if strings.TrimPrefix(req.URL.Path, "/products/")[0]%2 == 0 {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
 type mockHTTPClient struct {
 	Latency time.Duration
 }
@@ -0,0 +1,127 @@
+// Package pipeline chains processing stages connected by channels, each stage
+// running a bounded number of goroutines.
+//
+// Stages are composed by passing the output channel of a stage as the input
+// of the next one:
+//
+//	urls := pipeline.Source(ctx, "a", "b", "c")
+//	pages, fetchErrs := pipeline.Stage(ctx, urls, 4, fetch)
+//	docs, parseErrs := pipeline.Stage(ctx, pages, 2, parse)
+//	errs := pipeline.MergeErrors(fetchErrs, parseErrs)
+//
+// Cancelling ctx stops every stage: workers exit as soon as their in-flight
+// call returns and all channels are closed.
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Source publishes the given items on a channel that's closed once all items
+// are sent or ctx is cancelled.
+func Source[T any](ctx context.Context, items ...T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for _, item := range items {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- item:
+			}
+		}
+	}()
+	return out
+}
+
+// Stage starts the given number of workers calling fn for every value received
+// from in. Successful outputs are published on the first channel, errors on the
+// second. Inputs that fail are not forwarded to the next stage.
+//
+// Both channels are closed when in is closed and drained or ctx is cancelled.
+// Both must be consumed, otherwise workers block publishing their results:
+// use MergeErrors to collect the errors of multiple stages.
+func Stage[In, Out any](ctx context.Context, in <-chan In, workers int, fn func(In) (Out, error)) (<-chan Out, <-chan error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	out := make(chan Out)
+	errc := make(chan error)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			stageWorker(ctx, in, out, errc, fn)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		close(errc)
+	}()
+	return out, errc
+}
+
+func stageWorker[In, Out any](ctx context.Context, in <-chan In, out chan<- Out, errc chan<- error, fn func(In) (Out, error)) {
+	for {
+		// checking for cancellation first, as select picks a random ready case
+		// and inputs must not be processed after the context is done
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		var v In
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case v, ok = <-in:
+			if !ok {
+				return // upstream stage completed
+			}
+		}
+
+		res, err := fn(v)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case errc <- err:
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case out <- res:
+		}
+	}
+}
+
+// MergeErrors fans in the error channels of multiple stages into a single
+// channel that's closed once all the given channels are closed. The merged
+// channel must be consumed until closed.
+func MergeErrors(errcs ...<-chan error) <-chan error {
+	merged := make(chan error)
+
+	var wg sync.WaitGroup
+	wg.Add(len(errcs))
+	for _, errc := range errcs {
+		go func(errc <-chan error) {
+			defer wg.Done()
+			for err := range errc {
+				merged <- err
+			}
+		}(errc)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// drain consumes a stage output until the channel is closed
+func drain[T any](ch <-chan T) <-chan []T {
+	out := make(chan []T, 1)
+	go func() {
+		var values []T
+		for v := range ch {
+			values = append(values, v)
+		}
+		out <- values
+	}()
+	return out
+}
+
+func TestPipelineComposition(t *testing.T) {
+	ctx := context.Background()
+
+	inputs := make([]int, 100)
+	for i := range inputs {
+		inputs[i] = i + 1
+	}
+	squares, squareErrs := Stage(ctx, Source(ctx, inputs...), 4, func(n int) (int, error) {
+		return n * n, nil
+	})
+	labels, labelErrs := Stage(ctx, squares, 2, func(n int) (string, error) {
+		return fmt.Sprintf("%05d", n), nil
+	})
+	errs := drain(MergeErrors(squareErrs, labelErrs))
+
+	results := <-drain(labels)
+	if err := <-errs; len(err) != 0 {
+		t.Fatalf("unexpected errors: %v", err)
+	}
+	if len(results) != len(inputs) {
+		t.Fatalf("expected %d results, found %d", len(inputs), len(results))
+	}
+	sort.Strings(results)
+	for i, n := range inputs {
+		if expected := fmt.Sprintf("%05d", n*n); results[i] != expected {
+			t.Fatalf("expected result %s, found %s", expected, results[i])
+		}
+	}
+}
+
+func TestPipelineErrorPropagation(t *testing.T) {
+	ctx := context.Background()
+	errOdd := errors.New("odd number")
+
+	evens, parseErrs := Stage(ctx, Source(ctx, 1, 2, 3, 4, 5, 6), 3, func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, fmt.Errorf("parsing %d: %w", n, errOdd)
+		}
+		return n, nil
+	})
+	var stored int64
+	done, storeErrs := Stage(ctx, evens, 2, func(n int) (struct{}, error) {
+		atomic.AddInt64(&stored, int64(n))
+		return struct{}{}, nil
+	})
+	drain(done)
+	errs := <-drain(MergeErrors(parseErrs, storeErrs))
+
+	if len(errs) != 3 {
+		t.Fatalf("expected %d errors, found %d: %v", 3, len(errs), errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, errOdd) {
+			t.Fatalf("expected %v, found %v", errOdd, err)
+		}
+	}
+	// failed inputs are not forwarded to the next stage
+	if n := atomic.LoadInt64(&stored); n != 2+4+6 {
+		t.Fatalf("expected stored sum %d, found %d", 2+4+6, n)
+	}
+}
+
+func TestPipelineCancellationStopsAllStages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// an endless source that only stops when the context is cancelled
+	source := make(chan int)
+	sourceDone := make(chan struct{})
+	go func() {
+		defer close(sourceDone)
+		defer close(source)
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case source <- i:
+			}
+		}
+	}()
+
+	var processed int64
+	first, firstErrs := Stage(ctx, source, 3, func(n int) (int, error) {
+		atomic.AddInt64(&processed, 1)
+		return n, nil
+	})
+	second, secondErrs := Stage(ctx, first, 3, func(n int) (int, error) {
+		if n%10 == 0 {
+			return 0, fmt.Errorf("failed %d", n)
+		}
+		return n, nil
+	})
+	errs := drain(MergeErrors(firstErrs, secondErrs))
+
+	// read a few results and stop consuming, leaving the workers blocked
+	for i := 0; i < 5; i++ {
+		<-second
+	}
+	cancel()
+
+	results := drain(second)
+	select {
+	case <-results:
+	case <-time.After(time.Second):
+		t.Fatal("stage outputs should be closed when the context is cancelled")
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("stage errors should be closed when the context is cancelled")
+	}
+	select {
+	case <-sourceDone:
+	case <-time.After(time.Second):
+		t.Fatal("source should stop when the context is cancelled")
+	}
+
+	// no more inputs are processed once all stages exited
+	n := atomic.LoadInt64(&processed)
+	time.Sleep(10 * time.Millisecond)
+	if after := atomic.LoadInt64(&processed); after != n {
+		t.Fatalf("inputs processed after cancellation: %d, then %d", n, after)
+	}
+}
+
+func TestSourceStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := Source(ctx, 1, 2, 3)
+	<-src
+	cancel()
+
+	select {
+	case <-drain(src):
+	case <-time.After(time.Second):
+		t.Fatal("source should be closed when the context is cancelled")
+	}
+}
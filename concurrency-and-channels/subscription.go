@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"sync"
 	"time"
 )
@@ -20,11 +21,39 @@ type Event struct {
 // The EventStore type represents a buffer of updates that are sent to
 // a Topic. The store will buffer the first MaxPending events. When more
 // events are pushed into the store, older events will be deleted.
+//
+// If MaxAge is set, events older than MaxAge are also dropped from the store,
+// in addition to the MaxPending cap.
 type EventStore struct {
 	MaxPending  int
+	MaxAge      time.Duration
 	updates     []Event
 	lastUpdated time.Time
 	mu          sync.RWMutex
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+func (s *EventStore) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
+
+// expiredCount returns the number of events at the head of the store that are
+// older than MaxAge.
+func (s *EventStore) expiredCount(now time.Time) int {
+	if s.MaxAge <= 0 {
+		return 0
+	}
+	cutoff := now.Add(-s.MaxAge)
+	n := 0
+	for n < len(s.updates) && s.updates[n].ts.Before(cutoff) {
+		n++
+	}
+	return n
 }
 
 // Push a new event into the store. If the store is at capacity, this operation
@@ -38,13 +67,15 @@ func (s *EventStore) Push(evt Event) {
 		maxPending = DefaultMaxPending
 	}
 
-	evt.ts = time.Now() // make sure sender is not tampering with timestamp
+	evt.ts = s.clock() // make sure sender is not tampering with timestamp
 	u := append(s.updates, evt)
 	if len(u) > maxPending {
 		u = u[1:]
 	}
 	s.lastUpdated = evt.ts
 	s.updates = u
+	// drop the events that fell out of the retention window
+	s.updates = s.updates[s.expiredCount(evt.ts):]
 }
 
 // Return updates since the specified fromTime.
@@ -52,12 +83,13 @@ func (s *EventStore) Push(evt Event) {
 // that are older.
 //
 // This is useful if we want to avoid fetching same updates multiple times.
+// Events older than MaxAge are never returned.
 func (s *EventStore) UpdatesSince(fromTime time.Time) []Event {
 	s.mu.RLocker().Lock()
 	defer s.mu.RLocker().Unlock()
 
 	idx := -1
-	for i := 0; i < len(s.updates) && idx < 0; i++ {
+	for i := s.expiredCount(s.clock()); i < len(s.updates) && idx < 0; i++ {
 		if s.updates[i].ts.After(fromTime) {
 			idx = i
 		}
@@ -171,6 +203,133 @@ func (t *Topic) loop(stream chan []Event, closing chan chan error) {
 	}
 }
 
+// SubscribeSince creates a Subscription with at-least-once delivery semantics,
+// starting from the events pushed after the since timestamp.
+//
+// A batch received from the subscription must be acknowledged with Ack before the
+// next one is sent. If the consumer goes away without acknowledging a batch, it can
+// subscribe again from the acknowledged Position to have the unacknowledged events
+// redelivered, as long as they are still in the topic buffer.
+func (t *Topic) SubscribeSince(since time.Time) AckSubscription {
+	s := &ackSub{
+		sub:      sub{stream: make(chan []Event), closing: make(chan chan error)},
+		acks:     make(chan chan ackReply),
+		stopped:  make(chan struct{}),
+		position: since,
+	}
+
+	go t.ackLoop(s, since)
+
+	return s
+}
+
+// Internal event fetch loop for subscriptions with acknowledgements.
+// It works like the loop function, but the position in the event stream only
+// moves forward when the subscriber acknowledges the last batch sent. New updates
+// are not fetched while a batch is waiting to be acknowledged.
+func (t *Topic) ackLoop(s *ackSub, position time.Time) {
+	defer close(s.stopped)
+	var updates []Event
+	var sent bool
+
+	for {
+		var sendUpdates chan<- []Event
+		var fetchUpdates <-chan time.Time
+		switch {
+		case sent:
+			// wait for the batch to be acknowledged
+		case len(updates) > 0:
+			sendUpdates = s.stream
+		default:
+			fetchUpdates = time.After(DefaultPollInterval)
+		}
+
+		select {
+		case <-t.done:
+			close(s.stream)
+			return
+		case errc := <-s.closing:
+			close(s.stream)
+			errc <- nil
+			return
+		case <-fetchUpdates:
+			if !t.store.HasUpdates(position) {
+				break
+			}
+			updates = t.store.UpdatesSince(position)
+		case sendUpdates <- updates:
+			sent = true
+		case ackc := <-s.acks:
+			if !sent {
+				ackc <- ackReply{position, ErrNothingToAck}
+				break
+			}
+			position = updates[len(updates)-1].ts
+			updates = []Event{}
+			sent = false
+			ackc <- ackReply{position, nil}
+		}
+	}
+}
+
+// ErrNothingToAck is returned when acknowledging a subscription that has
+// no batch waiting for acknowledgement, or is closed.
+var ErrNothingToAck = errors.New("no batch waiting for acknowledgement")
+
+// The AckSubscription interface defines a Subscription with at-least-once
+// delivery semantics, where every batch of events has to be acknowledged.
+type AckSubscription interface {
+	Subscription
+	// Ack acknowledges the last batch received from Updates, allowing the
+	// next one to be sent.
+	Ack() error
+	// Position returns the timestamp of the last acknowledged event, or the
+	// since timestamp of the subscription if nothing was acknowledged yet.
+	Position() time.Time
+}
+
+// ackReply is the reply of the fetch loop to an acknowledgement.
+type ackReply struct {
+	position time.Time
+	err      error
+}
+
+// The ackSub struct is an internal type that holds the state of an AckSubscription.
+type ackSub struct {
+	sub
+	acks    chan chan ackReply
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	position time.Time
+}
+
+// Ack the last batch received from the subscription.
+func (s *ackSub) Ack() error {
+	ackc := make(chan ackReply, 1)
+	select {
+	case s.acks <- ackc:
+	case <-s.stopped:
+		return ErrNothingToAck
+	}
+
+	reply := <-ackc
+	if reply.err != nil {
+		return reply.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.position = reply.position
+	return nil
+}
+
+// Returns the position of the last acknowledged event.
+func (s *ackSub) Position() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position
+}
+
 // The Subscription interface defines how we can interact with a topic Subscription.
 type Subscription interface {
 	Updates() <-chan []Event
@@ -142,3 +142,103 @@ func TestSubscriptionThroughput(t *testing.T) {
 		t.Fatalf("not enough events processed: expected %d, found %d", expected, throughput)
 	}
 }
+
+// Test that events older than MaxAge are dropped together with the MaxPending cap.
+func TestEventStoreMaxAge(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := &EventStore{MaxPending: 3, MaxAge: time.Minute, now: func() time.Time { return now }}
+
+	store.Push(Event{Content: "old"})
+	now = now.Add(30 * time.Second)
+	store.Push(Event{Content: "recent"})
+	since := time.Unix(0, 0).Add(-time.Second)
+	if n := len(store.UpdatesSince(since)); n != 2 {
+		t.Fatalf("expected %d events within the retention window, found %d", 2, n)
+	}
+
+	// the first event falls out of the retention window
+	now = now.Add(45 * time.Second)
+	events := store.UpdatesSince(since)
+	if len(events) != 1 || events[0].Content != "recent" {
+		t.Fatalf("expected only the recent event, found %v", events)
+	}
+
+	// both limits apply together
+	for i := 0; i < 4; i++ {
+		store.Push(Event{Content: strconv.Itoa(i)})
+	}
+	events = store.UpdatesSince(since)
+	if len(events) != 3 || events[0].Content != "1" {
+		t.Fatalf("expected the %d most recent events, found %v", 3, events)
+	}
+
+	now = now.Add(2 * time.Minute)
+	store.Push(Event{Content: "latest"})
+	events = store.UpdatesSince(since)
+	if len(events) != 1 || events[0].Content != "latest" {
+		t.Fatalf("expected only the latest event, found %v", events)
+	}
+}
+
+// receiveBatch waits for the next batch of events from the subscription
+func receiveBatch(t *testing.T, s Subscription) []Event {
+	t.Helper()
+	select {
+	case events := <-s.Updates():
+		return events
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+	return nil
+}
+
+// Test that events not acknowledged by a subscriber are redelivered when it subscribes again.
+func TestAckSubscriptionRedelivery(t *testing.T) {
+	topic := NewTopic("orders")
+	defer topic.Close()
+
+	start := time.Now()
+	topic.Push("order 1")
+	topic.Push("order 2")
+
+	first := topic.SubscribeSince(start)
+	if err := first.Ack(); err != ErrNothingToAck {
+		t.Fatalf("expected error %v, found %v", ErrNothingToAck, err)
+	}
+	if events := receiveBatch(t, first); len(events) != 2 {
+		t.Fatalf("expected %d events, found %d", 2, len(events))
+	}
+
+	// next batches are held until the previous one is acknowledged
+	topic.Push("order 3")
+	select {
+	case events := <-first.Updates():
+		t.Fatalf("unexpected batch %v before acknowledgement", events)
+	case <-time.After(3 * DefaultPollInterval):
+	}
+
+	// the subscriber crashes without acknowledging the batch
+	first.Close()
+	if !first.Position().Equal(start) {
+		t.Fatalf("expected position %s, found %s", start, first.Position())
+	}
+
+	second := topic.SubscribeSince(first.Position())
+	defer second.Close()
+	events := receiveBatch(t, second)
+	if len(events) != 3 || events[0].Content != "order 1" {
+		t.Fatalf("expected unacknowledged events to be redelivered, found %v", events)
+	}
+	if err := second.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if !second.Position().Equal(events[2].ts) {
+		t.Fatalf("expected position %s, found %s", events[2].ts, second.Position())
+	}
+
+	topic.Push("order 4")
+	events = receiveBatch(t, second)
+	if len(events) != 1 || events[0].Content != "order 4" {
+		t.Fatalf("expected only new events after acknowledgement, found %v", events)
+	}
+}
@@ -0,0 +1,152 @@
+// Package workerpool implements the fan-out pattern with a fixed number of
+// goroutines processing the inputs submitted to a buffered channel.
+//
+// This is the "spawn N workers reading a channel with graceful shutdown" pattern
+// shared by the scrapers in this module, extracted into a reusable generic type.
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when submitting inputs to a pool that was closed
+// or whose context was cancelled.
+var ErrClosed = errors.New("worker pool closed")
+
+// WorkerPool processes the inputs submitted to the pool concurrently using
+// a fixed number of workers, and publishes their outputs on the Results channel.
+//
+// The pool supports two ways of terminating:
+//   - Close stops accepting new inputs and lets the workers drain the inputs
+//     already submitted before exiting (graceful termination).
+//   - cancelling the pool context stops the workers as soon as in-flight inputs
+//     are processed. Inputs still buffered are dropped.
+type WorkerPool[In, Out any] struct {
+	fn      func(context.Context, In) Out
+	ctx     context.Context
+	inputCh chan In
+	results chan Out
+
+	// inputMu guards inputCh from being closed while Submit is sending to it.
+	// closing is closed by Close to release Submit calls blocked on a full inputCh.
+	inputMu     sync.RWMutex
+	inputClosed bool
+	closing     chan struct{}
+	closeOnce   sync.Once
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// New starts a WorkerPool with the given number of workers calling fn for every
+// submitted input. Submit blocks once buffer inputs are waiting for a worker.
+//
+// Results must be consumed until the channel is closed, otherwise workers
+// block publishing their outputs.
+func New[In, Out any](ctx context.Context, workers int, buffer int, fn func(context.Context, In) Out) *WorkerPool[In, Out] {
+	if workers <= 0 {
+		workers = 1
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+
+	p := &WorkerPool[In, Out]{
+		fn:      fn,
+		ctx:     ctx,
+		inputCh: make(chan In, buffer),
+		results: make(chan Out, buffer),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.results)
+		close(p.done)
+	}()
+	return p
+}
+
+func (p *WorkerPool[In, Out]) worker() {
+	defer p.wg.Done()
+
+	for {
+		// checking for cancellation first, as select picks a random ready case
+		// and buffered inputs must not be processed after the context is done
+		select {
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case in, ok := <-p.inputCh:
+			if !ok {
+				return // pool closed and drained
+			}
+			p.results <- p.fn(p.ctx, in)
+		}
+	}
+}
+
+// Submit adds a new input to the pool, blocking while the input buffer is full.
+//
+// Submit is safe to call concurrently with Close: inputs submitted after the
+// pool is closed or its context is cancelled are rejected with ErrClosed.
+func (p *WorkerPool[In, Out]) Submit(in In) error {
+	p.inputMu.RLock()
+	defer p.inputMu.RUnlock()
+
+	if p.inputClosed || p.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	select {
+	case <-p.ctx.Done():
+		return ErrClosed
+	case <-p.closing:
+		return ErrClosed
+	case p.inputCh <- in:
+	}
+	return nil
+}
+
+// Results returns the channel publishing the outputs of the workers.
+// The channel is closed after all workers have exited.
+func (p *WorkerPool[In, Out]) Results() <-chan Out {
+	return p.results
+}
+
+// Close stops the pool from accepting new inputs. Workers exit after
+// processing the inputs already submitted.
+func (p *WorkerPool[In, Out]) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+
+		p.inputMu.Lock()
+		defer p.inputMu.Unlock()
+		p.inputClosed = true
+		close(p.inputCh)
+	})
+}
+
+// Wait blocks until all workers have exited, either because the pool
+// was closed and drained or because its context was cancelled.
+func (p *WorkerPool[In, Out]) Wait() {
+	<-p.done
+}
+
+// Done returns a channel that's closed when all workers have exited,
+// for callers that need to wait with a timeout.
+func (p *WorkerPool[In, Out]) Done() <-chan struct{} {
+	return p.done
+}
@@ -0,0 +1,169 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collect consumes the pool results until the channel is closed
+func collect[Out any](p *WorkerPool[int, Out]) <-chan []Out {
+	out := make(chan []Out, 1)
+	go func() {
+		var results []Out
+		for r := range p.Results() {
+			results = append(results, r)
+		}
+		out <- results
+	}()
+	return out
+}
+
+func TestWorkerPoolGracefulDrain(t *testing.T) {
+	pool := New(context.Background(), 3, 10, func(_ context.Context, n int) int {
+		time.Sleep(time.Millisecond)
+		return n * n
+	})
+	results := collect(pool)
+
+	for i := 1; i <= 10; i++ {
+		if err := pool.Submit(i); err != nil {
+			t.Fatalf("error submitting input: %v", err)
+		}
+	}
+	pool.Close()
+	pool.Wait()
+
+	sum := 0
+	for _, r := range <-results {
+		sum += r
+	}
+	// sum of squares from 1 to 10
+	if sum != 385 {
+		t.Fatalf("expected sum %d, found %d", 385, sum)
+	}
+
+	if err := pool.Submit(11); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v submitting after Close, found %v", ErrClosed, err)
+	}
+}
+
+func TestWorkerPoolContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var processed int64
+
+	pool := New(ctx, 1, 10, func(ctx context.Context, n int) int {
+		if n == 0 {
+			close(started)
+			<-ctx.Done()
+		}
+		atomic.AddInt64(&processed, 1)
+		return n
+	})
+	results := collect(pool)
+
+	for i := 0; i < 5; i++ {
+		if err := pool.Submit(i); err != nil {
+			t.Fatalf("error submitting input: %v", err)
+		}
+	}
+	<-started
+	cancel()
+
+	select {
+	case <-pool.Done():
+	case <-time.After(time.Second):
+		t.Fatal("workers should exit when the context is cancelled")
+	}
+
+	// the in-flight input completes, buffered inputs are dropped
+	if n := len(<-results); n != 1 {
+		t.Fatalf("expected %d results, found %d", 1, n)
+	}
+	if n := atomic.LoadInt64(&processed); n != 1 {
+		t.Fatalf("expected %d processed inputs, found %d", 1, n)
+	}
+	if err := pool.Submit(5); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v submitting after cancellation, found %v", ErrClosed, err)
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	pool := New(context.Background(), 1, 1, func(_ context.Context, n int) int {
+		<-release
+		return n
+	})
+	results := collect(pool)
+
+	// one input is processed by the worker and one waits in the buffer
+	for i := 0; i < 2; i++ {
+		if err := pool.Submit(i); err != nil {
+			t.Fatalf("error submitting input: %v", err)
+		}
+	}
+
+	submitted := make(chan error)
+	go func() {
+		submitted <- pool.Submit(2)
+	}()
+	go func() {
+		submitted <- pool.Submit(3)
+	}()
+
+	select {
+	case err := <-submitted:
+		t.Fatalf("submit should block while the input buffer is full, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-submitted:
+			if err != nil {
+				t.Fatalf("error submitting input: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("submit should unblock once the workers catch up")
+		}
+	}
+	pool.Close()
+
+	if n := len(<-results); n != 4 {
+		t.Fatalf("expected %d results, found %d", 4, n)
+	}
+}
+
+func TestWorkerPoolCloseReleasesBlockedSubmit(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	pool := New(context.Background(), 1, 0, func(_ context.Context, n int) int {
+		<-release
+		return n
+	})
+	collect(pool)
+
+	if err := pool.Submit(0); err != nil {
+		t.Fatalf("error submitting input: %v", err)
+	}
+	submitted := make(chan error)
+	go func() {
+		submitted <- pool.Submit(1)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	pool.Close()
+
+	select {
+	case err := <-submitted:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected %v, found %v", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close should release submits blocked on a full buffer")
+	}
+}
@@ -0,0 +1,140 @@
+package loadtest
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// subBucketBits is the number of bits used to split every power of two range
+// into linear sub-buckets. 7 bits keep the relative error of recorded values
+// below 1%.
+const subBucketBits = 7
+
+const subBucketCount = 1 << subBucketBits
+
+// Histogram is a streaming log-linear histogram of durations, similar to an
+// HDR histogram. Values are recorded with microsecond resolution and memory
+// usage doesn't depend on the number of recorded values.
+// A Histogram is safe for concurrent use.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	total  uint64
+	sum    uint64
+	min    uint64
+	max    uint64
+}
+
+// bucketIndex returns the index of the bucket for the value v
+func bucketIndex(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	top := v >> shift
+	return (shift+1)*subBucketCount + int(top-subBucketCount)
+}
+
+// bucketValue returns the highest value that falls into the bucket at idx
+func bucketValue(idx int) uint64 {
+	if idx < subBucketCount {
+		return uint64(idx)
+	}
+	shift := idx/subBucketCount - 1
+	top := uint64(idx%subBucketCount + subBucketCount)
+	return (top+1)<<shift - 1
+}
+
+// Record adds the duration d to the histogram.
+func (h *Histogram) Record(d time.Duration) {
+	v := uint64(max(d.Microseconds(), 0))
+	idx := bucketIndex(v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx >= len(h.counts) {
+		counts := make([]uint64, idx+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[idx]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.total++
+	h.sum += v
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+// Percentile returns the value below which the percentage p of recorded
+// values fall. It returns zero if no values were recorded.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.percentile(p)
+}
+
+func (h *Histogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	p = math.Min(math.Max(p, 0), 100)
+	rank := uint64(math.Ceil(p / 100 * float64(h.total)))
+	rank = max(rank, 1)
+
+	var cumulative uint64
+	for idx, c := range h.counts {
+		cumulative += c
+		if cumulative >= rank {
+			// bucket boundaries are approximations, never report values
+			// outside of the recorded range
+			v := min(max(bucketValue(idx), h.min), h.max)
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// Summary returns the latency statistics of recorded values.
+func (h *Histogram) Summary() LatencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total == 0 {
+		return LatencySummary{}
+	}
+	return LatencySummary{
+		Count: h.total,
+		Mean:  time.Duration(h.sum/h.total) * time.Microsecond,
+		P50:   h.percentile(50),
+		P95:   h.percentile(95),
+		P99:   h.percentile(99),
+		Max:   time.Duration(h.max) * time.Microsecond,
+	}
+}
+
+// LatencySummary contains the latency statistics of an operation.
+type LatencySummary struct {
+	Count uint64
+	Mean  time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func (s LatencySummary) String() string {
+	return fmt.Sprintf("count: %d, mean: %s, p50: %s, p95: %s, p99: %s, max: %s",
+		s.Count, s.Mean, s.P50, s.P95, s.P99, s.Max)
+}
@@ -0,0 +1,77 @@
+package loadtest
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// assertWithin fails the test if found is not within 1% of expected
+func assertWithin(t *testing.T, name string, expected, found time.Duration) {
+	t.Helper()
+	delta := expected / 100
+	if found < expected-delta || found > expected+delta {
+		t.Fatalf("%s: expected %s (±1%%), found %s", name, expected, found)
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h Histogram
+	// record 1ms..1000ms in random order
+	for _, i := range rand.Perm(1000) {
+		h.Record(time.Duration(i+1) * time.Millisecond)
+	}
+
+	s := h.Summary()
+	if s.Count != 1000 {
+		t.Fatalf("expected %d recorded values, found %d", 1000, s.Count)
+	}
+	assertWithin(t, "p50", 500*time.Millisecond, s.P50)
+	assertWithin(t, "p95", 950*time.Millisecond, s.P95)
+	assertWithin(t, "p99", 990*time.Millisecond, s.P99)
+	assertWithin(t, "mean", 500500*time.Microsecond, s.Mean)
+	if s.Max != time.Second {
+		t.Fatalf("expected max %s, found %s", time.Second, s.Max)
+	}
+	assertWithin(t, "p0", time.Millisecond, h.Percentile(0))
+	if p := h.Percentile(100); p != time.Second {
+		t.Fatalf("expected p100 %s, found %s", time.Second, p)
+	}
+}
+
+func TestHistogramTailLatency(t *testing.T) {
+	var h Histogram
+	for i := 0; i < 980; i++ {
+		h.Record(2 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		h.Record(3 * time.Second)
+	}
+
+	s := h.Summary()
+	assertWithin(t, "p50", 2*time.Millisecond, s.P50)
+	assertWithin(t, "p95", 2*time.Millisecond, s.P95)
+	assertWithin(t, "p99", 3*time.Second, s.P99)
+}
+
+func TestHistogramEmpty(t *testing.T) {
+	var h Histogram
+	if s := h.Summary(); s != (LatencySummary{}) {
+		t.Fatalf("expected empty summary, found %s", s)
+	}
+	if p := h.Percentile(99); p != 0 {
+		t.Fatalf("expected zero percentile, found %s", p)
+	}
+}
+
+func TestBucketIndexRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 129, 1000, 123456, 1 << 40} {
+		upper := bucketValue(bucketIndex(v))
+		if upper < v {
+			t.Fatalf("expected bucket upper bound >= %d, found %d", v, upper)
+		}
+		if v > 0 && float64(upper-v)/float64(v) > 0.01 {
+			t.Fatalf("expected bucket of %d within 1%%, found upper bound %d", v, upper)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// Package loadtest contains a load testing harness for the distributed-queue project that
+// pushes the system to its limit by processing as many messages as possible.
+// The harness activates the whole flow: produce -> consume -> ack/nack
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTargetMessages = 500000
+	defaultTopics         = 50
+	defaultPayloadSize    = 90
+	defaultTimeout        = 20 * time.Second
+	defaultNamespace      = "default"
+	topicNameLength       = 50
+	statsCheckpoint       = 1000
+	dequeueLimit          = 10
+	dequeueTimeoutSeconds = 20
+
+	randomMessageMetadata = "091237ajnfasd8234asdf8{Pajasdf}nasdfkiash{]adsf]asd]a[ashdfa(^(007^^%^&%%8"
+)
+
+// Config contains the load test settings. Zero values are replaced with defaults.
+type Config struct {
+	// BaseURL is the address of the distributed-queue API, e.g. http://localhost:8080
+	BaseURL string
+	// TargetMessages is the number of messages to consume before the test completes
+	TargetMessages int
+	// Topics is the number of topics messages are spread across. Every topic
+	// has its own consumer.
+	Topics int
+	// Concurrency is the number of producers enqueuing messages. Defaults to
+	// one producer per topic.
+	Concurrency int
+	// PayloadSize is the size in bytes of the payload of every message
+	PayloadSize int
+	// Namespace is the name of the namespace created for the test
+	Namespace string
+	// Timeout of every API request
+	Timeout time.Duration
+	// Out receives progress updates while the test runs. Progress is not
+	// reported if nil.
+	Out io.Writer
+}
+
+func (cfg *Config) withDefaults() {
+	if cfg.TargetMessages <= 0 {
+		cfg.TargetMessages = defaultTargetMessages
+	}
+	if cfg.Topics <= 0 {
+		cfg.Topics = defaultTopics
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = cfg.Topics
+	}
+	if cfg.PayloadSize <= 0 {
+		cfg.PayloadSize = defaultPayloadSize
+	}
+	if len(cfg.Namespace) == 0 {
+		cfg.Namespace = defaultNamespace
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Out == nil {
+		cfg.Out = io.Discard
+	}
+}
+
+// Report contains the results of a load test run.
+type Report struct {
+	// Enqueued is the number of messages successfully enqueued
+	Enqueued int64
+	// Dequeued is the number of messages received by consumers
+	Dequeued int64
+	// Acked is the number of acknowledgements accepted by the API
+	Acked int64
+	// Errors is the number of failed API requests
+	Errors int64
+	// Duration is the time it took to consume the target messages
+	Duration time.Duration
+	// EnqueueLatency contains the latencies of successful enqueue requests
+	EnqueueLatency LatencySummary
+	// DequeueLatency contains the latencies of successful dequeue requests,
+	// including the time spent long-polling for messages
+	DequeueLatency LatencySummary
+	// AckLatency contains the latencies of successful ack requests
+	AckLatency LatencySummary
+}
+
+// Throughput returns the number of messages consumed per minute.
+func (r Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Dequeued) / r.Duration.Minutes()
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("total messages: %d, overall throughput(msgs per minute): %.2f, total duration: %s, "+
+		"enqueued: %d, acked: %d, errors: %d\n"+
+		"enqueue latency: %s\ndequeue latency: %s\nack latency: %s",
+		r.Dequeued, r.Throughput(), r.Duration.String(), r.Enqueued, r.Acked, r.Errors,
+		r.EnqueueLatency, r.DequeueLatency, r.AckLatency)
+}
+
+// runner holds the state of a load test run
+type runner struct {
+	cfg     Config
+	cli     *http.Client
+	payload string
+
+	enqueued atomic.Int64
+	dequeued atomic.Int64
+	acked    atomic.Int64
+	errors   atomic.Int64
+
+	enqueueLatency Histogram
+	dequeueLatency Histogram
+	ackLatency     Histogram
+}
+
+// Run the load test until the target number of messages is consumed.
+func Run(cfg Config) (Report, error) {
+	cfg.withDefaults()
+	if _, err := url.ParseRequestURI(cfg.BaseURL); err != nil {
+		return Report{}, fmt.Errorf("invalid base url %q: %w", cfg.BaseURL, err)
+	}
+
+	r := &runner{
+		cfg:     cfg,
+		cli:     &http.Client{Timeout: cfg.Timeout},
+		payload: generateName(cfg.PayloadSize),
+	}
+
+	nsId, err := r.createNamespace(context.Background(), cfg.Namespace)
+	if err != nil {
+		return Report{}, err
+	}
+
+	topics := make([]string, cfg.Topics)
+	for i := range topics {
+		topics[i] = generateName(topicNameLength)
+	}
+
+	return r.attack(nsId, topics), nil
+}
+
+func (r *runner) url(path string) string {
+	return strings.TrimSuffix(r.cfg.BaseURL, "/") + path
+}
+
+// post sends the JSON body to the API and decodes the reply. Replies with a
+// status code different from the expected one are reported as errors.
+func (r *runner) post(ctx context.Context, path string, body any, expectedStatus int, reply any) error {
+	_, err := r.send(ctx, path, body, reply, expectedStatus)
+	return err
+}
+
+// send posts the JSON body to the API and returns the status code of the reply.
+// Replies with a status code not listed in accepted are reported as errors, the
+// reply body is decoded unless the status code is 204 No Content.
+func (r *runner) send(ctx context.Context, path string, body any, reply any, accepted ...int) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url(path), bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	response, err := r.cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if !slices.Contains(accepted, response.StatusCode) {
+		return response.StatusCode, fmt.Errorf("%s: unexpected status code %d", path, response.StatusCode)
+	}
+	if reply == nil || response.StatusCode == http.StatusNoContent {
+		return response.StatusCode, nil
+	}
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(reply)
+}
+
+func (r *runner) createNamespace(ctx context.Context, name string) (string, error) {
+	var reply map[string]string
+	if err := r.post(ctx, "/ns", map[string]any{"name": name}, http.StatusOK, &reply); err != nil {
+		return "", fmt.Errorf("error creating namespace: %w", err)
+	}
+	nsId, ok := reply["id"]
+	if !ok {
+		return "", errors.New("error creating namespace: missing id in reply")
+	}
+	return nsId, nil
+}
+
+// attack starts the producers and one consumer for every topic and waits until
+// the target number of messages is consumed.
+func (r *runner) attack(namespace string, topics []string) Report {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	notifyCh := make(chan int)
+	for i := 0; i < r.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			r.producer(ctx, namespace, topic)
+		}(topics[i%len(topics)])
+	}
+	for _, topic := range topics {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			r.consumer(ctx, notifyCh, namespace, topic)
+		}(topic)
+	}
+
+	overallStart := time.Now()
+	incrementStart := time.Now()
+	total := 0
+	increment := 0
+	for count := range notifyCh {
+		total += count
+		increment += count
+		if total >= r.cfg.TargetMessages {
+			break
+		}
+		if increment > statsCheckpoint {
+			incDuration := time.Since(incrementStart)
+			tpm := float64(increment) / incDuration.Minutes()
+			fmt.Fprintf(r.cfg.Out, "total messages: %d, increment: %d, throughput(msgs per minute): %.2f \n",
+				total, increment, tpm)
+			incrementStart = time.Now()
+			increment = 0
+		}
+	}
+	duration := time.Since(overallStart)
+
+	// stop producers and consumers, aborting in-flight requests
+	cancel()
+	wg.Wait()
+
+	return Report{
+		Enqueued: r.enqueued.Load(),
+		Dequeued: r.dequeued.Load(),
+		Acked:    r.acked.Load(),
+		Errors:   r.errors.Load(),
+		Duration: duration,
+
+		EnqueueLatency: r.enqueueLatency.Summary(),
+		DequeueLatency: r.dequeueLatency.Summary(),
+		AckLatency:     r.ackLatency.Summary(),
+	}
+}
+
+// fail records a failed request, unless the test is stopping
+func (r *runner) fail(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	r.errors.Add(1)
+	fmt.Fprintln(r.cfg.Out, err)
+}
+
+func (r *runner) producer(ctx context.Context, namespace, topic string) {
+	for ctx.Err() == nil {
+		body := map[string]any{
+			"namespace":           namespace,
+			"topic":               topic,
+			"priority":            rand.Intn(100),
+			"payload":             r.payload,
+			"metadata":            randomMessageMetadata,
+			"deliverAfterSeconds": rand.Intn(10),
+			"ttlSeconds":          900,
+		}
+		var reply map[string]string
+		start := time.Now()
+		if err := r.post(ctx, "/message/enqueue", body, http.StatusCreated, &reply); err != nil {
+			r.fail(ctx, err)
+			continue
+		}
+		if _, ok := reply["msgId"]; !ok {
+			r.fail(ctx, fmt.Errorf("error enqueuing message: %v", reply))
+			continue
+		}
+		r.enqueueLatency.Record(time.Since(start))
+		r.enqueued.Add(1)
+	}
+}
+
+func (r *runner) consumer(ctx context.Context, notifyCh chan<- int, namespace, topic string) {
+	for ctx.Err() == nil {
+		body := map[string]any{
+			"namespace":      namespace,
+			"topic":          topic,
+			"limit":          dequeueLimit,
+			"timeoutSeconds": dequeueTimeoutSeconds,
+		}
+		var reply struct {
+			Messages []struct {
+				Id    string `json:"id"`
+				Lease string `json:"lease"`
+			} `json:"messages"`
+		}
+		start := time.Now()
+		status, err := r.send(ctx, "/message/dequeue", body, &reply, http.StatusOK, http.StatusNoContent)
+		if err != nil {
+			r.fail(ctx, err)
+			continue
+		}
+		r.dequeueLatency.Record(time.Since(start))
+		// the server replies with no content when the long-polling times out
+		if status == http.StatusNoContent || len(reply.Messages) == 0 {
+			continue
+		}
+		r.dequeued.Add(int64(len(reply.Messages)))
+
+		// acknowledge received messages even when the test is stopping so
+		// they are not left in-flight on the server
+		ackCtx := context.WithoutCancel(ctx)
+		for _, m := range reply.Messages {
+			r.ack(ackCtx, m.Id, m.Lease, true)
+		}
+		select {
+		case notifyCh <- len(reply.Messages):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ack the delivery of the message identified by its lease, so that retried
+// acks can't affect later deliveries of the message
+func (r *runner) ack(ctx context.Context, msgId, lease string, v bool) {
+	body := []map[string]any{{"id": msgId, "ack": v, "lease": lease}}
+	start := time.Now()
+	if err := r.post(ctx, "/message/ack", body, http.StatusOK, nil); err != nil {
+		r.fail(ctx, err)
+		return
+	}
+	r.ackLatency.Record(time.Since(start))
+	r.acked.Add(1)
+}
+
+// generateName creates a random string of a specified length.
+func generateName(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	var output strings.Builder
+	for i := 0; i < length; i++ {
+		randomIndex := rand.Intn(len(charset))
+		randomChar := charset[randomIndex]
+		output.WriteByte(randomChar)
+	}
+	return output.String()
+}
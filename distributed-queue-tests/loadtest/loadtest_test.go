@@ -0,0 +1,150 @@
+package loadtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQueue is an in-memory implementation of the distributed-queue API
+type fakeQueue struct {
+	mu     sync.Mutex
+	nextId int
+	topics map[string][]string
+	acks   int
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{topics: map[string][]string{}}
+}
+
+func (q *fakeQueue) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ns", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": "1", "name": body.Name})
+	})
+	mux.HandleFunc("/message/enqueue", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Topic string `json:"topic"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q.mu.Lock()
+		q.nextId++
+		id := fmt.Sprint(q.nextId)
+		q.topics[body.Topic] = append(q.topics[body.Topic], id)
+		q.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "created", "msgId": id})
+	})
+	mux.HandleFunc("/message/dequeue", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Topic string `json:"topic"`
+			Limit int    `json:"limit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q.mu.Lock()
+		msgs := q.topics[body.Topic]
+		n := min(body.Limit, len(msgs))
+		batch := msgs[:n]
+		q.topics[body.Topic] = msgs[n:]
+		q.mu.Unlock()
+
+		if n == 0 {
+			// emulate a short long-polling wait
+			time.Sleep(5 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		messages := make([]map[string]string, n)
+		for i, id := range batch {
+			messages[i] = map[string]string{"id": id, "topic": body.Topic}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"messages": messages})
+	})
+	mux.HandleFunc("/message/ack", func(w http.ResponseWriter, r *http.Request) {
+		var body []map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q.mu.Lock()
+		q.acks += len(body)
+		q.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]int{"succeeded": len(body), "failed": 0})
+	})
+	return mux
+}
+
+func TestRun(t *testing.T) {
+	queue := newFakeQueue()
+	srv := httptest.NewServer(queue.handler())
+	defer srv.Close()
+
+	target := 50
+	report, err := Run(Config{
+		BaseURL:        srv.URL,
+		TargetMessages: target,
+		Topics:         3,
+		Concurrency:    2,
+		PayloadSize:    16,
+		Timeout:        time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if report.Dequeued < int64(target) {
+		t.Fatalf("expected at least %d dequeued messages, found %d", target, report.Dequeued)
+	}
+	if report.Enqueued < report.Dequeued {
+		t.Fatalf("expected at least %d enqueued messages, found %d", report.Dequeued, report.Enqueued)
+	}
+	if report.Acked != report.Dequeued {
+		t.Fatalf("expected %d acked messages, found %d", report.Dequeued, report.Acked)
+	}
+	if report.Errors != 0 {
+		t.Fatalf("expected no errors, found %d", report.Errors)
+	}
+	if report.Duration <= 0 || report.Throughput() <= 0 {
+		t.Fatalf("expected positive duration and throughput, found %s", report)
+	}
+	if report.EnqueueLatency.Count != uint64(report.Enqueued) {
+		t.Fatalf("expected %d enqueue latencies, found %d", report.Enqueued, report.EnqueueLatency.Count)
+	}
+	if report.AckLatency.Count != uint64(report.Acked) {
+		t.Fatalf("expected %d ack latencies, found %d", report.Acked, report.AckLatency.Count)
+	}
+	if report.DequeueLatency.Count == 0 || report.DequeueLatency.P99 < report.DequeueLatency.P50 {
+		t.Fatalf("unexpected dequeue latencies %s", report.DequeueLatency)
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if int64(queue.acks) != report.Acked {
+		t.Fatalf("expected %d acks received by the server, found %d", report.Acked, queue.acks)
+	}
+}
+
+func TestRunInvalidURL(t *testing.T) {
+	if _, err := Run(Config{BaseURL: "not a url"}); err == nil {
+		t.Fatalf("expected error for invalid base url")
+	}
+}
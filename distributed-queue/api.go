@@ -3,21 +3,94 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queue"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/ratelimit"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/tracing"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/wait"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const (
+	readinessPingTimeout     = 2 * time.Second
+	enqueueTimeout           = 60 * time.Second
+	defaultDequeueTimeout    = 30 * time.Second
+	defaultMaxDequeueTimeout = 60 * time.Second
+	defaultMaxPayloadSize    = 256 * 1024
+	defaultMaxMetadataSize   = 16 * 1024
+	// enqueueEnvelopeSize is the room left in enqueue request bodies for the
+	// other fields and the JSON encoding, on top of the payload and metadata
+	enqueueEnvelopeSize = 4 * 1024
+
+	// maxTopicLength is the size of the topic column in the messages table
+	maxTopicLength = 50
+
+	// dequeueTimeoutHeader is the response header reporting the effective
+	// timeout applied to a dequeue request
+	dequeueTimeoutHeader = "X-Dequeue-Timeout"
+)
+
+type shardPinger interface {
+	Ping(context.Context) map[uint32]error
+}
+
+// HealthService exposes the health and readiness status of the application
+// for load balancers and orchestrators.
+type HealthService struct {
+	Logger *zap.Logger
+	Shards shardPinger
+}
+
+// HandleHealth reports the process is up and serving requests.
+func (s *HealthService) HandleHealth(c *ApiCtx) {
+	c.Respond(http.StatusOK, H{"status": "ok"})
+}
+
+// HandleReady reports whether all database shards are reachable.
+// If any of the shards is down the service is not ready to serve traffic.
+func (s *HealthService) HandleReady(c *ApiCtx) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessPingTimeout)
+	defer cancel()
+
+	results := s.Shards.Ping(ctx)
+	ids := make([]uint32, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	ready := true
+	shards := []H{}
+	for _, id := range ids {
+		if err := results[id]; err != nil {
+			ready = false
+			c.Logger(s.Logger).Warn("shard unreachable", zap.Uint32("shardId", id), zap.Error(err))
+			shards = append(shards, H{"id": id, "status": "down", "error": err.Error()})
+		} else {
+			shards = append(shards, H{"id": id, "status": "ok"})
+		}
+	}
+
+	if !ready {
+		c.Respond(http.StatusServiceUnavailable, H{"status": "not ready", "shards": shards})
+		return
+	}
+	c.Respond(http.StatusOK, H{"status": "ready", "shards": shards})
+}
+
 type namespaceGetterCreator interface {
-	Save(*db.ShardMeta, *domain.Namespace) error
-	FindByStringId(*db.ShardMeta, string) (*domain.Namespace, error)
-	FindAll(*db.ShardMeta, ...db.OptsFn) ([]domain.Namespace, error)
+	Save(context.Context, *db.ShardMeta, *domain.Namespace) error
+	FindByStringId(context.Context, *db.ShardMeta, string) (*domain.Namespace, error)
+	FindAll(context.Context, *db.ShardMeta, ...db.OptsFn) ([]domain.Namespace, error)
 }
 
 type NamespaceService struct {
@@ -28,53 +101,100 @@ type NamespaceService struct {
 
 type CreateNsRequest struct {
 	Name string `json:"name"`
+	// Topics optionally restricts the topics messages can be enqueued to
+	Topics []string `json:"topics"`
 }
 
 func (s *NamespaceService) HandleCreateNamespace(c *ApiCtx) {
 	var req CreateNsRequest
-	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
 		return
 	}
 
-	item := domain.Namespace{Name: req.Name}
-	err := s.NsRepository.Save(s.MainShard, &item)
+	item, err := s.CreateNamespace(c.Request.Context(), &req)
 	if err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
+		c.Error(err)
 		return
 	}
 
-	err = c.JsonResponse(http.StatusOK, H{
-		"id":   item.Id.String(),
-		"name": item.Name,
+	c.Respond(http.StatusOK, H{
+		"id":     item.Id.String(),
+		"name":   item.Name,
+		"topics": item.Topics,
 	})
-	if err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
-		return
+}
+
+// CreateNamespace stores a new namespace in the main shard.
+func (s *NamespaceService) CreateNamespace(ctx context.Context, req *CreateNsRequest) (*domain.Namespace, error) {
+	for _, topic := range req.Topics {
+		if err := validateTopic(topic); err != nil {
+			return nil, err
+		}
+	}
+
+	item := &domain.Namespace{Name: req.Name, Topics: req.Topics}
+	if err := s.NsRepository.Save(ctx, s.MainShard, item); err != nil {
+		return nil, err
 	}
+	return item, nil
 }
 
 func (s *NamespaceService) HandleGetNamespaces(c *ApiCtx) {
-	results, err := s.NsRepository.FindAll(s.MainShard, db.WithLimit(100))
+	results, err := s.ListNamespaces(c.Request.Context())
 	if err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
+		c.Error(err)
 		return
 	}
 
 	var namespaces []H
 	for _, r := range results {
-		namespaces = append(namespaces, H{"namespace": r.Id.String(), "name": r.Name})
+		namespaces = append(namespaces, H{"namespace": r.Id.String(), "name": r.Name, "topics": r.Topics})
 	}
-	c.JsonResponse(http.StatusOK, H{"namespaces": namespaces})
+	c.Respond(http.StatusOK, H{"namespaces": namespaces})
+}
+
+// ListNamespaces returns the first page of namespaces stored in the main shard.
+func (s *NamespaceService) ListNamespaces(ctx context.Context) ([]domain.Namespace, error) {
+	return s.NsRepository.FindAll(ctx, s.MainShard, db.WithLimit(100))
+}
+
+type namespaceFinder interface {
+	CachedFindByStringId(context.Context, *db.ShardMeta, string) (*domain.Namespace, error)
 }
 
 type MessagesService struct {
 	Logger        *zap.Logger
 	MainShard     *db.ShardMeta
-	NsRepository  *db.NamespaceRepository
+	NsRepository  namespaceFinder
 	EnqueueBuffer chan queue.EnqueueRequest
 	DequeueBuffer *prefetch.PriorityBuffer
 	AckNackRouter *queue.AckNackRouter
+	// RateLimiter throttles enqueue and dequeue requests by namespace.
+	// Requests are not rate limited when nil.
+	RateLimiter *ratelimit.NamespaceLimiter
+
+	// MaxDequeueTimeout caps the time a consumer can wait for messages
+	// on a single dequeue request.
+	MaxDequeueTimeout time.Duration
+	// MaxPayloadSize and MaxMetadataSize limit the size in bytes of
+	// messages accepted by the queue.
+	MaxPayloadSize  int
+	MaxMetadataSize int
+	// Schemas finds the JSON Schemas payloads are validated against.
+	// Payloads are not validated when nil.
+	Schemas topicSchemaFinder
+	// Schedules stores recurring messages. Enqueue requests with a cron
+	// expression are rejected when nil.
+	Schedules scheduleSaver
+}
+
+type topicSchemaFinder interface {
+	CachedFindByTopic(context.Context, *db.ShardMeta, domain.UUID, string) (*domain.TopicSchema, error)
+}
+
+type scheduleSaver interface {
+	Save(context.Context, *db.ShardMeta, *domain.Schedule) error
 }
 
 type EnqueueRequest struct {
@@ -85,23 +205,65 @@ type EnqueueRequest struct {
 	Metadata            string        `json:"metadata"`
 	DeliverAfterSeconds time.Duration `json:"deliverAfterSeconds"`
 	TTLSeconds          time.Duration `json:"ttlSeconds"`
+	// Headers are key/value pairs consumers can filter messages on.
+	Headers map[string]string `json:"headers"`
+	// Cron makes the message recurring: a copy of the message is enqueued at
+	// every occurrence of the cron expression, see domain.NewSchedule.
+	Cron string `json:"cron"`
 }
 
 func (s *MessagesService) HandleEnqueue(c *ApiCtx) {
+	maxPayload, maxMetadata := s.messageSizeLimits()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body,
+		int64(maxPayload+maxMetadata+enqueueEnvelopeSize))
+
 	var req EnqueueRequest
-	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
 		return
 	}
 
-	ns, err := s.NsRepository.CachedFindByStringId(s.MainShard, req.Namespace)
-	if ns == nil {
-		c.JsonResponse(http.StatusNotFound, H{"error": "invalid namespace"})
+	if len(req.Cron) > 0 {
+		schedule, err := s.Schedule(requestContext(c), &req)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.Respond(http.StatusCreated, H{
+			"status":     "scheduled",
+			"scheduleId": schedule.Id.String(),
+			"nextRunAt":  schedule.NextRunAt,
+		})
 		return
-	} else if err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"error": err.Error()})
+	}
+
+	msgId, err := s.Enqueue(requestContext(c), &req)
+	if err != nil {
+		c.Error(err)
 		return
 	}
+	c.Respond(http.StatusCreated, H{
+		"status":  "created",
+		"msgId":   msgId.String(),
+		"shardId": msgId.ShardId(),
+	})
+}
+
+// Enqueue validates the message and hands it over to the enqueue workers.
+// It returns the id of the message once it's stored in the database.
+func (s *MessagesService) Enqueue(ctx context.Context, req *EnqueueRequest) (domain.UUID, error) {
+	ns, err := s.validateEnqueue(ctx, req)
+	if err != nil {
+		return domain.UUID{}, err
+	}
+
+	spanCtx, span := tracing.Tracer().Start(ctx, "enqueue",
+		trace.WithAttributes(attribute.String("topic", req.Topic)))
+	defer span.End()
+
+	// the timeout also cancels the database insert if the message wasn't stored yet
+	ctx, cancel := context.WithTimeout(spanCtx, enqueueTimeout)
+	defer cancel()
 
 	msg := domain.Message{
 		Namespace:    ns,
@@ -111,32 +273,156 @@ func (s *MessagesService) HandleEnqueue(c *ApiCtx) {
 		Metadata:     []byte(req.Metadata),
 		DeliverAfter: req.DeliverAfterSeconds * time.Second,
 		TTL:          req.TTLSeconds * time.Second,
+		TraceParent:  tracing.TraceParent(span.SpanContext()),
+		Headers:      req.Headers,
 	}
 
 	respCh := make(chan queue.EnqueueResponse)
 	s.EnqueueBuffer <- queue.EnqueueRequest{
-		Msg:    msg,
-		RespCh: respCh,
+		Ctx:     ctx,
+		Msg:     msg,
+		RespCh:  respCh,
+		SpanCtx: span.SpanContext(),
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
 	select {
 	case <-ctx.Done():
-		c.JsonResponse(http.StatusNotFound, H{"status": "operation timed out"})
-		return
+		return domain.UUID{}, errTimeout
 
 	case resp := <-respCh:
 		if resp.Err != nil {
-			c.JsonResponse(http.StatusInternalServerError, H{"status": err.Error()})
-			return
+			span.RecordError(resp.Err)
+			return domain.UUID{}, resp.Err
 		}
-		c.JsonResponse(http.StatusCreated, H{
-			"status": "created",
-			"msgId":  resp.MsgId.String(),
-		})
+		return resp.MsgId, nil
+	}
+}
+
+// Schedule validates the message and stores a schedule enqueueing it at every
+// occurrence of the request cron expression. Occurrences are enqueued by the
+// queue.SchedulerWorker.
+func (s *MessagesService) Schedule(ctx context.Context, req *EnqueueRequest) (*domain.Schedule, error) {
+	if s.Schedules == nil {
+		return nil, newApiError(http.StatusNotImplemented, "scheduled messages are not enabled")
+	}
+	if req.DeliverAfterSeconds > 0 {
+		return nil, newApiError(http.StatusBadRequest, "deliverAfterSeconds can't be used with a cron schedule")
+	}
+	ns, err := s.validateEnqueue(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := domain.NewSchedule(req.Cron, domain.Message{
+		Namespace: ns,
+		Topic:     req.Topic,
+		Priority:  req.Priority,
+		Payload:   []byte(req.Payload),
+		Metadata:  []byte(req.Metadata),
+		TTL:       req.TTLSeconds * time.Second,
+		Headers:   req.Headers,
+	})
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+	schedule.NextRunAt = schedule.Next(time.Now())
+	if err := s.Schedules.Save(ctx, s.MainShard, schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// validateEnqueue checks the message of an enqueue request can be enqueued to
+// the namespace topic, and returns the resolved namespace.
+func (s *MessagesService) validateEnqueue(ctx context.Context, req *EnqueueRequest) (*domain.Namespace, error) {
+	if err := s.validateMessageSize(req); err != nil {
+		return nil, err
 	}
+
+	ns, err := s.findNamespace(ctx, req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.allow(ns); err != nil {
+		return nil, err
+	}
+	if !ns.AllowsTopic(req.Topic) {
+		return nil, newApiError(http.StatusBadRequest, "topic %q is not allowed in namespace %s", req.Topic, ns.Name)
+	}
+	if err := s.validatePayload(ctx, ns, req); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// findNamespace resolves the namespace of the request.
+// Namespaces that don't exist are reported as not found errors.
+func (s *MessagesService) findNamespace(ctx context.Context, id string) (*domain.Namespace, error) {
+	ns, err := s.NsRepository.CachedFindByStringId(ctx, s.MainShard, id)
+	if err != nil {
+		return nil, err
+	} else if ns == nil {
+		return nil, fmt.Errorf("invalid namespace: %w", errNotFound)
+	}
+	return ns, nil
+}
+
+// allow applies namespace rate limiting to the request, returning a rateLimitError
+// if the namespace exceeded its rate.
+// Requests are limited by the id of resolved namespaces only, so that clients can't
+// create a token-bucket for every arbitrary namespace string they send.
+func (s *MessagesService) allow(ns *domain.Namespace) error {
+	if s.RateLimiter == nil {
+		return nil
+	}
+	if ok, retryAfter := s.RateLimiter.Allow(ns.Id.String()); !ok {
+		return &rateLimitError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// validatePayload validates the payload against the schema registered for the topic.
+// Non-conforming payloads are reported with a domain.SchemaValidationError.
+func (s *MessagesService) validatePayload(ctx context.Context, ns *domain.Namespace, req *EnqueueRequest) error {
+	if s.Schemas == nil {
+		return nil
+	}
+	schema, err := s.Schemas.CachedFindByTopic(ctx, s.MainShard, ns.Id, req.Topic)
+	if err != nil || schema == nil {
+		return err
+	}
+	return schema.Validate([]byte(req.Payload))
+}
+
+// messageSizeLimits returns the maximum payload and metadata sizes accepted by the service.
+func (s *MessagesService) messageSizeLimits() (int, int) {
+	maxPayload := s.MaxPayloadSize
+	if maxPayload <= 0 {
+		maxPayload = defaultMaxPayloadSize
+	}
+	maxMetadata := s.MaxMetadataSize
+	if maxMetadata <= 0 {
+		maxMetadata = defaultMaxMetadataSize
+	}
+	return maxPayload, maxMetadata
+}
+
+// validateMessageSize checks the message payload and metadata do not exceed the
+// maximum sizes allowed by the service. Headers count towards the metadata size.
+func (s *MessagesService) validateMessageSize(req *EnqueueRequest) error {
+	maxPayload, maxMetadata := s.messageSizeLimits()
+
+	if len(req.Payload) > maxPayload {
+		return newApiError(http.StatusRequestEntityTooLarge, "payload size %d exceeds the maximum of %d bytes", len(req.Payload), maxPayload)
+	}
+	metadataSize := len(req.Metadata)
+	for k, v := range req.Headers {
+		metadataSize += len(k) + len(v)
+	}
+	if metadataSize > maxMetadata {
+		return newApiError(http.StatusRequestEntityTooLarge, "metadata size %d exceeds the maximum of %d bytes", metadataSize, maxMetadata)
+	}
+	return nil
 }
 
 type DequeueRequest struct {
@@ -144,28 +430,71 @@ type DequeueRequest struct {
 	Topic          string `json:"topic"`
 	Limit          int    `json:"limit"`
 	TimeoutSeconds int    `json:"timeoutSeconds"`
+	// Match restricts delivery to messages whose headers contain all
+	// of its key/value pairs.
+	Match map[string]string `json:"match"`
 }
 
+// HandleDequeue long-polls the topic for messages until the dequeue timeout
+// expires. It replies with 204 No Content when no messages became available.
 func (s *MessagesService) HandleDequeue(c *ApiCtx) {
-	var dequeueReq DequeueRequest
-	if err := json.NewDecoder(c.Request.Body).Decode(&dequeueReq); err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"error": err.Error()})
+	var req DequeueRequest
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
+		return
+	}
+	c.Writer.Header().Set(dequeueTimeoutHeader, s.dequeueTimeout(req.TimeoutSeconds).String())
+
+	messages, err := s.Dequeue(requestContext(c), &req)
+	if err != nil {
+		c.Error(err)
 		return
 	}
+	if len(messages) == 0 {
+		// no messages became available before the timeout
+		c.NoContent(http.StatusNoContent)
+		return
+	}
+	c.Respond(http.StatusOK, H{"messages": messagesResponse(messages)})
+}
+
+// Dequeue long-polls the topic for messages until the dequeue timeout expires.
+// No messages are returned if none became available before the timeout.
+func (s *MessagesService) Dequeue(ctx context.Context, req *DequeueRequest) ([]domain.Message, error) {
+	if s.RateLimiter != nil {
+		ns, err := s.findNamespace(ctx, req.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.allow(ns); err != nil {
+			return nil, err
+		}
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "dequeue",
+		trace.WithAttributes(attribute.String("topic", req.Topic)))
+	defer span.End()
 
 	r := &prefetch.GetItemsRequest{
-		Namespace: dequeueReq.Namespace,
-		Topic:     dequeueReq.Topic,
-		Limit:     dequeueReq.Limit,
-		// TODO check for max allowed timeout
-		Timeout: time.Second * time.Duration(dequeueReq.TimeoutSeconds),
+		Namespace: req.Namespace,
+		Topic:     req.Topic,
+		Limit:     req.Limit,
+		Timeout:   s.dequeueTimeout(req.TimeoutSeconds),
+		Match:     req.Match,
 	}
-	if r.Timeout == 0 {
-		r.Timeout = 30 * time.Second
+
+	messages := s.pollMessages(context.Background(), r)
+	if len(messages) > 0 {
+		span.SetAttributes(attribute.Int("messages", len(messages)))
 	}
+	return messages, nil
+}
 
+// pollMessages polls the prefetch buffer for messages with exponential backoff,
+// until messages become available, the request timeout expires or ctx is done.
+func (s *MessagesService) pollMessages(ctx context.Context, r *prefetch.GetItemsRequest) []domain.Message {
 	backoff := wait.NewBackoff(time.Millisecond, 2, time.Second)
-	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	pollCtx, cancel := context.WithTimeout(ctx, r.Timeout)
 	defer cancel()
 
 	for {
@@ -176,50 +505,511 @@ func (s *MessagesService) HandleDequeue(c *ApiCtx) {
 				backoff.Backoff()
 				continue
 			}
+			return resp.Messages
 
-			msgs := []H{}
-			for _, m := range resp.Messages {
-				msgs = append(msgs, H{
-					"id":        m.Id.String(),
-					"topic":     m.Topic,
-					"namespace": "todo",
-					"priority":  m.Priority,
-					"payload":   string(m.Payload),
-					"metadata":  string(m.Metadata),
-				})
-			}
-			c.JsonResponse(http.StatusOK, H{"messages": msgs})
-			return
-
-		case <-ctx.Done():
-			c.JsonResponse(http.StatusNotFound, H{"messages": []string{}})
-			return
+		case <-pollCtx.Done():
+			return nil
 		}
 	}
 }
 
+type PeekRequest struct {
+	Namespace string `json:"namespace"`
+	Topic     string `json:"topic"`
+	Limit     int    `json:"limit"`
+	// Match restricts the result to messages whose headers contain all
+	// of its key/value pairs.
+	Match map[string]string `json:"match"`
+}
+
+// HandlePeek returns the messages that would be delivered next for a topic
+// without consuming them, leaving the queue state unchanged.
+func (s *MessagesService) HandlePeek(c *ApiCtx) {
+	var peekReq PeekRequest
+	if err := decodeJSON(c, &peekReq); err != nil {
+		c.Error(err)
+		return
+	}
+
+	r := &prefetch.GetItemsRequest{
+		Namespace: peekReq.Namespace,
+		Topic:     peekReq.Topic,
+		Limit:     peekReq.Limit,
+		Match:     peekReq.Match,
+	}
+	resp := <-s.DequeueBuffer.Peek(r)
+	c.Respond(http.StatusOK, H{"messages": messagesResponse(resp.Messages)})
+}
+
+// messagesResponse converts messages into their API response representation
+func messagesResponse(messages []domain.Message) []H {
+	msgs := []H{}
+	for _, m := range messages {
+		msgs = append(msgs, H{
+			"id":        m.Id.String(),
+			"topic":     m.Topic,
+			"namespace": "todo",
+			"priority":  m.Priority,
+			"payload":   string(m.Payload),
+			"metadata":  string(m.Metadata),
+			"headers":   m.Headers,
+			"createdAt": m.CreatedAt(),
+			// consumers can send the traceparent back when acknowledging
+			// the message to link the ack to the message trace
+			"traceparent": m.TraceParent,
+			// the lease identifies this delivery when acknowledging the message
+			"lease": m.Lease,
+			// previous deliveries that were nacked
+			"attempts": m.Attempts,
+		})
+	}
+	return msgs
+}
+
+// requestContext returns the context of the API request, continuing the trace
+// propagated by the client in the request headers, if any.
+func requestContext(c *ApiCtx) context.Context {
+	return tracing.ContextFromHeaders(c.Request.Context(), c.Request.Header)
+}
+
+// dequeueTimeout returns the effective timeout for a dequeue request, clamping
+// the timeout requested by the client to the MaxDequeueTimeout.
+func (s *MessagesService) dequeueTimeout(seconds int) time.Duration {
+	maxTimeout := s.MaxDequeueTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = defaultMaxDequeueTimeout
+	}
+
+	if seconds <= 0 {
+		return min(defaultDequeueTimeout, maxTimeout)
+	}
+	// clamp before converting to avoid overflows with large client values
+	if seconds >= int(maxTimeout/time.Second) {
+		return maxTimeout
+	}
+	return time.Second * time.Duration(seconds)
+}
+
 type AckNackRequest struct {
 	Id  string `json:"id"`
 	Ack bool   `json:"ack"`
+	// TraceParent is the trace context returned with the dequeued message
+	TraceParent string `json:"traceparent"`
+	// Lease is the lease returned with the dequeued message. Requests with the
+	// lease of a previous delivery of the message are ignored.
+	Lease string `json:"lease"`
 }
 
+// HandleAckNack routes ack/nack requests to the workers of the shards storing
+// the messages.
+// Every item in the batch is routed independently. The reply lists the ids that
+// were successfully routed and the ones that failed with their error, using a
+// 207 Multi-Status code when any of the items could not be routed.
 func (s *MessagesService) HandleAckNack(c *ApiCtx) {
 	var acks []AckNackRequest
-	if err := json.NewDecoder(c.Request.Body).Decode(&acks); err != nil {
-		c.JsonResponse(http.StatusInternalServerError, H{"error": err.Error()})
+	if err := decodeJSON(c, &acks); err != nil {
+		c.Error(err)
 		return
 	}
 
-	for _, ack := range acks {
+	succeeded, failed := s.ackNackReport(requestContext(c), c.Logger(s.Logger), acks)
+
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.Respond(status, H{"succeeded": succeeded, "failed": failed})
+}
+
+// ackNackReport routes the ack/nack requests and returns the ids that were
+// successfully routed and the ones that failed with their error.
+func (s *MessagesService) ackNackReport(ctx context.Context, logger *zap.Logger, acks []AckNackRequest) ([]string, []H) {
+	succeeded := []string{}
+	failed := []H{}
+	for i, err := range s.AckNack(ctx, acks) {
+		if err != nil {
+			logger.Error("error routing ack/nack", zap.String("id", acks[i].Id), zap.Error(err))
+			failed = append(failed, H{"id": acks[i].Id, "error": err.Error()})
+			continue
+		}
+		succeeded = append(succeeded, acks[i].Id)
+	}
+	return succeeded, failed
+}
+
+// AckNack routes the ack/nack requests to the workers of the shards storing the
+// messages. Every request is routed independently: the returned errors report
+// the outcome of the request at the same index, nil if it was routed.
+func (s *MessagesService) AckNack(ctx context.Context, acks []AckNackRequest) []error {
+	errs := make([]error, len(acks))
+	for i, ack := range acks {
 		uid, err := domain.ParseUUID(ack.Id)
 		if err != nil {
-			s.Logger.Error("error parsing UUID", zap.Error(err))
+			errs[i] = err
+			continue
+		}
+		errs[i] = s.routeAckNack(ctx, uid, ack)
+	}
+	return errs
+}
+
+// routeAckNack sends the ack/nack request to the worker of the shard storing the message.
+// The request is traced as part of the message trace when the client provides its traceparent.
+func (s *MessagesService) routeAckNack(ctx context.Context, uid *domain.UUID, ack AckNackRequest) error {
+	ctx = tracing.ContextWithTraceParent(ctx, ack.TraceParent)
+	_, span := tracing.Tracer().Start(ctx, "acknack",
+		trace.WithAttributes(attribute.Bool("ack", ack.Ack)))
+	defer span.End()
+
+	req := queue.AckNackRequest{Id: *uid, Ack: ack.Ack, Lease: ack.Lease, SpanCtx: span.SpanContext()}
+	if err := s.AckNackRouter.Route(uid, req); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// validateTopic checks the topic name can be stored in the database.
+func validateTopic(topic string) error {
+	if len(topic) == 0 {
+		return newApiError(http.StatusBadRequest, "topic is required")
+	}
+	if len(topic) > maxTopicLength {
+		return newApiError(http.StatusBadRequest, "topic length %d exceeds the maximum of %d characters", len(topic), maxTopicLength)
+	}
+	return nil
+}
+
+type shardGetter interface {
+	Get(id uint32) *db.ShardMeta
+}
+
+type messageMover interface {
+	MoveToTopic(context.Context, *db.ShardMeta, domain.UUID, []domain.UUID, string) (int64, error)
+}
+
+type shardMigrator interface {
+	Migrate(context.Context, *db.ShardMeta, *db.ShardMeta) (int64, error)
+}
+
+type shardRegistry interface {
+	shardGetter
+	shardLister
+}
+
+type topicDeleter interface {
+	DeleteTopic(context.Context, *db.ShardMeta, domain.UUID, string) (int64, error)
+}
+
+type topicBufferPurger interface {
+	Purge(domain.UUID, string) int
+	PurgeMoved(domain.UUID, []domain.UUID, string) int
+}
+
+// AdminService exposes endpoints for operators to manage the messages stored
+// in the queue.
+type AdminService struct {
+	Logger *zap.Logger
+	Shards shardRegistry
+	// MainShard and NsRepository resolve the namespace of moved messages
+	MainShard     *db.ShardMeta
+	NsRepository  namespaceFinder
+	MsgRepository messageMover
+	Migrator      shardMigrator
+	// TopicDeleter and DequeueBuffer remove the messages of purged topics from
+	// the shards and from the prefetch buffer
+	TopicDeleter  topicDeleter
+	DequeueBuffer topicBufferPurger
+}
+
+type MoveRequest struct {
+	Namespace string   `json:"namespace"`
+	Ids       []string `json:"ids"`
+	Topic     string   `json:"topic"`
+}
+
+// HandleMove moves messages of a namespace to the target topic, for example to
+// requeue stuck or dead-lettered messages. The target topic must be allowed in the
+// namespace. Moved messages are removed from the prefetch buffer and become ready
+// for delivery to the consumers of the target topic.
+// Message ids are grouped by the shard storing them and every shard is updated
+// with a single statement. The reply reports how many messages were moved.
+func (s *AdminService) HandleMove(c *ApiCtx) {
+	var req MoveRequest
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := validateTopic(req.Topic); err != nil {
+		c.Error(err)
+		return
+	}
+	ns, err := s.NsRepository.CachedFindByStringId(c.Request.Context(), s.MainShard, req.Namespace)
+	if err != nil {
+		c.Error(err)
+		return
+	} else if ns == nil {
+		c.Error(fmt.Errorf("invalid namespace: %w", errNotFound))
+		return
+	}
+	if !ns.AllowsTopic(req.Topic) {
+		c.Error(newApiError(http.StatusBadRequest, "topic %q is not allowed in namespace %s", req.Topic, ns.Name))
+		return
+	}
+	if len(req.Ids) == 0 {
+		c.Error(newApiError(http.StatusBadRequest, "no message ids to move"))
+		return
+	}
+
+	byShard := map[uint32][]domain.UUID{}
+	for _, id := range req.Ids {
+		uid, err := domain.ParseUUID(id)
+		if err != nil {
+			c.Error(newApiError(http.StatusBadRequest, "invalid message id %q: %v", id, err))
+			return
+		}
+		byShard[uid.ShardId()] = append(byShard[uid.ShardId()], *uid)
+	}
+
+	// reject the whole request before moving anything if some ids can't be
+	// routed to a shard, so the client never gets a partial move
+	shards := make(map[uint32]*db.ShardMeta, len(byShard))
+	var unroutable []string
+	for shardId, ids := range byShard {
+		shard := s.Shards.Get(shardId)
+		if shard == nil {
+			for _, uid := range ids {
+				unroutable = append(unroutable, uid.String())
+			}
 			continue
 		}
-		req := queue.AckNackRequest{Id: *uid, Ack: ack.Ack}
-		if err := s.AckNackRouter.Route(uid, req); err != nil {
-			c.JsonResponse(http.StatusInternalServerError, H{"error": err.Error()})
+		shards[shardId] = shard
+	}
+	if len(unroutable) > 0 {
+		slices.Sort(unroutable)
+		c.Respond(http.StatusBadRequest, H{
+			"error":      "message ids don't belong to a known shard",
+			"unroutable": unroutable,
+		})
+		return
+	}
+
+	// messages prefetched before the move are removed from the buffer once their
+	// shard is updated: their lease was reset and they can't be acknowledged
+	var moved int64
+	var movedIds []domain.UUID
+	for shardId, ids := range byShard {
+		shard := shards[shardId]
+		n, err := s.MsgRepository.MoveToTopic(c.Request.Context(), shard, ns.Id, ids, req.Topic)
+		if err != nil {
+			c.Logger(s.Logger).Error("error moving messages",
+				zap.Uint32("shardId", shardId), zap.Error(err))
+			s.DequeueBuffer.PurgeMoved(ns.Id, movedIds, req.Topic)
+			c.Respond(errorStatus(err), H{"error": err.Error(), "moved": moved})
 			return
 		}
+		moved += n
+		movedIds = append(movedIds, ids...)
+	}
+	buffered := s.DequeueBuffer.PurgeMoved(ns.Id, movedIds, req.Topic)
+
+	c.Respond(http.StatusOK, H{"moved": moved, "topic": req.Topic, "buffered": buffered})
+}
+
+// HandlePurgeTopic deletes all messages of the topic in the path, in the namespace
+// selected with the namespace query parameter, for example to wipe a topic used in
+// tests. Messages are deleted from every shard before being removed from the
+// prefetch buffer, so that they are not delivered once the request completes.
+// The reply reports how many messages were deleted from every shard.
+func (s *AdminService) HandlePurgeTopic(c *ApiCtx) {
+	topic := c.Request.PathValue("topic")
+	if err := validateTopic(topic); err != nil {
+		c.Error(err)
+		return
 	}
+	namespace := c.Request.URL.Query().Get("namespace")
+	uid, err := domain.ParseUUID(namespace)
+	if err != nil {
+		c.Error(newApiError(http.StatusBadRequest, "invalid namespace %q: %v", namespace, err))
+		return
+	}
+
+	var deleted int64
+	shards := []H{}
+	for _, shard := range s.Shards.Shards() {
+		n, err := s.TopicDeleter.DeleteTopic(c.Request.Context(), shard, *uid, topic)
+		if err != nil {
+			c.Logger(s.Logger).Error("error purging topic",
+				zap.Uint32("shardId", shard.Id), zap.String("topic", topic), zap.Error(err))
+			c.Respond(errorStatus(err), H{"error": err.Error(), "deleted": deleted, "shards": shards})
+			return
+		}
+		deleted += n
+		shards = append(shards, H{"shardId": shard.Id, "deleted": n})
+	}
+	buffered := s.DequeueBuffer.Purge(*uid, topic)
+
+	c.Respond(http.StatusOK, H{
+		"namespace": uid.String(),
+		"topic":     topic,
+		"deleted":   deleted,
+		"shards":    shards,
+		"buffered":  buffered,
+	})
+}
+
+type MigrateShardRequest struct {
+	Source      uint32 `json:"source"`
+	Destination uint32 `json:"destination"`
+}
+
+// HandleMigrateShard moves all messages stored in the source shard to the destination
+// shard, for example before removing the source shard from the cluster.
+// Migrated messages keep their ids and their ack/nack requests are redirected to
+// the destination shard. Migrations that fail can be requested again to move the
+// remaining messages. The reply reports how many messages were moved.
+func (s *AdminService) HandleMigrateShard(c *ApiCtx) {
+	var req MigrateShardRequest
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
+		return
+	}
+	if req.Source == req.Destination {
+		c.Error(newApiError(http.StatusBadRequest, "source and destination shards must be different"))
+		return
+	}
+
+	src := s.Shards.Get(req.Source)
+	if src == nil {
+		c.Error(newApiError(http.StatusBadRequest, "unknown source shard %d", req.Source))
+		return
+	}
+	dst := s.Shards.Get(req.Destination)
+	if dst == nil {
+		c.Error(newApiError(http.StatusBadRequest, "unknown destination shard %d", req.Destination))
+		return
+	}
+
+	moved, err := s.Migrator.Migrate(c.Request.Context(), src, dst)
+	if err != nil {
+		c.Logger(s.Logger).Error("error migrating shard",
+			zap.Uint32("source", req.Source),
+			zap.Uint32("destination", req.Destination),
+			zap.Error(err))
+		c.Respond(errorStatus(err), H{"error": err.Error(), "moved": moved})
+		return
+	}
+
+	c.Respond(http.StatusOK, H{"moved": moved, "source": req.Source, "destination": req.Destination})
+}
+
+type shardLister interface {
+	Shards() []*db.ShardMeta
+}
+
+type topicCounter interface {
+	CountReadyByTopic(context.Context, *db.ShardMeta, domain.UUID) (map[string]int64, error)
+}
+
+// TopicsService exposes information about the topics with messages in the queue.
+type TopicsService struct {
+	Logger        *zap.Logger
+	Shards        shardLister
+	MsgRepository topicCounter
+}
+
+// HandleGetTopics lists the topics of a namespace with the number of messages
+// ready for delivery. Counts are aggregated across all shards.
+func (s *TopicsService) HandleGetTopics(c *ApiCtx) {
+	namespace := c.Request.URL.Query().Get("namespace")
+	uid, err := domain.ParseUUID(namespace)
+	if err != nil {
+		c.Error(newApiError(http.StatusBadRequest, "invalid namespace %q: %v", namespace, err))
+		return
+	}
+
+	totals := map[string]int64{}
+	for _, shard := range s.Shards.Shards() {
+		counts, err := s.MsgRepository.CountReadyByTopic(c.Request.Context(), shard, *uid)
+		if err != nil {
+			c.Logger(s.Logger).Error("error counting topic messages",
+				zap.Uint32("shardId", shard.Id), zap.Error(err))
+			c.Error(err)
+			return
+		}
+		for topic, n := range counts {
+			totals[topic] += n
+		}
+	}
+
+	names := make([]string, 0, len(totals))
+	for topic := range totals {
+		names = append(names, topic)
+	}
+	slices.Sort(names)
+
+	topics := []H{}
+	for _, topic := range names {
+		topics = append(topics, H{"topic": topic, "ready": totals[topic]})
+	}
+	c.Respond(http.StatusOK, H{"topics": topics})
+}
+
+type topicSchemaSaver interface {
+	Save(context.Context, *db.ShardMeta, *domain.TopicSchema) error
+}
+
+// SchemaService manages the JSON Schemas validating the payloads enqueued to topics.
+type SchemaService struct {
+	Logger           *zap.Logger
+	MainShard        *db.ShardMeta
+	NsRepository     namespaceFinder
+	SchemaRepository topicSchemaSaver
+}
+
+type RegisterSchemaRequest struct {
+	Namespace string          `json:"namespace"`
+	Topic     string          `json:"topic"`
+	Schema    json.RawMessage `json:"schema"`
+}
+
+// HandleRegisterSchema registers the JSON Schema of a namespace topic, replacing
+// the previous one. Once registered, payloads enqueued to the topic that don't
+// conform to the schema are rejected.
+func (s *SchemaService) HandleRegisterSchema(c *ApiCtx) {
+	var req RegisterSchemaRequest
+	if err := decodeJSON(c, &req); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := validateTopic(req.Topic); err != nil {
+		c.Error(err)
+		return
+	}
+	ns, err := s.NsRepository.CachedFindByStringId(c.Request.Context(), s.MainShard, req.Namespace)
+	if err != nil {
+		c.Error(err)
+		return
+	} else if ns == nil {
+		c.Error(fmt.Errorf("invalid namespace: %w", errNotFound))
+		return
+	}
+	if !ns.AllowsTopic(req.Topic) {
+		c.Error(newApiError(http.StatusBadRequest, "topic %q is not allowed in namespace %s", req.Topic, ns.Name))
+		return
+	}
+
+	schema, err := domain.NewTopicSchema(ns.Id, req.Topic, string(req.Schema))
+	if err != nil {
+		c.Error(newApiError(http.StatusBadRequest, "invalid schema: %v", err))
+		return
+	}
+	if err := s.SchemaRepository.Save(c.Request.Context(), s.MainShard, schema); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Respond(http.StatusOK, H{"namespace": ns.Id.String(), "topic": req.Topic})
 }
@@ -0,0 +1,1320 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queue"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/ratelimit"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// newTestCtx creates an ApiCtx to call handlers directly with a recorded response
+func newTestCtx(method string, path string, body io.Reader) (*ApiCtx, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c := &ApiCtx{
+		Request: httptest.NewRequest(method, path, body),
+		Writer:  w,
+	}
+	return c, w
+}
+
+type fakeShardPinger map[uint32]error
+
+func (f fakeShardPinger) Ping(context.Context) map[uint32]error {
+	return f
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &HealthService{Logger: logger, Shards: fakeShardPinger{}}
+
+	c, w := newTestCtx(http.MethodGet, "/healthz", nil)
+	svc.HandleHealth(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadinessWithShardDown(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.ErrorLevel))
+	svc := &HealthService{
+		Logger: logger,
+		Shards: fakeShardPinger{
+			10: nil,
+			20: errors.New("connection refused"),
+		},
+	}
+
+	c, w := newTestCtx(http.MethodGet, "/readyz", nil)
+	svc.HandleReady(c)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	var reply struct {
+		Shards []struct {
+			Id     uint32 `json:"id"`
+			Status string `json:"status"`
+		} `json:"shards"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	down := []uint32{}
+	for _, s := range reply.Shards {
+		if s.Status == "down" {
+			down = append(down, s.Id)
+		}
+	}
+	if len(down) != 1 || down[0] != 20 {
+		t.Fatalf("expected shard 20 to be reported down, found %v", down)
+	}
+}
+
+func TestReadinessAllShardsUp(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &HealthService{
+		Logger: logger,
+		Shards: fakeShardPinger{10: nil, 20: nil},
+	}
+
+	c, w := newTestCtx(http.MethodGet, "/readyz", nil)
+	svc.HandleReady(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+}
+
+// jsonBody encodes the value v into a JSON request body
+func jsonBody(t testing.TB, v any) io.Reader {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b)
+}
+
+// newTestPriorityBuffer runs a PriorityBuffer until the test completes
+func newTestPriorityBuffer(t testing.TB, logger *zap.Logger) *prefetch.PriorityBuffer {
+	buf := prefetch.NewPriorityBuffer(logger)
+	buf.Run()
+	t.Cleanup(func() { buf.Stop() })
+	return buf
+}
+
+func TestDequeueTimeoutIsClamped(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     newTestPriorityBuffer(t, logger),
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	body := jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test", TimeoutSeconds: 3600})
+	c, w := newTestCtx(http.MethodPost, "/message/dequeue", body)
+
+	start := time.Now()
+	svc.HandleDequeue(c)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dequeue timeout was not clamped: took %s", elapsed)
+	}
+
+	if v := w.Header().Get(dequeueTimeoutHeader); v != "100ms" {
+		t.Fatalf("wrong effective timeout reported: expected %s, found %s", "100ms", v)
+	}
+}
+
+func TestDequeueNoMessagesReturnsNoContent(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     newTestPriorityBuffer(t, logger),
+		MaxDequeueTimeout: 50 * time.Millisecond,
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "empty"}))
+	svc.HandleDequeue(c)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusNoContent)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected empty body, found %q", w.Body.String())
+	}
+}
+
+func TestDequeueTimeoutDefaults(t *testing.T) {
+	svc := &MessagesService{}
+
+	if v := svc.dequeueTimeout(0); v != defaultDequeueTimeout {
+		t.Fatalf("expected default timeout %s, found %s", defaultDequeueTimeout, v)
+	}
+	if v := svc.dequeueTimeout(3600); v != defaultMaxDequeueTimeout {
+		t.Fatalf("expected max timeout %s, found %s", defaultMaxDequeueTimeout, v)
+	}
+	if v := svc.dequeueTimeout(5); v != 5*time.Second {
+		t.Fatalf("expected timeout %s, found %s", 5*time.Second, v)
+	}
+	// values that overflow time.Duration are clamped too
+	if v := svc.dequeueTimeout(math.MaxInt); v != defaultMaxDequeueTimeout {
+		t.Fatalf("expected max timeout %s, found %s", defaultMaxDequeueTimeout, v)
+	}
+}
+
+func TestEnqueueRejectsOversizedMessages(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	enqueueBuf := make(chan queue.EnqueueRequest, 1)
+	svc := &MessagesService{
+		Logger:          logger,
+		EnqueueBuffer:   enqueueBuf,
+		MaxPayloadSize:  16,
+		MaxMetadataSize: 8,
+	}
+
+	testCases := []EnqueueRequest{
+		{Namespace: "ns", Topic: "test", Payload: strings.Repeat("x", 17)},
+		{Namespace: "ns", Topic: "test", Payload: "ok", Metadata: strings.Repeat("x", 9)},
+		// bodies larger than the limits are rejected before being decoded
+		{Namespace: "ns", Topic: "test", Payload: strings.Repeat("x", 1024*1024)},
+	}
+	for _, req := range testCases {
+		c, w := newTestCtx(http.MethodPost, "/message/enqueue", jsonBody(t, req))
+		svc.HandleEnqueue(c)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusRequestEntityTooLarge)
+		}
+		if len(enqueueBuf) != 0 {
+			t.Fatal("oversized message should not reach the enqueue buffer")
+		}
+	}
+}
+
+func TestDequeueRateLimitedByNamespace(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	finder := &fakeNamespaceFinder{}
+	noisy, _ := finder.CachedFindByStringId(context.Background(), nil, "noisy")
+	limiter := &ratelimit.NamespaceLimiter{
+		Default:   ratelimit.Limit{Rate: 100, Burst: 100},
+		Overrides: map[string]ratelimit.Limit{noisy.Id.String(): {Rate: 1, Burst: 1}},
+	}
+	svc := &MessagesService{
+		Logger:            logger,
+		NsRepository:      finder,
+		DequeueBuffer:     newTestPriorityBuffer(t, logger),
+		MaxDequeueTimeout: 10 * time.Millisecond,
+		RateLimiter:       limiter,
+	}
+
+	dequeue := func(ns string) *httptest.ResponseRecorder {
+		body := jsonBody(t, DequeueRequest{Namespace: ns, Topic: "test"})
+		c, w := newTestCtx(http.MethodPost, "/message/dequeue", body)
+		svc.HandleDequeue(c)
+		return w
+	}
+
+	if w := dequeue("noisy"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("first request should not be rate limited")
+	}
+	w := dequeue("noisy")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusTooManyRequests)
+	}
+	if len(w.Header().Get("Retry-After")) == 0 {
+		t.Fatal("rate limited response is missing the Retry-After header")
+	}
+
+	if w := dequeue("quiet"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("other namespaces should not be rate limited")
+	}
+
+	// unknown namespaces are rejected without creating a token-bucket
+	if w := dequeue("missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+	if n := limiter.Len(); n != 2 {
+		t.Fatalf("expected %d limiters, found %d", 2, n)
+	}
+}
+
+// ingestTestMessages loads messages into the prefetch buffer as a dequeue worker would
+func ingestTestMessages(t testing.TB, buf *prefetch.PriorityBuffer, msgs []domain.Message) {
+	respCh := make(chan []prefetch.PrefetchResponseStatus)
+	buf.C() <- prefetch.IngestEnvelope{Batch: msgs, RespCh: respCh}
+	for _, status := range <-respCh {
+		if status != prefetch.PrefetchStatusOk {
+			t.Fatal("test message rejected by prefetch buffer")
+		}
+	}
+}
+
+type messagesReply struct {
+	Messages []struct {
+		Id        string    `json:"id"`
+		CreatedAt time.Time `json:"createdAt"`
+		Attempts  int       `json:"attempts"`
+	} `json:"messages"`
+}
+
+func TestDequeueIncludesCreatedAt(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	msg := domain.Message{Id: domain.NewUUID(10), Topic: "test"}
+	ingestTestMessages(t, buf, []domain.Message{msg})
+
+	c, w := newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test"}))
+	svc.HandleDequeue(c)
+
+	var dequeued messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != 1 {
+		t.Fatalf("expected %d dequeued messages, found %d", 1, len(dequeued.Messages))
+	}
+	if !dequeued.Messages[0].CreatedAt.Equal(msg.CreatedAt()) {
+		t.Fatalf("expected createdAt %s, found %s", msg.CreatedAt(), dequeued.Messages[0].CreatedAt)
+	}
+}
+
+func TestDequeueIncludesAttempts(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	// messages are redelivered with the attempts counted by the database
+	for attempts := 0; attempts < 3; attempts++ {
+		msg := domain.Message{Id: domain.NewUUID(10), Topic: "test", Attempts: attempts}
+		ingestTestMessages(t, buf, []domain.Message{msg})
+
+		c, w := newTestCtx(http.MethodPost, "/message/dequeue",
+			jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test"}))
+		svc.HandleDequeue(c)
+
+		var dequeued messagesReply
+		if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+			t.Fatal(err)
+		}
+		if len(dequeued.Messages) != 1 {
+			t.Fatalf("expected %d dequeued messages, found %d", 1, len(dequeued.Messages))
+		}
+		if dequeued.Messages[0].Attempts != attempts {
+			t.Fatalf("expected %d attempts, found %d", attempts, dequeued.Messages[0].Attempts)
+		}
+	}
+}
+
+func TestPeekDoesNotConsumeMessages(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	ingestTestMessages(t, buf, []domain.Message{
+		{Id: domain.NewUUID(10), Topic: "test", Priority: 2},
+		{Id: domain.NewUUID(10), Topic: "test", Priority: 1},
+	})
+
+	c, w := newTestCtx(http.MethodPost, "/message/peek",
+		jsonBody(t, PeekRequest{Namespace: "ns", Topic: "test"}))
+	svc.HandlePeek(c)
+
+	var peeked messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&peeked); err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked.Messages) != 2 {
+		t.Fatalf("expected %d peeked messages, found %d", 2, len(peeked.Messages))
+	}
+
+	c, w = newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test"}))
+	svc.HandleDequeue(c)
+
+	var dequeued messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != len(peeked.Messages) {
+		t.Fatalf("expected %d dequeued messages, found %d", len(peeked.Messages), len(dequeued.Messages))
+	}
+	for i := range peeked.Messages {
+		if peeked.Messages[i].Id != dequeued.Messages[i].Id {
+			t.Fatalf("dequeued message %s does not match peeked message %s",
+				dequeued.Messages[i].Id, peeked.Messages[i].Id)
+		}
+	}
+}
+
+func TestDequeueMatchesHeaders(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	order := domain.Message{Id: domain.NewUUID(10), Topic: "test", Priority: 2,
+		Headers: map[string]string{"type": "order", "region": "eu"}}
+	ingestTestMessages(t, buf, []domain.Message{
+		{Id: domain.NewUUID(10), Topic: "test", Priority: 1, Headers: map[string]string{"type": "refund"}},
+		order,
+		{Id: domain.NewUUID(10), Topic: "test", Priority: 3},
+	})
+
+	c, w := newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test", Limit: 10,
+			Match: map[string]string{"type": "order"}}))
+	svc.HandleDequeue(c)
+
+	var dequeued messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != 1 {
+		t.Fatalf("expected %d dequeued messages, found %d", 1, len(dequeued.Messages))
+	}
+	if dequeued.Messages[0].Id != order.Id.String() {
+		t.Fatalf("expected message %s, found %s", order.Id.String(), dequeued.Messages[0].Id)
+	}
+
+	// messages that didn't match are still available to other consumers
+	c, w = newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test", Limit: 10}))
+	svc.HandleDequeue(c)
+
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != 2 {
+		t.Fatalf("expected %d dequeued messages, found %d", 2, len(dequeued.Messages))
+	}
+}
+
+func TestAckNackForwardsLease(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	buf := make(chan queue.AckNackRequest, 1)
+	router := &queue.AckNackRouter{}
+	router.RegisterWorker(10, queue.NewAckNackWorker(nil, buf, logger))
+	svc := &MessagesService{Logger: logger, AckNackRouter: router}
+
+	id := domain.NewUUID(10)
+	c, w := newTestCtx(http.MethodPost, "/message/ack", jsonBody(t, []AckNackRequest{
+		{Id: id.String(), Ack: true, Lease: "cnv1h2q8hfkc73c3ug8g"},
+	}))
+	svc.HandleAckNack(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+	req := <-buf
+	if req.Id != id || req.Lease != "cnv1h2q8hfkc73c3ug8g" {
+		t.Fatalf("expected ack of %s with lease %q, found %s with lease %q",
+			id.String(), "cnv1h2q8hfkc73c3ug8g", req.Id.String(), req.Lease)
+	}
+}
+
+func TestAckNackReportsPerItemOutcome(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	router := &queue.AckNackRouter{}
+	router.RegisterWorker(10, queue.NewAckNackWorker(nil, make(chan queue.AckNackRequest, 10), logger))
+	svc := &MessagesService{Logger: logger, AckNackRouter: router}
+
+	routable := domain.NewUUID(10)
+	unroutable := domain.NewUUID(99)
+	acks := []AckNackRequest{
+		{Id: routable.String(), Ack: true},
+		{Id: unroutable.String(), Ack: true},
+		{Id: "malformed", Ack: false},
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/message/ack", jsonBody(t, acks))
+	svc.HandleAckNack(c)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusMultiStatus)
+	}
+
+	var reply struct {
+		Succeeded []string `json:"succeeded"`
+		Failed    []struct {
+			Id    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"failed"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reply.Succeeded) != 1 || reply.Succeeded[0] != routable.String() {
+		t.Fatalf("expected %s to succeed, found %v", routable.String(), reply.Succeeded)
+	}
+	if len(reply.Failed) != 2 {
+		t.Fatalf("expected %d failed items, found %d", 2, len(reply.Failed))
+	}
+	for i, id := range []string{unroutable.String(), "malformed"} {
+		if reply.Failed[i].Id != id || len(reply.Failed[i].Error) == 0 {
+			t.Fatalf("expected failure report for %s, found %v", id, reply.Failed[i])
+		}
+	}
+}
+
+// fakeNamespaceFinder resolves every namespace except "missing", returning the
+// same namespace id for repeated lookups.
+type fakeNamespaceFinder struct {
+	err error
+
+	mu         sync.Mutex
+	namespaces map[string]*domain.Namespace
+}
+
+func (f *fakeNamespaceFinder) CachedFindByStringId(_ context.Context, _ *db.ShardMeta, id string) (*domain.Namespace, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if id == "missing" {
+		return nil, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.namespaces == nil {
+		f.namespaces = map[string]*domain.Namespace{}
+	}
+	ns, ok := f.namespaces[id]
+	if !ok {
+		ns = &domain.Namespace{Id: domain.NewUUID(10), Name: id}
+		f.namespaces[id] = ns
+	}
+	return ns, nil
+}
+
+func TestEnqueueReportsNamespaceLookupError(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &MessagesService{
+		Logger:       logger,
+		NsRepository: &fakeNamespaceFinder{err: errors.New("connection refused")},
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "test"}))
+	svc.HandleEnqueue(c)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestEnqueueReportsSaveError(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	enqueueBuf := make(chan queue.EnqueueRequest)
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  &fakeNamespaceFinder{},
+		EnqueueBuffer: enqueueBuf,
+	}
+
+	// failing enqueue worker
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{Err: errors.New("could not save message: disk full")}
+	}()
+
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "test", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.Body.String(), "disk full") {
+		t.Fatalf("response should report the save error, found %s", w.Body.String())
+	}
+}
+
+func TestEnqueueTopicAllowlist(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	enqueueBuf := make(chan queue.EnqueueRequest, 1)
+	finder := &fakeNamespaceFinder{namespaces: map[string]*domain.Namespace{
+		"ns": {Id: domain.NewUUID(10), Name: "ns", Topics: []string{"orders", "invoices"}},
+	}}
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  finder,
+		EnqueueBuffer: enqueueBuf,
+	}
+
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{MsgId: domain.NewUUID(10)}
+	}()
+
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "orders", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+
+	c, w = newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "ordres", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	if len(enqueueBuf) != 0 {
+		t.Fatal("messages for unknown topics should not be enqueued")
+	}
+
+	// namespaces without an allowlist accept any topic
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{MsgId: domain.NewUUID(10)}
+	}()
+	c, w = newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "open", Topic: "anything", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestEnqueueReturnsShardPlacement(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	enqueueBuf := make(chan queue.EnqueueRequest)
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  &fakeNamespaceFinder{},
+		EnqueueBuffer: enqueueBuf,
+	}
+
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{MsgId: domain.NewUUID(42)}
+	}()
+
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "test", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+
+	var reply struct {
+		MsgId   string `json:"msgId"`
+		ShardId uint32 `json:"shardId"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ShardId != 42 {
+		t.Fatalf("expected shard id %d, found %d", 42, reply.ShardId)
+	}
+	// the shard id matches the prefix of the message id
+	prefix, _, _ := strings.Cut(reply.MsgId, "-")
+	if prefix != strconv.FormatUint(uint64(reply.ShardId), 10) {
+		t.Fatalf("shard id %d doesn't match message id %s", reply.ShardId, reply.MsgId)
+	}
+}
+
+// fakeScheduleSaver records the schedules stored by the API
+type fakeScheduleSaver struct {
+	saved []*domain.Schedule
+}
+
+func (f *fakeScheduleSaver) Save(_ context.Context, shard *db.ShardMeta, item *domain.Schedule) error {
+	item.Id = domain.NewUUID(10)
+	f.saved = append(f.saved, item)
+	return nil
+}
+
+func TestEnqueueWithCronSchedule(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	schedules := &fakeScheduleSaver{}
+	svc := &MessagesService{
+		Logger:       logger,
+		NsRepository: &fakeNamespaceFinder{},
+		Schedules:    schedules,
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue", jsonBody(t, EnqueueRequest{
+		Namespace: "ns", Topic: "reports", Payload: "payload", TTLSeconds: 60, Cron: "*/5 * * * *",
+	}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+	var reply struct {
+		ScheduleId string    `json:"scheduleId"`
+		NextRunAt  time.Time `json:"nextRunAt"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules.saved) != 1 || reply.ScheduleId != schedules.saved[0].Id.String() {
+		t.Fatalf("expected schedule %s to be stored, found %v", reply.ScheduleId, schedules.saved)
+	}
+	saved := schedules.saved[0]
+	if saved.Message.Topic != "reports" || saved.Message.TTL != time.Minute {
+		t.Fatalf("unexpected scheduled message %+v", saved.Message)
+	}
+	if !reply.NextRunAt.After(time.Now()) || reply.NextRunAt.Minute()%5 != 0 {
+		t.Fatalf("unexpected next occurrence %s", reply.NextRunAt)
+	}
+
+	invalid := []EnqueueRequest{
+		{Namespace: "ns", Topic: "reports", Cron: "not a cron"},
+		{Namespace: "ns", Topic: "reports", Cron: "* * * * *", DeliverAfterSeconds: 10},
+	}
+	for _, req := range invalid {
+		c, w := newTestCtx(http.MethodPost, "/message/enqueue", jsonBody(t, req))
+		svc.HandleEnqueue(c)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("request %+v: returned status code %d, expected %d", req, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(schedules.saved) != 1 {
+		t.Fatalf("expected invalid schedules to be rejected, found %d schedules", len(schedules.saved))
+	}
+}
+
+// fakeTopicSchemaStore keeps registered topic schemas in memory
+type fakeTopicSchemaStore struct {
+	mu      sync.Mutex
+	schemas map[string]*domain.TopicSchema
+}
+
+func (f *fakeTopicSchemaStore) Save(_ context.Context, _ *db.ShardMeta, item *domain.TopicSchema) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.schemas == nil {
+		f.schemas = map[string]*domain.TopicSchema{}
+	}
+	f.schemas[item.Namespace.String()+"/"+item.Topic] = item
+	return nil
+}
+
+func (f *fakeTopicSchemaStore) CachedFindByTopic(_ context.Context, _ *db.ShardMeta, ns domain.UUID, topic string) (*domain.TopicSchema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.schemas[ns.String()+"/"+topic], nil
+}
+
+func TestEnqueueValidatesTopicSchema(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	finder := &fakeNamespaceFinder{}
+	schemas := &fakeTopicSchemaStore{}
+	enqueueBuf := make(chan queue.EnqueueRequest, 1)
+	schemaSvc := &SchemaService{Logger: logger, NsRepository: finder, SchemaRepository: schemas}
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  finder,
+		EnqueueBuffer: enqueueBuf,
+		Schemas:       schemas,
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/ns/schema", jsonBody(t, RegisterSchemaRequest{
+		Namespace: "ns",
+		Topic:     "orders",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}, "amount": {"type": "number", "minimum": 0}},
+			"required": ["id", "amount"]
+		}`),
+	}))
+	schemaSvc.HandleRegisterSchema(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{MsgId: domain.NewUUID(10)}
+	}()
+	c, w = newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "orders", Payload: `{"id": 1, "amount": 9.99}`}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+
+	c, w = newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "orders", Payload: `{"id": "one", "amount": -1}`}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	var reply struct {
+		ValidationErrors []string `json:"validationErrors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.ValidationErrors) != 2 {
+		t.Fatalf("expected %d validation errors, found %v", 2, reply.ValidationErrors)
+	}
+	if len(enqueueBuf) != 0 {
+		t.Fatal("non-conforming messages should not be enqueued")
+	}
+
+	// topics without a schema accept any payload
+	go func() {
+		req := <-enqueueBuf
+		req.RespCh <- queue.EnqueueResponse{MsgId: domain.NewUUID(10)}
+	}()
+	c, w = newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "invoices", Payload: "not json"}))
+	svc.HandleEnqueue(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestRegisterInvalidSchema(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &SchemaService{Logger: logger, NsRepository: &fakeNamespaceFinder{}, SchemaRepository: &fakeTopicSchemaStore{}}
+
+	testCases := []RegisterSchemaRequest{
+		{Namespace: "ns", Topic: "orders", Schema: json.RawMessage(`{"type": "unknown"}`)},
+		// referenced documents are never loaded
+		{Namespace: "ns", Topic: "orders", Schema: json.RawMessage(`{"$ref": "file:///etc/passwd"}`)},
+	}
+	for _, req := range testCases {
+		c, w := newTestCtx(http.MethodPost, "/ns/schema", jsonBody(t, req))
+		svc.HandleRegisterSchema(c)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusBadRequest)
+		}
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/ns/schema",
+		jsonBody(t, RegisterSchemaRequest{Namespace: "missing", Topic: "orders", Schema: json.RawMessage(`{}`)}))
+	svc.HandleRegisterSchema(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// recordSpans installs a tracer provider that records spans in memory for the
+// duration of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestTracingLinksEnqueueAndAck(t *testing.T) {
+	recorder := recordSpans(t)
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	enqueueBuf := make(chan queue.EnqueueRequest)
+	router := &queue.AckNackRouter{}
+	router.RegisterWorker(10, queue.NewAckNackWorker(nil, make(chan queue.AckNackRequest, 1), logger))
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  &fakeNamespaceFinder{},
+		EnqueueBuffer: enqueueBuf,
+		AckNackRouter: router,
+	}
+
+	msgId := domain.NewUUID(10)
+	traceParentCh := make(chan string, 1)
+	go func() {
+		req := <-enqueueBuf
+		traceParentCh <- req.Msg.TraceParent
+		req.RespCh <- queue.EnqueueResponse{MsgId: msgId}
+	}()
+
+	c, _ := newTestCtx(http.MethodPost, "/message/enqueue",
+		jsonBody(t, EnqueueRequest{Namespace: "ns", Topic: "test", Payload: "payload"}))
+	svc.HandleEnqueue(c)
+
+	// the consumer sends back the traceparent received with the dequeued message
+	acks := []AckNackRequest{{Id: msgId.String(), Ack: true, TraceParent: <-traceParentCh}}
+	c, _ = newTestCtx(http.MethodPost, "/message/ack", jsonBody(t, acks))
+	svc.HandleAckNack(c)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	enqueueSpan, ok := spans["enqueue"]
+	if !ok {
+		t.Fatal("enqueue span not recorded")
+	}
+	ackSpan, ok := spans["acknack"]
+	if !ok {
+		t.Fatal("acknack span not recorded")
+	}
+	if enqueueSpan.SpanContext().TraceID() != ackSpan.SpanContext().TraceID() {
+		t.Fatalf("expected ack span in trace %s, found %s",
+			enqueueSpan.SpanContext().TraceID(), ackSpan.SpanContext().TraceID())
+	}
+}
+
+type fakeShardGetter map[uint32]*db.ShardMeta
+
+func (f fakeShardGetter) Get(id uint32) *db.ShardMeta {
+	return f[id]
+}
+
+func (f fakeShardGetter) Shards() []*db.ShardMeta {
+	shards := make([]*db.ShardMeta, 0, len(f))
+	for _, shard := range f {
+		shards = append(shards, shard)
+	}
+	slices.SortFunc(shards, func(a, b *db.ShardMeta) int { return cmp.Compare(a.Id, b.Id) })
+	return shards
+}
+
+// fakeMessageMover records the ids moved on every shard
+type fakeMessageMover struct {
+	moved map[uint32][]domain.UUID
+	topic string
+}
+
+func (f *fakeMessageMover) MoveToTopic(_ context.Context, shard *db.ShardMeta, _ domain.UUID, ids []domain.UUID, topic string) (int64, error) {
+	if f.moved == nil {
+		f.moved = map[uint32][]domain.UUID{}
+	}
+	f.moved[shard.Id] = append(f.moved[shard.Id], ids...)
+	f.topic = topic
+	return int64(len(ids)), nil
+}
+
+func TestMoveMessagesGroupsByShard(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	mover := &fakeMessageMover{}
+	svc := &AdminService{
+		Logger: logger,
+		Shards: fakeShardGetter{
+			10: db.NewShardMeta(10, nil, true),
+			20: db.NewShardMeta(20, nil, false),
+		},
+		NsRepository:  &fakeNamespaceFinder{},
+		MsgRepository: mover,
+		DequeueBuffer: newTestPriorityBuffer(t, logger),
+	}
+
+	ids := []domain.UUID{domain.NewUUID(10), domain.NewUUID(20), domain.NewUUID(10)}
+	c, w := newTestCtx(http.MethodPost, "/message/move", jsonBody(t, MoveRequest{
+		Namespace: "ns",
+		Ids:       []string{ids[0].String(), ids[1].String(), ids[2].String()},
+		Topic:     "retry",
+	}))
+	svc.HandleMove(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+	var reply struct {
+		Moved int64 `json:"moved"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Moved != 3 {
+		t.Fatalf("expected %d moved messages, found %d", 3, reply.Moved)
+	}
+	if len(mover.moved[10]) != 2 || len(mover.moved[20]) != 1 || mover.topic != "retry" {
+		t.Fatalf("unexpected moves %v to topic %s", mover.moved, mover.topic)
+	}
+}
+
+func TestMoveMessagesRejectsUnroutableIds(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	mover := &fakeMessageMover{}
+	svc := &AdminService{
+		Logger:        logger,
+		Shards:        fakeShardGetter{10: db.NewShardMeta(10, nil, true)},
+		NsRepository:  &fakeNamespaceFinder{},
+		MsgRepository: mover,
+		DequeueBuffer: newTestPriorityBuffer(t, logger),
+	}
+
+	known, unknown := domain.NewUUID(10), domain.NewUUID(30)
+	c, w := newTestCtx(http.MethodPost, "/message/move", jsonBody(t, MoveRequest{
+		Namespace: "ns",
+		Ids:       []string{known.String(), unknown.String()},
+		Topic:     "retry",
+	}))
+	svc.HandleMove(c)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	var reply struct {
+		Unroutable []string `json:"unroutable"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Unroutable) != 1 || reply.Unroutable[0] != unknown.String() {
+		t.Fatalf("expected unroutable ids [%s], found %v", unknown.String(), reply.Unroutable)
+	}
+	if len(mover.moved) != 0 {
+		t.Fatalf("expected no messages moved, found %v", mover.moved)
+	}
+}
+
+func TestMoveMessagesValidatesRequest(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	finder := &fakeNamespaceFinder{}
+	restricted, _ := finder.CachedFindByStringId(context.Background(), nil, "restricted")
+	restricted.Topics = []string{"orders"}
+	svc := &AdminService{Logger: logger, Shards: fakeShardGetter{}, NsRepository: finder,
+		MsgRepository: &fakeMessageMover{}}
+
+	id := domain.NewUUID(10)
+	requests := []struct {
+		req    MoveRequest
+		status int
+	}{
+		{MoveRequest{Namespace: "ns", Ids: []string{id.String()}, Topic: ""}, http.StatusBadRequest},
+		{MoveRequest{Namespace: "ns", Ids: []string{id.String()}, Topic: strings.Repeat("t", maxTopicLength+1)}, http.StatusBadRequest},
+		{MoveRequest{Namespace: "ns", Ids: []string{}, Topic: "retry"}, http.StatusBadRequest},
+		{MoveRequest{Namespace: "ns", Ids: []string{"invalid"}, Topic: "retry"}, http.StatusBadRequest},
+		{MoveRequest{Namespace: "restricted", Ids: []string{id.String()}, Topic: "retry"}, http.StatusBadRequest},
+		{MoveRequest{Namespace: "missing", Ids: []string{id.String()}, Topic: "retry"}, http.StatusNotFound},
+	}
+	for _, tt := range requests {
+		c, w := newTestCtx(http.MethodPost, "/message/move", jsonBody(t, tt.req))
+		svc.HandleMove(c)
+		if w.Code != tt.status {
+			t.Fatalf("returned status code %d for %+v, expected %d", w.Code, tt.req, tt.status)
+		}
+	}
+}
+
+func TestMoveMessagesPurgesPrefetchedMessages(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	finder := &fakeNamespaceFinder{}
+	ns, _ := finder.CachedFindByStringId(context.Background(), nil, "ns")
+	other, _ := finder.CachedFindByStringId(context.Background(), nil, "other")
+	buf := newTestPriorityBuffer(t, logger)
+	admin := &AdminService{
+		Logger:        logger,
+		Shards:        fakeShardGetter{10: db.NewShardMeta(10, nil, true)},
+		NsRepository:  finder,
+		MsgRepository: &fakeMessageMover{},
+		DequeueBuffer: buf,
+	}
+
+	prefetched := []domain.Message{
+		{Id: domain.NewUUID(10), Topic: "stuck", Namespace: ns},
+		{Id: domain.NewUUID(10), Topic: "stuck", Namespace: ns},
+		{Id: domain.NewUUID(10), Topic: "stuck", Namespace: ns},
+	}
+	ingestTestMessages(t, buf, prefetched)
+
+	moved := []string{prefetched[0].Id.String(), prefetched[1].Id.String()}
+	c, w := newTestCtx(http.MethodPost, "/message/move", jsonBody(t, MoveRequest{Namespace: "ns", Ids: moved, Topic: "retry"}))
+	admin.HandleMove(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var reply struct {
+		Buffered int `json:"buffered"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Buffered != 2 {
+		t.Fatalf("expected %d messages removed from the buffer, found %d", 2, reply.Buffered)
+	}
+
+	// moving ids of another namespace leaves its buffered messages alone
+	c, w = newTestCtx(http.MethodPost, "/message/move",
+		jsonBody(t, MoveRequest{Namespace: other.Name, Ids: []string{prefetched[2].Id.String()}, Topic: "retry"}))
+	admin.HandleMove(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// moved messages are no longer delivered to the consumers of the previous topic
+	msgSvc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+	c, w = newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "stuck", Limit: 10}))
+	msgSvc.HandleDequeue(c)
+
+	var dequeued messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != 1 || dequeued.Messages[0].Id != prefetched[2].Id.String() {
+		t.Fatalf("expected only message %s that was not moved, found %+v", prefetched[2].Id.String(), dequeued.Messages)
+	}
+}
+
+// fakeShardMigrator records the migrated shards
+type fakeShardMigrator struct {
+	source, destination uint32
+}
+
+func (f *fakeShardMigrator) Migrate(_ context.Context, src, dst *db.ShardMeta) (int64, error) {
+	f.source, f.destination = src.Id, dst.Id
+	return 7, nil
+}
+
+func TestMigrateShard(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	migrator := &fakeShardMigrator{}
+	svc := &AdminService{
+		Logger: logger,
+		Shards: fakeShardGetter{
+			10: db.NewShardMeta(10, nil, true),
+			20: db.NewShardMeta(20, nil, false),
+		},
+		Migrator: migrator,
+	}
+
+	c, w := newTestCtx(http.MethodPost, "/shard/migrate", jsonBody(t, MigrateShardRequest{Source: 20, Destination: 10}))
+	svc.HandleMigrateShard(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+	var reply struct {
+		Moved int64 `json:"moved"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Moved != 7 {
+		t.Fatalf("expected %d moved messages, found %d", 7, reply.Moved)
+	}
+	if migrator.source != 20 || migrator.destination != 10 {
+		t.Fatalf("expected migration from shard %d to %d, found %d to %d", 20, 10, migrator.source, migrator.destination)
+	}
+
+	for _, req := range []MigrateShardRequest{
+		{Source: 20, Destination: 20},
+		{Source: 30, Destination: 10},
+		{Source: 20, Destination: 30},
+	} {
+		c, w := newTestCtx(http.MethodPost, "/shard/migrate", jsonBody(t, req))
+		svc.HandleMigrateShard(c)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("returned status code %d for %+v, expected %d", w.Code, req, http.StatusBadRequest)
+		}
+	}
+}
+
+// fakeTopicDeleter deletes the messages of the namespace topics stored by shard
+type fakeTopicDeleter struct {
+	mu       sync.Mutex
+	messages map[uint32][]domain.Message
+}
+
+func (f *fakeTopicDeleter) DeleteTopic(_ context.Context, shard *db.ShardMeta, namespace domain.UUID, topic string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var deleted int64
+	kept := []domain.Message{}
+	for _, msg := range f.messages[shard.Id] {
+		if msg.Namespace.Id == namespace && msg.Topic == topic {
+			deleted++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	f.messages[shard.Id] = kept
+	return deleted, nil
+}
+
+func TestPurgeTopic(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	purged := &domain.Namespace{Id: domain.NewUUID(10)}
+	other := &domain.Namespace{Id: domain.NewUUID(10)}
+
+	// messages of the topic are stored in both shards, and prefetched
+	deleter := &fakeTopicDeleter{messages: map[uint32][]domain.Message{}}
+	var prefetched []domain.Message
+	for _, shardId := range []uint32{10, 20} {
+		for i := 0; i < 3; i++ {
+			msg := domain.Message{Id: domain.NewUUID(shardId), Namespace: purged, Topic: "test"}
+			deleter.messages[shardId] = append(deleter.messages[shardId], msg)
+			prefetched = append(prefetched, msg)
+		}
+	}
+	kept := domain.Message{Id: domain.NewUUID(20), Namespace: other, Topic: "test"}
+	deleter.messages[20] = append(deleter.messages[20], kept)
+	ingestTestMessages(t, buf, append(prefetched, kept))
+
+	admin := &AdminService{
+		Logger: logger,
+		Shards: fakeShardGetter{
+			10: db.NewShardMeta(10, nil, true),
+			20: db.NewShardMeta(20, nil, true),
+		},
+		TopicDeleter:  deleter,
+		DequeueBuffer: buf,
+	}
+	c, w := newTestCtx(http.MethodDelete, "/topics/test?namespace="+purged.Id.String(), nil)
+	c.Request.SetPathValue("topic", "test")
+	admin.HandlePurgeTopic(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var reply struct {
+		Deleted int64 `json:"deleted"`
+		Shards  []struct {
+			ShardId uint32 `json:"shardId"`
+			Deleted int64  `json:"deleted"`
+		} `json:"shards"`
+		Buffered int `json:"buffered"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Deleted != 6 || reply.Buffered != 6 {
+		t.Fatalf("expected %d deleted and buffered messages, found %+v", 6, reply)
+	}
+	for i, shardId := range []uint32{10, 20} {
+		if shard := reply.Shards[i]; shard.ShardId != shardId || shard.Deleted != 3 {
+			t.Fatalf("expected %d messages deleted from shard %d, found %+v", 3, shardId, shard)
+		}
+	}
+
+	// purged messages are no longer delivered
+	msgSvc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+	c, w = newTestCtx(http.MethodPost, "/message/dequeue",
+		jsonBody(t, DequeueRequest{Namespace: "ns", Topic: "test", Limit: 10}))
+	msgSvc.HandleDequeue(c)
+
+	var dequeued messagesReply
+	if err := json.NewDecoder(w.Body).Decode(&dequeued); err != nil {
+		t.Fatal(err)
+	}
+	if len(dequeued.Messages) != 1 || dequeued.Messages[0].Id != kept.Id.String() {
+		t.Fatalf("expected only message %s of another namespace, found %+v", kept.Id.String(), dequeued.Messages)
+	}
+}
+
+func TestPurgeTopicRequiresNamespace(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	admin := &AdminService{Logger: logger, Shards: fakeShardGetter{}}
+
+	c, w := newTestCtx(http.MethodDelete, "/topics/test", nil)
+	c.Request.SetPathValue("topic", "test")
+	admin.HandlePurgeTopic(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+type fakeShardLister []*db.ShardMeta
+
+func (f fakeShardLister) Shards() []*db.ShardMeta {
+	return f
+}
+
+// fakeTopicCounter returns the ready messages count by topic for every shard
+type fakeTopicCounter map[uint32]map[string]int64
+
+func (f fakeTopicCounter) CountReadyByTopic(_ context.Context, shard *db.ShardMeta, _ domain.UUID) (map[string]int64, error) {
+	return f[shard.Id], nil
+}
+
+func TestGetTopicsMergesShardCounts(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &TopicsService{
+		Logger: logger,
+		Shards: fakeShardLister{db.NewShardMeta(10, nil, true), db.NewShardMeta(20, nil, false)},
+		MsgRepository: fakeTopicCounter{
+			10: {"orders": 3, "payments": 1},
+			20: {"orders": 2},
+		},
+	}
+
+	ns := domain.NewUUID(10)
+	c, w := newTestCtx(http.MethodGet, "/topics?namespace="+ns.String(), nil)
+	svc.HandleGetTopics(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+	var reply struct {
+		Topics []struct {
+			Topic string `json:"topic"`
+			Ready int64  `json:"ready"`
+		} `json:"topics"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Topics) != 2 {
+		t.Fatalf("expected %d topics, found %d", 2, len(reply.Topics))
+	}
+	if reply.Topics[0].Topic != "orders" || reply.Topics[0].Ready != 5 {
+		t.Fatalf("unexpected orders topic count %+v", reply.Topics[0])
+	}
+	if reply.Topics[1].Topic != "payments" || reply.Topics[1].Ready != 1 {
+		t.Fatalf("unexpected payments topic count %+v", reply.Topics[1])
+	}
+}
+
+func TestGetTopicsRequiresNamespace(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	svc := &TopicsService{Logger: logger, Shards: fakeShardLister{}, MsgRepository: fakeTopicCounter{}}
+
+	c, w := newTestCtx(http.MethodGet, "/topics", nil)
+	svc.HandleGetTopics(c)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("returned status code %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+}
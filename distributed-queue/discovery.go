@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/discovery"
+	gossip "github.com/mcastellin/golang-mastery/gossip/pkg"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultGossipBindAddr = ":7946"
+
+	// shardDiscoveryInterval is how often the shards are synced with the cluster
+	shardDiscoveryInterval = 5 * time.Second
+	// mainShardDiscoveryTimeout is the maximum time the application waits
+	// at startup for the main shard to join the cluster
+	mainShardDiscoveryTimeout = time.Minute
+)
+
+// shardDiscoverer keeps the ShardManager in sync with the shard nodes advertised
+// in the gossip cluster.
+type shardDiscoverer struct {
+	logger *zap.Logger
+	mgr    *db.ShardManager
+	node   *gossip.Gossiper
+	src    db.ShardSource
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newShardDiscoverer joins the gossip cluster and waits until the main shard is
+// discovered. Queue workers of shards joining later are started by the
+// ShardManager Added hook.
+func newShardDiscoverer(mgr *db.ShardManager, conf *appConfig, logger *zap.Logger) (*shardDiscoverer, error) {
+	node := gossip.NewGossiper(conf.GossipBindAddr, false, conf.DiscoverySeeds)
+	if err := node.Serve(); err != nil {
+		return nil, err
+	}
+	d := &shardDiscoverer{
+		logger: logger,
+		mgr:    mgr,
+		node:   node,
+		src:    &discovery.GossipShardSource{Logger: logger, Cluster: node},
+	}
+
+	deadline := time.Now().Add(mainShardDiscoveryTimeout)
+	for {
+		if err := mgr.Sync(d.src); err != nil {
+			logger.Warn("shard discovery failed", zap.Error(err))
+		}
+		if mgr.MainShard() != nil {
+			return d, nil
+		}
+		if time.Now().After(deadline) {
+			node.Shutdown()
+			return nil, errors.New("main shard not discovered in the gossip cluster")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Run syncs the shards with the cluster in the background
+func (d *shardDiscoverer) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		d.mgr.Discover(ctx, d.src, shardDiscoveryInterval)
+	}()
+	return nil
+}
+
+// Stop syncing shards and leave the gossip cluster
+func (d *shardDiscoverer) Stop() error {
+	if d.cancel != nil {
+		d.cancel()
+		<-d.done
+	}
+	return d.node.Shutdown()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// newSQLiteShard creates a shard backed by an in-memory SQLite database, so that
+// the queue workers can be tested end-to-end without PostgreSQL.
+func newSQLiteShard(t *testing.T, id uint32, main bool) *db.ShardMeta {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", t.Name(), id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single connection keeps the in-memory database alive and avoids table locks
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	schema, err := os.ReadFile("scripts/initdb_sqlite.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return db.NewShardMetaWithDialect(id, conn, main, db.SQLite)
+}
+
+// countMessages returns the number of messages stored in the shards, and how
+// many of them were delivered before.
+func countMessages(t *testing.T, shards []*db.ShardMeta) (stored, redelivered int) {
+	t.Helper()
+	for _, shard := range shards {
+		var n, attempts int
+		row := shard.Conn().QueryRow("SELECT count(*), count(*) FILTER (WHERE deliveryattempts > 0) FROM messages")
+		if err := row.Scan(&n, &attempts); err != nil {
+			t.Fatal(err)
+		}
+		stored += n
+		redelivered += attempts
+	}
+	return stored, redelivered
+}
+
+type dequeuedMessage struct {
+	Id       string `json:"id"`
+	Payload  string `json:"payload"`
+	Lease    string `json:"lease"`
+	Attempts int    `json:"attempts"`
+}
+
+func TestMessageLifecycleWithSQLiteShards(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	shards := []*db.ShardMeta{newSQLiteShard(t, 10, true), newSQLiteShard(t, 20, false)}
+
+	app := &App{logger: logger}
+	conf := &appConfig{BufferSize: 10, PrefetchChanSize: 10, DequeueBatchSize: 10,
+		EnqueueWorkers: 1, AckNackWorkers: 1, EnqueueReplyTimeout: time.Second}
+	bufs := app.addQueueWorkers(shards, conf)
+	started, err := app.startWorkers()
+	t.Cleanup(func() { app.stopWorkers(started) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &MessagesService{
+		Logger:            logger,
+		MainShard:         shards[0],
+		NsRepository:      &fakeNamespaceFinder{},
+		EnqueueBuffer:     bufs.enqueue,
+		DequeueBuffer:     bufs.prefetch,
+		AckNackRouter:     bufs.ackNack,
+		MaxDequeueTimeout: 10 * time.Second,
+	}
+
+	const numMessages = 6
+	enqueued := []string{}
+	for i := 0; i < numMessages; i++ {
+		req := EnqueueRequest{Namespace: "ns", Topic: "orders", Payload: fmt.Sprintf("order-%d", i), TTLSeconds: 3600}
+		c, w := newTestCtx(http.MethodPost, "/message/enqueue", jsonBody(t, req))
+		svc.HandleEnqueue(c)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned status code %d, expected %d: %s", w.Code, http.StatusCreated, w.Body.String())
+		}
+		var reply struct {
+			MsgId string `json:"msgId"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatal(err)
+		}
+		enqueued = append(enqueued, reply.MsgId)
+	}
+	if stored, _ := countMessages(t, shards); stored != numMessages {
+		t.Fatalf("expected %d messages stored, found %d", numMessages, stored)
+	}
+
+	// dequeue collects n messages, waiting for the dequeue workers to prefetch them
+	dequeue := func(n int) []dequeuedMessage {
+		t.Helper()
+		var msgs []dequeuedMessage
+		for len(msgs) < n {
+			req := DequeueRequest{Namespace: "ns", Topic: "orders", Limit: n - len(msgs), TimeoutSeconds: 10}
+			c, w := newTestCtx(http.MethodPost, "/message/dequeue", jsonBody(t, req))
+			svc.HandleDequeue(c)
+			if w.Code != http.StatusOK {
+				t.Fatalf("returned status code %d, expected %d after %d messages", w.Code, http.StatusOK, len(msgs))
+			}
+			var reply struct {
+				Messages []dequeuedMessage `json:"messages"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, reply.Messages...)
+		}
+		return msgs
+	}
+	ackNack := func(msgs []dequeuedMessage, ack bool) {
+		t.Helper()
+		acks := make([]AckNackRequest, len(msgs))
+		for i, m := range msgs {
+			acks[i] = AckNackRequest{Id: m.Id, Ack: ack, Lease: m.Lease}
+		}
+		c, w := newTestCtx(http.MethodPost, "/message/acknack", jsonBody(t, acks))
+		svc.HandleAckNack(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("returned status code %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+	}
+	// waitForMessages waits until the ack/nack workers updated the shards
+	waitForMessages := func(stored, redelivered int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s, r := countMessages(t, shards)
+			if s == stored && r == redelivered {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d messages stored and %d nacked, found %d and %d", stored, redelivered, s, r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	msgs := dequeue(numMessages)
+	dequeued := []string{}
+	for _, m := range msgs {
+		dequeued = append(dequeued, m.Id)
+		if len(m.Lease) == 0 {
+			t.Fatalf("message %s dequeued without lease", m.Id)
+		}
+	}
+	slices.Sort(enqueued)
+	slices.Sort(dequeued)
+	if !slices.Equal(enqueued, dequeued) {
+		t.Fatalf("expected messages %v, dequeued %v", enqueued, dequeued)
+	}
+
+	acked, nacked := msgs[:numMessages/2], msgs[numMessages/2:]
+	ackNack(acked, true)
+	ackNack(nacked, false)
+	waitForMessages(len(nacked), len(nacked))
+
+	// nacked messages are delivered again after the redelivery delay
+	redelivered := dequeue(len(nacked))
+	for _, m := range redelivered {
+		if !slices.ContainsFunc(nacked, func(n dequeuedMessage) bool { return n.Id == m.Id }) {
+			t.Fatalf("unexpected message %s redelivered", m.Id)
+		}
+		if m.Attempts != 1 {
+			t.Fatalf("expected redelivered message with %d attempts, found %d", 1, m.Attempts)
+		}
+	}
+	ackNack(redelivered, true)
+	waitForMessages(0, 0)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+)
+
+// apiError is an error reported to API clients with its HTTP status code.
+type apiError struct {
+	Status int
+	Msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.Msg
+}
+
+// newApiError creates an apiError with a formatted message.
+func newApiError(status int, format string, a ...any) *apiError {
+	return &apiError{Status: status, Msg: fmt.Sprintf(format, a...)}
+}
+
+// rateLimitError is returned when a namespace exceeded its request rate.
+// Clients should retry the request after RetryAfter.
+type rateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "rate limit exceeded"
+}
+
+var (
+	errNotFound = errors.New("not found")
+	errTimeout  = errors.New("operation timed out")
+)
+
+// errorStatus returns the HTTP status code to reply with for the error.
+// Client errors are reported with an apiError, for example by decodeJSON. Errors that
+// don't belong to a known category, including database and connection errors, are
+// reported as internal server errors.
+func errorStatus(err error) int {
+	var (
+		apiErr        *apiError
+		rateLimitErr  *rateLimitError
+		validationErr *domain.SchemaValidationError
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Status
+	case errors.As(err, &rateLimitErr):
+		return http.StatusTooManyRequests
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errTimeout), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// decodeJSON decodes the JSON request body into v.
+// Malformed bodies are reported as bad requests.
+func decodeJSON(c *ApiCtx, v any) error {
+	if err := json.NewDecoder(c.Request.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return newApiError(http.StatusRequestEntityTooLarge,
+				"request body exceeds the maximum of %d bytes", maxBytesErr.Limit)
+		}
+		return newApiError(http.StatusBadRequest, "malformed request body: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{newApiError(http.StatusRequestEntityTooLarge, "too large"), http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("wrapped: %w", newApiError(http.StatusBadRequest, "bad")), http.StatusBadRequest},
+		{fmt.Errorf("invalid namespace: %w", errNotFound), http.StatusNotFound},
+		// backend failures are not reported as client errors
+		{sql.ErrNoRows, http.StatusInternalServerError},
+		{io.ErrUnexpectedEOF, http.StatusInternalServerError},
+		{errTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if status := errorStatus(tt.err); status != tt.expected {
+			t.Fatalf("status for error %q: expected %d, found %d", tt.err, tt.expected, status)
+		}
+	}
+}
+
+func TestMalformedJsonIsBadRequest(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	msgSvc := &MessagesService{Logger: logger}
+	nsSvc := &NamespaceService{Logger: logger}
+	adminSvc := &AdminService{Logger: logger}
+
+	handlers := map[string]Handler{
+		"/namespace":       nsSvc.HandleCreateNamespace,
+		"/message/enqueue": msgSvc.HandleEnqueue,
+		"/message/dequeue": msgSvc.HandleDequeue,
+		"/message/peek":    msgSvc.HandlePeek,
+		"/message/ack":     msgSvc.HandleAckNack,
+		"/message/move":    adminSvc.HandleMove,
+		"/shard/migrate":   adminSvc.HandleMigrateShard,
+	}
+
+	for path, handler := range handlers {
+		for _, body := range []string{"", "{not json", `"not an object"`} {
+			c, w := newTestCtx(http.MethodPost, path, strings.NewReader(body))
+			handler(c)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%s with body %q returned status code %d, expected %d",
+					path, body, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestDecodeJSONLimitsBodySize(t *testing.T) {
+	c, w := newTestCtx(http.MethodPost, "/message/enqueue", strings.NewReader(`{"payload": "`+strings.Repeat("x", 1024)+`"}`))
+	c.Request.Body = http.MaxBytesReader(w, c.Request.Body, 64)
+
+	var req EnqueueRequest
+	err := decodeJSON(c, &req)
+	if status := errorStatus(err); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, found %d", http.StatusRequestEntityTooLarge, status)
+	}
+}
@@ -1,14 +1,38 @@
 module github.com/mcastellin/golang-mastery/distributed-queue
 
-go 1.21
+go 1.22
 
 require (
 	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/mcastellin/golang-mastery/gossip v0.0.0
 	github.com/mcastellin/golang-mastery/objects-cache v0.0.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/rs/xid v1.5.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
 	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.21.0
+	golang.org/x/time v0.5.0
+	google.golang.org/grpc v1.63.2
+	google.golang.org/protobuf v1.33.0
 )
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240227224415-6ceb2ff114de // indirect
+)
 
 replace github.com/mcastellin/golang-mastery/objects-cache => ../objects-cache
+
+replace github.com/mcastellin/golang-mastery/gossip => ../gossip
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queuepb"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/tracing"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NewGrpcServer initializes a GrpcServer serving the queue API on addr
+func NewGrpcServer(addr string, namespaces *NamespaceService, messages *MessagesService, logger *zap.Logger) *GrpcServer {
+	return &GrpcServer{
+		logger:     logger,
+		addr:       addr,
+		namespaces: namespaces,
+		messages:   messages,
+	}
+}
+
+// GrpcServer serves the queue API over gRPC for internal clients that need
+// higher throughput than the HTTP API. Requests are handled by the same
+// services backing the HTTP API.
+type GrpcServer struct {
+	queuepb.UnimplementedQueueServer
+
+	// ShutdownTimeout is the grace period given to in-flight requests
+	// to complete before the server is forcefully stopped.
+	ShutdownTimeout time.Duration
+
+	logger     *zap.Logger
+	addr       string
+	namespaces *NamespaceService
+	messages   *MessagesService
+}
+
+// Serve starts the gRPC server and blocks until the context is cancelled
+// and in-flight requests are drained.
+func (s *GrpcServer) Serve(ctx context.Context, notifyReady chan struct{}) error {
+	s.logger.Info("grpc server starting")
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(s.recoveryInterceptor))
+	queuepb.RegisterQueueServer(srv, s)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		s.logger.Info("grpc server shutting down")
+		s.shutdown(srv)
+	}()
+
+	s.logger.Info("grpc server listening", zap.String("addr", lis.Addr().String()))
+	if notifyReady != nil {
+		close(notifyReady)
+	}
+	if err := srv.Serve(lis); err != nil {
+		return err
+	}
+	<-shutdownDone
+	return nil
+}
+
+// shutdown gracefully stops the gRPC server giving in-flight requests up to
+// ShutdownTimeout to complete. Requests still running after the timeout are
+// forcefully terminated.
+func (s *GrpcServer) shutdown(srv *grpc.Server) {
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		s.logger.Info("grpc graceful shutdown completed")
+	case <-time.After(timeout):
+		s.logger.Warn("grpc graceful shutdown timed out, forcing stop",
+			zap.Duration("timeout", timeout))
+		srv.Stop()
+	}
+}
+
+// recoveryInterceptor recovers from panics raised by request handlers and
+// replies with an internal error instead of crashing the server.
+func (s *GrpcServer) recoveryInterceptor(ctx context.Context, req any,
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("recovered from panic in grpc handler",
+				zap.String("method", info.FullMethod),
+				zap.String("panic", fmt.Sprint(r)),
+				zap.Stack("stack"))
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(rpcContext(ctx), req)
+}
+
+func (s *GrpcServer) CreateNamespace(ctx context.Context, req *queuepb.CreateNamespaceRequest) (*queuepb.Namespace, error) {
+	ns, err := s.namespaces.CreateNamespace(ctx, &CreateNsRequest{Name: req.Name, Topics: req.Topics})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return namespaceProto(ns), nil
+}
+
+func (s *GrpcServer) ListNamespaces(ctx context.Context, _ *queuepb.ListNamespacesRequest) (*queuepb.ListNamespacesResponse, error) {
+	results, err := s.namespaces.ListNamespaces(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &queuepb.ListNamespacesResponse{}
+	for i := range results {
+		resp.Namespaces = append(resp.Namespaces, namespaceProto(&results[i]))
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) Enqueue(ctx context.Context, req *queuepb.EnqueueRequest) (*queuepb.EnqueueResponse, error) {
+	msgId, err := s.messages.Enqueue(ctx, &EnqueueRequest{
+		Namespace:           req.Namespace,
+		Topic:               req.Topic,
+		Priority:            req.Priority,
+		Payload:             string(req.Payload),
+		Metadata:            string(req.Metadata),
+		DeliverAfterSeconds: time.Duration(req.DeliverAfterSeconds),
+		TTLSeconds:          time.Duration(req.TtlSeconds),
+		Headers:             req.Headers,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &queuepb.EnqueueResponse{MsgId: msgId.String()}, nil
+}
+
+func (s *GrpcServer) Dequeue(ctx context.Context, req *queuepb.DequeueRequest) (*queuepb.DequeueResponse, error) {
+	messages, err := s.messages.Dequeue(ctx, &DequeueRequest{
+		Namespace:      req.Namespace,
+		Topic:          req.Topic,
+		Limit:          int(req.Limit),
+		TimeoutSeconds: int(req.TimeoutSeconds),
+		Match:          req.Match,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &queuepb.DequeueResponse{}
+	for i := range messages {
+		resp.Messages = append(resp.Messages, messageProto(&messages[i]))
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) AckNack(ctx context.Context, req *queuepb.AckNackRequest) (*queuepb.AckNackResponse, error) {
+	acks := make([]AckNackRequest, len(req.Items))
+	for i, item := range req.Items {
+		acks[i] = AckNackRequest{Id: item.Id, Ack: item.Ack, TraceParent: item.Traceparent, Lease: item.Lease}
+	}
+
+	resp := &queuepb.AckNackResponse{}
+	for i, err := range s.messages.AckNack(ctx, acks) {
+		if err != nil {
+			s.logger.Error("error routing ack/nack", zap.String("id", acks[i].Id), zap.Error(err))
+			resp.Failed = append(resp.Failed, &queuepb.AckNackFailure{Id: acks[i].Id, Error: err.Error()})
+			continue
+		}
+		resp.Succeeded = append(resp.Succeeded, acks[i].Id)
+	}
+	return resp, nil
+}
+
+// rpcContext returns the context of the gRPC request, continuing the trace
+// propagated by the client in the traceparent metadata, if any.
+func rpcContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	if values := md.Get("traceparent"); len(values) > 0 {
+		return tracing.ContextWithTraceParent(ctx, values[0])
+	}
+	return ctx
+}
+
+// grpcError converts the error into a gRPC status error, using the code
+// matching the HTTP status the error is reported with by the HTTP API.
+func grpcError(err error) error {
+	var code codes.Code
+	switch errorStatus(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// namespaceProto converts a namespace into its gRPC representation
+func namespaceProto(ns *domain.Namespace) *queuepb.Namespace {
+	return &queuepb.Namespace{
+		Id:     ns.Id.String(),
+		Name:   ns.Name,
+		Topics: ns.Topics,
+	}
+}
+
+// messageProto converts a message into its gRPC representation
+func messageProto(m *domain.Message) *queuepb.Message {
+	return &queuepb.Message{
+		Id:          m.Id.String(),
+		Topic:       m.Topic,
+		Priority:    m.Priority,
+		Payload:     m.Payload,
+		Metadata:    m.Metadata,
+		Headers:     m.Headers,
+		CreatedAt:   timestamppb.New(m.CreatedAt()),
+		Traceparent: m.TraceParent,
+		Lease:       m.Lease,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queue"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queuepb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// startTestGrpcServer serves the GrpcServer in the background until the test completes
+// and returns a client connected to it.
+func startTestGrpcServer(t testing.TB, srv *GrpcServer) queuepb.QueueClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	notify := make(chan struct{})
+	go srv.Serve(ctx, notify)
+	<-notify
+
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost%s", srv.addr),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not connect to grpc server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return queuepb.NewQueueClient(conn)
+}
+
+func TestGrpcEnqueueAndDequeue(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	enqueueBuf := make(chan queue.EnqueueRequest)
+	svc := &MessagesService{
+		Logger:        logger,
+		NsRepository:  &fakeNamespaceFinder{},
+		EnqueueBuffer: enqueueBuf,
+		DequeueBuffer: buf,
+	}
+
+	// enqueue worker making stored messages available for delivery
+	go func() {
+		for req := range enqueueBuf {
+			msg := req.Msg
+			msg.Id = domain.NewUUID(10)
+			ingestTestMessages(t, buf, []domain.Message{msg})
+			req.RespCh <- queue.EnqueueResponse{MsgId: msg.Id}
+		}
+	}()
+	t.Cleanup(func() { close(enqueueBuf) })
+
+	srv := NewGrpcServer(fmt.Sprintf(":%d", bindAvailablePort(t)), &NamespaceService{}, svc, logger)
+	client := startTestGrpcServer(t, srv)
+
+	ctx := context.Background()
+	enqueued, err := client.Enqueue(ctx, &queuepb.EnqueueRequest{
+		Namespace: "ns",
+		Topic:     "test",
+		Payload:   []byte("payload"),
+		Headers:   map[string]string{"region": "eu"},
+	})
+	if err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	reply, err := client.Dequeue(ctx, &queuepb.DequeueRequest{Namespace: "ns", Topic: "test", Limit: 1, TimeoutSeconds: 1})
+	if err != nil {
+		t.Fatalf("dequeue failed: %v", err)
+	}
+	if len(reply.Messages) != 1 {
+		t.Fatalf("expected %d messages, found %d", 1, len(reply.Messages))
+	}
+	msg := reply.Messages[0]
+	if msg.Id != enqueued.MsgId {
+		t.Fatalf("expected message %s, found %s", enqueued.MsgId, msg.Id)
+	}
+	if string(msg.Payload) != "payload" || msg.Headers["region"] != "eu" {
+		t.Fatalf("dequeued message doesn't match the enqueued one: %v", msg)
+	}
+
+	// errors are reported with the gRPC code matching the HTTP status
+	_, err = client.Enqueue(ctx, &queuepb.EnqueueRequest{Namespace: "missing", Topic: "test"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("returned code %s, expected %s", code, codes.NotFound)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queue"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+type noopServer struct{}
+
+func (noopServer) Serve(context.Context, chan struct{}) error { return nil }
+
+// blockingServer serves until the context is cancelled
+type blockingServer struct{}
+
+func (blockingServer) Serve(ctx context.Context, _ chan struct{}) error {
+	<-ctx.Done()
+	return nil
+}
+
+type failingServer struct{ err error }
+
+func (s failingServer) Serve(context.Context, chan struct{}) error { return s.err }
+
+// recordingWorker appends its name to a shared log when started and stopped
+type recordingWorker struct {
+	name    string
+	started *[]string
+	stopped *[]string
+}
+
+func (w *recordingWorker) Run() error {
+	*w.started = append(*w.started, w.name)
+	return nil
+}
+
+func (w *recordingWorker) Stop() error {
+	*w.stopped = append(*w.stopped, w.name)
+	return nil
+}
+
+func TestAppShutdownOrder(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	app := &App{logger: logger, server: noopServer{}}
+
+	var started, stopped []string
+	newWorker := func(name string) *recordingWorker {
+		return &recordingWorker{name: name, started: &started, stopped: &stopped}
+	}
+
+	app.AddWorker(newWorker("enqueue"))
+	app.AddDependency(newWorker("prefetch"))
+	app.AddWorker(newWorker("dequeue-1"))
+	app.AddWorker(newWorker("dequeue-2"))
+
+	if err := app.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if started[0] != "prefetch" {
+		t.Fatalf("prefetch buffer should start first, found start order %v", started)
+	}
+	if len(stopped) != 4 {
+		t.Fatalf("expected %d stopped workers, found %d", 4, len(stopped))
+	}
+	if stopped[len(stopped)-1] != "prefetch" {
+		t.Fatalf("prefetch buffer should stop last, found stop order %v", stopped)
+	}
+}
+
+func TestAppStopsLateWorkersFirst(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	app := &App{logger: logger, server: noopServer{}}
+
+	var started, stopped []string
+	newWorker := func(name string) *recordingWorker {
+		return &recordingWorker{name: name, started: &started, stopped: &stopped}
+	}
+	app.AddDependency(newWorker("prefetch"))
+	app.AddWorker(newWorker("dequeue"))
+
+	// workers of a shard discovered at runtime
+	if err := app.startLateWorker(newWorker("late-dequeue")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stopped, []string{"late-dequeue", "dequeue", "prefetch"}) {
+		t.Fatalf("expected late workers to stop first, found stop order %v", stopped)
+	}
+
+	if err := app.startLateWorker(newWorker("too-late")); err == nil {
+		t.Fatal("expected error starting a worker after the application stopped")
+	}
+	if slices.Contains(started, "too-late") {
+		t.Fatal("worker started after the application stopped")
+	}
+}
+
+func TestAppStopsServersWhenAdminServerFails(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	errListen := errors.New("address already in use")
+	app := &App{logger: logger, server: blockingServer{}, adminServer: failingServer{err: errListen}}
+
+	if err := app.Run(); !errors.Is(err, errListen) {
+		t.Fatalf("expected error %v, found %v", errListen, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("BUFFER_SIZE", "1000")
+	t.Setenv("PREFETCH_CHAN_SIZE", "50")
+	t.Setenv("DEQUEUE_BATCH_SIZE", "")
+	t.Setenv("FIFO_TOPICS", "orders,invoices")
+
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.BufferSize != 1000 {
+		t.Fatalf("expected buffer size %d, found %d", 1000, conf.BufferSize)
+	}
+	if conf.PrefetchChanSize != 50 {
+		t.Fatalf("expected prefetch chan size %d, found %d", 50, conf.PrefetchChanSize)
+	}
+	if conf.DequeueBatchSize != queue.DefaultDequeueBatchSize {
+		t.Fatalf("expected dequeue batch size %d, found %d", queue.DefaultDequeueBatchSize, conf.DequeueBatchSize)
+	}
+	if conf.EnqueueReplyTimeout != queue.DefaultReplyTimeout {
+		t.Fatalf("expected enqueue reply timeout %s, found %s", queue.DefaultReplyTimeout, conf.EnqueueReplyTimeout)
+	}
+	if fifo := conf.TopicOrderings.FIFOTopics(); !slices.Equal(fifo, []string{"invoices", "orders"}) {
+		t.Fatalf("expected FIFO topics %v, found %v", []string{"invoices", "orders"}, fifo)
+	}
+}
+
+func TestQueueWorkersUseConfig(t *testing.T) {
+	conf := &appConfig{BufferSize: 7, PrefetchChanSize: 11, DequeueBatchSize: 13, EnqueueWorkers: 2, AckNackWorkers: 3,
+		EnqueueReplyTimeout: 250 * time.Millisecond}
+	shards := []*db.ShardMeta{db.NewShardMeta(10, nil, true), db.NewShardMeta(20, nil, false)}
+
+	app := &App{logger: zaptest.NewLogger(t)}
+	bufs := app.addQueueWorkers(shards, conf)
+
+	if cap(bufs.enqueue) != conf.BufferSize {
+		t.Fatalf("expected enqueue buffer size %d, found %d", conf.BufferSize, cap(bufs.enqueue))
+	}
+	if cap(bufs.prefetch.C()) != conf.PrefetchChanSize {
+		t.Fatalf("expected prefetch chan size %d, found %d", conf.PrefetchChanSize, cap(bufs.prefetch.C()))
+	}
+
+	var enqueueWorkers, dequeueWorkers, ackNackWorkers int
+	for _, pw := range app.workers {
+		switch w := pw.w.(type) {
+		case *queue.EnqueueWorker:
+			enqueueWorkers++
+			if w.ReplyTimeout != conf.EnqueueReplyTimeout {
+				t.Fatalf("expected enqueue reply timeout %s, found %s", conf.EnqueueReplyTimeout, w.ReplyTimeout)
+			}
+		case *queue.DequeueWorker:
+			dequeueWorkers++
+			if w.BatchSize != conf.DequeueBatchSize {
+				t.Fatalf("expected dequeue batch size %d, found %d", conf.DequeueBatchSize, w.BatchSize)
+			}
+		case *queue.AckNackWorker:
+			ackNackWorkers++
+		}
+	}
+	if enqueueWorkers != conf.EnqueueWorkers*len(shards) {
+		t.Fatalf("expected %d enqueue workers, found %d", conf.EnqueueWorkers*len(shards), enqueueWorkers)
+	}
+	if dequeueWorkers != len(shards) {
+		t.Fatalf("expected %d dequeue workers, found %d", len(shards), dequeueWorkers)
+	}
+	if ackNackWorkers != conf.AckNackWorkers*len(shards) {
+		t.Fatalf("expected %d ack/nack workers, found %d", conf.AckNackWorkers*len(shards), ackNackWorkers)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	for _, v := range []string{"0", "-10", "many"} {
+		t.Setenv("BUFFER_SIZE", v)
+		if _, err := loadConfig(); err == nil {
+			t.Fatalf("expected error for BUFFER_SIZE=%q, found nil", v)
+		}
+	}
+}
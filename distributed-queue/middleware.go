@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// requestIdHeader carries the id used to correlate client and server logs
+	requestIdHeader    = "X-Request-Id"
+	maxRequestIdLength = 128
+)
+
+// RequestIdMiddleware reads the request id from the X-Request-Id header, or
+// generates a new one if missing, and echoes it back in the response header.
+// The id is stored in the ApiCtx so that it's included in the request log lines.
+//
+// This middleware should be registered first, so the request id is available
+// to all other middlewares.
+func RequestIdMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return func(c *ApiCtx) {
+			id := c.Request.Header.Get(requestIdHeader)
+			if !validRequestId(id) {
+				id = newRequestId()
+			}
+			c.RequestId = id
+			c.Writer.Header().Set(requestIdHeader, id)
+			next(c)
+		}
+	}
+}
+
+// validRequestId returns true if the client supplied id can be safely logged
+// and echoed back.
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestId returns a random request id
+func newRequestId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// LoggingMiddleware logs every request served by the ApiServer with the
+// response status code and the time it took to complete.
+func LoggingMiddleware(logger *zap.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(c *ApiCtx) {
+			start := time.Now()
+			next(c)
+			c.Logger(logger).Info("request served",
+				zap.String("method", c.Request.Method),
+				zap.String("path", c.Request.URL.Path),
+				zap.Int("status", c.StatusCode()),
+				zap.Duration("duration", time.Since(start)))
+		}
+	}
+}
+
+// RecoveryMiddleware recovers from panics raised by request handlers and
+// replies with an internal server error instead of dropping the connection.
+//
+// The ApiServer always recovers from panics, though registering this middleware
+// after the LoggingMiddleware allows panicking requests to be logged too.
+func RecoveryMiddleware(logger *zap.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(c *ApiCtx) {
+			defer func() {
+				if r := recover(); r != nil {
+					handlePanic(logger, c, r)
+				}
+			}()
+			next(c)
+		}
+	}
+}
+
+// handlePanic logs the recovered panic with its stack trace and replies to the
+// client with an internal server error.
+func handlePanic(logger *zap.Logger, c *ApiCtx, r any) {
+	c.Logger(logger).Error("recovered from panic in request handler",
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("panic", fmt.Sprint(r)),
+		zap.Stack("stack"))
+	c.Respond(http.StatusInternalServerError, H{"error": "internal server error"})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	api := newTestApiServer(t, logger)
+
+	calls := []string{}
+	tracer := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(c *ApiCtx) {
+				calls = append(calls, name)
+				next(c)
+			}
+		}
+	}
+	api.Use(tracer("first"))
+	api.Use(tracer("second"))
+	api.HandleFunc(http.MethodGet, "/test", func(c *ApiCtx) {
+		calls = append(calls, "handler")
+		c.JsonResponse(http.StatusOK, H{})
+	})
+
+	baseUrl := startTestServer(t, api)
+
+	cli := http.Client{Timeout: time.Second}
+	resp, err := cli.Get(baseUrl + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	expected := []string{"first", "second", "handler"}
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("wrong middleware order: expected %v, found %v", expected, calls)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	api := newTestApiServer(t, logger)
+	api.Use(RecoveryMiddleware(logger))
+	api.HandleFunc(http.MethodGet, "/panic", func(c *ApiCtx) {
+		panic("something went wrong")
+	})
+
+	baseUrl := startTestServer(t, api)
+
+	cli := http.Client{Timeout: time.Second}
+	resp, err := cli.Get(baseUrl + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("returned status code %d, expected %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	var body H
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if _, ok := body["error"]; !ok {
+		t.Fatalf("response body is missing error message: %v", body)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	api := newTestApiServer(t, logger)
+	api.Use(LoggingMiddleware(logger))
+	api.HandleFunc(http.MethodGet, "/test", func(c *ApiCtx) {
+		c.JsonResponse(http.StatusTeapot, H{})
+	})
+
+	baseUrl := startTestServer(t, api)
+
+	cli := http.Client{Timeout: time.Second}
+	resp, err := cli.Get(baseUrl + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	entries := logs.FilterMessage("request served").AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("expected %d request log entries, found %d", 1, len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["method"] != http.MethodGet {
+		t.Fatalf("wrong method logged: %v", fields["method"])
+	}
+	if fields["path"] != "/test" {
+		t.Fatalf("wrong path logged: %v", fields["path"])
+	}
+	if fields["status"] != int64(http.StatusTeapot) {
+		t.Fatalf("wrong status logged: expected %d, found %v", http.StatusTeapot, fields["status"])
+	}
+	if _, ok := fields["duration"]; !ok {
+		t.Fatal("request duration was not logged")
+	}
+}
+
+func TestRequestIdMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	api := newTestApiServer(t, logger)
+	api.Use(RequestIdMiddleware())
+	api.Use(LoggingMiddleware(logger))
+	api.HandleFunc(http.MethodGet, "/test", func(c *ApiCtx) {
+		c.Logger(logger).Info("handling request")
+		c.JsonResponse(http.StatusOK, H{})
+	})
+
+	baseUrl := startTestServer(t, api)
+	cli := http.Client{Timeout: time.Second}
+	get := func(requestId string) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, baseUrl+"/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(requestId) > 0 {
+			req.Header.Set(requestIdHeader, requestId)
+		}
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get(requestIdHeader)
+	}
+
+	if echoed := get("client-request-1"); echoed != "client-request-1" {
+		t.Fatalf("expected request id %s to be echoed, found %q", "client-request-1", echoed)
+	}
+	for _, msg := range []string{"handling request", "request served"} {
+		entries := logs.FilterMessage(msg).FilterField(zap.String("requestId", "client-request-1")).AllUntimed()
+		if len(entries) != 1 {
+			t.Fatalf("expected %d %q log entries with the request id, found %d", 1, msg, len(entries))
+		}
+	}
+
+	generated := get("")
+	if len(generated) == 0 {
+		t.Fatal("expected a request id to be generated")
+	}
+	if other := get(""); other == generated {
+		t.Fatalf("expected unique generated request ids, found %s twice", generated)
+	}
+	tooLong := strings.Repeat("x", maxRequestIdLength+1)
+	if echoed := get(tooLong); echoed == tooLong || len(echoed) == 0 {
+		t.Fatalf("expected invalid request id to be replaced, found %q", echoed)
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dialect adapts the SQL statements of the message repository to the database
+// engine of a shard. Statements are written for PostgreSQL, the engine of
+// production shards, and the dialect rewrites the parts that are engine specific.
+//
+// Only the message lifecycle (enqueue, prefetch, ack and nack) is portable:
+// namespaces, schedules and shard migrations require PostgreSQL.
+type Dialect interface {
+	// Rebind rewrites the $N placeholders of the statement.
+	Rebind(statement string) string
+	// Time returns the argument storing a timestamp.
+	Time(t time.Time) any
+	// AnyOf returns the condition matching expr with any of the values, either
+	// []string or [][]byte, and the argument to bind to the placeholder.
+	AnyOf(expr, placeholder string, values any) (string, any)
+	// JSONContains returns the condition matching JSON objects in column that
+	// contain all the key/value pairs of the object bound to the placeholder.
+	JSONContains(column, placeholder string) string
+	// Least returns the smallest of two numeric expressions.
+	Least(a, b string) string
+	// Exp2 returns the power of 2 of an integer expression.
+	Exp2(exp string) string
+	// AddSeconds returns the timestamp expression ts moved forward by secs seconds.
+	AddSeconds(ts, secs string) string
+}
+
+var (
+	// Postgres is the dialect of PostgreSQL shards, used unless configured otherwise.
+	Postgres Dialect = postgresDialect{}
+	// SQLite is the dialect of SQLite shards created with scripts/initdb_sqlite.sql.
+	// Timestamps are stored as nanoseconds since the Unix epoch.
+	SQLite Dialect = sqliteDialect{}
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Rebind(statement string) string { return statement }
+
+func (postgresDialect) Time(t time.Time) any { return t }
+
+func (postgresDialect) AnyOf(expr, placeholder string, values any) (string, any) {
+	return fmt.Sprintf("%s = ANY(%s)", expr, placeholder), pq.Array(values)
+}
+
+func (postgresDialect) JSONContains(column, placeholder string) string {
+	return fmt.Sprintf("%s @> %s", column, placeholder)
+}
+
+func (postgresDialect) Least(a, b string) string {
+	return fmt.Sprintf("LEAST(%s, %s)", a, b)
+}
+
+func (postgresDialect) Exp2(exp string) string {
+	return fmt.Sprintf("power(2, %s)", exp)
+}
+
+func (postgresDialect) AddSeconds(ts, secs string) string {
+	return fmt.Sprintf("%s + make_interval(secs => %s)", ts, secs)
+}
+
+type sqliteDialect struct{}
+
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// Rebind uses numbered ?N placeholders: SQLite numbers $N placeholders in order
+// of appearance, regardless of N.
+func (sqliteDialect) Rebind(statement string) string {
+	return placeholderRe.ReplaceAllString(statement, "?$1")
+}
+
+func (sqliteDialect) Time(t time.Time) any { return t.UnixNano() }
+
+// AnyOf binds the values as a JSON array. Byte values are encoded in hex.
+func (sqliteDialect) AnyOf(expr, placeholder string, values any) (string, any) {
+	elems := []string{}
+	value := "value"
+	switch v := values.(type) {
+	case []string:
+		elems = append(elems, v...)
+	case [][]byte:
+		for _, b := range v {
+			elems = append(elems, hex.EncodeToString(b))
+		}
+		value = "unhex(value)"
+	default:
+		panic(fmt.Sprintf("unsupported array type %T", values))
+	}
+	arr, _ := json.Marshal(elems)
+	return fmt.Sprintf("%s IN (SELECT %s FROM json_each(%s))", expr, value, placeholder), string(arr)
+}
+
+// JSONContains compares the values of every key, as SQLite has no JSON containment
+// operator. Headers are stored as blobs and need a conversion to text.
+func (sqliteDialect) JSONContains(column, placeholder string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM json_each(CAST(%s AS TEXT)) m
+		WHERE m.value IS NOT (SELECT h.value FROM json_each(CAST(%s AS TEXT)) h WHERE h.key = m.key))`,
+		placeholder, column)
+}
+
+func (sqliteDialect) Least(a, b string) string {
+	return fmt.Sprintf("min(%s, %s)", a, b)
+}
+
+func (sqliteDialect) Exp2(exp string) string {
+	return fmt.Sprintf("(1 << %s)", exp)
+}
+
+func (sqliteDialect) AddSeconds(ts, secs string) string {
+	return fmt.Sprintf("%s + CAST((%s) * %d AS INTEGER)", ts, secs, int64(time.Second))
+}
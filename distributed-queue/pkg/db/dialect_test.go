@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+)
+
+// testSQLiteShard creates a shard backed by an in-memory SQLite database.
+// Unlike testShard, it doesn't need an external database and is never skipped.
+func testSQLiteShard(t testing.TB) *ShardMeta {
+	conn, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single connection keeps the in-memory database alive and avoids table locks
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	schema, err := os.ReadFile("../../scripts/initdb_sqlite.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return NewShardMetaWithDialect(10, conn, true, SQLite)
+}
+
+func TestSQLiteRebind(t *testing.T) {
+	statement := "DELETE FROM messages WHERE ($2 = '' OR lease = $2) AND id = $1 LIMIT $10"
+	expected := "DELETE FROM messages WHERE (?2 = '' OR lease = ?2) AND id = ?1 LIMIT ?10"
+	if found := SQLite.Rebind(statement); found != expected {
+		t.Fatalf("expected %q, found %q", expected, found)
+	}
+	if found := Postgres.Rebind(statement); found != statement {
+		t.Fatalf("expected %q, found %q", statement, found)
+	}
+}
+
+func TestSQLiteFindMessages(t *testing.T) {
+	shard := testSQLiteShard(t)
+	ctx := context.Background()
+	repo := &MessageRepository{}
+	saved := saveTestMessages(t, shard, "fifo", 10)
+	ns := saved[0].Namespace
+
+	items := []*domain.Message{
+		{Topic: "headers", Headers: map[string]string{"type": "order", "region": "eu"}},
+		{Topic: "headers", Headers: map[string]string{"type": "refund"}},
+		{Topic: "headers"},
+		{Topic: "later", DeliverAfter: time.Hour},
+	}
+	for _, item := range items {
+		item.Namespace, item.Payload, item.Metadata, item.TTL = ns, []byte("payload"), []byte{}, time.Hour
+	}
+	if err := repo.SaveBatch(ctx, shard, items); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := repo.FindMessagesReadyForDelivery(ctx, shard, false, []string{"fifo"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("expected %d messages of topics not excluded and ready, found %d", 3, len(found))
+	}
+
+	found, err = repo.FindMessagesReadyForDelivery(ctx, shard, false, []string{}, 10,
+		WithHeaders(map[string]string{"type": "order"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != items[0].Id {
+		t.Fatalf("expected message %s, found %+v", items[0].Id.String(), found)
+	}
+	if found[0].Headers["region"] != "eu" {
+		t.Fatalf("expected header region %s, found %q", "eu", found[0].Headers["region"])
+	}
+
+	found, err = repo.FindMessagesReadyForDelivery(ctx, shard, false, []string{"headers"}, 10,
+		WithLimit(5), WithFIFOTopics([]string{"fifo"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 5 {
+		t.Fatalf("expected %d messages, found %d", 5, len(found))
+	}
+	for i, m := range found {
+		if m.Id != saved[i].Id {
+			t.Fatalf("message %d not in enqueue order: expected %s, found %s",
+				i, saved[i].Id.String(), m.Id.String())
+		}
+	}
+}
+
+func TestSQLiteAckNack(t *testing.T) {
+	shard := testSQLiteShard(t)
+	saved := saveTestMessages(t, shard, "orders", 1)
+	repo := &MessageRepository{}
+	ctx := context.Background()
+	ids := []domain.UUID{saved[0].Id}
+
+	readyAt := func() int64 {
+		t.Helper()
+		var v int64
+		row := shard.Conn().QueryRow("SELECT readyat FROM messages WHERE id = ?", saved[0].Id.Bytes())
+		if err := row.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	deliver := func(lease string) {
+		t.Helper()
+		if err := repo.LeaseBatch(ctx, shard, ids, lease); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := repo.UpdatePrefetchedBatch(ctx, shard, ids, true, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver("first")
+	last := readyAt()
+	if err := repo.AckNack(ctx, shard, saved[0].Id, false, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if delay := time.Duration(readyAt() - last); delay < nackBackoffBase {
+		t.Fatalf("expected redelivery delayed by at least %s, found %s", nackBackoffBase, delay)
+	}
+	found, err := repo.FindMessagesReadyForDelivery(ctx, shard, false, []string{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected nacked message to be delayed, found %d ready messages", len(found))
+	}
+
+	deliver("second")
+	if err := repo.AckNack(ctx, shard, saved[0].Id, true, "first"); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("expected %v, found %v", ErrStaleLease, err)
+	}
+	if err := repo.AckNack(ctx, shard, saved[0].Id, true, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AckNack(ctx, shard, saved[0].Id, true, "second"); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("expected %v acking a deleted message, found %v", ErrStaleLease, err)
+	}
+}
+
+func TestSQLiteMoveToTopic(t *testing.T) {
+	shard := testSQLiteShard(t)
+	saved := saveTestMessages(t, shard, "stuck", 2)
+	repo := &MessageRepository{}
+	ctx := context.Background()
+	ids := []domain.UUID{saved[0].Id, saved[1].Id}
+
+	// the messages are prefetched and leased to a consumer
+	if err := repo.LeaseBatch(ctx, shard, ids, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := repo.UpdatePrefetchedBatch(ctx, shard, ids, true, "stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ids of other namespaces are not moved
+	if moved, err := repo.MoveToTopic(ctx, shard, domain.NewUUID(shard.Id), ids, "retry"); err != nil || moved != 0 {
+		t.Fatalf("expected no messages moved in another namespace, found %d: %v", moved, err)
+	}
+	moved, err := repo.MoveToTopic(ctx, shard, saved[0].Namespace.Id, ids, "retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Fatalf("expected %d moved messages, found %d", 2, moved)
+	}
+
+	found, err := repo.FindMessagesReadyForDelivery(ctx, shard, false, []string{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Topic != "retry" || found[1].Topic != "retry" {
+		t.Fatalf("expected moved messages ready in topic retry, found %+v", found)
+	}
+	// the lease of the previous delivery can't acknowledge moved messages
+	if err := repo.AckNack(ctx, shard, saved[0].Id, true, "stale"); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("expected %v, found %v", ErrStaleLease, err)
+	}
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ShardEndpoint is the connection information advertised by a database shard
+type ShardEndpoint struct {
+	Id         uint32
+	Main       bool
+	ConnString string
+}
+
+// ShardSource provides the endpoints of the shards that are currently
+// members of the cluster
+type ShardSource interface {
+	ShardEndpoints() []ShardEndpoint
+}
+
+// Sync the managed shards with the endpoints advertised by the source.
+// Advertised shards are added, shards whose connection string changed are
+// reconnected and shards no longer advertised are detached. Connections of
+// shards leaving the cluster are not closed, because queue workers keep
+// using them: when a shard joins again, even after a brief membership flap,
+// its workers resume with the same ShardMeta. The main shard is never
+// detached because services keep a reference to it.
+// Errors connecting to single shards are joined in the returned error, the
+// other shards are synced regardless.
+func (m *ShardManager) Sync(src ShardSource) error {
+	var errs []error
+	advertised := map[uint32]bool{}
+	for _, ep := range src.ShardEndpoints() {
+		advertised[ep.Id] = true
+
+		if existing := m.Get(ep.Id); existing != nil {
+			if existing.ConnString == ep.ConnString {
+				continue
+			}
+			if err := m.Reconnect(ep.Id, ep.ConnString); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			m.logInfo("shard reconnected", zap.Uint32("shardId", ep.Id))
+			continue
+		}
+		if _, err := m.Add(ep.Id, ep.Main, ep.ConnString); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.logInfo("shard discovered", zap.Uint32("shardId", ep.Id))
+	}
+
+	for _, meta := range m.Shards() {
+		if advertised[meta.Id] || meta.main {
+			continue
+		}
+		m.Detach(meta.Id)
+		m.logInfo("shard detached", zap.Uint32("shardId", meta.Id))
+	}
+	return errors.Join(errs...)
+}
+
+// Discover syncs the managed shards with the source every interval until
+// the context is cancelled.
+func (m *ShardManager) Discover(ctx context.Context, src ShardSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Sync(src); err != nil && m.Logger != nil {
+			m.Logger.Warn("shard discovery failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *ShardManager) logInfo(msg string, fields ...zap.Field) {
+	if m.Logger != nil {
+		m.Logger.Info(msg, fields...)
+	}
+}
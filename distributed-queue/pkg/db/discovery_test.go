@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// fakeShardSource advertises a configurable list of shard endpoints,
+// like cluster members joining and leaving
+type fakeShardSource struct {
+	mu        sync.Mutex
+	endpoints []ShardEndpoint
+}
+
+func (s *fakeShardSource) set(endpoints ...ShardEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = endpoints
+}
+
+func (s *fakeShardSource) ShardEndpoints() []ShardEndpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.endpoints)
+}
+
+func shardIds(mgr *ShardManager) []uint32 {
+	ids := []uint32{}
+	for _, s := range mgr.Shards() {
+		ids = append(ids, s.Id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestSyncFollowsClusterMembership(t *testing.T) {
+	mgr := &ShardManager{opener: openWithoutPing}
+	defer mgr.Close()
+
+	main := ShardEndpoint{Id: 10, Main: true, ConnString: "postgres://db10/foqs?sslmode=disable"}
+	src := &fakeShardSource{}
+	src.set(main)
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if ids := shardIds(mgr); !slices.Equal(ids, []uint32{10}) {
+		t.Fatalf("expected shards %v, found %v", []uint32{10}, ids)
+	}
+	if mgr.MainShard() == nil || mgr.MainShard().Id != 10 {
+		t.Fatal("expected shard 10 to be the main shard")
+	}
+
+	// a new shard node joins the cluster
+	src.set(main, ShardEndpoint{Id: 20, ConnString: "postgres://db20/foqs?sslmode=disable"})
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if ids := shardIds(mgr); !slices.Equal(ids, []uint32{10, 20}) {
+		t.Fatalf("expected shards %v, found %v", []uint32{10, 20}, ids)
+	}
+
+	// the shard node moves to a different address
+	src.set(main, ShardEndpoint{Id: 20, ConnString: "postgres://db20-new/foqs?sslmode=disable"})
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if conn := mgr.Get(20).ConnString; conn != "postgres://db20-new/foqs?sslmode=disable" {
+		t.Fatalf("expected shard 20 to be reconnected, found %s", conn)
+	}
+
+	// all nodes leave: the main shard is kept
+	src.set()
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if ids := shardIds(mgr); !slices.Equal(ids, []uint32{10}) {
+		t.Fatalf("expected shards %v, found %v", []uint32{10}, ids)
+	}
+	if mgr.Get(20) != nil {
+		t.Fatal("shard 20 should be removed")
+	}
+}
+
+// openSQLite opens an in-memory SQLite database that can be pinged
+func openSQLite(connString string) (*sql.DB, error) {
+	return sql.Open("sqlite3", connString)
+}
+
+func TestSyncKeepsShardMetaAcrossFlaps(t *testing.T) {
+	var added []uint32
+	mgr := &ShardManager{opener: openSQLite, Added: func(s *ShardMeta) { added = append(added, s.Id) }}
+	defer mgr.Close()
+
+	main := ShardEndpoint{Id: 10, Main: true, ConnString: "file:flap-10?mode=memory"}
+	shard := ShardEndpoint{Id: 20, ConnString: "file:flap-20?mode=memory"}
+	src := &fakeShardSource{}
+	src.set(main, shard)
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	// the reference queue workers hold
+	meta := mgr.Get(20)
+	conn := meta.Conn()
+
+	// the shard briefly leaves the cluster
+	src.set(main)
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Get(20) != nil {
+		t.Fatal("shard 20 should be detached")
+	}
+	if meta.Healthy() {
+		t.Fatal("detached shard should be unhealthy")
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("detached shard connection should be open: %v", err)
+	}
+
+	src.set(main, shard)
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Get(20) != meta {
+		t.Fatal("shard 20 should join again with the same ShardMeta")
+	}
+	if meta.Conn() != conn {
+		t.Fatal("shard 20 should keep its connection")
+	}
+	if err := meta.Ping(context.Background()); err != nil || !meta.Healthy() {
+		t.Fatalf("expected shard 20 to recover, found %v", err)
+	}
+
+	// the shard leaves and joins again at a different address
+	src.set(main)
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	src.set(main, ShardEndpoint{Id: 20, ConnString: "file:flap-20-new?mode=memory"})
+	if err := mgr.Sync(src); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Get(20) != meta {
+		t.Fatal("shard 20 should join again with the same ShardMeta")
+	}
+	if meta.Conn() == conn || meta.ConnString != "file:flap-20-new?mode=memory" {
+		t.Fatal("shard 20 should be reconnected to the new address")
+	}
+	if err := conn.Ping(); err == nil {
+		t.Fatal("previous shard connection should be closed")
+	}
+	if err := meta.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(added, []uint32{10, 20}) {
+		t.Fatalf("expected new shards %v, found %v", []uint32{10, 20}, added)
+	}
+}
@@ -1,8 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -13,6 +17,17 @@ import (
 const (
 	cacheTTLDuration = time.Minute
 	cacheMaxObjects  = 500
+
+	// namespaceLoadTimeout bounds the namespace and topic schema queries shared
+	// by concurrent lookups
+	namespaceLoadTimeout = 5 * time.Second
+
+	// redelivery delay of nacked messages, doubled on every delivery attempt
+	nackBackoffBase = time.Second
+	nackBackoffMax  = 5 * time.Minute
+	// nackBackoffMaxExponent keeps the exponential delay computation in range
+	// for messages with many delivery attempts
+	nackBackoffMaxExponent = 20
 )
 
 func NewNamespaceRepository() *NamespaceRepository {
@@ -27,11 +42,11 @@ type NamespaceRepository struct {
 	itemsCache *objcache.ObjectsCache
 }
 
-func (r *NamespaceRepository) Save(shard *ShardMeta, item *domain.Namespace) error {
-	statement := "INSERT INTO namespaces (id, name) VALUES ($1, $2) RETURNING id"
+func (r *NamespaceRepository) Save(ctx context.Context, shard *ShardMeta, item *domain.Namespace) error {
+	statement := "INSERT INTO namespaces (id, name, topics) VALUES ($1, $2, $3) RETURNING id"
 
 	newUid := domain.NewUUID(shard.Id)
-	err := shard.Conn().QueryRow(statement, newUid.Bytes(), item.Name).Scan(&item.Id)
+	err := shard.Conn().QueryRowContext(ctx, statement, newUid.Bytes(), item.Name, pq.Array(item.Topics)).Scan(&item.Id)
 	if err == nil {
 		r.itemsCache.Delete(newUid.String())
 	}
@@ -42,10 +57,23 @@ func (r *NamespaceRepository) Save(shard *ShardMeta, item *domain.Namespace) err
 // Even though this application relies on a sharded database, namespaces are only stored in a "main" shard
 // and are not replicated to avoid introducing additional complexity.
 // To avoid creating a query hotspot on the main database this method uses an in-memory objects cache to cache
-// namespaces.
-func (r *NamespaceRepository) CachedFindByStringId(shard *ShardMeta, id string) (*domain.Namespace, error) {
-	retrieveFn := func(id string) (any, error) {
-		row, err := r.FindByStringId(shard, id)
+// namespaces. Concurrent lookups of the same missing namespace share a single database query.
+//
+// Cached namespaces are returned right away. On a miss, the shared query is detached from the
+// cancellation of the caller that started it, so that other callers waiting for the same
+// namespace are not affected. Every caller stops waiting when its own context is done.
+func (r *NamespaceRepository) CachedFindByStringId(ctx context.Context, shard *ShardMeta, id string) (*domain.Namespace, error) {
+	if cached := r.itemsCache.Get(id); cached != nil {
+		// cached misses are stored as nil values
+		item, _ := cached.Value.(*domain.Namespace)
+		return item, nil
+	}
+
+	loader := func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), namespaceLoadTimeout)
+		defer cancel()
+
+		row, err := r.FindByStringId(loadCtx, shard, id)
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			// result not found will be cached as nil to prevent bad consumers
@@ -57,32 +85,49 @@ func (r *NamespaceRepository) CachedFindByStringId(shard *ShardMeta, id string)
 			return row, nil
 		}
 	}
-	item, err := objcache.GetCachedResource(r.itemsCache, id, retrieveFn)
-	if err != nil {
-		return nil, err
-	}
 
-	return item.Value.(*domain.Namespace), nil
+	type result struct {
+		v   any
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		v, err := r.itemsCache.GetOrLoad(id, loader)
+		resCh <- result{v, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resCh:
+		if res.err != nil {
+			return nil, res.err
+		}
+		// cached misses are stored as nil values
+		item, _ := res.v.(*domain.Namespace)
+		return item, nil
+	}
 }
 
-func (r *NamespaceRepository) FindByStringId(shard *ShardMeta, id string) (*domain.Namespace, error) {
+func (r *NamespaceRepository) FindByStringId(ctx context.Context, shard *ShardMeta, id string) (*domain.Namespace, error) {
 	uid, err := domain.ParseUUID(id)
 	if err != nil {
 		return nil, err
 	}
-	statement := "SELECT id, name FROM namespaces WHERE id = $1"
+	statement := "SELECT id, name, topics FROM namespaces WHERE id = $1"
 	var item domain.Namespace
-	err = shard.Conn().QueryRow(statement, uid.Bytes()).Scan(&item.Id, &item.Name)
+	err = shard.Conn().QueryRowContext(ctx, statement, uid.Bytes()).Scan(&item.Id, &item.Name, pq.Array(&item.Topics))
 	return &item, err
 }
 
-func (r *NamespaceRepository) FindAll(shard *ShardMeta, fns ...OptsFn) ([]domain.Namespace, error) {
-	statement := "SELECT id, name FROM namespaces LIMIT $1"
+func (r *NamespaceRepository) FindAll(ctx context.Context, shard *ShardMeta, fns ...OptsFn) ([]domain.Namespace, error) {
+	// results are sorted by id so that pages are stable when using offsets
+	statement := "SELECT id, name, topics FROM namespaces ORDER BY id LIMIT $1 OFFSET $2"
 
 	opts := &sqlOpts{}
 	opts.withDefaults(fns)
 
-	rows, err := shard.Conn().Query(statement, opts.rows)
+	rows, err := shard.Conn().QueryContext(ctx, statement, opts.rows, opts.offset)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +136,7 @@ func (r *NamespaceRepository) FindAll(shard *ShardMeta, fns ...OptsFn) ([]domain
 	var vals []domain.Namespace
 	for rows.Next() {
 		var v domain.Namespace
-		if err := rows.Scan(&v.Id, &v.Name); err != nil {
+		if err := rows.Scan(&v.Id, &v.Name, pq.Array(&v.Topics)); err != nil {
 			return nil, err
 		}
 		vals = append(vals, v)
@@ -100,20 +145,214 @@ func (r *NamespaceRepository) FindAll(shard *ShardMeta, fns ...OptsFn) ([]domain
 	return vals, nil
 }
 
+func NewTopicSchemaRepository() *TopicSchemaRepository {
+	c := objcache.NewObjectsCache(cacheMaxObjects, cacheTTLDuration)
+	return &TopicSchemaRepository{
+		itemsCache: c,
+	}
+}
+
+// TopicSchemaRepository has methods to handle database operations for TopicSchema objects.
+// Like namespaces, topic schemas are only stored in the "main" shard.
+type TopicSchemaRepository struct {
+	itemsCache *objcache.ObjectsCache
+}
+
+// Save stores the schema of the namespace topic, replacing the previous one.
+// Other application instances keep using cached schemas for up to cacheTTLDuration.
+func (r *TopicSchemaRepository) Save(ctx context.Context, shard *ShardMeta, item *domain.TopicSchema) error {
+	statement := `INSERT INTO topic_schemas (namespace, topic, schema) VALUES ($1, $2, $3)
+ON CONFLICT (namespace, topic) DO UPDATE SET schema = EXCLUDED.schema`
+
+	_, err := shard.Conn().ExecContext(ctx, statement, item.Namespace.Bytes(), item.Topic, item.Schema)
+	if err == nil {
+		r.itemsCache.Delete(topicSchemaKey(item.Namespace, item.Topic))
+	}
+	return err
+}
+
+// CachedFindByTopic finds the schema of the namespace topic using the in-memory
+// objects cache. It returns nil if the topic has no schema.
+func (r *TopicSchemaRepository) CachedFindByTopic(ctx context.Context, shard *ShardMeta, namespace domain.UUID, topic string) (*domain.TopicSchema, error) {
+	v, err := r.itemsCache.GetOrLoad(topicSchemaKey(namespace, topic), func() (any, error) {
+		// the query is shared with concurrent lookups: don't let the caller cancel it
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), namespaceLoadTimeout)
+		defer cancel()
+
+		item, err := r.FindByTopic(loadCtx, shard, namespace, topic)
+		if errors.Is(err, sql.ErrNoRows) {
+			// topics without a schema are cached as nil
+			return nil, nil
+		}
+		return item, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	item, _ := v.(*domain.TopicSchema)
+	return item, nil
+}
+
+func (r *TopicSchemaRepository) FindByTopic(ctx context.Context, shard *ShardMeta, namespace domain.UUID, topic string) (*domain.TopicSchema, error) {
+	statement := "SELECT schema FROM topic_schemas WHERE namespace = $1 AND topic = $2"
+	var schema string
+	if err := shard.Conn().QueryRowContext(ctx, statement, namespace.Bytes(), topic).Scan(&schema); err != nil {
+		return nil, err
+	}
+	return domain.NewTopicSchema(namespace, topic, schema)
+}
+
+func topicSchemaKey(namespace domain.UUID, topic string) string {
+	return namespace.String() + "/" + topic
+}
+
+// ShardRedirectRepository has methods to handle the redirects of migrated shards.
+// Like namespaces, redirects are only stored in the "main" shard.
+type ShardRedirectRepository struct{}
+
+// Save redirects the messages with ids of the source shard to the destination
+// shard, replacing the previous redirect of the source.
+func (r *ShardRedirectRepository) Save(ctx context.Context, shard *ShardMeta, source, destination uint32) error {
+	statement := `INSERT INTO shard_redirects (source, destination) VALUES ($1, $2)
+ON CONFLICT (source) DO UPDATE SET destination = EXCLUDED.destination`
+
+	_, err := shard.Conn().ExecContext(ctx, statement, int64(source), int64(destination))
+	return err
+}
+
+// FindAll returns the destination shards keyed by source shard.
+func (r *ShardRedirectRepository) FindAll(ctx context.Context, shard *ShardMeta) (map[uint32]uint32, error) {
+	rows, err := shard.Conn().QueryContext(ctx, "SELECT source, destination FROM shard_redirects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redirects := map[uint32]uint32{}
+	for rows.Next() {
+		var source, destination int64
+		if err := rows.Scan(&source, &destination); err != nil {
+			return nil, err
+		}
+		redirects[uint32(source)] = uint32(destination)
+	}
+	return redirects, rows.Err()
+}
+
+// ScheduleRepository has methods to handle database operations for Schedule objects.
+// Like namespaces, schedules are only stored in the "main" shard: the messages of
+// their occurrences are enqueued to any shard.
+type ScheduleRepository struct{}
+
+// Save stores a new schedule. The first occurrence is enqueued at NextRunAt.
+func (r *ScheduleRepository) Save(ctx context.Context, shard *ShardMeta, item *domain.Schedule) error {
+	statement := `INSERT INTO schedules (
+		id, cron, topic, priority, namespace,
+		payload, metadata, ttl, headers, nextrunat
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, make_interval(secs => $8), $9, $10)
+	RETURNING id`
+
+	headers, err := encodeHeaders(item.Message.Headers)
+	if err != nil {
+		return err
+	}
+
+	msg := item.Message
+	newUid := domain.NewUUID(shard.Id)
+	return shard.Conn().QueryRowContext(ctx, statement,
+		newUid.Bytes(),
+		item.Cron,
+		msg.Topic,
+		msg.Priority,
+		msg.Namespace.Id.Bytes(),
+		msg.Payload,
+		msg.Metadata,
+		msg.TTL.Seconds(),
+		headers,
+		item.NextRunAt,
+	).Scan(&item.Id)
+}
+
+// FindDue returns up to limit schedules whose next occurrence is due at now,
+// sorted by next occurrence.
+func (r *ScheduleRepository) FindDue(ctx context.Context, shard *ShardMeta, now time.Time, limit int) ([]*domain.Schedule, error) {
+	statement := `SELECT id, cron, topic, priority, namespace,
+		payload, metadata, EXTRACT(EPOCH FROM ttl), headers, nextrunat
+		FROM schedules WHERE nextrunat <= $1 ORDER BY nextrunat LIMIT $2`
+
+	rows, err := shard.Conn().QueryContext(ctx, statement, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*domain.Schedule
+	for rows.Next() {
+		var (
+			id, namespace domain.UUID
+			expr          string
+			msg           domain.Message
+			headers       []byte
+			ttl           float64
+			nextRunAt     time.Time
+		)
+		if err := rows.Scan(&id, &expr, &msg.Topic, &msg.Priority, &namespace,
+			&msg.Payload, &msg.Metadata, &ttl, &headers, &nextRunAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers for schedule %s: %w", id.String(), err)
+		}
+		msg.TTL = time.Duration(ttl * float64(time.Second))
+		msg.Namespace = &domain.Namespace{Id: namespace}
+
+		item, err := domain.NewSchedule(expr, msg)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", id.String(), err)
+		}
+		item.Id = id
+		item.NextRunAt = nextRunAt
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Advance moves the next occurrence of the schedule from its NextRunAt to next.
+// It returns false if the occurrence was already advanced, for example by the
+// scheduler of another application instance: only the caller that advanced the
+// occurrence must enqueue its message.
+func (r *ScheduleRepository) Advance(ctx context.Context, shard *ShardMeta, item *domain.Schedule, next time.Time) (bool, error) {
+	statement := `UPDATE schedules SET nextrunat = $1 WHERE id = $2 AND nextrunat = $3`
+	res, err := shard.Conn().ExecContext(ctx, statement, next, item.Id.Bytes(), item.NextRunAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // MessageRepository has methods to handle database operations for Message objects.
 type MessageRepository struct{}
 
-func (r *MessageRepository) Save(shard *ShardMeta, item *domain.Message) error {
+func (r *MessageRepository) Save(ctx context.Context, shard *ShardMeta, item *domain.Message) error {
 	statement := `INSERT INTO messages (
 		id, topic, priority, namespace,
 		payload, metadata, deliverafter, ttl,
-		readyat, expiresat
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		readyat, expiresat, traceparent, headers
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 	RETURNING id`
 
 	newUid := domain.NewUUID(shard.Id)
+	headers, err := encodeHeaders(item.Headers)
+	if err != nil {
+		return err
+	}
 
-	return shard.Conn().QueryRow(statement,
+	dialect := shard.Dialect()
+	return shard.Conn().QueryRowContext(ctx, dialect.Rebind(statement),
 		newUid.Bytes(),
 		item.Topic,
 		item.Priority,
@@ -122,66 +361,386 @@ func (r *MessageRepository) Save(shard *ShardMeta, item *domain.Message) error {
 		item.Metadata,
 		item.DeliverAfter,
 		item.TTL,
-		time.Now().Add(item.DeliverAfter),
-		time.Now().Add(item.TTL),
+		dialect.Time(time.Now().Add(item.DeliverAfter)),
+		dialect.Time(time.Now().Add(item.TTL)),
+		item.TraceParent,
+		headers,
 	).Scan(&item.Id)
 }
 
-func (r *MessageRepository) AckNack(shard *ShardMeta, uid domain.UUID, ack bool) error {
-	var statement string
+// encodeHeaders returns the JSON representation of message headers stored
+// in the jsonb headers column.
+func encodeHeaders(headers map[string]string) ([]byte, error) {
+	if headers == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(headers)
+}
+
+// SaveBatch stores multiple messages using a single multi-row INSERT statement.
+// The batch is inserted atomically: if the statement fails none of the messages
+// are stored.
+// Message ids are generated before the insert and assigned to the items once the
+// batch is stored, without relying on the order of rows returned by the database.
+func (r *MessageRepository) SaveBatch(ctx context.Context, shard *ShardMeta, items []*domain.Message) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	const numCols = 12
+	var values strings.Builder
+	args := make([]any, 0, len(items)*numCols)
+	ids := make([]domain.UUID, len(items))
+	now := time.Now()
+	dialect := shard.Dialect()
+	for i, item := range items {
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		values.WriteString("(")
+		for c := 1; c <= numCols; c++ {
+			if c > 1 {
+				values.WriteString(", ")
+			}
+			fmt.Fprintf(&values, "$%d", i*numCols+c)
+		}
+		values.WriteString(")")
+
+		headers, err := encodeHeaders(item.Headers)
+		if err != nil {
+			return err
+		}
+
+		ids[i] = domain.NewUUID(shard.Id)
+		args = append(args,
+			ids[i].Bytes(),
+			item.Topic,
+			item.Priority,
+			item.Namespace.Id.Bytes(),
+			item.Payload,
+			item.Metadata,
+			item.DeliverAfter,
+			item.TTL,
+			dialect.Time(now.Add(item.DeliverAfter)),
+			dialect.Time(now.Add(item.TTL)),
+			item.TraceParent,
+			headers,
+		)
+	}
+
+	statement := `INSERT INTO messages (
+		id, topic, priority, namespace,
+		payload, metadata, deliverafter, ttl,
+		readyat, expiresat, traceparent, headers
+	) VALUES ` + values.String()
+
+	res, err := shard.Conn().ExecContext(ctx, dialect.Rebind(statement), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != int64(len(items)) {
+		return fmt.Errorf("batch insert stored %d rows for %d messages", n, len(items))
+	}
+
+	for i := range items {
+		items[i].Id = ids[i]
+	}
+	return nil
+}
+
+// ErrStaleLease is returned when acknowledging a message with the lease of a
+// previous delivery, or a message that doesn't exist anymore.
+var ErrStaleLease = errors.New("stale message lease")
+
+// AckNack deletes acknowledged messages. Nacked messages are made available for
+// delivery again after a delay that grows exponentially with the number of delivery
+// attempts, so that messages that can't be processed don't hot-loop between the
+// queue and its consumers.
+//
+// When lease is not empty, the message is only updated if it's still leased to the
+// consumer, otherwise ErrStaleLease is returned: retried or late acks and nacks can't
+// affect a message that was delivered again to another consumer.
+func (r *MessageRepository) AckNack(ctx context.Context, shard *ShardMeta, uid domain.UUID, ack bool, lease string) error {
+	var (
+		res     sql.Result
+		err     error
+		dialect = shard.Dialect()
+	)
 	if ack {
-		statement = `DELETE FROM messages WHERE id = $1`
+		res, err = shard.Conn().ExecContext(ctx,
+			dialect.Rebind(`DELETE FROM messages WHERE id = $1 AND ($2 = '' OR lease = $2)`), uid.Bytes(), lease)
 	} else {
-		statement = `UPDATE messages SET prefetched = false WHERE id = $1`
+		// readyat = $2 + min($3 * 2^min(deliveryattempts, $4), $5) seconds
+		delay := dialect.Least("$3 * "+dialect.Exp2(dialect.Least("deliveryattempts", "$4")), "$5")
+		statement := fmt.Sprintf(`UPDATE messages SET prefetched = false, lease = '',
+			deliveryattempts = deliveryattempts + 1,
+			readyat = %s
+			WHERE id = $1 AND ($6 = '' OR lease = $6)`, dialect.AddSeconds("$2", delay))
+		res, err = shard.Conn().ExecContext(ctx, dialect.Rebind(statement), uid.Bytes(), dialect.Time(time.Now()),
+			nackBackoffBase.Seconds(), nackBackoffMaxExponent, nackBackoffMax.Seconds(), lease)
 	}
-	_, err := shard.Conn().Exec(statement, uid.Bytes())
-	return err
+	if err != nil || len(lease) == 0 {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStaleLease
+	}
+	return nil
+}
+
+// MoveToTopic moves the messages of the namespace to a different topic and clears
+// their prefetched flag and lease, so that they are delivered again to the consumers
+// of the new topic and can't be acknowledged with the lease of a previous delivery.
+// Ids of messages stored in other namespaces are ignored.
+// It returns the number of messages moved.
+func (r *MessageRepository) MoveToTopic(ctx context.Context, shard *ShardMeta, namespace domain.UUID, ids []domain.UUID, topic string) (int64, error) {
+	dialect := shard.Dialect()
+	match, arr := dialect.AnyOf("id", "$3", uuidBytes(ids))
+	statement := `UPDATE messages SET topic = $1, prefetched = false, lease = ''
+		WHERE namespace = $2 AND ` + match
+	res, err := shard.Conn().ExecContext(ctx, dialect.Rebind(statement), topic, namespace.Bytes(), arr)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteTopic deletes all messages of a namespace topic stored in the shard and
+// returns the number of messages deleted.
+func (r *MessageRepository) DeleteTopic(ctx context.Context, shard *ShardMeta, namespace domain.UUID, topic string) (int64, error) {
+	statement := `DELETE FROM messages WHERE namespace = $1 AND topic = $2`
+	res, err := shard.Conn().ExecContext(ctx, shard.Dialect().Rebind(statement), namespace.Bytes(), topic)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MigrateBatch moves up to limit messages from the src shard to the dst shard and
+// returns the number of messages moved. Messages keep their ids, and so the
+// shard prefix of src: callers must redirect the routing of src ids to dst.
+//
+// Moved messages are copied with their prefetched flag cleared, so that messages
+// in-flight while the shard is migrated are delivered again from dst instead of
+// waiting for an ack that can't reach them.
+// Rows are copied to dst before being deleted from src: if the delete fails the
+// batch can be migrated again, as messages already stored in dst are skipped.
+func (r *MessageRepository) MigrateBatch(ctx context.Context, src, dst *ShardMeta, limit int) (int64, error) {
+	tx, err := src.Conn().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// interval columns are copied using their text representation
+	rows, err := tx.QueryContext(ctx, `SELECT id, topic, priority, namespace,
+		payload, metadata, deliverafter::text, ttl::text,
+		readyat, expiresat, traceparent, deliveryattempts, headers
+		FROM messages ORDER BY id LIMIT $1 FOR UPDATE`, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	const numCols = 13
+	var (
+		values strings.Builder
+		args   []any
+		ids    []domain.UUID
+	)
+	for rows.Next() {
+		var (
+			id                 domain.UUID
+			topic, traceparent string
+			priority, attempts int64
+			namespace, payload []byte
+			metadata, headers  []byte
+			deliverAfter, ttl  string
+			readyAt, expiresAt time.Time
+		)
+		if err := rows.Scan(&id, &topic, &priority, &namespace, &payload, &metadata,
+			&deliverAfter, &ttl, &readyAt, &expiresAt, &traceparent, &attempts, &headers); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		if len(ids) > 0 {
+			values.WriteString(", ")
+		}
+		values.WriteString("(")
+		for c := 1; c <= numCols; c++ {
+			if c > 1 {
+				values.WriteString(", ")
+			}
+			fmt.Fprintf(&values, "$%d", len(ids)*numCols+c)
+		}
+		values.WriteString(")")
+
+		ids = append(ids, id)
+		args = append(args, id.Bytes(), topic, priority, namespace, payload, metadata,
+			deliverAfter, ttl, readyAt, expiresAt, traceparent, attempts, string(headers))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	statement := `INSERT INTO messages (
+		id, topic, priority, namespace,
+		payload, metadata, deliverafter, ttl,
+		readyat, expiresat, traceparent, deliveryattempts, headers
+	) VALUES ` + values.String() + ` ON CONFLICT (id) DO NOTHING`
+	if _, err := dst.Conn().ExecContext(ctx, statement, args...); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = ANY($1)`, pq.Array(uuidBytes(ids)))
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (r *MessageRepository) FindMessagesReadyForDelivery(shard *ShardMeta, prefetched bool,
+// CountReadyByTopic returns the number of messages ready for delivery in the namespace,
+// grouped by topic.
+func (r *MessageRepository) CountReadyByTopic(ctx context.Context, shard *ShardMeta, namespace domain.UUID) (map[string]int64, error) {
+	statement := `SELECT topic, count(*) FROM messages
+	WHERE namespace = $1 AND readyat <= $2 AND expiresat > $2
+	GROUP BY topic`
+
+	rows, err := shard.Conn().QueryContext(ctx, statement, namespace.Bytes(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var topic string
+		var n int64
+		if err := rows.Scan(&topic, &n); err != nil {
+			return nil, err
+		}
+		counts[topic] = n
+	}
+	return counts, rows.Err()
+}
+
+// FindMessagesReadyForDelivery returns messages that met delivery conditions, bound
+// both globally (opts rows) and by topic (maxRowsByTopic).
+//
+// Results can be paginated with a keyset cursor using the WithAfter option. Because
+// message ids embed a sortable XID, paginated results are sorted by id and the id of
+// the last message returned can be used as the cursor for the next page.
+// WithOffset skips the given number of rows after sorting.
+// WithHeaders only returns messages whose headers contain the given key/value pairs.
+// WithFIFOTopics sorts the messages of the given topics by id, i.e. in enqueue order,
+// regardless of their priority.
+func (r *MessageRepository) FindMessagesReadyForDelivery(ctx context.Context, shard *ShardMeta, prefetched bool,
 	excludedTopics []string, maxRowsByTopic int, fns ...OptsFn) ([]domain.Message, error) {
 
-	statement := `WITH ranked AS(
-		SELECT id, topic, priority, payload, metadata,
+	opts := &sqlOpts{}
+	opts.withDefaults(fns)
+
+	dialect := shard.Dialect()
+	excluded, excludedArg := dialect.AnyOf("topic", "$3", excludedTopics)
+	args := []any{dialect.Time(time.Now()), prefetched, excludedArg, maxRowsByTopic}
+	filters := ""
+	// id breaks ties between priorities so that offsets skip the same rows
+	orderBy := "priority, id"
+	if len(opts.fifoTopics) > 0 {
+		// messages of FIFO topics are sorted as if they had the highest priority so that
+		// the rows fetched for the topic are always the oldest ones
+		fifo, fifoArg := dialect.AnyOf("topic", fmt.Sprintf("$%d", len(args)+1), opts.fifoTopics)
+		args = append(args, fifoArg)
+		orderBy = fmt.Sprintf("CASE WHEN %s THEN 0 ELSE priority END, id", fifo)
+	}
+	if opts.after != nil {
+		args = append(args, opts.after.Bytes())
+		filters += fmt.Sprintf(" AND id > $%d", len(args))
+		orderBy = "id"
+	}
+	if len(opts.headers) > 0 {
+		match, err := encodeHeaders(opts.headers)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, match)
+		filters += " AND " + dialect.JSONContains("headers", fmt.Sprintf("$%d", len(args)))
+	}
+	args = append(args, opts.rows, opts.offset)
+
+	statement := fmt.Sprintf(`WITH ranked AS(
+		SELECT id, topic, priority, namespace, payload, metadata, traceparent, headers, deliveryattempts,
 		ROW_NUMBER() OVER (PARTITION BY topic ORDER BY id) AS rn
 		FROM messages
-		WHERE readyat <= $1 AND expiresat > $1 AND prefetched = $2 AND NOT topic = ANY($3)
-		ORDER BY priority
+		WHERE readyat <= $1 AND expiresat > $1 AND prefetched = $2 AND NOT %s%s
+		ORDER BY %s
 	)
-	SELECT id, topic, priority, payload, metadata FROM ranked
-	WHERE rn <= $4 LIMIT $5`
+	SELECT id, topic, priority, namespace, payload, metadata, traceparent, headers, deliveryattempts FROM ranked
+	WHERE rn <= $4 ORDER BY %s LIMIT $%d OFFSET $%d`, excluded, filters, orderBy, orderBy, len(args)-1, len(args))
 
 	// TODO:
 	// Store lease duration and lease identifier when prefetching
 	// Include in pre-fetch rows with expired leases
 	// Sort returned rows by ascending priority
 
-	opts := &sqlOpts{}
-	opts.withDefaults(fns)
-
-	rows, err := shard.Conn().Query(statement,
-		time.Now(), prefetched, pq.Array(excludedTopics), maxRowsByTopic, opts.rows)
+	rows, err := shard.Conn().QueryContext(ctx, dialect.Rebind(statement), args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	results := []domain.Message{}
 	for rows.Next() {
-		item := domain.Message{}
-		rows.Scan(&item.Id, &item.Topic, &item.Priority, &item.Payload, &item.Metadata)
+		item := domain.Message{Namespace: &domain.Namespace{}}
+		var headers []byte
+		rows.Scan(&item.Id, &item.Topic, &item.Priority, &item.Namespace.Id, &item.Payload, &item.Metadata, &item.TraceParent, &headers, &item.Attempts)
+		if err := json.Unmarshal(headers, &item.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers for message %s: %w", item.Id.String(), err)
+		}
 		results = append(results, item)
 	}
 	return results, nil
 }
 
-func (r *MessageRepository) UpdatePrefetchedBatch(shard *ShardMeta, ids []domain.UUID, v bool) (*sql.Tx, error) {
-	tx, err := shard.Conn().Begin()
+// LeaseBatch assigns the lease of a new delivery to the messages. Acks and nacks
+// of previous deliveries are rejected from now on.
+func (r *MessageRepository) LeaseBatch(ctx context.Context, shard *ShardMeta, ids []domain.UUID, lease string) error {
+	dialect := shard.Dialect()
+	match, arr := dialect.AnyOf("id", "$2", uuidBytes(ids))
+	statement := `UPDATE messages SET lease = $1 WHERE ` + match
+	_, err := shard.Conn().ExecContext(ctx, dialect.Rebind(statement), lease, arr)
+	return err
+}
+
+// UpdatePrefetchedBatch sets the prefetched flag of the messages that still hold the
+// lease, in a transaction that callers must commit. Messages nacked since they were
+// leased are left alone, so that they can be delivered again.
+func (r *MessageRepository) UpdatePrefetchedBatch(ctx context.Context, shard *ShardMeta, ids []domain.UUID, v bool, lease string) (*sql.Tx, error) {
+	tx, err := shard.Conn().BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	statement := `UPDATE messages SET prefetched = $1 WHERE id=ANY($2)`
-	_, err = tx.Exec(statement, v, uuidToByteArray(ids))
+	dialect := shard.Dialect()
+	match, arr := dialect.AnyOf("id", "$2", uuidBytes(ids))
+	statement := `UPDATE messages SET prefetched = $1 WHERE ` + match + ` AND lease = $3`
+	_, err = tx.ExecContext(ctx, dialect.Rebind(statement), v, arr, lease)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -190,12 +749,12 @@ func (r *MessageRepository) UpdatePrefetchedBatch(shard *ShardMeta, ids []domain
 	return tx, nil
 }
 
-func uuidToByteArray(items []domain.UUID) interface{} {
+func uuidBytes(items []domain.UUID) [][]byte {
 	arr := make([][]byte, len(items))
 	for idx, item := range items {
 		arr[idx] = item.Bytes()
 	}
-	return pq.Array(arr)
+	return arr
 }
 
 const (
@@ -205,8 +764,12 @@ const (
 type OptsFn func(*sqlOpts)
 
 type sqlOpts struct {
-	rows   int
-	offset int
+	rows    int
+	offset  int
+	after   *domain.UUID
+	headers map[string]string
+
+	fifoTopics []string
 }
 
 func (opts *sqlOpts) withDefaults(fns []OptsFn) {
@@ -228,3 +791,28 @@ func WithOffset(offset int) OptsFn {
 		opts.offset = offset
 	}
 }
+
+// WithHeaders filters messages by headers, returning only messages whose
+// headers contain all the key/value pairs in match.
+func WithHeaders(match map[string]string) OptsFn {
+	return func(opts *sqlOpts) {
+		opts.headers = match
+	}
+}
+
+// WithFIFOTopics sorts the messages of the given topics in enqueue order
+// instead of by priority.
+func WithFIFOTopics(topics []string) OptsFn {
+	return func(opts *sqlOpts) {
+		opts.fifoTopics = topics
+	}
+}
+
+// WithAfter paginates results using a keyset cursor, returning only
+// records with an id greater than the cursor.
+// To iterate from the first record use the zero value domain.UUID{} as cursor.
+func WithAfter(cursor domain.UUID) OptsFn {
+	return func(opts *sqlOpts) {
+		opts.after = &cursor
+	}
+}
@@ -1,26 +1,88 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/wait"
 	"go.uber.org/zap"
 )
 
+// NewShardMeta creates a ShardMeta for an open database connection
+func NewShardMeta(id uint32, conn *sql.DB, main bool) *ShardMeta {
+	return &ShardMeta{Id: id, conn: conn, main: main}
+}
+
+// NewShardMetaWithDialect creates a ShardMeta for an open connection to a database
+// engine other than PostgreSQL, like the SQLite shards of integration tests.
+func NewShardMetaWithDialect(id uint32, conn *sql.DB, main bool, dialect Dialect) *ShardMeta {
+	return &ShardMeta{Id: id, conn: conn, main: main, dialect: dialect}
+}
+
 // ShardMeta represents a connected database shard
 type ShardMeta struct {
 	Id         uint32
 	ConnString string
 
-	conn *sql.DB
-	main bool
+	// connMu guards conn, which is replaced when the shard moves to a
+	// different address while queue workers are using it
+	connMu sync.RWMutex
+	conn   *sql.DB
+	main   bool
+	// dialect of the shard database engine, PostgreSQL when nil
+	dialect Dialect
+	// unhealthy is set when operations on the shard fail, until a
+	// successful ping proves the connection is working again
+	unhealthy atomic.Bool
 }
 
 // Conn returns an active sql.DB connection that can be used to
 // communicate with the shard
 func (meta *ShardMeta) Conn() *sql.DB {
+	meta.connMu.RLock()
+	defer meta.connMu.RUnlock()
 	return meta.conn
 }
 
+// rebind replaces the shard connection and returns the previous one
+func (meta *ShardMeta) rebind(conn *sql.DB, connString string) *sql.DB {
+	meta.connMu.Lock()
+	defer meta.connMu.Unlock()
+	old := meta.conn
+	meta.conn, meta.ConnString = conn, connString
+	return old
+}
+
+// Dialect returns the SQL dialect of the shard database engine
+func (meta *ShardMeta) Dialect() Dialect {
+	if meta.dialect == nil {
+		return Postgres
+	}
+	return meta.dialect
+}
+
+// Healthy returns false if the shard connection is known to be broken
+func (meta *ShardMeta) Healthy() bool {
+	return !meta.unhealthy.Load()
+}
+
+// MarkUnhealthy flags the shard connection as broken after a failed operation
+func (meta *ShardMeta) MarkUnhealthy() {
+	meta.unhealthy.Store(true)
+}
+
+// Ping the shard database and update its health status
+func (meta *ShardMeta) Ping(ctx context.Context) error {
+	err := meta.Conn().PingContext(ctx)
+	meta.unhealthy.Store(err != nil)
+	return err
+}
+
 func (m *ShardMeta) initialize() error {
 
 	// TODO read shard information from database
@@ -33,19 +95,135 @@ func (m *ShardMeta) initialize() error {
 	return nil
 }
 
-// ShardManager maintains the state of active database shards
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 5 * time.Minute
+
+	defaultConnectAttempts = 5
+	connectBackoffInitial  = 200 * time.Millisecond
+	connectBackoffMax      = 5 * time.Second
+	connectBackoffFactor   = 2
+)
+
+// PoolConfig contains the connection pool settings applied to every shard
+// connection. Zero values are replaced with sensible defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// apply the pool configuration to the database connection
+func (c PoolConfig) apply(dbConn *sql.DB) {
+	maxOpen := c.MaxOpenConns
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenConns
+	}
+	maxIdle := c.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	lifetime := c.ConnMaxLifetime
+	if lifetime <= 0 {
+		lifetime = defaultConnMaxLifetime
+	}
+
+	dbConn.SetMaxOpenConns(maxOpen)
+	dbConn.SetMaxIdleConns(maxIdle)
+	dbConn.SetConnMaxLifetime(lifetime)
+}
+
+// connOpener opens a connection to a database shard and verifies it's reachable
+type connOpener func(connString string) (*sql.DB, error)
+
+// openPostgres is the default connOpener for PostgreSQL shards
+func openPostgres(connString string) (*sql.DB, error) {
+	dbConn, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbConn.Ping(); err != nil {
+		dbConn.Close()
+		return nil, err
+	}
+	return dbConn, nil
+}
+
+// ShardManager maintains the state of active database shards.
+// Shards can be added and removed while the manager is in use, for
+// example by Discover.
 type ShardManager struct {
 	Logger *zap.Logger
+	Pool   PoolConfig
+	// ConnectAttempts is the number of times Add tries to connect to
+	// a shard before giving up. Defaults to defaultConnectAttempts.
+	ConnectAttempts int
+	// Added is called with every new shard added to the manager, so that
+	// queue workers can be started for shards discovered at runtime.
+	// It's not called for detached shards that are added again.
+	Added func(shard *ShardMeta)
+
+	opener connOpener
+	mu     sync.RWMutex
 	shards []*ShardMeta
 	index  map[uint32]*ShardMeta
+	// detached shards left the cluster but their connections are still open,
+	// because queue workers keep using their ShardMeta
+	detached map[uint32]*ShardMeta
 }
 
-// Add a connection to an existing database shard
+// connect opens a connection to the shard, retrying with a backoff if the
+// database is not reachable yet.
+func (m *ShardManager) connect(connString string) (*sql.DB, error) {
+	open := m.opener
+	if open == nil {
+		open = openPostgres
+	}
+	attempts := m.ConnectAttempts
+	if attempts <= 0 {
+		attempts = defaultConnectAttempts
+	}
+
+	bo := wait.NewBackoff(connectBackoffInitial, connectBackoffFactor, connectBackoffMax)
+	var err error
+	for i := 1; i <= attempts; i++ {
+		var dbConn *sql.DB
+		dbConn, err = open(connString)
+		if err == nil {
+			return dbConn, nil
+		}
+		if i == attempts {
+			break
+		}
+
+		bo.Backoff()
+		if m.Logger != nil {
+			m.Logger.Warn("shard connection failed, retrying",
+				zap.Int("attempt", i),
+				zap.Error(err))
+		}
+		<-bo.After()
+	}
+	return nil, fmt.Errorf("connecting to shard after %d attempts: %w", attempts, err)
+}
+
+// Add a connection to an existing database shard.
+// A detached shard is attached again with the same ShardMeta, so that the queue
+// workers holding it resume working with the shard.
 func (m *ShardManager) Add(shardId uint32, main bool, connString string) (*ShardMeta, error) {
-	dbConn, err := sql.Open("postgres", connString)
+	if meta := m.attach(shardId); meta != nil {
+		if meta.ConnString == connString {
+			return meta, nil
+		}
+		return meta, m.Reconnect(shardId, connString)
+	}
+
+	dbConn, err := m.connect(connString)
 	if err != nil {
 		return nil, err
 	}
+	m.Pool.apply(dbConn)
 
 	meta := &ShardMeta{
 		Id:         shardId,
@@ -57,6 +235,13 @@ func (m *ShardManager) Add(shardId uint32, main bool, connString string) (*Shard
 		meta.conn.Close() // bad shard initialization: closing
 		return nil, err
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.index[meta.Id]; exists {
+		meta.conn.Close()
+		return nil, fmt.Errorf("shard %d already exists", meta.Id)
+	}
 	m.shards = append(m.shards, meta)
 
 	if m.index == nil {
@@ -64,23 +249,100 @@ func (m *ShardManager) Add(shardId uint32, main bool, connString string) (*Shard
 	}
 	m.index[meta.Id] = meta
 
+	if m.Added != nil {
+		m.Added(meta)
+	}
 	return meta, nil
 }
 
+// attach moves a detached shard back to the active shards and returns it.
+// It returns nil if the shard is not detached.
+func (m *ShardManager) attach(id uint32) *ShardMeta {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, ok := m.detached[id]
+	if !ok {
+		return nil
+	}
+	delete(m.detached, id)
+	m.shards = append(m.shards, meta)
+	m.index[id] = meta
+	return meta
+}
+
+// Reconnect the shard with the given ID to a new address. The ShardMeta is
+// kept, so that queue workers holding it use the new connection, and the
+// previous connection is closed once in-flight queries are done.
+func (m *ShardManager) Reconnect(id uint32, connString string) error {
+	meta := m.Get(id)
+	if meta == nil {
+		return fmt.Errorf("shard %d not found", id)
+	}
+	dbConn, err := m.connect(connString)
+	if err != nil {
+		meta.MarkUnhealthy()
+		return err
+	}
+	m.Pool.apply(dbConn)
+	return meta.rebind(dbConn, connString).Close()
+}
+
+// Detach the shard with the given ID from the active shards without closing
+// its connection, like when the shard leaves the cluster. The shard is marked
+// unhealthy, so that its workers back off until it's reachable again.
+// Detaching a shard that doesn't exist is a no-op.
+func (m *ShardManager) Detach(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, ok := m.index[id]
+	if !ok {
+		return
+	}
+	delete(m.index, id)
+	m.shards = slices.DeleteFunc(m.shards, func(s *ShardMeta) bool { return s.Id == id })
+	if m.detached == nil {
+		m.detached = map[uint32]*ShardMeta{}
+	}
+	m.detached[id] = meta
+	meta.MarkUnhealthy()
+}
+
+// Remove the shard with the given ID and close its connection.
+// Shards used by queue workers must be detached instead.
+// Removing a shard that doesn't exist is a no-op.
+func (m *ShardManager) Remove(id uint32) error {
+	m.mu.Lock()
+	meta, ok := m.index[id]
+	if ok {
+		delete(m.index, id)
+		m.shards = slices.DeleteFunc(m.shards, func(s *ShardMeta) bool { return s.Id == id })
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return meta.Conn().Close()
+}
+
 // Shards returns the list of active ShardMeta
 func (m *ShardManager) Shards() []*ShardMeta {
-	return m.shards
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.shards)
 }
 
 // Get an active shard by its ID
 func (m *ShardManager) Get(id uint32) *ShardMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.index[id]
 }
 
 // MainShard returns the shard that acts as a "main" to store common
 // non-sharded information
 func (m *ShardManager) MainShard() *ShardMeta {
-	for _, m := range m.shards {
+	for _, m := range m.Shards() {
 		if m.main {
 			return m
 		}
@@ -88,9 +350,28 @@ func (m *ShardManager) MainShard() *ShardMeta {
 	return nil
 }
 
-// Close all active connections to shards
+// Ping all active shards and return the connection errors by shard id.
+// Reachable shards are reported with a nil error.
+// Pinging also updates the health status of every shard.
+func (m *ShardManager) Ping(ctx context.Context) map[uint32]error {
+	shards := m.Shards()
+	out := make(map[uint32]error, len(shards))
+	for _, meta := range shards {
+		out[meta.Id] = meta.Ping(ctx)
+	}
+	return out
+}
+
+// Close all connections to active and detached shards
 func (m *ShardManager) Close() {
-	for _, meta := range m.shards {
+	m.mu.RLock()
+	shards := slices.Clone(m.shards)
+	for _, meta := range m.detached {
+		shards = append(shards, meta)
+	}
+	m.mu.RUnlock()
+
+	for _, meta := range shards {
 		if err := meta.Conn().Close(); err != nil {
 			m.Logger.Error("error closing connection to shard",
 				zap.Uint32("shardId", meta.Id),
@@ -1,10 +1,17 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
 )
 
+// openWithoutPing opens a postgres connection without contacting the database
+func openWithoutPing(connString string) (*sql.DB, error) {
+	return sql.Open("postgres", connString)
+}
+
 func TestGetShardById(t *testing.T) {
 	mgr := &ShardManager{}
 	defer mgr.Close()
@@ -13,3 +20,74 @@ func TestGetShardById(t *testing.T) {
 	fmt.Println(shard)
 	//t.Fatal()
 }
+
+func TestAddAppliesPoolConfig(t *testing.T) {
+	tests := []struct {
+		pool        PoolConfig
+		expectedMax int
+	}{
+		{PoolConfig{}, defaultMaxOpenConns},
+		{PoolConfig{MaxOpenConns: 7, MaxIdleConns: 2}, 7},
+	}
+
+	for _, tt := range tests {
+		mgr := &ShardManager{Pool: tt.pool, opener: openWithoutPing}
+		shard, err := mgr.Add(10, true, "postgres://localhost/foqs?sslmode=disable")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := shard.Conn().Stats()
+		if stats.MaxOpenConnections != tt.expectedMax {
+			t.Fatalf("expected max open connections %d, found %d", tt.expectedMax, stats.MaxOpenConnections)
+		}
+		mgr.Close()
+	}
+}
+
+func TestAddRetriesConnection(t *testing.T) {
+	calls := 0
+	mgr := &ShardManager{
+		ConnectAttempts: 3,
+		opener: func(connString string) (*sql.DB, error) {
+			calls++
+			if calls < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return openWithoutPing(connString)
+		},
+	}
+	defer mgr.Close()
+
+	shard, err := mgr.Add(10, true, "postgres://localhost/foqs?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard.Conn() == nil {
+		t.Fatal("shard connection not initialized")
+	}
+	if calls != 3 {
+		t.Fatalf("expected %d connection attempts, found %d", 3, calls)
+	}
+}
+
+func TestAddGivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	mgr := &ShardManager{
+		ConnectAttempts: 2,
+		opener: func(connString string) (*sql.DB, error) {
+			calls++
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	if _, err := mgr.Add(10, true, "postgres://localhost/foqs?sslmode=disable"); err == nil {
+		t.Fatal("expected connection error, found nil")
+	}
+	if calls != 2 {
+		t.Fatalf("expected %d connection attempts, found %d", 2, calls)
+	}
+	if len(mgr.Shards()) != 0 {
+		t.Fatal("failed shard should not be registered")
+	}
+}
@@ -0,0 +1,86 @@
+// Package discovery finds the database shards of the queue through a gossip cluster.
+// Every shard node joins the cluster advertising its connection information as
+// gossip app state, so shards can be added and removed without configuration changes.
+package discovery
+
+import (
+	"strconv"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	gossip "github.com/mcastellin/golang-mastery/gossip/pkg"
+	"go.uber.org/zap"
+)
+
+// App state keys advertised by shard nodes
+const (
+	ShardIdKey   = "foqs.shard.id"
+	ShardMainKey = "foqs.shard.main"
+	ShardConnKey = "foqs.shard.conn"
+)
+
+// Cluster provides the local view of the gossip cluster members
+type Cluster interface {
+	States() map[gossip.NodeAddr]gossip.EndpointState
+}
+
+// ShardAppState returns the gossip app state a shard node advertises
+// to be discovered.
+func ShardAppState(ep db.ShardEndpoint) map[string]string {
+	return map[string]string{
+		ShardIdKey:   strconv.FormatUint(uint64(ep.Id), 10),
+		ShardMainKey: strconv.FormatBool(ep.Main),
+		ShardConnKey: ep.ConnString,
+	}
+}
+
+// GossipShardSource is a db.ShardSource reading shard endpoints from the
+// app state of online cluster members. Members that don't advertise a shard,
+// like other queue nodes, are ignored.
+type GossipShardSource struct {
+	Logger  *zap.Logger
+	Cluster Cluster
+}
+
+// ShardEndpoints returns the endpoints of the shards currently in the cluster
+func (s *GossipShardSource) ShardEndpoints() []db.ShardEndpoint {
+	endpoints := []db.ShardEndpoint{}
+	for addr, state := range s.Cluster.States() {
+		ep, ok, err := parseShardEndpoint(state.AppState)
+		if err != nil {
+			if s.Logger != nil {
+				s.Logger.Warn("invalid shard app state",
+					zap.String("node", string(addr)),
+					zap.Error(err))
+			}
+			continue
+		}
+		if ok {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// parseShardEndpoint reads the shard endpoint from the node app state.
+// It returns false if the node doesn't advertise a shard.
+func parseShardEndpoint(appState map[string]string) (db.ShardEndpoint, bool, error) {
+	rawId, ok := appState[ShardIdKey]
+	if !ok {
+		return db.ShardEndpoint{}, false, nil
+	}
+	id, err := strconv.ParseUint(rawId, 10, 32)
+	if err != nil {
+		return db.ShardEndpoint{}, false, err
+	}
+	var main bool
+	if rawMain, ok := appState[ShardMainKey]; ok {
+		if main, err = strconv.ParseBool(rawMain); err != nil {
+			return db.ShardEndpoint{}, false, err
+		}
+	}
+	return db.ShardEndpoint{
+		Id:         uint32(id),
+		Main:       main,
+		ConnString: appState[ShardConnKey],
+	}, true, nil
+}
@@ -0,0 +1,48 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	gossip "github.com/mcastellin/golang-mastery/gossip/pkg"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeCluster is a gossip cluster view with fixed members
+type fakeCluster map[gossip.NodeAddr]gossip.EndpointState
+
+func (c fakeCluster) States() map[gossip.NodeAddr]gossip.EndpointState {
+	return c
+}
+
+func TestGossipShardSource(t *testing.T) {
+	shard := db.ShardEndpoint{Id: 20, ConnString: "postgres://db20/foqs?sslmode=disable"}
+	cluster := fakeCluster{
+		"db20:7946":  {NodeAddr: "db20:7946", AppState: ShardAppState(shard)},
+		"queue:7946": {NodeAddr: "queue:7946"},
+		"bad:7946": {NodeAddr: "bad:7946", AppState: map[string]string{
+			ShardIdKey: "not-a-number",
+		}},
+	}
+	src := &GossipShardSource{Logger: zaptest.NewLogger(t), Cluster: cluster}
+
+	endpoints := src.ShardEndpoints()
+	if len(endpoints) != 1 {
+		t.Fatalf("expected %d shard endpoints, found %d", 1, len(endpoints))
+	}
+	if endpoints[0] != shard {
+		t.Fatalf("expected endpoint %+v, found %+v", shard, endpoints[0])
+	}
+
+	// a new shard node appears in the cluster membership
+	main := db.ShardEndpoint{Id: 10, Main: true, ConnString: "postgres://db10/foqs?sslmode=disable"}
+	cluster["db10:7946"] = gossip.EndpointState{NodeAddr: "db10:7946", AppState: ShardAppState(main)}
+
+	found := map[uint32]db.ShardEndpoint{}
+	for _, ep := range src.ShardEndpoints() {
+		found[ep.Id] = ep
+	}
+	if len(found) != 2 || found[10] != main {
+		t.Fatalf("expected main shard %+v to be discovered, found %+v", main, found)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,53 @@ import (
 type Namespace struct {
 	Id   UUID
 	Name string
+	// Topics is the allowlist of topics messages can be enqueued to.
+	// Any topic is accepted when the list is empty.
+	Topics []string
+}
+
+// AllowsTopic returns true if messages can be enqueued to topic in the namespace.
+func (ns *Namespace) AllowsTopic(topic string) bool {
+	if len(ns.Topics) == 0 {
+		return true
+	}
+	for _, t := range ns.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Ordering is the order messages of a topic are delivered in.
+type Ordering int
+
+const (
+	// OrderByPriority delivers messages with lower priority values first
+	OrderByPriority Ordering = iota
+	// OrderFIFO delivers messages in enqueue order, regardless of their priority
+	OrderFIFO
+)
+
+// TopicOrderings configures the delivery order of topics, keyed by topic name.
+// Topics that are not configured are delivered by priority.
+type TopicOrderings map[string]Ordering
+
+// Of returns the delivery order of the topic.
+func (o TopicOrderings) Of(topic string) Ordering {
+	return o[topic]
+}
+
+// FIFOTopics returns the sorted names of the topics delivered in enqueue order.
+func (o TopicOrderings) FIFOTopics() []string {
+	topics := []string{}
+	for topic, ordering := range o {
+		if ordering == OrderFIFO {
+			topics = append(topics, topic)
+		}
+	}
+	slices.Sort(topics)
+	return topics
 }
 
 // Message represents a single message that can be sent to the queue
@@ -27,6 +75,41 @@ type Message struct {
 	Metadata     []byte
 	DeliverAfter time.Duration
 	TTL          time.Duration
+	// TraceParent is the W3C trace context of the request that enqueued
+	// the message, used to link its lifecycle in distributed traces.
+	TraceParent string
+	// Headers are key/value pairs attached to the message that consumers
+	// can match to select the messages they dequeue.
+	Headers map[string]string
+	// Lease identifies the delivery of a dequeued message. Consumers send it
+	// back when acknowledging the message, so that acks and nacks of previous
+	// deliveries are ignored.
+	Lease string
+	// Attempts is the number of previous deliveries of the message that were
+	// nacked, so that consumers can special-case poison messages.
+	Attempts int
+}
+
+// MatchesHeaders returns true if the message headers contain all the key/value
+// pairs in match. Every message matches an empty match.
+func (m *Message) MatchesHeaders(match map[string]string) bool {
+	for k, v := range match {
+		if hv, ok := m.Headers[k]; !ok || hv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// CreatedAt returns the time the message was enqueued, extracted from the
+// timestamp embedded in its XID. The timestamp has a one second precision.
+func (m *Message) CreatedAt() time.Time {
+	return m.Id.XID().Time()
+}
+
+// Age returns how long ago the message was enqueued.
+func (m *Message) Age() time.Duration {
+	return time.Since(m.CreatedAt())
 }
 
 // UUID type is a custom-built identifier for sharded records.
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+func TestMessageAge(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var uid UUID
+	binary.BigEndian.PutUint32(uid[:4], 10)
+	copy(uid[4:], xid.NewWithTime(created).Bytes())
+	msg := Message{Id: uid}
+
+	if !msg.CreatedAt().Equal(created) {
+		t.Fatalf("expected created at %s, found %s", created, msg.CreatedAt())
+	}
+	if age := msg.Age(); age < time.Hour || age > time.Hour+time.Minute {
+		t.Fatalf("expected age of about %s, found %s", time.Hour, age)
+	}
+}
+
+func TestNamespaceAllowsTopic(t *testing.T) {
+	open := Namespace{Name: "open"}
+	if !open.AllowsTopic("anything") {
+		t.Fatal("namespaces without topics should allow any topic")
+	}
+
+	restricted := Namespace{Name: "restricted", Topics: []string{"orders"}}
+	if !restricted.AllowsTopic("orders") {
+		t.Fatalf("expected topic %s to be allowed", "orders")
+	}
+	if restricted.AllowsTopic("ordres") {
+		t.Fatalf("expected topic %s to be rejected", "ordres")
+	}
+}
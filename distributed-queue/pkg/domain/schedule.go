@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule enqueues a copy of its message at every occurrence of a cron
+// expression, like `*/5 * * * *` or `@every 30s`.
+type Schedule struct {
+	Id   UUID
+	Cron string
+	// Message is the template of the messages enqueued at every occurrence
+	Message Message
+	// NextRunAt is the time of the next occurrence of the schedule
+	NextRunAt time.Time
+
+	compiled cron.Schedule
+}
+
+// NewSchedule parses the cron expression of a schedule enqueueing msg.
+// Expressions have the standard five fields, or use descriptors like @hourly
+// and @every <duration>. An error is returned if the expression is not valid.
+func NewSchedule(expr string, msg Message) (*Schedule, error) {
+	compiled, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	return &Schedule{Cron: expr, Message: msg, compiled: compiled}, nil
+}
+
+// Next returns the first occurrence of the schedule after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.compiled.Next(t)
+}
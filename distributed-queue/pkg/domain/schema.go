@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// topicSchemaURL is the base URL of compiled topic schemas. Schemas are
+// compiled from memory and references to other documents are not resolved.
+const topicSchemaURL = "topic-schema.json"
+
+// TopicSchema is the JSON Schema that payloads enqueued to a topic of
+// a namespace must conform to.
+type TopicSchema struct {
+	Namespace UUID
+	Topic     string
+	Schema    string
+
+	compiled *jsonschema.Schema
+}
+
+// NewTopicSchema compiles the JSON Schema for the namespace topic.
+// An error is returned if the schema is not valid.
+func NewTopicSchema(namespace UUID, topic string, schema string) (*TopicSchema, error) {
+	c := jsonschema.NewCompiler()
+	// schemas are provided by API clients: never load referenced documents
+	// from the local filesystem or the network
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("loading referenced schema %s is not allowed", s)
+	}
+	if err := c.AddResource(topicSchemaURL, strings.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	compiled, err := c.Compile(topicSchemaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicSchema{
+		Namespace: namespace,
+		Topic:     topic,
+		Schema:    schema,
+		compiled:  compiled,
+	}, nil
+}
+
+// SchemaValidationError reports why a payload doesn't conform to a topic schema.
+type SchemaValidationError struct {
+	Errors []string
+}
+
+func (e *SchemaValidationError) Error() string {
+	return "payload does not conform to the topic schema: " + strings.Join(e.Errors, "; ")
+}
+
+// Validate checks the payload is a JSON document conforming to the schema.
+// Non-conforming payloads are reported with a SchemaValidationError.
+func (s *TopicSchema) Validate(payload []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return &SchemaValidationError{Errors: []string{fmt.Sprintf("payload is not valid JSON: %v", err)}}
+	}
+	if dec.More() {
+		return &SchemaValidationError{Errors: []string{"payload is not valid JSON: unexpected data after the document"}}
+	}
+
+	err := s.compiled.Validate(v)
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		return &SchemaValidationError{Errors: validationMessages(validationErr, nil)}
+	}
+	return err
+}
+
+// validationMessages flattens the validation errors, keeping the leaves
+// that point to the invalid values in the payload.
+func validationMessages(err *jsonschema.ValidationError, msgs []string) []string {
+	if len(err.Causes) == 0 {
+		location := err.InstanceLocation
+		if len(location) == 0 {
+			location = "/"
+		}
+		return append(msgs, fmt.Sprintf("%s: %s", location, err.Message))
+	}
+	for _, cause := range err.Causes {
+		msgs = validationMessages(cause, msgs)
+	}
+	return msgs
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTopicSchemaValidate(t *testing.T) {
+	schema, err := NewTopicSchema(NewUUID(10), "orders", `{
+		"type": "object",
+		"properties": {"id": {"type": "integer"}},
+		"required": ["id"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.Validate([]byte(`{"id": 12345678901234567890}`)); err != nil {
+		t.Fatalf("expected conforming payload, found %v", err)
+	}
+
+	testCases := []string{`{"id": 1.5}`, `{}`, `not json`, `{"id": 1} {"id": 2}`}
+	for _, payload := range testCases {
+		var validationErr *SchemaValidationError
+		if err := schema.Validate([]byte(payload)); !errors.As(err, &validationErr) {
+			t.Fatalf("expected validation error for %s, found %v", payload, err)
+		}
+	}
+}
@@ -2,10 +2,16 @@ package prefetch
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -14,8 +20,10 @@ const (
 	// will prefetch for every topic
 	MaxPrefetchItemCount = 100
 
+	// DefaultChanSize is the size of the buffer channels when not configured
+	DefaultChanSize = 300
+
 	defaultDequeueLimitPerTopic = 20
-	defaultChanSize             = 300
 
 	responseCommunicationTimeout = 100 * time.Millisecond
 )
@@ -46,6 +54,9 @@ const (
 
 // GetItemsRequest is a request structure used by API clients to ask for messages that are ready
 // for delivery.
+// Requests with an empty Topic are served from all topics in round-robin fashion.
+// When Match is set, only messages with headers containing all of its key/value
+// pairs are returned.
 // GetitemsRequests are buffered and will be processed by the PriorityBuffer asynchronously. Requests
 // must contain an initialized replyCh to receive a response from the buffer.
 type GetItemsRequest struct {
@@ -53,7 +64,9 @@ type GetItemsRequest struct {
 	Topic     string
 	Limit     int
 	Timeout   time.Duration
+	Match     map[string]string
 
+	peek    bool
 	replyCh chan<- GetItemsResponse
 }
 
@@ -67,14 +80,32 @@ type GetItemsResponse struct {
 type IngestEnvelope struct {
 	Batch  []domain.Message
 	RespCh chan<- []PrefetchResponseStatus
+	// SpanCtx is the trace context of the worker that fetched the batch
+	SpanCtx trace.SpanContext
+}
+
+// purgeRequest asks the buffer to drop the messages of a namespace topic or,
+// when ids is set, the namespace messages with those ids buffered outside topic
+type purgeRequest struct {
+	namespace domain.UUID
+	topic     string
+	ids       map[domain.UUID]bool
+	replyCh   chan<- int
 }
 
 // NewPriorityBuffer creates a new PriorityBuffer struct.
 func NewPriorityBuffer(logger *zap.Logger) *PriorityBuffer {
+	return NewPriorityBufferWithSize(logger, DefaultChanSize)
+}
+
+// NewPriorityBufferWithSize creates a new PriorityBuffer struct with request and
+// ingest channels of the given size.
+func NewPriorityBufferWithSize(logger *zap.Logger, chanSize int) *PriorityBuffer {
 	return &PriorityBuffer{
 		logger:   logger,
-		apiReqCh: make(chan GetItemsRequest, defaultChanSize),
-		ingestCh: make(chan IngestEnvelope, defaultChanSize),
+		apiReqCh: make(chan GetItemsRequest, chanSize),
+		ingestCh: make(chan IngestEnvelope, chanSize),
+		purgeCh:  make(chan purgeRequest),
 	}
 }
 
@@ -82,15 +113,26 @@ func NewPriorityBuffer(logger *zap.Logger) *PriorityBuffer {
 // for faster delivery to clients.
 // A certain number of items is prefetched for each topic that has messages that are ready to be delivered.
 type PriorityBuffer struct {
+	// Orderings configures the delivery order of topics: topics are delivered by
+	// priority unless configured otherwise. Orderings must be set before Run.
+	Orderings domain.TopicOrderings
+
 	logger   *zap.Logger
 	apiReqCh chan GetItemsRequest
 	ingestCh chan IngestEnvelope
+	purgeCh  chan purgeRequest
 
 	// buffers contains one key per fetched topic.
 	// Every topic stores a pre-fetch heap with messages
 	// that are ready for delivery up to MaxPrefetchItemCount
-	buffers  map[string]*msgHeap
+	buffers map[string]*msgHeap
+	// rrLastTopic is the topic that opened the last round-robin batch.
+	// The next topic-less request starts from the one that follows it.
+	rrLastTopic string
+
 	shutdown chan chan error
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // C returns the ingest channel that receives messages from the prefetch workers.
@@ -104,6 +146,7 @@ func (pb *PriorityBuffer) C() chan IngestEnvelope {
 // Run the prefetch worker loop
 func (pb *PriorityBuffer) Run() error {
 	pb.shutdown = make(chan chan error)
+	pb.done = make(chan struct{})
 
 	if pb.buffers == nil {
 		pb.buffers = map[string]*msgHeap{}
@@ -121,7 +164,7 @@ func (pb *PriorityBuffer) Run() error {
 func (pb *PriorityBuffer) serveLoop() {
 	cleanup := func() {
 		pb.buffers = nil
-		close(pb.shutdown)
+		close(pb.done)
 	}
 	defer cleanup()
 
@@ -131,6 +174,9 @@ func (pb *PriorityBuffer) serveLoop() {
 			respCh <- nil
 			return
 
+		case req := <-pb.purgeCh:
+			req.replyCh <- pb.processPurge(&req)
+
 		case envelope := <-pb.ingestCh:
 			reply := pb.processIngest(&envelope)
 			envelope.RespCh <- reply
@@ -158,39 +204,116 @@ func (pb *PriorityBuffer) serveLoop() {
 }
 
 func (pb *PriorityBuffer) processGetItems(req *GetItemsRequest) *GetItemsResponse {
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultDequeueLimitPerTopic
+	}
+
+	if len(req.Topic) == 0 {
+		return &GetItemsResponse{Messages: pb.roundRobinItems(limit, req.Match, req.peek)}
+	}
+
 	tHeap, ok := pb.buffers[req.Topic]
 	if !ok {
 		return &GetItemsResponse{Messages: []domain.Message{}}
 	}
 
-	limit := req.Limit
-	if limit == 0 {
-		limit = defaultDequeueLimitPerTopic
+	if req.peek {
+		// popping items from a copy of the heap to leave the buffer untouched
+		tHeap = tHeap.clone()
 	}
-	n := min(len(*tHeap), limit)
+	return &GetItemsResponse{Messages: popItems(tHeap, limit, req.Match)}
+}
 
-	prefetched := make([]domain.Message, n)
-	for i := 0; i < n; i++ {
+// popItems pops up to limit messages with headers matching match from the heap,
+// in delivery order. Messages that don't match are left in the heap.
+func popItems(tHeap *msgHeap, limit int, match map[string]string) []domain.Message {
+	items := []domain.Message{}
+	var skipped []*domain.Message
+	for len(items) < limit && tHeap.Len() > 0 {
 		item := heap.Pop(tHeap).(*domain.Message)
-		prefetched[i] = *item
+		if !item.MatchesHeaders(match) {
+			skipped = append(skipped, item)
+			continue
+		}
+		items = append(items, *item)
+	}
+	for _, item := range skipped {
+		heap.Push(tHeap, item)
+	}
+	return items
+}
+
+// roundRobinItems pops up to limit messages taking one item at a time from every
+// topic, so that busy topics can't starve the others.
+// Every call starts from the topic following the one that opened the previous batch.
+func (pb *PriorityBuffer) roundRobinItems(limit int, match map[string]string, peek bool) []domain.Message {
+	topics := make([]string, 0, len(pb.buffers))
+	for topic, tHeap := range pb.buffers {
+		if tHeap.Len() > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return []domain.Message{}
+	}
+	slices.Sort(topics)
+
+	start, _ := slices.BinarySearch(topics, pb.rrLastTopic)
+	if start < len(topics) && topics[start] == pb.rrLastTopic {
+		start++
+	}
+	start %= len(topics)
+
+	heaps := make([]*msgHeap, len(topics))
+	for i := range heaps {
+		tHeap := pb.buffers[topics[(start+i)%len(topics)]]
+		if peek {
+			tHeap = tHeap.clone()
+		}
+		heaps[i] = tHeap
+	}
+	if !peek {
+		pb.rrLastTopic = topics[start]
+	}
+
+	items := []domain.Message{}
+	for len(items) < limit {
+		popped := false
+		for _, tHeap := range heaps {
+			if len(items) == limit {
+				break
+			}
+			if next := popItems(tHeap, 1, match); len(next) > 0 {
+				items = append(items, next...)
+				popped = true
+			}
+		}
+		if !popped {
+			break
+		}
 	}
-	return &GetItemsResponse{Messages: prefetched}
+	return items
 }
 
 func (pb *PriorityBuffer) processIngest(envelope *IngestEnvelope) []PrefetchResponseStatus {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), envelope.SpanCtx)
+	_, span := tracing.Tracer().Start(ctx, "prefetch.ingest",
+		trace.WithAttributes(attribute.Int("batch.size", len(envelope.Batch))))
+	defer span.End()
+
 	reply := make([]PrefetchResponseStatus, len(envelope.Batch))
 
 	for i := 0; i < len(envelope.Batch); i++ {
 		msg := envelope.Batch[i]
 		tHeap, ok := pb.buffers[msg.Topic]
 		if !ok {
-			newHeap := make(msgHeap, 0)
-			tHeap = &newHeap
+			tHeap = &msgHeap{ordering: pb.Orderings.Of(msg.Topic)}
 			heap.Init(tHeap)
 			pb.buffers[msg.Topic] = tHeap
 		}
 
-		if len(*tHeap) < MaxPrefetchItemCount {
+		if tHeap.Len() < MaxPrefetchItemCount {
 			heap.Push(tHeap, &msg)
 			reply[i] = PrefetchStatusOk
 		} else {
@@ -200,12 +323,50 @@ func (pb *PriorityBuffer) processIngest(envelope *IngestEnvelope) []PrefetchResp
 	return reply
 }
 
-// Stop the worker loop
+// processPurge removes the messages of the namespace topic, or the messages moved
+// to the topic, from the buffer and returns the number of messages removed.
+func (pb *PriorityBuffer) processPurge(req *purgeRequest) int {
+	if req.ids != nil {
+		removed := 0
+		for topic, tHeap := range pb.buffers {
+			if topic == req.topic {
+				continue
+			}
+			removed += tHeap.remove(func(msg *domain.Message) bool {
+				return req.ids[msg.Id] && msg.Namespace != nil && msg.Namespace.Id == req.namespace
+			})
+		}
+		return removed
+	}
+
+	tHeap, ok := pb.buffers[req.topic]
+	if !ok {
+		return 0
+	}
+	return tHeap.remove(func(msg *domain.Message) bool {
+		return msg.Namespace != nil && msg.Namespace.Id == req.namespace
+	})
+}
+
+// Stop the worker loop.
+// Stop is idempotent: calling it more than once, or after the loop exited,
+// returns immediately.
 func (pb *PriorityBuffer) Stop() error {
-	errCh := make(chan error)
-	pb.shutdown <- errCh
+	if pb.done == nil {
+		// worker was never started
+		return nil
+	}
 
-	return <-errCh
+	var err error
+	pb.stopOnce.Do(func() {
+		errCh := make(chan error)
+		select {
+		case pb.shutdown <- errCh:
+			err = <-errCh
+		case <-pb.done:
+		}
+	})
+	return err
 }
 
 // GetItems places a new GetItemRequest into the worker's buffer and returns
@@ -219,31 +380,92 @@ func (pb *PriorityBuffer) GetItems(req *GetItemsRequest) chan GetItemsResponse {
 	return respCh
 }
 
+// Peek places a new GetItemRequest into the worker's buffer like GetItems, though
+// messages are returned without removing them from the buffer.
+func (pb *PriorityBuffer) Peek(req *GetItemsRequest) chan GetItemsResponse {
+	req.peek = true
+	return pb.GetItems(req)
+}
+
+// Purge removes the buffered messages of a namespace topic, so that they are no
+// longer delivered, and returns the number of messages removed.
+func (pb *PriorityBuffer) Purge(namespace domain.UUID, topic string) int {
+	respCh := make(chan int, 1)
+	pb.purgeCh <- purgeRequest{namespace: namespace, topic: topic, replyCh: respCh}
+	return <-respCh
+}
+
+// PurgeMoved removes the buffered messages of the namespace with the given ids that
+// were moved to topic, so that they are no longer delivered to the consumers of their previous
+// topic, and returns the number of messages removed. Messages buffered in topic
+// were prefetched after the move and are kept.
+func (pb *PriorityBuffer) PurgeMoved(namespace domain.UUID, ids []domain.UUID, topic string) int {
+	set := make(map[domain.UUID]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	respCh := make(chan int, 1)
+	pb.purgeCh <- purgeRequest{namespace: namespace, topic: topic, ids: set, replyCh: respCh}
+	return <-respCh
+}
+
 // msgHeap is an implementation of the heap.Interface that allows us to
-// store prefetched messages in a priority tree
-type msgHeap []*domain.Message
+// store prefetched messages in a priority tree.
+// Messages are popped in the delivery order of their topic: by priority, or in
+// enqueue order for FIFO topics.
+type msgHeap struct {
+	msgs     []*domain.Message
+	ordering domain.Ordering
+}
+
+// clone returns a shallow copy of the heap that can be popped without
+// modifying the original.
+func (mh *msgHeap) clone() *msgHeap {
+	c := &msgHeap{msgs: make([]*domain.Message, len(mh.msgs)), ordering: mh.ordering}
+	copy(c.msgs, mh.msgs)
+	return c
+}
+
+// remove the messages matching drop from the heap and return how many were removed
+func (mh *msgHeap) remove(drop func(*domain.Message) bool) int {
+	kept := mh.msgs[:0]
+	for _, msg := range mh.msgs {
+		if !drop(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	removed := len(mh.msgs) - len(kept)
+	clear(mh.msgs[len(kept):])
+	mh.msgs = kept
+	heap.Init(mh)
+	return removed
+}
 
-func (mh msgHeap) Len() int {
-	return len(mh)
+func (mh *msgHeap) Len() int {
+	return len(mh.msgs)
 }
 
-func (mh msgHeap) Less(i, j int) bool {
-	return mh[i].Priority < mh[j].Priority
+func (mh *msgHeap) Less(i, j int) bool {
+	if mh.ordering == domain.OrderFIFO {
+		// message ids embed a sortable XID with the time messages were enqueued
+		return mh.msgs[i].Id.XID().Compare(mh.msgs[j].Id.XID()) < 0
+	}
+	return mh.msgs[i].Priority < mh.msgs[j].Priority
 }
 
-func (mh msgHeap) Swap(i, j int) {
-	mh[i], mh[j] = mh[j], mh[i]
+func (mh *msgHeap) Swap(i, j int) {
+	mh.msgs[i], mh.msgs[j] = mh.msgs[j], mh.msgs[i]
 }
 
 func (mh *msgHeap) Push(v any) {
 	item := v.(*domain.Message)
-	*mh = append(*mh, item)
+	mh.msgs = append(mh.msgs, item)
 }
 
 func (mh *msgHeap) Pop() any {
-	old := *mh
+	old := mh.msgs
 	n := len(old)
 	item := old[n-1]
-	*mh = old[:n-1]
+	mh.msgs = old[:n-1]
 	return item
 }
@@ -1,6 +1,7 @@
 package prefetch
 
 import (
+	"slices"
 	"testing"
 	"time"
 
@@ -71,3 +72,103 @@ func TestBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestBufferFIFOTopic(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := NewPriorityBuffer(logger)
+	buf.Orderings = domain.TopicOrderings{"fifo": domain.OrderFIFO}
+	buf.Run()
+	defer buf.Stop()
+
+	// messages enqueued out of priority order
+	priorities := []uint32{30, 10, 20, 0}
+	enqueued := make([]domain.Message, len(priorities))
+	for i, p := range priorities {
+		enqueued[i] = domain.Message{Id: domain.NewUUID(10), Topic: "fifo", Priority: p}
+	}
+	// ingesting in reverse order, delivery order must not depend on the fetch order
+	batch := slices.Clone(enqueued)
+	slices.Reverse(batch)
+
+	respCh := make(chan []PrefetchResponseStatus)
+	buf.C() <- IngestEnvelope{Batch: batch, RespCh: respCh}
+	<-respCh
+
+	reply := <-buf.GetItems(&GetItemsRequest{Namespace: "ns", Topic: "fifo"})
+	if len(reply.Messages) != len(enqueued) {
+		t.Fatalf("expected %d messages, found %d", len(enqueued), len(reply.Messages))
+	}
+	for i, m := range reply.Messages {
+		if m.Id != enqueued[i].Id {
+			t.Fatalf("message %d: expected priority %d in enqueue order, found priority %d",
+				i, enqueued[i].Priority, m.Priority)
+		}
+	}
+}
+
+func TestBufferRoundRobin(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := NewPriorityBuffer(logger)
+	buf.Run()
+	defer buf.Stop()
+
+	topics := []string{"a", "b", "c"}
+	batch := []domain.Message{}
+	for _, topic := range topics {
+		for i := 0; i < 30; i++ {
+			batch = append(batch, domain.Message{Topic: topic, Priority: uint32(i)})
+		}
+	}
+	respCh := make(chan []PrefetchResponseStatus)
+	buf.C() <- IngestEnvelope{Batch: batch, RespCh: respCh}
+	<-respCh
+
+	consumed := map[string]int{}
+	for i := 0; i < 5; i++ {
+		reply := <-buf.GetItems(&GetItemsRequest{Namespace: "ns", Limit: 10})
+		if len(reply.Messages) != 10 {
+			t.Fatalf("expected %d messages, found %d", 10, len(reply.Messages))
+		}
+		for _, m := range reply.Messages {
+			consumed[m.Topic]++
+		}
+
+		for _, topic := range topics {
+			// limits not divisible by the number of topics can
+			// favour a topic by one message per request.
+			if diff := consumed[topic] - (i+1)*10/len(topics); diff < -1 || diff > 1 {
+				t.Fatalf("topic %s drained unevenly: %v", topic, consumed)
+			}
+		}
+	}
+}
+
+func TestBufferStopIsIdempotent(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := NewPriorityBuffer(logger)
+	buf.Run()
+
+	if err := buf.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- buf.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second call to Stop did not return")
+	}
+}
+
+func TestNewPriorityBufferWithSize(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := NewPriorityBufferWithSize(logger, 42)
+
+	if cap(buf.apiReqCh) != 42 || cap(buf.ingestCh) != 42 {
+		t.Fatalf("expected channels of size %d, found %d and %d", 42, cap(buf.apiReqCh), cap(buf.ingestCh))
+	}
+}
@@ -1,38 +1,59 @@
 package queue
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/tracing"
 	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/wait"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 const (
-	dequeueBatchSize             = 100
-	backoffInitialDuration       = 10 * time.Millisecond
-	backoffMaxDuration           = 5 * time.Second
-	topicBackoffMaxDuration      = 5 * time.Second
-	backoffFactor                = 2
-	defaultChanSize              = 300
-	responseCommunicationTimeout = 100 * time.Millisecond
+	// DefaultDequeueBatchSize is the number of messages dequeue workers
+	// fetch on every round when not configured
+	DefaultDequeueBatchSize = 100
+	// DefaultReplyTimeout is the time enqueue workers wait for clients
+	// to receive the reply to their requests.
+	DefaultReplyTimeout = 100 * time.Millisecond
+	// DefaultRouteTimeout is the time the ack/nack router waits for workers
+	// to accept requests when not configured
+	DefaultRouteTimeout = time.Second
+
+	backoffInitialDuration  = 10 * time.Millisecond
+	backoffMaxDuration      = 5 * time.Second
+	topicBackoffMaxDuration = 5 * time.Second
+	backoffFactor           = 2
+	defaultChanSize         = 300
+	enqueueBatchSize        = 50
+	enqueueFlushInterval    = 5 * time.Millisecond
+	shardPingTimeout        = 2 * time.Second
 )
 
 type messageSaver interface {
-	Save(*db.ShardMeta, *domain.Message) error
+	Save(context.Context, *db.ShardMeta, *domain.Message) error
+	SaveBatch(context.Context, *db.ShardMeta, []*domain.Message) error
 }
 type messageAckNacker interface {
-	AckNack(*db.ShardMeta, domain.UUID, bool) error
+	AckNack(context.Context, *db.ShardMeta, domain.UUID, bool, string) error
 }
 type messageSearcherUpdater interface {
-	FindMessagesReadyForDelivery(*db.ShardMeta, bool, []string,
+	FindMessagesReadyForDelivery(context.Context, *db.ShardMeta, bool, []string,
 		int, ...db.OptsFn) ([]domain.Message, error)
 
-	UpdatePrefetchedBatch(*db.ShardMeta, []domain.UUID, bool) (*sql.Tx, error)
+	LeaseBatch(context.Context, *db.ShardMeta, []domain.UUID, string) error
+	UpdatePrefetchedBatch(context.Context, *db.ShardMeta, []domain.UUID, bool, string) (*sql.Tx, error)
 }
 
 type EnqueueResponse struct {
@@ -41,8 +62,16 @@ type EnqueueResponse struct {
 }
 
 type EnqueueRequest struct {
+	// Ctx is the context of the API request that submitted the message.
+	// The message is not stored if the context is done before it is saved.
+	Ctx    context.Context
 	Msg    domain.Message
 	RespCh chan<- EnqueueResponse
+	// SpanCtx is the trace context of the API request that submitted the message
+	SpanCtx trace.SpanContext
+	// ReplyTimeout overrides the time the worker waits for the client to
+	// receive the reply, when positive.
+	ReplyTimeout time.Duration
 }
 
 // NewEnqueueWorker creates a new EnqueueWorker
@@ -52,10 +81,12 @@ func NewEnqueueWorker(shard *db.ShardMeta, buf chan EnqueueRequest, logger *zap.
 		ibuf = make(chan EnqueueRequest, defaultChanSize)
 	}
 	return &EnqueueWorker{
-		logger: logger,
-		shard:  shard,
-		repo:   &db.MessageRepository{},
-		buffer: ibuf,
+		logger:        logger,
+		shard:         shard,
+		repo:          &db.MessageRepository{},
+		buffer:        ibuf,
+		batchSize:     enqueueBatchSize,
+		flushInterval: enqueueFlushInterval,
 	}
 }
 
@@ -67,17 +98,31 @@ func NewEnqueueWorker(shard *db.ShardMeta, buf chan EnqueueRequest, logger *zap.
 // API clients can drop the EnqueueRequest into a single buffer and workers will handle the
 // record creation asynchronously, one at a time.
 // A response is then sent to the caller using the RespCh included in the request.
+//
+// To improve insert throughput, requests received within a short flushInterval are
+// coalesced into a single batch of up to batchSize messages and stored with one statement.
 type EnqueueWorker struct {
+	// ReplyTimeout is the time the worker waits for clients to receive the
+	// reply before giving up on them. Defaults to DefaultReplyTimeout and can
+	// be overridden by every request.
+	ReplyTimeout time.Duration
+
 	logger *zap.Logger
 	shard  *db.ShardMeta
 	repo   messageSaver
 
-	buffer chan EnqueueRequest
+	buffer        chan EnqueueRequest
+	batchSize     int
+	flushInterval time.Duration
 
+	// ctx is cancelled when the worker stops to abort in-flight queries
+	ctx      context.Context
+	cancel   context.CancelFunc
 	shutdown chan chan error
 }
 
 func (w *EnqueueWorker) Run() error {
+	w.ctx, w.cancel = context.WithCancel(context.Background())
 	w.shutdown = make(chan chan error)
 	cleanup := func() {
 		close(w.shutdown)
@@ -85,28 +130,37 @@ func (w *EnqueueWorker) Run() error {
 
 	runLoop := func() {
 		defer cleanup()
+		recoveryBackoff := wait.NewBackoff(backoffInitialDuration, backoffFactor, backoffMaxDuration)
 		for {
+			// while the shard is down, requests are left in the shared buffer
+			// for the workers of healthy shards
+			if !w.shard.Healthy() {
+				select {
+				case respCh := <-w.shutdown:
+					respCh <- nil
+					return
+				case <-recoveryBackoff.After():
+					recoverShard(w.logger, w.shard, recoveryBackoff)
+				}
+				continue
+			}
+
 			select {
 			case respCh := <-w.shutdown:
 				respCh <- nil
 				return
 
 			case enqReq := <-w.buffer:
-				if enqReq.RespCh == nil {
-					// response channel not set. Discarding request
+				batch := w.collectBatch(enqReq)
+				if len(batch) == 0 {
 					continue
 				}
 
-				reply := w.enqueueMessage(&enqReq.Msg)
-
-				timer := time.NewTimer(responseCommunicationTimeout)
-				select {
-				case enqReq.RespCh <- reply:
-					timer.Stop()
-				case <-timer.C:
-					// client probably died and didn't pick up the response. Proceeding.
-					continue
+				replies := w.enqueueBatch(batch)
+				for i, req := range batch {
+					w.reply(req, replies[i])
 				}
+				w.checkShard(replies)
 			}
 		}
 	}
@@ -114,9 +168,170 @@ func (w *EnqueueWorker) Run() error {
 	return nil
 }
 
-func (w *EnqueueWorker) enqueueMessage(msg *domain.Message) EnqueueResponse {
+// collectBatch gathers requests from the buffer until the batch is full or the
+// flush interval has elapsed.
+// Requests without a response channel, or whose context is done, are discarded.
+func (w *EnqueueWorker) collectBatch(first EnqueueRequest) []EnqueueRequest {
+	batch := make([]EnqueueRequest, 0, w.batchSize)
+	if first.RespCh != nil && requestContext(first).Err() == nil {
+		batch = append(batch, first)
+	}
+
+	timer := time.NewTimer(w.flushInterval)
+	defer timer.Stop()
+	for len(batch) < w.batchSize {
+		select {
+		case req := <-w.buffer:
+			if req.RespCh == nil {
+				// response channel not set. Discarding request
+				continue
+			}
+			if requestContext(req).Err() != nil {
+				// client gave up waiting. Discarding request
+				continue
+			}
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// enqueueBatch stores the batch of messages with a single insert and returns one
+// reply for every request.
+// If the batch insert fails, messages are stored one at a time so errors can be
+// reported to the requests that caused them.
+func (w *EnqueueWorker) enqueueBatch(batch []EnqueueRequest) []EnqueueResponse {
+	replies := make([]EnqueueResponse, len(batch))
+
+	links := make([]trace.Link, 0, len(batch))
+	for _, req := range batch {
+		if req.SpanCtx.IsValid() {
+			links = append(links, trace.Link{SpanContext: req.SpanCtx})
+		}
+	}
+	ctx, cancel := w.batchContext(batch)
+	defer cancel()
+	ctx, span := tracing.Tracer().Start(ctx, "enqueue.save",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("batch.size", len(batch))))
+	defer span.End()
+
+	msgs := make([]*domain.Message, len(batch))
+	for i := range batch {
+		msgs[i] = &batch[i].Msg
+	}
+
+	err := w.repo.SaveBatch(ctx, w.shard, msgs)
+	switch {
+	case err == nil:
+		for i, msg := range msgs {
+			replies[i].MsgId = msg.Id
+		}
+	case len(msgs) == 1:
+		replies[0].Err = err
+	default:
+		w.logger.Warn("batch insert failed, falling back to single inserts",
+			zap.Int("size", len(msgs)),
+			zap.Error(err))
+		for i, msg := range msgs {
+			replies[i] = w.enqueueMessage(requestContext(batch[i]), msg)
+		}
+	}
+	return replies
+}
+
+// checkShard marks the shard unhealthy if none of the messages in the batch could
+// be stored. Failures caused by clients giving up, or by the worker stopping, say
+// nothing about the shard connection and are ignored.
+func (w *EnqueueWorker) checkShard(replies []EnqueueResponse) {
+	var err error
+	for _, reply := range replies {
+		if reply.Err == nil || isContextErr(reply.Err) {
+			return
+		}
+		err = reply.Err
+	}
+	if err == nil || w.ctx.Err() != nil {
+		return
+	}
+	w.logger.Error("error storing messages in database",
+		zap.Uint32("shardId", w.shard.Id),
+		zap.Error(err))
+	w.shard.MarkUnhealthy()
+}
+
+// isContextErr returns true if the error was caused by a cancelled or expired context.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// batchContext returns a context for storing the batch that is cancelled once
+// every request in the batch is done, or the worker stops: there is no point in
+// completing the insert when no client is waiting for it.
+func (w *EnqueueWorker) batchContext(batch []EnqueueRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(w.ctx)
+
+	var pending atomic.Int32
+	pending.Store(int32(len(batch)))
+	stops := make([]func() bool, len(batch))
+	for i, req := range batch {
+		stops[i] = context.AfterFunc(requestContext(req), func() {
+			if pending.Add(-1) == 0 {
+				cancel()
+			}
+		})
+	}
+
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
+
+// requestContext returns the context of the enqueue request.
+// Requests without a context are never cancelled.
+func requestContext(req EnqueueRequest) context.Context {
+	if req.Ctx == nil {
+		return context.Background()
+	}
+	return req.Ctx
+}
+
+// replyTimeout returns the time to wait for the client to receive the reply
+func (w *EnqueueWorker) replyTimeout(req EnqueueRequest) time.Duration {
+	switch {
+	case req.ReplyTimeout > 0:
+		return req.ReplyTimeout
+	case w.ReplyTimeout > 0:
+		return w.ReplyTimeout
+	default:
+		return DefaultReplyTimeout
+	}
+}
+
+// reply sends the response to the client that submitted the request.
+func (w *EnqueueWorker) reply(req EnqueueRequest, resp EnqueueResponse) {
+	timer := time.NewTimer(w.replyTimeout(req))
+	defer timer.Stop()
+	select {
+	case req.RespCh <- resp:
+	case <-timer.C:
+		// client probably died and didn't pick up the response. Proceeding.
+	}
+}
+
+func (w *EnqueueWorker) enqueueMessage(ctx context.Context, msg *domain.Message) EnqueueResponse {
 	var reply EnqueueResponse
-	if err := w.repo.Save(w.shard, msg); err != nil {
+	if err := ctx.Err(); err != nil {
+		// client gave up waiting, the message is not stored
+		reply.Err = err
+		return reply
+	}
+	if err := w.repo.Save(ctx, w.shard, msg); err != nil {
 		reply.Err = err
 		return reply
 	}
@@ -125,12 +340,30 @@ func (w *EnqueueWorker) enqueueMessage(msg *domain.Message) EnqueueResponse {
 }
 
 func (w *EnqueueWorker) Stop() error {
+	w.cancel()
 	errCh := make(chan error)
 	w.shutdown <- errCh
 
 	return <-errCh
 }
 
+// recoverShard pings an unhealthy shard to check whether the connection is working
+// again. Workers keep backing off until the shard is reachable.
+func recoverShard(logger *zap.Logger, shard *db.ShardMeta, bo *wait.BackoffStrategy) {
+	ctx, cancel := context.WithTimeout(context.Background(), shardPingTimeout)
+	defer cancel()
+
+	if err := shard.Ping(ctx); err != nil {
+		logger.Warn("shard connection still down",
+			zap.Uint32("shardId", shard.Id),
+			zap.Error(err))
+		bo.Backoff()
+		return
+	}
+	logger.Info("shard connection recovered", zap.Uint32("shardId", shard.Id))
+	bo.Reset()
+}
+
 // NewDequeueWorker creates a new DequeueWorker
 func NewDequeueWorker(shard *db.ShardMeta, buf *prefetch.PriorityBuffer, logger *zap.Logger) *DequeueWorker {
 	return &DequeueWorker{
@@ -151,17 +384,28 @@ func NewDequeueWorker(shard *db.ShardMeta, buf *prefetch.PriorityBuffer, logger
 // If the prefetch buffer is full, it can send a "backoff" response to ask workers to slow
 // down message retrieval from the database for specific topics.
 type DequeueWorker struct {
+	// BatchSize is the maximum number of messages fetched from the database
+	// on every round. Defaults to DefaultDequeueBatchSize.
+	BatchSize int
+	// Orderings configures the delivery order of topics. Messages of FIFO
+	// topics are fetched in enqueue order.
+	Orderings domain.TopicOrderings
+
 	logger *zap.Logger
 	shard  *db.ShardMeta
 	repo   messageSearcherUpdater
 
 	prefetchBuf *prefetch.PriorityBuffer
 
+	// ctx is cancelled when the worker stops to abort in-flight queries
+	ctx           context.Context
+	cancel        context.CancelFunc
 	shutdown      chan chan error
 	topicBackoffs map[string]*wait.BackoffStrategy
 }
 
 func (w *DequeueWorker) Run() error {
+	w.ctx, w.cancel = context.WithCancel(context.Background())
 	w.shutdown = make(chan chan error)
 	cleanup := func() {
 		close(w.shutdown)
@@ -177,8 +421,18 @@ func (w *DequeueWorker) Run() error {
 				respCh <- nil
 				return
 			case <-loopBackoff.After():
+				if !w.shard.Healthy() {
+					recoverShard(w.logger, w.shard, loopBackoff)
+					continue
+				}
 				if err := w.dequeueMessages(loopBackoff); err != nil {
+					if w.ctx.Err() != nil {
+						// query aborted by Stop
+						continue
+					}
 					w.logger.Error("error fetching messages from database", zap.Error(err))
+					w.shard.MarkUnhealthy()
+					loopBackoff.Backoff()
 				}
 			}
 		}
@@ -189,8 +443,9 @@ func (w *DequeueWorker) Run() error {
 
 func (w *DequeueWorker) dequeueMessages(bo *wait.BackoffStrategy) error {
 	exclusions := excludedTopics(w.topicBackoffs)
-	msgs, err := w.repo.FindMessagesReadyForDelivery(w.shard, false,
-		exclusions, prefetch.MaxPrefetchItemCount, db.WithLimit(dequeueBatchSize))
+	msgs, err := w.repo.FindMessagesReadyForDelivery(w.ctx, w.shard, false,
+		exclusions, prefetch.MaxPrefetchItemCount, db.WithLimit(w.batchSize()),
+		db.WithFIFOTopics(w.Orderings.FIFOTopics()))
 	if err != nil {
 		return err
 	}
@@ -201,9 +456,28 @@ func (w *DequeueWorker) dequeueMessages(bo *wait.BackoffStrategy) error {
 	}
 	bo.Reset()
 
-	fetchedIds := w.sendToPrefetchBuffer(msgs)
+	// messages are leased before they're delivered, so that consumers can
+	// ack them as soon as they're dequeued from the buffer
+	lease := xid.New().String()
+	ids := make([]domain.UUID, len(msgs))
+	traceParents := make([]string, len(msgs))
+	for i := range msgs {
+		msgs[i].Lease = lease
+		ids[i] = msgs[i].Id
+		traceParents[i] = msgs[i].TraceParent
+	}
+	if err := w.repo.LeaseBatch(w.ctx, w.shard, ids, lease); err != nil {
+		return err
+	}
 
-	tx, err := w.repo.UpdatePrefetchedBatch(w.shard, fetchedIds, true)
+	_, span := tracing.Tracer().Start(context.Background(), "dequeue.prefetch",
+		trace.WithLinks(tracing.LinksFromTraceParents(traceParents...)...),
+		trace.WithAttributes(attribute.Int("batch.size", len(msgs))))
+	defer span.End()
+
+	fetchedIds := w.sendToPrefetchBuffer(span.SpanContext(), msgs)
+
+	tx, err := w.repo.UpdatePrefetchedBatch(w.ctx, w.shard, fetchedIds, true, lease)
 	if err != nil {
 		return err
 	}
@@ -212,11 +486,18 @@ func (w *DequeueWorker) dequeueMessages(bo *wait.BackoffStrategy) error {
 	return nil
 }
 
-func (w *DequeueWorker) sendToPrefetchBuffer(items []domain.Message) []domain.UUID {
+func (w *DequeueWorker) batchSize() int {
+	if w.BatchSize <= 0 {
+		return DefaultDequeueBatchSize
+	}
+	return w.BatchSize
+}
+
+func (w *DequeueWorker) sendToPrefetchBuffer(sc trace.SpanContext, items []domain.Message) []domain.UUID {
 	replyCh := make(chan []prefetch.PrefetchResponseStatus)
 	defer close(replyCh)
 
-	envelope := prefetch.IngestEnvelope{Batch: items, RespCh: replyCh}
+	envelope := prefetch.IngestEnvelope{Batch: items, RespCh: replyCh, SpanCtx: sc}
 	w.prefetchBuf.C() <- envelope
 
 	reply := <-replyCh
@@ -256,6 +537,7 @@ func excludedTopics(backoffs map[string]*wait.BackoffStrategy) []string {
 }
 
 func (w *DequeueWorker) Stop() error {
+	w.cancel()
 	errCh := make(chan error)
 	w.shutdown <- errCh
 
@@ -265,6 +547,11 @@ func (w *DequeueWorker) Stop() error {
 type AckNackRequest struct {
 	Id  domain.UUID
 	Ack bool
+	// Lease of the delivery being acknowledged. Requests with the lease of a
+	// previous delivery are ignored. The lease is not checked when empty.
+	Lease string
+	// SpanCtx is the trace context of the API request that acknowledged the message
+	SpanCtx trace.SpanContext
 }
 
 // NewAckNackWorker creates a new AckNackWorker
@@ -292,10 +579,14 @@ type AckNackWorker struct {
 
 	buffer chan AckNackRequest
 
+	// ctx is cancelled when the worker stops to abort in-flight queries
+	ctx      context.Context
+	cancel   context.CancelFunc
 	shutdown chan chan error
 }
 
 func (w *AckNackWorker) Run() error {
+	w.ctx, w.cancel = context.WithCancel(context.Background())
 	w.shutdown = make(chan chan error)
 	cleanup := func() {
 		close(w.shutdown)
@@ -303,19 +594,28 @@ func (w *AckNackWorker) Run() error {
 
 	runLoop := func() {
 		defer cleanup()
+		recoveryBackoff := wait.NewBackoff(backoffInitialDuration, backoffFactor, backoffMaxDuration)
 		for {
+			// while the shard is down, requests wait in the buffer until
+			// the connection is recovered
+			if !w.shard.Healthy() {
+				select {
+				case respCh := <-w.shutdown:
+					respCh <- nil
+					return
+				case <-recoveryBackoff.After():
+					recoverShard(w.logger, w.shard, recoveryBackoff)
+				}
+				continue
+			}
+
 			select {
 			case respCh := <-w.shutdown:
 				respCh <- nil
 				return
 
 			case ackNack := <-w.buffer:
-				if err := w.repo.AckNack(w.shard, ackNack.Id, ackNack.Ack); err != nil {
-					w.logger.Error("error ack/nack message",
-						zap.String("id", ackNack.Id.String()),
-						zap.Bool("ack", ackNack.Ack),
-						zap.Error(err))
-				}
+				w.ackNack(ackNack)
 			}
 		}
 	}
@@ -323,7 +623,37 @@ func (w *AckNackWorker) Run() error {
 	return nil
 }
 
+func (w *AckNackWorker) ackNack(req AckNackRequest) {
+	ctx := trace.ContextWithRemoteSpanContext(w.ctx, req.SpanCtx)
+	ctx, span := tracing.Tracer().Start(ctx, "acknack.update",
+		trace.WithAttributes(attribute.Bool("ack", req.Ack)))
+	defer span.End()
+
+	err := w.repo.AckNack(ctx, w.shard, req.Id, req.Ack, req.Lease)
+	if errors.Is(err, db.ErrStaleLease) {
+		// retried or late request for a message delivered again since
+		span.AddEvent("stale lease")
+		w.logger.Debug("ignoring ack/nack with stale lease",
+			zap.String("id", req.Id.String()),
+			zap.Bool("ack", req.Ack))
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		if w.ctx.Err() != nil {
+			// query aborted by Stop
+			return
+		}
+		w.logger.Error("error ack/nack message",
+			zap.String("id", req.Id.String()),
+			zap.Bool("ack", req.Ack),
+			zap.Error(err))
+		w.shard.MarkUnhealthy()
+	}
+}
+
 func (w *AckNackWorker) Stop() error {
+	w.cancel()
 	errCh := make(chan error)
 	w.shutdown <- errCh
 
@@ -334,24 +664,111 @@ func (w *AckNackWorker) Stop() error {
 // that can update correct database shard where the message is stored.
 // To handle the routing smoothly, we use UUID keys for messages that include shard identification
 // so we can route request with a simple map lookup.
+// Messages of shards migrated to another shard keep their ids: their requests are
+// redirected to the workers of the destination shard.
+//
+// Routing fails with ErrRouteTimeout when the workers of the shard don't accept the
+// request in time, like when they were stopped or their shard is down and their
+// buffer is full, so that API handlers never hang on them.
 type AckNackRouter struct {
-	routes map[uint32]chan<- AckNackRequest
+	// Timeout is the time to wait for workers to accept a request.
+	// Defaults to DefaultRouteTimeout.
+	Timeout time.Duration
+
+	mu        sync.RWMutex
+	routes    map[uint32]chan<- AckNackRequest
+	redirects map[uint32]uint32
 }
 
 // RegisterWorker registers a new worker into the router.
+// Several workers can be registered for the same shard to process requests
+// concurrently, as long as they consume the same buffer.
 func (r *AckNackRouter) RegisterWorker(shardId uint32, w *AckNackWorker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.routes == nil {
 		r.routes = map[uint32]chan<- AckNackRequest{}
 	}
+	if route, ok := r.routes[shardId]; ok && route != w.buffer {
+		panic(fmt.Sprintf("ack/nack workers of shard %d must share the same buffer", shardId))
+	}
 	r.routes[shardId] = w.buffer
 }
 
+// Redirect the requests for messages with ids of the source shard to the workers of
+// the destination shard. Redirects take precedence over the workers registered for
+// the source shard and can be chained, as long as they don't form a cycle.
+func (r *AckNackRouter) Redirect(source, destination uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkRedirect(source, destination); err != nil {
+		return err
+	}
+	if r.redirects == nil {
+		r.redirects = map[uint32]uint32{}
+	}
+	r.redirects[source] = destination
+	return nil
+}
+
+// CheckRedirect returns an error if the source shard can't be redirected to the
+// destination shard.
+func (r *AckNackRouter) CheckRedirect(source, destination uint32) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkRedirect(source, destination)
+}
+
+// checkRedirect is CheckRedirect for callers already holding the lock.
+func (r *AckNackRouter) checkRedirect(source, destination uint32) error {
+	if r.resolve(destination) == source {
+		return fmt.Errorf("redirecting shard %d to %d would create a cycle", source, destination)
+	}
+	return nil
+}
+
+// resolve follows the redirects of the shard and returns the shard storing its
+// messages. Callers must hold the lock.
+func (r *AckNackRouter) resolve(shardId uint32) uint32 {
+	for {
+		to, ok := r.redirects[shardId]
+		if !ok {
+			return shardId
+		}
+		shardId = to
+	}
+}
+
 // Route an incoming ack/nack request to the correct worker buffer for processing.
 func (r *AckNackRouter) Route(uid *domain.UUID, req AckNackRequest) error {
-	wChan, ok := r.routes[uid.ShardId()]
+	r.mu.RLock()
+	wChan, ok := r.routes[r.resolve(uid.ShardId())]
+	r.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("could not route for uid %s", uid.String())
 	}
-	wChan <- req
-	return nil
+
+	select {
+	case wChan <- req:
+		return nil
+	default:
+	}
+	// the buffer is full: wait for the workers to catch up
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRouteTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case wChan <- req:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w for uid %s", ErrRouteTimeout, uid.String())
+	}
 }
+
+// ErrRouteTimeout is returned when the workers of a shard don't accept ack/nack requests in time.
+var ErrRouteTimeout = errors.New("timeout waiting for ack/nack workers")
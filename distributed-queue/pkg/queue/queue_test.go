@@ -0,0 +1,642 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+type fakeSaver struct {
+	mu         sync.Mutex
+	batchSizes []int
+	failTopic  string
+}
+
+func (f *fakeSaver) Save(_ context.Context, shard *db.ShardMeta, item *domain.Message) error {
+	if item.Topic == f.failTopic {
+		return errors.New("save failed")
+	}
+	item.Id = domain.NewUUID(10)
+	return nil
+}
+
+func (f *fakeSaver) SaveBatch(_ context.Context, shard *db.ShardMeta, items []*domain.Message) error {
+	f.mu.Lock()
+	f.batchSizes = append(f.batchSizes, len(items))
+	f.mu.Unlock()
+
+	for _, item := range items {
+		if item.Topic == f.failTopic {
+			return errors.New("batch failed")
+		}
+	}
+	for _, item := range items {
+		item.Id = domain.NewUUID(10)
+	}
+	return nil
+}
+
+func (f *fakeSaver) batches() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.batchSizes...)
+}
+
+func newTestEnqueueWorker(t *testing.T, repo messageSaver, reqs []EnqueueRequest) *EnqueueWorker {
+	t.Helper()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := make(chan EnqueueRequest, len(reqs))
+	for _, req := range reqs {
+		buf <- req
+	}
+
+	w := NewEnqueueWorker(db.NewShardMeta(10, nil, true), buf, logger)
+	w.repo = repo
+	w.flushInterval = 50 * time.Millisecond
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Stop() })
+	return w
+}
+
+func TestEnqueueWorkerBatchesInserts(t *testing.T) {
+	const numRequests = 10
+
+	respCh := make(chan EnqueueResponse, numRequests)
+	reqs := make([]EnqueueRequest, numRequests)
+	for i := range reqs {
+		reqs[i] = EnqueueRequest{Msg: domain.Message{Topic: "test"}, RespCh: respCh}
+	}
+
+	repo := &fakeSaver{}
+	newTestEnqueueWorker(t, repo, reqs)
+
+	seen := map[domain.UUID]bool{}
+	for i := 0; i < numRequests; i++ {
+		select {
+		case resp := <-respCh:
+			if resp.Err != nil {
+				t.Fatalf("unexpected enqueue error: %v", resp.Err)
+			}
+			seen[resp.MsgId] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for enqueue response %d", i)
+		}
+	}
+	if len(seen) != numRequests {
+		t.Fatalf("distinct message ids mismatch: expected %d, found %d", numRequests, len(seen))
+	}
+
+	batches := repo.batches()
+	if len(batches) != 1 || batches[0] != numRequests {
+		t.Fatalf("expected a single batch of %d messages, found %v", numRequests, batches)
+	}
+}
+
+func TestEnqueueWorkerReplyTimeout(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := make(chan EnqueueRequest, 1)
+	w := NewEnqueueWorker(db.NewShardMeta(10, nil, true), buf, logger)
+	w.repo = &fakeSaver{}
+	w.flushInterval = time.Millisecond
+	w.ReplyTimeout = 10 * time.Millisecond
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// slowReceive waits before picking up the reply, like a busy client
+	slowReceive := func(respCh chan EnqueueResponse) bool {
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-respCh:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	respCh := make(chan EnqueueResponse)
+	buf <- EnqueueRequest{Msg: domain.Message{Topic: "test"}, RespCh: respCh, ReplyTimeout: time.Second}
+	if !slowReceive(respCh) {
+		t.Fatal("reply should be delivered within the request reply timeout")
+	}
+
+	respCh = make(chan EnqueueResponse)
+	buf <- EnqueueRequest{Msg: domain.Message{Topic: "test"}, RespCh: respCh}
+	if slowReceive(respCh) {
+		t.Fatal("reply should be abandoned after the worker reply timeout")
+	}
+}
+
+func TestEnqueueWorkerBatchPartialFailure(t *testing.T) {
+	okCh := make(chan EnqueueResponse, 2)
+	failCh := make(chan EnqueueResponse, 1)
+	reqs := []EnqueueRequest{
+		{Msg: domain.Message{Topic: "ok"}, RespCh: okCh},
+		{Msg: domain.Message{Topic: "bad"}, RespCh: failCh},
+		{Msg: domain.Message{Topic: "ok"}, RespCh: okCh},
+	}
+
+	newTestEnqueueWorker(t, &fakeSaver{failTopic: "bad"}, reqs)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-okCh:
+			if resp.Err != nil {
+				t.Fatalf("unexpected enqueue error: %v", resp.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for enqueue response")
+		}
+	}
+	select {
+	case resp := <-failCh:
+		if resp.Err == nil {
+			t.Fatal("expected enqueue error for failing message, found nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for enqueue response")
+	}
+}
+
+// blockingSaver blocks every insert until its context is cancelled.
+type blockingSaver struct {
+	started   chan struct{}
+	cancelled chan error
+}
+
+func (f *blockingSaver) Save(ctx context.Context, shard *db.ShardMeta, item *domain.Message) error {
+	return f.SaveBatch(ctx, shard, []*domain.Message{item})
+}
+
+func (f *blockingSaver) SaveBatch(ctx context.Context, shard *db.ShardMeta, items []*domain.Message) error {
+	select {
+	case f.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	select {
+	case f.cancelled <- ctx.Err():
+	default:
+	}
+	return ctx.Err()
+}
+
+func TestEnqueueWorkerCancelsInsertWithRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	respCh := make(chan EnqueueResponse, 2)
+	reqs := []EnqueueRequest{
+		{Ctx: ctx, Msg: domain.Message{Topic: "test"}, RespCh: respCh},
+		{Ctx: ctx, Msg: domain.Message{Topic: "test"}, RespCh: respCh},
+	}
+
+	repo := &blockingSaver{started: make(chan struct{}, 1), cancelled: make(chan error, 1)}
+	newTestEnqueueWorker(t, repo, reqs)
+
+	select {
+	case <-repo.started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for batch insert")
+	}
+	cancel()
+
+	select {
+	case err := <-repo.cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, found %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch insert was not cancelled with the requests")
+	}
+}
+
+// fakeConnector is a database/sql connector whose connections fail to ping
+// while down is set. Transactions always commit successfully.
+type fakeConnector struct {
+	down atomic.Bool
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) { return &fakeConn{c}, nil }
+func (c *fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ connector *fakeConnector }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return fakeTx{}, nil }
+func (c *fakeConn) Ping(context.Context) error {
+	if c.connector.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+// fakeSearcher returns a single message for every search while the database
+// connection is up.
+type fakeSearcher struct {
+	connector *fakeConnector
+}
+
+func (f *fakeSearcher) FindMessagesReadyForDelivery(_ context.Context, shard *db.ShardMeta, prefetched bool,
+	excluded []string, maxRowsByTopic int, fns ...db.OptsFn) ([]domain.Message, error) {
+	if f.connector.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return []domain.Message{{Id: domain.NewUUID(10), Topic: "test"}}, nil
+}
+
+func (f *fakeSearcher) LeaseBatch(context.Context, *db.ShardMeta, []domain.UUID, string) error {
+	return nil
+}
+
+func (f *fakeSearcher) UpdatePrefetchedBatch(_ context.Context, shard *db.ShardMeta, ids []domain.UUID, v bool, lease string) (*sql.Tx, error) {
+	return shard.Conn().Begin()
+}
+
+func TestDequeueWorkerRecoversShardConnection(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	connector := &fakeConnector{}
+	connector.down.Store(true)
+	conn := sql.OpenDB(connector)
+	defer conn.Close()
+	shard := db.NewShardMeta(10, conn, true)
+
+	buf := prefetch.NewPriorityBuffer(logger)
+	buf.Run()
+	defer buf.Stop()
+
+	w := NewDequeueWorker(shard, buf, logger)
+	w.repo = &fakeSearcher{connector: connector}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	prefetched := func() int {
+		reply := <-buf.Peek(&prefetch.GetItemsRequest{Topic: "test"})
+		return len(reply.Messages)
+	}
+
+	// while the connection is down the worker can't fetch messages
+	time.Sleep(100 * time.Millisecond)
+	if n := prefetched(); n != 0 {
+		t.Fatalf("unexpected %d prefetched messages while shard is down", n)
+	}
+	if shard.Healthy() {
+		t.Fatal("shard should be reported unhealthy while down")
+	}
+
+	connector.down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for prefetched() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not resume after shard recovery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !shard.Healthy() {
+		t.Fatal("shard should be reported healthy after recovery")
+	}
+}
+
+// fakeDownSaver fails every insert while the database connection is down.
+type fakeDownSaver struct {
+	connector *fakeConnector
+}
+
+func (f *fakeDownSaver) Save(ctx context.Context, shard *db.ShardMeta, item *domain.Message) error {
+	return f.SaveBatch(ctx, shard, []*domain.Message{item})
+}
+
+func (f *fakeDownSaver) SaveBatch(_ context.Context, shard *db.ShardMeta, items []*domain.Message) error {
+	if f.connector.down.Load() {
+		return errors.New("connection refused")
+	}
+	for _, item := range items {
+		item.Id = domain.NewUUID(shard.Id)
+	}
+	return nil
+}
+
+// newDownShard returns a shard whose connection is down until the connector is brought up.
+func newDownShard(t *testing.T) (*db.ShardMeta, *fakeConnector) {
+	t.Helper()
+	connector := &fakeConnector{}
+	connector.down.Store(true)
+	conn := sql.OpenDB(connector)
+	t.Cleanup(func() { conn.Close() })
+	return db.NewShardMeta(10, conn, true), connector
+}
+
+func TestEnqueueWorkerRecoversShardConnection(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	shard, connector := newDownShard(t)
+
+	buf := make(chan EnqueueRequest, 1)
+	w := NewEnqueueWorker(shard, buf, logger)
+	w.repo = &fakeDownSaver{connector: connector}
+	w.flushInterval = 10 * time.Millisecond
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	respCh := make(chan EnqueueResponse, 1)
+	buf <- EnqueueRequest{Msg: domain.Message{Topic: "test"}, RespCh: respCh}
+	select {
+	case resp := <-respCh:
+		if resp.Err == nil {
+			t.Fatal("expected enqueue error while shard is down, found nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for enqueue response")
+	}
+	if shard.Healthy() {
+		t.Fatal("shard should be reported unhealthy while down")
+	}
+
+	// requests are left in the buffer for other workers while the shard is down
+	buf <- EnqueueRequest{Msg: domain.Message{Topic: "test"}, RespCh: respCh}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(buf); n != 1 {
+		t.Fatalf("expected %d buffered requests while shard is down, found %d", 1, n)
+	}
+
+	connector.down.Store(false)
+	select {
+	case resp := <-respCh:
+		if resp.Err != nil {
+			t.Fatalf("unexpected enqueue error after recovery: %v", resp.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not resume after shard recovery")
+	}
+	if !shard.Healthy() {
+		t.Fatal("shard should be reported healthy after recovery")
+	}
+}
+
+// fakeAckNacker fails every update while the database connection is down.
+type fakeAckNacker struct {
+	connector *fakeConnector
+	acked     chan domain.UUID
+}
+
+func (f *fakeAckNacker) AckNack(_ context.Context, _ *db.ShardMeta, uid domain.UUID, _ bool, _ string) error {
+	if f.connector.down.Load() {
+		return errors.New("connection refused")
+	}
+	f.acked <- uid
+	return nil
+}
+
+func TestAckNackWorkerRecoversShardConnection(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	shard, connector := newDownShard(t)
+
+	buf := make(chan AckNackRequest, 1)
+	repo := &fakeAckNacker{connector: connector, acked: make(chan domain.UUID, 1)}
+	w := NewAckNackWorker(shard, buf, logger)
+	w.repo = repo
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	buf <- AckNackRequest{Id: domain.NewUUID(10), Ack: true}
+	deadline := time.Now().Add(time.Second)
+	for shard.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("shard should be reported unhealthy while down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// requests wait in the buffer while the shard is down
+	id := domain.NewUUID(10)
+	buf <- AckNackRequest{Id: id, Ack: true}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(buf); n != 1 {
+		t.Fatalf("expected %d buffered requests while shard is down, found %d", 1, n)
+	}
+
+	connector.down.Store(false)
+	select {
+	case acked := <-repo.acked:
+		if acked != id {
+			t.Fatalf("expected ack for message %s, found %s", id.String(), acked.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not resume after shard recovery")
+	}
+	if !shard.Healthy() {
+		t.Fatal("shard should be reported healthy after recovery")
+	}
+}
+
+// blockingAckNacker holds every update until the expected number of updates
+// are in flight at the same time.
+type blockingAckNacker struct {
+	mu       sync.Mutex
+	inFlight int
+	expected int
+	release  chan struct{}
+}
+
+func (f *blockingAckNacker) AckNack(ctx context.Context, _ *db.ShardMeta, _ domain.UUID, _ bool, _ string) error {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight == f.expected {
+		close(f.release)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-f.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestAckNackWorkersProcessConcurrently(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	shard := db.NewShardMeta(10, nil, true)
+	repo := &blockingAckNacker{expected: 3, release: make(chan struct{})}
+
+	buf := make(chan AckNackRequest, 3)
+	router := &AckNackRouter{}
+	for i := 0; i < 3; i++ {
+		w := NewAckNackWorker(shard, buf, logger)
+		w.repo = repo
+		if err := w.Run(); err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		router.RegisterWorker(shard.Id, w)
+	}
+
+	for i := 0; i < 3; i++ {
+		uid := domain.NewUUID(shard.Id)
+		if err := router.Route(&uid, AckNackRequest{Id: uid, Ack: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-repo.release:
+	case <-time.After(5 * time.Second):
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		t.Fatalf("expected %d concurrent acks, found %d", 3, repo.inFlight)
+	}
+}
+
+func TestRegisterWorkersWithDifferentBuffers(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	shard := db.NewShardMeta(10, nil, true)
+	router := &AckNackRouter{}
+	router.RegisterWorker(shard.Id, NewAckNackWorker(shard, nil, logger))
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic registering a worker with a different buffer")
+		}
+	}()
+	router.RegisterWorker(shard.Id, NewAckNackWorker(shard, nil, logger))
+}
+
+func TestRouteToStoppedWorkerTimesOut(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	shard := db.NewShardMeta(10, nil, true)
+
+	// the worker buffer has room for a single request
+	w := NewAckNackWorker(shard, make(chan AckNackRequest, 1), logger)
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	router := &AckNackRouter{Timeout: 50 * time.Millisecond}
+	router.RegisterWorker(shard.Id, w)
+
+	uid := domain.NewUUID(shard.Id)
+	if err := router.Route(&uid, AckNackRequest{Id: uid, Ack: true}); err != nil {
+		t.Fatalf("expected request to be buffered, found %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- router.Route(&uid, AckNackRequest{Id: uid, Ack: true}) }()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrRouteTimeout) {
+			t.Fatalf("expected error %v, found %v", ErrRouteTimeout, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("routing to a stopped worker did not time out")
+	}
+}
+
+func TestAckNackIgnoresStaleLease(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	shard := newFakeShard(t, 10)
+	store := &fakeShards{msgs: map[uint32]map[domain.UUID]*fakeRow{}}
+	id := domain.NewUUID(shard.Id)
+	store.add(shard.Id, id, false)
+
+	buf := prefetch.NewPriorityBuffer(logger)
+	buf.Run()
+	defer buf.Stop()
+	dequeueW := NewDequeueWorker(shard, buf, logger)
+	dequeueW.repo = store
+	if err := dequeueW.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer dequeueW.Stop()
+
+	router := &AckNackRouter{}
+	ackNackW := NewAckNackWorker(shard, nil, logger)
+	ackNackW.repo = store
+	if err := ackNackW.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ackNackW.Stop()
+	router.RegisterWorker(shard.Id, ackNackW)
+
+	deadline := time.Now().Add(5 * time.Second)
+	dequeue := func() domain.Message {
+		t.Helper()
+		for time.Now().Before(deadline) {
+			reply := <-buf.GetItems(&prefetch.GetItemsRequest{Topic: "test", Limit: 1})
+			if len(reply.Messages) > 0 {
+				return reply.Messages[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("message was not delivered")
+		return domain.Message{}
+	}
+	route := func(msg domain.Message, ack bool) {
+		t.Helper()
+		if err := router.Route(&msg.Id, AckNackRequest{Id: msg.Id, Ack: ack, Lease: msg.Lease}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first consumer nacks the message, which is delivered to another consumer
+	stale := dequeue()
+	if len(stale.Lease) == 0 {
+		t.Fatal("dequeued message has no lease")
+	}
+	route(stale, false)
+	current := dequeue()
+	if current.Id != id || current.Lease == stale.Lease {
+		t.Fatalf("expected message %s delivered with a new lease, found %s with lease %q",
+			id.String(), current.Id.String(), current.Lease)
+	}
+
+	// retried requests of the first consumer are ignored
+	route(stale, true)
+	route(stale, false)
+	for store.staleCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d stale requests, found %d", 2, store.staleCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	row, ok := store.row(shard.Id, id)
+	if !ok || !row.prefetched || row.lease != current.Lease {
+		t.Fatalf("expected message leased to the current consumer, found %+v (exists: %t)", row, ok)
+	}
+	if !shard.Healthy() {
+		t.Fatal("stale requests should not mark the shard unhealthy")
+	}
+
+	route(current, true)
+	for store.count(shard.Id) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected message acked by the current consumer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
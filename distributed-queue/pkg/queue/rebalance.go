@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"go.uber.org/zap"
+)
+
+// DefaultMigrationBatchSize is the number of messages moved on every round
+// of a shard migration when not configured
+const DefaultMigrationBatchSize = 500
+
+type messageMigrator interface {
+	MigrateBatch(context.Context, *db.ShardMeta, *db.ShardMeta, int) (int64, error)
+}
+type redirectSaver interface {
+	Save(context.Context, *db.ShardMeta, uint32, uint32) error
+}
+
+// NewShardMigrator creates a new ShardMigrator redirecting the ack/nack
+// requests of migrated shards with the router. Redirects are stored in the
+// main shard, so that they're restored when the application starts.
+func NewShardMigrator(mainShard *db.ShardMeta, router *AckNackRouter, logger *zap.Logger) *ShardMigrator {
+	return &ShardMigrator{
+		logger:    logger,
+		mainShard: mainShard,
+		router:    router,
+		repo:      &db.MessageRepository{},
+		redirects: &db.ShardRedirectRepository{},
+	}
+}
+
+// ShardMigrator moves the messages stored in a shard to another shard, for example
+// before removing the shard from the cluster.
+//
+// Message ids embed the id of the shard they were created in, and clients keep using
+// them to ack or nack messages after the migration. For this reason, migrated messages
+// keep their ids and the ack/nack requests of the source shard are redirected to the
+// destination shard.
+//
+// The redirect is installed before messages are moved, so that moved messages can be
+// acked as soon as they're delivered from the destination shard. Acks for messages
+// delivered from the source shard while the migration is running can be lost: these
+// messages are delivered again from the destination shard.
+//
+// Other application instances load the stored redirects when they start: they
+// should be restarted after a migration to route the ack/nack requests of the
+// migrated shard.
+type ShardMigrator struct {
+	// BatchSize is the number of messages moved on every round.
+	// Defaults to DefaultMigrationBatchSize.
+	BatchSize int
+
+	logger    *zap.Logger
+	mainShard *db.ShardMeta
+	router    *AckNackRouter
+	repo      messageMigrator
+	redirects redirectSaver
+}
+
+// Migrate moves all messages from the src shard to the dst shard and returns the
+// number of messages moved. Messages enqueued to src while it's migrated are moved
+// as long as they're stored before the last batch.
+//
+// Migrations that fail can be run again to move the remaining messages.
+func (m *ShardMigrator) Migrate(ctx context.Context, src, dst *db.ShardMeta) (int64, error) {
+	if src.Id == dst.Id {
+		return 0, fmt.Errorf("can't migrate shard %d to itself", src.Id)
+	}
+	if err := m.router.CheckRedirect(src.Id, dst.Id); err != nil {
+		return 0, err
+	}
+	if err := m.redirects.Save(ctx, m.mainShard, src.Id, dst.Id); err != nil {
+		return 0, fmt.Errorf("saving redirect of shard %d: %w", src.Id, err)
+	}
+	if err := m.router.Redirect(src.Id, dst.Id); err != nil {
+		return 0, err
+	}
+
+	batchSize := m.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+
+	var moved int64
+	for {
+		n, err := m.repo.MigrateBatch(ctx, src, dst, batchSize)
+		moved += n
+		if err != nil {
+			return moved, fmt.Errorf("migrating shard %d to %d: %w", src.Id, dst.Id, err)
+		}
+		if n < int64(batchSize) {
+			break
+		}
+	}
+
+	m.logger.Info("shard migrated",
+		zap.Uint32("source", src.Id),
+		zap.Uint32("destination", dst.Id),
+		zap.Int64("moved", moved))
+	return moved, nil
+}
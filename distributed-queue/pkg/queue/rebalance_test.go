@@ -0,0 +1,253 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeShards stores the messages of every shard in memory, keyed by shard id,
+// with their prefetched flag and lease.
+type fakeShards struct {
+	mu   sync.Mutex
+	msgs map[uint32]map[domain.UUID]*fakeRow
+	// stale counts the acks and nacks rejected for their lease
+	stale int
+}
+
+type fakeRow struct {
+	prefetched bool
+	lease      string
+}
+
+func (f *fakeShards) add(shardId uint32, id domain.UUID, prefetched bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.msgs[shardId] == nil {
+		f.msgs[shardId] = map[domain.UUID]*fakeRow{}
+	}
+	f.msgs[shardId][id] = &fakeRow{prefetched: prefetched}
+}
+
+func (f *fakeShards) count(shardId uint32) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.msgs[shardId])
+}
+
+func (f *fakeShards) row(shardId uint32, id domain.UUID) (fakeRow, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.msgs[shardId][id]
+	if !ok {
+		return fakeRow{}, false
+	}
+	return *row, true
+}
+
+func (f *fakeShards) staleCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stale
+}
+
+func (f *fakeShards) MigrateBatch(_ context.Context, src, dst *db.ShardMeta, limit int) (int64, error) {
+	f.mu.Lock()
+	ids := make([]domain.UUID, 0, len(f.msgs[src.Id]))
+	for id := range f.msgs[src.Id] {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+
+	slices.SortFunc(ids, func(a, b domain.UUID) int { return a.XID().Compare(b.XID()) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	for _, id := range ids {
+		f.add(dst.Id, id, false)
+		f.mu.Lock()
+		delete(f.msgs[src.Id], id)
+		f.mu.Unlock()
+	}
+	return int64(len(ids)), nil
+}
+
+func (f *fakeShards) FindMessagesReadyForDelivery(_ context.Context, shard *db.ShardMeta, prefetched bool,
+	excluded []string, maxRowsByTopic int, fns ...db.OptsFn) ([]domain.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msgs := []domain.Message{}
+	for id, row := range f.msgs[shard.Id] {
+		if row.prefetched == prefetched {
+			msgs = append(msgs, domain.Message{Id: id, Topic: "test"})
+		}
+	}
+	return msgs, nil
+}
+
+func (f *fakeShards) LeaseBatch(_ context.Context, shard *db.ShardMeta, ids []domain.UUID, lease string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range ids {
+		if row, ok := f.msgs[shard.Id][id]; ok {
+			row.lease = lease
+		}
+	}
+	return nil
+}
+
+func (f *fakeShards) UpdatePrefetchedBatch(_ context.Context, shard *db.ShardMeta, ids []domain.UUID, v bool, lease string) (*sql.Tx, error) {
+	f.mu.Lock()
+	for _, id := range ids {
+		if row, ok := f.msgs[shard.Id][id]; ok && row.lease == lease {
+			row.prefetched = v
+		}
+	}
+	f.mu.Unlock()
+	return shard.Conn().Begin()
+}
+
+func (f *fakeShards) AckNack(_ context.Context, shard *db.ShardMeta, uid domain.UUID, ack bool, lease string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.msgs[shard.Id][uid]
+	if !ok || (len(lease) > 0 && row.lease != lease) {
+		if len(lease) > 0 {
+			f.stale++
+			return db.ErrStaleLease
+		}
+		return nil
+	}
+	if ack {
+		delete(f.msgs[shard.Id], uid)
+	} else {
+		row.prefetched, row.lease = false, ""
+	}
+	return nil
+}
+
+// fakeRedirects records the stored shard redirects
+type fakeRedirects map[uint32]uint32
+
+func (f fakeRedirects) Save(_ context.Context, _ *db.ShardMeta, source, destination uint32) error {
+	f[source] = destination
+	return nil
+}
+
+// newFakeShard returns a shard with a fake connection that is always up
+func newFakeShard(t *testing.T, id uint32) *db.ShardMeta {
+	t.Helper()
+	conn := sql.OpenDB(&fakeConnector{})
+	t.Cleanup(func() { conn.Close() })
+	return db.NewShardMeta(id, conn, false)
+}
+
+func TestShardMigrationKeepsMessagesDeliverable(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	src, dst := newFakeShard(t, 10), newFakeShard(t, 20)
+	store := &fakeShards{msgs: map[uint32]map[domain.UUID]*fakeRow{}}
+
+	var ids []domain.UUID
+	for i := 0; i < 5; i++ {
+		id := domain.NewUUID(src.Id)
+		ids = append(ids, id)
+		// the first message was delivered before the migration and never acked
+		store.add(src.Id, id, i == 0)
+	}
+
+	router := &AckNackRouter{}
+	for _, shard := range []*db.ShardMeta{src, dst} {
+		w := NewAckNackWorker(shard, nil, logger)
+		w.repo = store
+		if err := w.Run(); err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		router.RegisterWorker(shard.Id, w)
+	}
+
+	redirects := fakeRedirects{}
+	migrator := NewShardMigrator(nil, router, logger)
+	migrator.BatchSize = 2
+	migrator.repo = store
+	migrator.redirects = redirects
+	moved, err := migrator.Migrate(context.Background(), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 5 {
+		t.Fatalf("expected %d messages moved, found %d", 5, moved)
+	}
+	if n := store.count(src.Id); n != 0 {
+		t.Fatalf("expected source shard to be empty, found %d messages", n)
+	}
+	if redirects[src.Id] != dst.Id {
+		t.Fatalf("expected stored redirect from shard %d to %d, found %v", src.Id, dst.Id, redirects)
+	}
+
+	buf := prefetch.NewPriorityBuffer(logger)
+	buf.Run()
+	defer buf.Stop()
+	w := NewDequeueWorker(dst, buf, logger)
+	w.repo = store
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// all messages are delivered from the destination, including the one in-flight
+	var delivered []domain.UUID
+	deadline := time.Now().Add(5 * time.Second)
+	for len(delivered) < len(ids) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages delivered from the destination shard, found %d", len(ids), len(delivered))
+		}
+		reply := <-buf.GetItems(&prefetch.GetItemsRequest{Topic: "test", Limit: 10})
+		for _, msg := range reply.Messages {
+			delivered = append(delivered, msg.Id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// messages keep the ids of the source shard and are acked in the destination
+	for _, id := range delivered {
+		if id.ShardId() != src.Id {
+			t.Fatalf("expected message id of shard %d, found %s", src.Id, id.String())
+		}
+		if err := router.Route(&id, AckNackRequest{Id: id, Ack: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for store.count(dst.Id) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected migrated messages to be acked, %d left", store.count(dst.Id))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedirectRejectsCycles(t *testing.T) {
+	router := &AckNackRouter{}
+	if err := router.Redirect(10, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Redirect(20, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Redirect(30, 10); err == nil {
+		t.Fatal("expected error redirecting to a shard redirected to the source, found nil")
+	}
+	if err := router.Redirect(40, 40); err == nil {
+		t.Fatal("expected error redirecting a shard to itself, found nil")
+	}
+}
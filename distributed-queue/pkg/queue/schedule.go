@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/wait"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultScheduleInterval is the time between checks for due schedules
+	// when not configured
+	DefaultScheduleInterval = time.Second
+
+	scheduleBatchSize      = 100
+	scheduleEnqueueTimeout = 10 * time.Second
+)
+
+type scheduleAdvancer interface {
+	FindDue(context.Context, *db.ShardMeta, time.Time, int) ([]*domain.Schedule, error)
+	Advance(context.Context, *db.ShardMeta, *domain.Schedule, time.Time) (bool, error)
+}
+
+// NewSchedulerWorker creates a new SchedulerWorker for the schedules stored in
+// the main shard. Occurrences are enqueued to the buffer of the enqueue workers.
+func NewSchedulerWorker(mainShard *db.ShardMeta, buf chan<- EnqueueRequest, logger *zap.Logger) *SchedulerWorker {
+	return &SchedulerWorker{
+		logger: logger,
+		shard:  mainShard,
+		repo:   &db.ScheduleRepository{},
+		buffer: buf,
+		now:    time.Now,
+	}
+}
+
+// SchedulerWorker implements the worker interface to materialize the occurrences of
+// recurring messages.
+// On every round, the worker finds the schedules whose next occurrence is due and
+// enqueues a copy of their message through the enqueue workers, like API requests.
+//
+// Occurrences are claimed by advancing the schedule to its next occurrence before
+// the message is enqueued, so that schedulers of multiple application instances
+// never enqueue the same occurrence twice. Occurrences are enqueued at most once:
+// if enqueueing fails, the occurrence is skipped. Occurrences missed while no
+// scheduler was running are coalesced into a single message.
+type SchedulerWorker struct {
+	// Interval is the time between checks for due schedules.
+	// Defaults to DefaultScheduleInterval.
+	Interval time.Duration
+
+	logger *zap.Logger
+	shard  *db.ShardMeta
+	repo   scheduleAdvancer
+	buffer chan<- EnqueueRequest
+	// now returns the current time occurrences are compared to
+	now func() time.Time
+
+	// ctx is cancelled when the worker stops to abort in-flight queries
+	ctx      context.Context
+	cancel   context.CancelFunc
+	shutdown chan chan error
+}
+
+func (w *SchedulerWorker) Run() error {
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.shutdown = make(chan chan error)
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultScheduleInterval
+	}
+
+	runLoop := func() {
+		defer close(w.shutdown)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		recoveryBackoff := wait.NewBackoff(backoffInitialDuration, backoffFactor, backoffMaxDuration)
+		for {
+			select {
+			case respCh := <-w.shutdown:
+				respCh <- nil
+				return
+			case <-ticker.C:
+				if !w.shard.Healthy() {
+					recoverShard(w.logger, w.shard, recoveryBackoff)
+					continue
+				}
+				if err := w.enqueueDue(); err != nil {
+					if w.ctx.Err() != nil {
+						// query aborted by Stop
+						continue
+					}
+					w.logger.Error("error fetching due schedules", zap.Error(err))
+					w.shard.MarkUnhealthy()
+				}
+			}
+		}
+	}
+	go runLoop()
+	return nil
+}
+
+// enqueueDue claims and enqueues the due occurrences of all schedules.
+func (w *SchedulerWorker) enqueueDue() error {
+	for {
+		now := w.now()
+		due, err := w.repo.FindDue(w.ctx, w.shard, now, scheduleBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, schedule := range due {
+			advanced, err := w.repo.Advance(w.ctx, w.shard, schedule, schedule.Next(now))
+			if err != nil {
+				return err
+			}
+			if advanced {
+				w.enqueue(schedule)
+			}
+		}
+		if len(due) < scheduleBatchSize {
+			return nil
+		}
+	}
+}
+
+// enqueue hands over a copy of the schedule message to the enqueue workers and
+// waits for it to be stored.
+func (w *SchedulerWorker) enqueue(schedule *domain.Schedule) {
+	ctx, cancel := context.WithTimeout(w.ctx, scheduleEnqueueTimeout)
+	defer cancel()
+
+	respCh := make(chan EnqueueResponse, 1)
+	req := EnqueueRequest{Ctx: ctx, Msg: schedule.Message, RespCh: respCh}
+	select {
+	case <-ctx.Done():
+		w.logger.Warn("could not enqueue scheduled message",
+			zap.String("scheduleId", schedule.Id.String()), zap.Error(ctx.Err()))
+		return
+	case w.buffer <- req:
+	}
+
+	select {
+	case <-ctx.Done():
+		w.logger.Warn("could not enqueue scheduled message",
+			zap.String("scheduleId", schedule.Id.String()), zap.Error(ctx.Err()))
+	case resp := <-respCh:
+		if resp.Err != nil {
+			w.logger.Error("error enqueueing scheduled message",
+				zap.String("scheduleId", schedule.Id.String()), zap.Error(resp.Err))
+			return
+		}
+		w.logger.Debug("scheduled message enqueued",
+			zap.String("scheduleId", schedule.Id.String()),
+			zap.String("msgId", resp.MsgId.String()))
+	}
+}
+
+func (w *SchedulerWorker) Stop() error {
+	w.cancel()
+	errCh := make(chan error)
+	w.shutdown <- errCh
+
+	return <-errCh
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/db"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeScheduleStore keeps schedules in memory
+type fakeScheduleStore struct {
+	mu        sync.Mutex
+	schedules []*domain.Schedule
+}
+
+func (f *fakeScheduleStore) FindDue(_ context.Context, _ *db.ShardMeta, now time.Time, limit int) ([]*domain.Schedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var due []*domain.Schedule
+	for _, s := range f.schedules {
+		if !s.NextRunAt.After(now) && len(due) < limit {
+			copied := *s
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeScheduleStore) Advance(_ context.Context, _ *db.ShardMeta, item *domain.Schedule, next time.Time) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range f.schedules {
+		if s.Id == item.Id && s.NextRunAt.Equal(item.NextRunAt) {
+			s.NextRunAt = next
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fakeClock is a clock that only moves forward when advanced manually
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSchedulerEnqueuesOccurrences(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 10, 0, 30, 0, time.UTC)}
+
+	msg := domain.Message{Namespace: &domain.Namespace{Id: domain.NewUUID(10)}, Topic: "reports", Payload: []byte("run")}
+	schedule, err := domain.NewSchedule("* * * * *", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule.Id = domain.NewUUID(10)
+	schedule.NextRunAt = schedule.Next(clock.Now())
+	store := &fakeScheduleStore{schedules: []*domain.Schedule{schedule}}
+
+	buf := make(chan EnqueueRequest)
+	w := NewSchedulerWorker(db.NewShardMeta(10, nil, true), buf, logger)
+	w.repo = store
+	w.now = clock.Now
+	w.Interval = 5 * time.Millisecond
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	expectNone := func() {
+		t.Helper()
+		select {
+		case req := <-buf:
+			t.Fatalf("unexpected message enqueued at %s: %+v", clock.Now(), req.Msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectOccurrence := func() {
+		t.Helper()
+		select {
+		case req := <-buf:
+			if req.Msg.Topic != "reports" || string(req.Msg.Payload) != "run" {
+				t.Fatalf("unexpected message enqueued: %+v", req.Msg)
+			}
+			req.RespCh <- EnqueueResponse{MsgId: domain.NewUUID(10)}
+		case <-time.After(time.Second):
+			t.Fatalf("no message enqueued at %s", clock.Now())
+		}
+	}
+
+	// nothing is enqueued before the first occurrence
+	expectNone()
+
+	const occurrences = 3
+	for i := 0; i < occurrences; i++ {
+		clock.Advance(time.Minute)
+		expectOccurrence()
+		// every occurrence is enqueued once
+		expectNone()
+	}
+
+	expectedNext := time.Date(2024, 3, 1, 10, 4, 0, 0, time.UTC)
+	store.mu.Lock()
+	next := store.schedules[0].NextRunAt
+	store.mu.Unlock()
+	if !next.Equal(expectedNext) {
+		t.Fatalf("expected next occurrence at %s, found %s", expectedNext, next)
+	}
+
+	// occurrences missed while the scheduler is late are coalesced
+	clock.Advance(10 * time.Minute)
+	expectOccurrence()
+	expectNone()
+}
@@ -0,0 +1,4 @@
+// Package queuepb contains the protocol buffers and gRPC stubs of the queue API.
+package queuepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative queue.proto
@@ -0,0 +1,261 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: queue.proto
+
+package queuepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Queue_CreateNamespace_FullMethodName = "/queue.v1.Queue/CreateNamespace"
+	Queue_ListNamespaces_FullMethodName  = "/queue.v1.Queue/ListNamespaces"
+	Queue_Enqueue_FullMethodName         = "/queue.v1.Queue/Enqueue"
+	Queue_Dequeue_FullMethodName         = "/queue.v1.Queue/Dequeue"
+	Queue_AckNack_FullMethodName         = "/queue.v1.Queue/AckNack"
+)
+
+// QueueClient is the client API for Queue service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QueueClient interface {
+	CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*Namespace, error)
+	ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error)
+	Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error)
+	// Dequeue long-polls the topic for messages until the timeout expires.
+	// The response has no messages if none became available.
+	Dequeue(ctx context.Context, in *DequeueRequest, opts ...grpc.CallOption) (*DequeueResponse, error)
+	AckNack(ctx context.Context, in *AckNackRequest, opts ...grpc.CallOption) (*AckNackResponse, error)
+}
+
+type queueClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQueueClient(cc grpc.ClientConnInterface) QueueClient {
+	return &queueClient{cc}
+}
+
+func (c *queueClient) CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*Namespace, error) {
+	out := new(Namespace)
+	err := c.cc.Invoke(ctx, Queue_CreateNamespace_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error) {
+	out := new(ListNamespacesResponse)
+	err := c.cc.Invoke(ctx, Queue_ListNamespaces_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error) {
+	out := new(EnqueueResponse)
+	err := c.cc.Invoke(ctx, Queue_Enqueue_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) Dequeue(ctx context.Context, in *DequeueRequest, opts ...grpc.CallOption) (*DequeueResponse, error) {
+	out := new(DequeueResponse)
+	err := c.cc.Invoke(ctx, Queue_Dequeue_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queueClient) AckNack(ctx context.Context, in *AckNackRequest, opts ...grpc.CallOption) (*AckNackResponse, error) {
+	out := new(AckNackResponse)
+	err := c.cc.Invoke(ctx, Queue_AckNack_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QueueServer is the server API for Queue service.
+// All implementations must embed UnimplementedQueueServer
+// for forward compatibility
+type QueueServer interface {
+	CreateNamespace(context.Context, *CreateNamespaceRequest) (*Namespace, error)
+	ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error)
+	Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error)
+	// Dequeue long-polls the topic for messages until the timeout expires.
+	// The response has no messages if none became available.
+	Dequeue(context.Context, *DequeueRequest) (*DequeueResponse, error)
+	AckNack(context.Context, *AckNackRequest) (*AckNackResponse, error)
+	mustEmbedUnimplementedQueueServer()
+}
+
+// UnimplementedQueueServer must be embedded to have forward compatible implementations.
+type UnimplementedQueueServer struct {
+}
+
+func (UnimplementedQueueServer) CreateNamespace(context.Context, *CreateNamespaceRequest) (*Namespace, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateNamespace not implemented")
+}
+func (UnimplementedQueueServer) ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNamespaces not implemented")
+}
+func (UnimplementedQueueServer) Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enqueue not implemented")
+}
+func (UnimplementedQueueServer) Dequeue(context.Context, *DequeueRequest) (*DequeueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Dequeue not implemented")
+}
+func (UnimplementedQueueServer) AckNack(context.Context, *AckNackRequest) (*AckNackResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckNack not implemented")
+}
+func (UnimplementedQueueServer) mustEmbedUnimplementedQueueServer() {}
+
+// UnsafeQueueServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QueueServer will
+// result in compilation errors.
+type UnsafeQueueServer interface {
+	mustEmbedUnimplementedQueueServer()
+}
+
+func RegisterQueueServer(s grpc.ServiceRegistrar, srv QueueServer) {
+	s.RegisterService(&Queue_ServiceDesc, srv)
+}
+
+func _Queue_CreateNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).CreateNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Queue_CreateNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).CreateNamespace(ctx, req.(*CreateNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_ListNamespaces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNamespacesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).ListNamespaces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Queue_ListNamespaces_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).ListNamespaces(ctx, req.(*ListNamespacesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_Enqueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnqueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).Enqueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Queue_Enqueue_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).Enqueue(ctx, req.(*EnqueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_Dequeue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DequeueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).Dequeue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Queue_Dequeue_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).Dequeue(ctx, req.(*DequeueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Queue_AckNack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AckNackRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueueServer).AckNack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Queue_AckNack_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueueServer).AckNack(ctx, req.(*AckNackRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Queue_ServiceDesc is the grpc.ServiceDesc for Queue service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Queue_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "queue.v1.Queue",
+	HandlerType: (*QueueServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateNamespace",
+			Handler:    _Queue_CreateNamespace_Handler,
+		},
+		{
+			MethodName: "ListNamespaces",
+			Handler:    _Queue_ListNamespaces_Handler,
+		},
+		{
+			MethodName: "Enqueue",
+			Handler:    _Queue_Enqueue_Handler,
+		},
+		{
+			MethodName: "Dequeue",
+			Handler:    _Queue_Dequeue_Handler,
+		},
+		{
+			MethodName: "AckNack",
+			Handler:    _Queue_AckNack_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "queue.proto",
+}
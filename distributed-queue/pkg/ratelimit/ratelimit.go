@@ -0,0 +1,117 @@
+// Package ratelimit implements token-bucket rate limiting of API requests by namespace.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit represents the token-bucket configuration for a namespace.
+// Rate is the number of requests allowed per second and Burst is the maximum
+// number of requests that can be served at once.
+type Limit struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+// defaultIdleTimeout is the time after which the limiter of an inactive namespace is released
+const defaultIdleTimeout = 10 * time.Minute
+
+// NamespaceLimiter keeps a separate token-bucket for every namespace so a noisy
+// namespace can't starve all others of shared resources.
+//
+// Namespaces are limited using the Default configuration unless a specific
+// Limit is configured in the Overrides map.
+// Token-buckets of namespaces that made no requests for IdleTimeout are released,
+// so the number of limiters is bound by the number of active namespaces.
+type NamespaceLimiter struct {
+	Default   Limit
+	Overrides map[string]Limit
+	// IdleTimeout defaults to defaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+	// now returns the current time, defaults to time.Now
+	now func() time.Time
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastUsed time.Time
+}
+
+// Allow reports whether a request for the namespace can be served now.
+// When the request is rejected, Allow returns the time the caller should wait
+// before retrying.
+func (l *NamespaceLimiter) Allow(namespace string) (bool, time.Duration) {
+	r := l.limiter(namespace).Reserve()
+	if !r.OK() {
+		// request can never be served with the current burst
+		return false, time.Second
+	}
+	if delay := r.Delay(); delay > 0 {
+		// returning tokens to the bucket as this request will be rejected
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// Len returns the number of namespaces with an active token-bucket.
+func (l *NamespaceLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// limiter returns the token-bucket for the namespace, creating it on first use.
+func (l *NamespaceLimiter) limiter(namespace string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.limiters == nil {
+		l.limiters = map[string]*limiterEntry{}
+		l.lastSweep = now
+	}
+	l.evictIdle(now)
+
+	entry, ok := l.limiters[namespace]
+	if !ok {
+		cfg, found := l.Overrides[namespace]
+		if !found {
+			cfg = l.Default
+		}
+		entry = &limiterEntry{lim: rate.NewLimiter(cfg.Rate, cfg.Burst)}
+		l.limiters[namespace] = entry
+	}
+	entry.lastUsed = now
+	return entry.lim
+}
+
+// evictIdle releases the token-buckets of namespaces that have been idle for longer
+// than IdleTimeout. Limiters are scanned at most once every IdleTimeout.
+// Callers must hold the lock.
+func (l *NamespaceLimiter) evictIdle(now time.Time) {
+	idle := l.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	if now.Sub(l.lastSweep) < idle {
+		return
+	}
+	l.lastSweep = now
+
+	for namespace, entry := range l.limiters {
+		if now.Sub(entry.lastUsed) >= idle {
+			delete(l.limiters, namespace)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNamespaceLimiter(t *testing.T) {
+	l := &NamespaceLimiter{
+		Default:   Limit{Rate: 100, Burst: 100},
+		Overrides: map[string]Limit{"noisy": {Rate: 1, Burst: 2}},
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("noisy"); !ok {
+			t.Fatalf("request %d should be allowed within burst", i)
+		}
+	}
+
+	ok, retryAfter := l.Allow("noisy")
+	if ok {
+		t.Fatal("request should have been rate limited")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("rate limited request should report a retry delay, found %s", retryAfter)
+	}
+
+	if ok, _ := l.Allow("quiet"); !ok {
+		t.Fatal("other namespaces should not be affected by a noisy namespace")
+	}
+}
+
+func TestNamespaceLimiterEvictsIdleNamespaces(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &NamespaceLimiter{
+		Default:     Limit{Rate: 100, Burst: 100},
+		IdleTimeout: time.Minute,
+		now:         func() time.Time { return now },
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprintf("ns-%d", i))
+	}
+	if n := l.Len(); n != 100 {
+		t.Fatalf("expected %d limiters, found %d", 100, n)
+	}
+
+	now = now.Add(30 * time.Second)
+	l.Allow("ns-0")
+	now = now.Add(45 * time.Second)
+	l.Allow("ns-1")
+
+	// only namespaces used within the idle timeout are kept
+	if n := l.Len(); n != 2 {
+		t.Fatalf("expected %d limiters, found %d", 2, n)
+	}
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/mcastellin/golang-mastery/distributed-queue"
+
+	// ExporterNone disables tracing. Spans are created by a no-op tracer.
+	ExporterNone = "none"
+	// ExporterStdout writes spans to the standard output, useful for debugging.
+	ExporterStdout = "stdout"
+)
+
+// propagator encodes span contexts using the W3C Trace Context format
+var propagator = propagation.TraceContext{}
+
+// Setup configures the global tracer provider with the given exporter.
+// An empty exporter is equivalent to ExporterNone.
+// The returned function flushes pending spans and must be called on shutdown.
+func Setup(exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		e, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		exp = e
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %q", exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer used to instrument the distributed queue.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// TraceParent encodes the span context into a W3C traceparent value that can be
+// stored alongside messages. Invalid span contexts are encoded as an empty string.
+func TraceParent(sc trace.SpanContext) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+	return carrier.Get("traceparent")
+}
+
+// ContextWithTraceParent returns a copy of ctx carrying the remote span context
+// decoded from a W3C traceparent value, so that new spans join the same trace.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if len(traceParent) == 0 {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceParent}
+	return propagator.Extract(ctx, carrier)
+}
+
+// ContextFromHeaders returns a copy of ctx carrying the span context propagated
+// by the client in the HTTP request headers, if any.
+func ContextFromHeaders(ctx context.Context, h http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// LinksFromTraceParents returns span links to the traces identified by the given
+// W3C traceparent values. Empty or invalid values are skipped.
+func LinksFromTraceParents(traceParents ...string) []trace.Link {
+	links := []trace.Link{}
+	for _, tp := range traceParents {
+		sc := trace.SpanContextFromContext(ContextWithTraceParent(context.Background(), tp))
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return links
+}
@@ -1,6 +1,37 @@
 CREATE TABLE IF NOT EXISTS namespaces (
     id BYTEA PRIMARY KEY,
-    name VARCHAR(50)
+    name VARCHAR(50),
+    topics VARCHAR(50)[]
+);
+
+-- JSON Schemas validating the payloads enqueued to a namespace topic
+CREATE TABLE IF NOT EXISTS topic_schemas (
+    namespace BYTEA NOT NULL,
+    topic VARCHAR(50) NOT NULL,
+    schema TEXT NOT NULL,
+    PRIMARY KEY (namespace, topic)
+);
+
+-- shards whose messages were migrated to another shard: message ids keep the
+-- prefix of the source shard and are routed to the destination
+CREATE TABLE IF NOT EXISTS shard_redirects (
+    source BIGINT PRIMARY KEY,
+    destination BIGINT NOT NULL
+);
+
+-- recurring messages: the scheduler enqueues a copy of the message at every
+-- occurrence of the cron expression
+CREATE TABLE IF NOT EXISTS schedules (
+    id BYTEA PRIMARY KEY,
+    cron VARCHAR(100) NOT NULL,
+    topic VARCHAR(50) NOT NULL,
+    priority INTEGER NOT NULL,
+    namespace BYTEA NOT NULL,
+    payload BYTEA NOT NULL,
+    metadata BYTEA NOT NULL,
+    ttl INTERVAL NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    nextrunat TIMESTAMP NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS messages (
@@ -14,10 +45,25 @@ CREATE TABLE IF NOT EXISTS messages (
     ttl INTERVAL NOT NULL,
     readyat TIMESTAMP NOT NULL,
     expiresat TIMESTAMP NOT NULL,
-    prefetched BOOLEAN DEFAULT false
+    prefetched BOOLEAN DEFAULT false,
+    traceparent VARCHAR(55) NOT NULL DEFAULT '',
+    deliveryattempts INTEGER NOT NULL DEFAULT 0,
+    headers JSONB NOT NULL DEFAULT '{}',
+    lease VARCHAR(20) NOT NULL DEFAULT ''
 );
 
+-- added after the initial schema: upgrade existing databases
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS traceparent VARCHAR(55) NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deliveryattempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE namespaces ADD COLUMN IF NOT EXISTS topics VARCHAR(50)[];
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS lease VARCHAR(20) NOT NULL DEFAULT '';
+
 CREATE INDEX IF NOT EXISTS topic_id_idx ON messages (topic, id);
 
+CREATE INDEX IF NOT EXISTS messages_headers_idx ON messages USING GIN (headers jsonb_path_ops);
+
 CREATE INDEX IF NOT EXISTS messages_filter_idx ON messages (prefetched, readyat, expiresat)
 WHERE prefetched = false; -- partial index assuming prefetched = false most of the time
+
+CREATE INDEX IF NOT EXISTS schedules_nextrunat_idx ON schedules (nextrunat);
@@ -0,0 +1,25 @@
+-- messages table of SQLite shards, see db.SQLite. Only the message lifecycle is
+-- supported: namespaces and schedules require PostgreSQL.
+-- Timestamps are stored as nanoseconds since the Unix epoch.
+CREATE TABLE IF NOT EXISTS messages (
+    id BLOB PRIMARY KEY,
+    topic VARCHAR(50) NOT NULL,
+    priority INTEGER NOT NULL,
+    namespace BLOB NOT NULL,
+    payload BLOB NOT NULL,
+    metadata BLOB NOT NULL,
+    deliverafter INTEGER NOT NULL,
+    ttl INTEGER NOT NULL,
+    readyat INTEGER NOT NULL,
+    expiresat INTEGER NOT NULL,
+    prefetched BOOLEAN DEFAULT false,
+    traceparent VARCHAR(55) NOT NULL DEFAULT '',
+    deliveryattempts INTEGER NOT NULL DEFAULT 0,
+    headers BLOB NOT NULL DEFAULT '{}',
+    lease VARCHAR(20) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS topic_id_idx ON messages (topic, id);
+
+CREATE INDEX IF NOT EXISTS messages_filter_idx ON messages (prefetched, readyat, expiresat)
+WHERE prefetched = false;
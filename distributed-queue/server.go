@@ -1,23 +1,62 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/vmihailenco/msgpack/v5"
 	"go.uber.org/zap"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 // H is inspired by the gin.H struct, just a shorthand for a map type
 type H map[string]any
 
+// Handler is the signature of functions that handle API requests
+type Handler func(*ApiCtx)
+
+// Middleware wraps a Handler to add cross-cutting behaviour like logging
+// or authentication to every request served by the ApiServer.
+type Middleware func(next Handler) Handler
+
 // ApiCtx represents the context of an API request
 type ApiCtx struct {
 	Request *http.Request
 	Writer  http.ResponseWriter
+	// RequestId identifies the request in logs, see RequestIdMiddleware
+	RequestId string
+
+	recorder *statusRecorder
+}
+
+// Logger returns the logger with the fields identifying the request, so that
+// log lines can be correlated with the client logs.
+func (c *ApiCtx) Logger(logger *zap.Logger) *zap.Logger {
+	if len(c.RequestId) == 0 {
+		return logger
+	}
+	return logger.With(zap.String("requestId", c.RequestId))
+}
+
+// StatusCode returns the status code written in response to the request.
+func (c *ApiCtx) StatusCode() int {
+	if c.recorder == nil || c.recorder.status == 0 {
+		return http.StatusOK
+	}
+	return c.recorder.status
 }
 
 // JsonResponse is a utility function to write a JSON response with its associated
@@ -29,6 +68,66 @@ func (c *ApiCtx) JsonResponse(statusCode int, v H) error {
 	return err
 }
 
+// media types of the response encodings negotiated with clients
+const (
+	mimeJson    = "application/json"
+	mimeMsgpack = "application/msgpack"
+)
+
+// Respond writes v with its associated status code to the ResponseWriter, encoded
+// with the format requested by the client: msgpack when the Accept header lists
+// application/msgpack, JSON otherwise. Msgpack responses use the same keys as
+// their JSON counterparts.
+func (c *ApiCtx) Respond(statusCode int, v any) error {
+	if !c.accepts(mimeMsgpack) {
+		c.Writer.Header().Add("Content-Type", mimeJson)
+		c.Writer.WriteHeader(statusCode)
+		return json.NewEncoder(c.Writer).Encode(v)
+	}
+
+	c.Writer.Header().Add("Content-Type", mimeMsgpack)
+	c.Writer.WriteHeader(statusCode)
+	enc := msgpack.NewEncoder(c.Writer)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// accepts returns true if the media type is listed in the Accept header of the request.
+func (c *ApiCtx) accepts(mediaType string) bool {
+	for _, accepted := range c.Request.Header.Values("Accept") {
+		for _, v := range strings.Split(accepted, ",") {
+			if mt, _, err := mime.ParseMediaType(v); err == nil && mt == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NoContent writes a response with the given status code and an empty body
+func (c *ApiCtx) NoContent(statusCode int) {
+	c.Writer.WriteHeader(statusCode)
+}
+
+// Error writes an error response with the status code matching the error category.
+func (c *ApiCtx) Error(err error) error {
+	var (
+		rateLimitErr  *rateLimitError
+		validationErr *domain.SchemaValidationError
+	)
+	switch {
+	case errors.As(err, &rateLimitErr):
+		seconds := int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))
+		c.Writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	case errors.As(err, &validationErr):
+		return c.Respond(errorStatus(err), H{
+			"error":            "payload does not conform to the topic schema",
+			"validationErrors": validationErr.Errors,
+		})
+	}
+	return c.Respond(errorStatus(err), H{"error": err.Error()})
+}
+
 // NewApiServer initializes an ApiServer struct
 func NewApiServer(addr string, basePath string, logger *zap.Logger) *ApiServer {
 	prefixedBase, err := url.JoinPath(basePath, "/")
@@ -39,22 +138,40 @@ func NewApiServer(addr string, basePath string, logger *zap.Logger) *ApiServer {
 		logger:   logger,
 		addr:     addr,
 		basePath: prefixedBase,
-		router:   map[string]func(*ApiCtx){},
+		router:   map[string]Handler{},
 	}
 }
 
 // ApiServer represents the state of the API router
 type ApiServer struct {
+	// ShutdownTimeout is the grace period given to in-flight requests
+	// to complete before the server is forcefully closed.
+	ShutdownTimeout time.Duration
+
 	logger   *zap.Logger
 	addr     string
 	basePath string
 	mux      *http.ServeMux
-	router   map[string]func(*ApiCtx)
+	router   map[string]Handler
+	// patterns are the routes with wildcard path segments, matched in
+	// registration order when no route matches the path exactly
+	patterns []routePattern
+
+	middlewares []Middleware
+}
+
+// Use adds a middleware to the chain of every request handler.
+// Middlewares wrap handlers in registration order, meaning the first
+// registered middleware is the first one to be invoked.
+func (s *ApiServer) Use(mw Middleware) {
+	s.middlewares = append(s.middlewares, mw)
 }
 
 // HandleFunc adds a new handler to the router to handle requests with
 // matching method and URL path.
-func (s *ApiServer) HandleFunc(method string, path string, fn func(*ApiCtx)) {
+// Path segments like {name} match any non-empty segment: handlers read the
+// matched value with c.Request.PathValue(name).
+func (s *ApiServer) HandleFunc(method string, path string, fn Handler) {
 	if s.mux == nil {
 		s.mux = http.NewServeMux()
 	}
@@ -64,12 +181,76 @@ func (s *ApiServer) HandleFunc(method string, path string, fn func(*ApiCtx)) {
 			zap.Error(err))
 		fullPath = path
 	}
+	if unescaped, err := url.PathUnescape(fullPath); err == nil {
+		// requests are matched on their decoded path
+		fullPath = unescaped
+	}
+	if strings.Contains(fullPath, "{") {
+		s.patterns = append(s.patterns, routePattern{
+			method:   method,
+			segments: strings.Split(fullPath, "/"),
+			fn:       fn,
+		})
+		return
+	}
 	key := routerKey(method, fullPath)
 	s.router[key] = fn
 }
 
+// route returns the handler of the request, setting the values of the
+// wildcard path segments of the matched route.
+func (s *ApiServer) route(r *http.Request) (Handler, bool) {
+	if fn, ok := s.router[routerKey(r.Method, r.URL.Path)]; ok {
+		return fn, true
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	for _, p := range s.patterns {
+		if p.method != r.Method {
+			continue
+		}
+		if values, ok := p.match(segments); ok {
+			for name, v := range values {
+				r.SetPathValue(name, v)
+			}
+			return p.fn, true
+		}
+	}
+	return nil, false
+}
+
+// routePattern is a route with wildcard path segments
+type routePattern struct {
+	method   string
+	segments []string
+	fn       Handler
+}
+
+// match returns the values of the wildcard segments if the path segments
+// match the pattern.
+func (p *routePattern) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(p.segments) {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, seg := range p.segments {
+		if name, ok := strings.CutPrefix(seg, "{"); ok && strings.HasSuffix(name, "}") {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			values[strings.TrimSuffix(name, "}")] = segments[i]
+			continue
+		}
+		if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
 // Serve listens for incoming HTTP requests on the specified bind addr
 // and routes them to the appropriate function for handling.
+// Panics raised while handling a request are recovered and reported to
+// the client as internal server errors.
 func (s *ApiServer) Serve(ctx context.Context, notifyReady chan struct{}) error {
 	s.logger.Info("server starting")
 	srv := &http.Server{
@@ -77,28 +258,34 @@ func (s *ApiServer) Serve(ctx context.Context, notifyReady chan struct{}) error
 		Handler: s.mux,
 	}
 	router := func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
 		c := &ApiCtx{
-			Writer:  w,
-			Request: r,
+			Writer:   rec,
+			Request:  r,
+			recorder: rec,
 		}
-		key := routerKey(r.Method, r.URL.Path)
-		fn, ok := s.router[key]
+		defer func() {
+			if r := recover(); r != nil {
+				handlePanic(s.logger, c, r)
+			}
+		}()
+
+		fn, ok := s.route(r)
 		if !ok {
-			c.JsonResponse(http.StatusNotFound, H{"status": "page not found"})
-			return
+			fn = notFoundHandler
 		}
 
-		fn(c)
+		s.chain(fn)(c)
 	}
 	s.mux.HandleFunc(s.basePath, router)
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		select {
 		case <-ctx.Done():
 			s.logger.Info("shutting down")
-			if err := srv.Shutdown(context.TODO()); err != nil {
-				panic(err)
-			}
+			s.shutdown(srv)
 		}
 	}()
 
@@ -112,9 +299,76 @@ func (s *ApiServer) Serve(ctx context.Context, notifyReady chan struct{}) error
 	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
+	// ListenAndServe returns as soon as shutdown begins. Waiting
+	// for in-flight requests to drain before returning.
+	<-shutdownDone
 	return nil
 }
 
+// shutdown gracefully stops the http server giving in-flight requests up to
+// ShutdownTimeout to complete. Connections still active after the timeout
+// are forcefully closed.
+func (s *ApiServer) shutdown(srv *http.Server) {
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		s.logger.Warn("graceful shutdown timed out, forcing close",
+			zap.Duration("timeout", timeout),
+			zap.Error(err))
+		srv.Close()
+		return
+	}
+	s.logger.Info("graceful shutdown completed")
+}
+
+// statusRecorder wraps an http.ResponseWriter to record the status code
+// written in response to a request.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it to the wrapped
+// ResponseWriter
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Hijack lets handlers take over the connection, as required to serve
+// WebSocket requests. The request is recorded as switching protocols.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// chain wraps the handler function with all registered middlewares
+func (s *ApiServer) chain(fn Handler) Handler {
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		fn = s.middlewares[i](fn)
+	}
+	return fn
+}
+
+// notFoundHandler replies to requests that don't match any registered route
+func notFoundHandler(c *ApiCtx) {
+	c.Respond(http.StatusNotFound, H{"status": "page not found"})
+}
+
 // routerKey is an internal function to build the key used by the router to
 // match handler functions
 func routerKey(method string, path string) string {
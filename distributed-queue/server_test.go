@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/vmihailenco/msgpack/v5"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
@@ -93,6 +97,195 @@ func TestApiServerBaseUrl(t *testing.T) {
 	}
 }
 
+// bindAvailablePort returns an available TCP port.
+//
+// Note: there still is a chance the returned port gets allocated
+// before the caller binds the port
 func bindAvailablePort(t testing.TB) int {
-	return 9999
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatalf("could not allocate port: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestServer serves the ApiServer in the background until the test completes
+// and returns the base url to reach it.
+func startTestServer(t testing.TB, api *ApiServer) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	notify := make(chan struct{})
+	go api.Serve(ctx, notify)
+	<-notify
+
+	return fmt.Sprintf("http://localhost%s", api.addr)
+}
+
+// newTestApiServer creates an ApiServer bound to an available port
+func newTestApiServer(t testing.TB, logger *zap.Logger) *ApiServer {
+	port := bindAvailablePort(t)
+	return NewApiServer(fmt.Sprintf(":%d", port), "/", logger)
+}
+
+func TestApiServerRoutesPathWildcards(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	api := newTestApiServer(t, logger)
+	api.HandleFunc(http.MethodDelete, "/topics/{topic}", func(c *ApiCtx) {
+		c.Respond(http.StatusOK, H{"topic": c.Request.PathValue("topic")})
+	})
+	baseUrl := startTestServer(t, api)
+
+	cli := http.Client{Timeout: time.Second}
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, baseUrl+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodDelete, "/topics/orders")
+	var reply struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || reply.Topic != "orders" {
+		t.Fatalf("expected topic %q with status %d, found %q with status %d",
+			"orders", http.StatusOK, reply.Topic, resp.StatusCode)
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/topics/orders"},
+		{http.MethodDelete, "/topics/"},
+		{http.MethodDelete, "/topics/orders/all"},
+	} {
+		if resp := do(req.method, req.path); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("returned status code %d for %s %s, expected %d",
+				resp.StatusCode, req.method, req.path, http.StatusNotFound)
+		}
+	}
+}
+
+func TestApiServerRecoversFromPanic(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.FatalLevel))
+	api := newTestApiServer(t, logger)
+	api.HandleFunc(http.MethodGet, "/panic", func(c *ApiCtx) {
+		var m map[string]string
+		m["boom"] = "nil map assignment"
+	})
+
+	baseUrl := startTestServer(t, api)
+
+	cli := http.Client{Timeout: time.Second}
+	resp, err := cli.Get(baseUrl + "/panic")
+	if err != nil {
+		t.Fatalf("connection should not have been dropped: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("returned status code %d, expected %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+}
+
+func TestApiServerShutdownTimeout(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.ErrorLevel))
+	api := newTestApiServer(t, logger)
+	api.ShutdownTimeout = 200 * time.Millisecond
+
+	handling := make(chan struct{})
+	api.HandleFunc(http.MethodGet, "/slow", func(c *ApiCtx) {
+		close(handling)
+		time.Sleep(5 * time.Second)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notify := make(chan struct{})
+	served := make(chan error)
+	go func() { served <- api.Serve(ctx, notify) }()
+	<-notify
+
+	go func() {
+		cli := http.Client{Timeout: 10 * time.Second}
+		cli.Get(fmt.Sprintf("http://localhost%s/slow", api.addr))
+	}()
+	<-handling
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < api.ShutdownTimeout {
+			t.Fatalf("server should have waited for in-flight requests: took %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server shutdown did not honour the configured timeout")
+	}
+}
+
+func TestRespondNegotiatesEncoding(t *testing.T) {
+	type reply struct {
+		Status   string `json:"status"`
+		Messages []struct {
+			Id       string `json:"id"`
+			Priority uint32 `json:"priority"`
+		} `json:"messages"`
+	}
+	decodeMsgpack := func(data []byte, v any) error {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+
+	testCases := []struct {
+		Accept      string
+		ContentType string
+		Decode      func([]byte, any) error
+	}{
+		{"", mimeJson, json.Unmarshal},
+		{"*/*", mimeJson, json.Unmarshal},
+		{"application/json", mimeJson, json.Unmarshal},
+		{"application/msgpack", mimeMsgpack, decodeMsgpack},
+		{"text/plain, application/msgpack;q=0.9", mimeMsgpack, decodeMsgpack},
+	}
+
+	for _, tc := range testCases {
+		c, w := newTestCtx(http.MethodGet, "/", nil)
+		if len(tc.Accept) > 0 {
+			c.Request.Header.Set("Accept", tc.Accept)
+		}
+		c.Respond(http.StatusOK, H{
+			"status":   "ok",
+			"messages": []H{{"id": "10-cnv1h2q8hfkc73c3ug8g", "priority": uint32(3)}},
+		})
+
+		if ct := w.Header().Get("Content-Type"); ct != tc.ContentType {
+			t.Fatalf("accept %q: expected content type %s, found %s", tc.Accept, tc.ContentType, ct)
+		}
+		var r reply
+		if err := tc.Decode(w.Body.Bytes(), &r); err != nil {
+			t.Fatalf("accept %q: error decoding response: %v", tc.Accept, err)
+		}
+		if r.Status != "ok" || len(r.Messages) != 1 ||
+			r.Messages[0].Id != "10-cnv1h2q8hfkc73c3ug8g" || r.Messages[0].Priority != 3 {
+			t.Fatalf("accept %q: unexpected response %+v", tc.Accept, r)
+		}
+	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// types of the frames sent to WebSocket consumers
+const (
+	wsMessagesFrame = "messages"
+	wsAcksFrame     = "acks"
+	wsErrorFrame    = "error"
+)
+
+// HandleConsume upgrades the request to a WebSocket connection that delivers
+// the messages of a topic to the consumer as they become available.
+//
+// The topic is selected with the namespace and topic query parameters, and the
+// limit parameter caps the size of every batch. Batches are sent in frames like
+// {"type": "messages", "messages": [...]}, with messages in the same format as
+// dequeue responses. Consumers acknowledge messages by sending frames with the
+// same body as ack requests, and receive the outcome in frames like
+// {"type": "acks", "succeeded": [...], "failed": [...]}.
+//
+// Delivery stops as soon as the consumer disconnects. As with dequeue, messages
+// that were delivered but not acknowledged are delivered again once their
+// prefetch expires.
+func (s *MessagesService) HandleConsume(c *ApiCtx) {
+	query := c.Request.URL.Query()
+	req := DequeueRequest{Namespace: query.Get("namespace"), Topic: query.Get("topic")}
+	if v := query.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			c.Error(newApiError(http.StatusBadRequest, "invalid limit %q", v))
+			return
+		}
+		req.Limit = limit
+	}
+
+	// namespaces are only resolved for rate limiting, as with dequeue requests
+	var ns *domain.Namespace
+	if s.RateLimiter != nil {
+		var err error
+		if ns, err = s.findNamespace(requestContext(c), req.Namespace); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	srv := websocket.Server{Handler: func(ws *websocket.Conn) {
+		s.consume(c, ws, &req, ns)
+	}}
+	srv.ServeHTTP(c.Writer, c.Request)
+}
+
+// consume delivers message batches over the WebSocket connection while routing
+// the acks received from the consumer, until the connection is closed.
+func (s *MessagesService) consume(c *ApiCtx, ws *websocket.Conn, req *DequeueRequest, ns *domain.Namespace) {
+	defer ws.Close()
+	logger := c.Logger(s.Logger)
+
+	// the server doesn't cancel the context of hijacked requests when the client
+	// disconnects: the ack reader cancels it once the connection is closed.
+	ctx, cancel := context.WithCancel(requestContext(c))
+	defer cancel()
+	go func() {
+		defer cancel()
+		s.receiveAcks(ctx, ws, logger)
+	}()
+
+	r := &prefetch.GetItemsRequest{
+		Namespace: req.Namespace,
+		Topic:     req.Topic,
+		Limit:     req.Limit,
+		Timeout:   s.dequeueTimeout(0),
+	}
+	for ctx.Err() == nil {
+		if ns != nil {
+			if err := s.allow(ns); err != nil {
+				waitRateLimit(ctx, err)
+				continue
+			}
+		}
+
+		messages := s.pollMessages(ctx, r)
+		if len(messages) == 0 {
+			continue
+		}
+		frame := H{"type": wsMessagesFrame, "messages": messagesResponse(messages)}
+		if err := websocket.JSON.Send(ws, frame); err != nil {
+			logger.Warn("could not deliver messages to consumer",
+				zap.Int("messages", len(messages)), zap.Error(err))
+			return
+		}
+	}
+}
+
+// receiveAcks routes the ack frames sent by the consumer and replies with their
+// outcome, until the connection is closed.
+func (s *MessagesService) receiveAcks(ctx context.Context, ws *websocket.Conn, logger *zap.Logger) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Debug("consumer connection closed", zap.Error(err))
+			}
+			return
+		}
+
+		var acks []AckNackRequest
+		if err := json.Unmarshal(data, &acks); err != nil {
+			reply := H{"type": wsErrorFrame, "error": "malformed ack frame: " + err.Error()}
+			if websocket.JSON.Send(ws, reply) != nil {
+				return
+			}
+			continue
+		}
+
+		succeeded, failed := s.ackNackReport(ctx, logger, acks)
+		reply := H{"type": wsAcksFrame, "succeeded": succeeded, "failed": failed}
+		if websocket.JSON.Send(ws, reply) != nil {
+			return
+		}
+	}
+}
+
+// waitRateLimit waits until the consumer is allowed to receive messages again,
+// or ctx is done.
+func waitRateLimit(ctx context.Context, err error) {
+	retryAfter := time.Second
+	var rateLimitErr *rateLimitError
+	if errors.As(err, &rateLimitErr) {
+		retryAfter = rateLimitErr.RetryAfter
+	}
+
+	timer := time.NewTimer(retryAfter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
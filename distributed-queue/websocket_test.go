@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/domain"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/prefetch"
+	"github.com/mcastellin/golang-mastery/distributed-queue/pkg/queue"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/websocket"
+)
+
+// wsFrame is the union of the frames sent to WebSocket consumers
+type wsFrame struct {
+	Type     string `json:"type"`
+	Messages []struct {
+		Id    string `json:"id"`
+		Lease string `json:"lease"`
+	} `json:"messages"`
+	Succeeded []string `json:"succeeded"`
+	Failed    []H      `json:"failed"`
+	Error     string   `json:"error"`
+}
+
+// receiveFrame reads the next frame sent by the server, failing the test
+// if none is received within a second
+func receiveFrame(t *testing.T, ws *websocket.Conn) wsFrame {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var frame wsFrame
+	if err := websocket.JSON.Receive(ws, &frame); err != nil {
+		t.Fatalf("error receiving frame: %v", err)
+	}
+	return frame
+}
+
+func TestConsumeOverWebSocket(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	buf := newTestPriorityBuffer(t, logger)
+	acks := make(chan queue.AckNackRequest, 1)
+	router := &queue.AckNackRouter{}
+	router.RegisterWorker(10, queue.NewAckNackWorker(nil, acks, logger))
+	svc := &MessagesService{
+		Logger:            logger,
+		DequeueBuffer:     buf,
+		AckNackRouter:     router,
+		MaxDequeueTimeout: 100 * time.Millisecond,
+	}
+
+	api := newTestApiServer(t, logger)
+	api.HandleFunc(http.MethodGet, "/message/ws", svc.HandleConsume)
+	baseUrl := startTestServer(t, api)
+
+	wsUrl := strings.Replace(baseUrl, "http://", "ws://", 1) + "/message/ws?namespace=ns&topic=test"
+	ws, err := websocket.Dial(wsUrl, "", baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	msg := domain.Message{Id: domain.NewUUID(10), Topic: "test", Lease: "cnv1h2q8hfkc73c3ug8g"}
+	ingestTestMessages(t, buf, []domain.Message{msg})
+
+	frame := receiveFrame(t, ws)
+	if frame.Type != wsMessagesFrame || len(frame.Messages) != 1 {
+		t.Fatalf("expected a messages frame with %d message, found %+v", 1, frame)
+	}
+	delivered := frame.Messages[0]
+	if delivered.Id != msg.Id.String() {
+		t.Fatalf("expected message %s, found %s", msg.Id.String(), delivered.Id)
+	}
+
+	// the message is acknowledged over the same connection
+	ack := []AckNackRequest{{Id: delivered.Id, Ack: true, Lease: delivered.Lease}}
+	if err := websocket.JSON.Send(ws, ack); err != nil {
+		t.Fatal(err)
+	}
+	frame = receiveFrame(t, ws)
+	if frame.Type != wsAcksFrame || len(frame.Succeeded) != 1 || frame.Succeeded[0] != msg.Id.String() {
+		t.Fatalf("expected ack of %s to succeed, found %+v", msg.Id.String(), frame)
+	}
+	select {
+	case req := <-acks:
+		if req.Id != msg.Id || !req.Ack || req.Lease != msg.Lease {
+			t.Fatalf("expected ack of %s with lease %q, found %+v", msg.Id.String(), msg.Lease, req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ack was not routed to the shard worker")
+	}
+
+	// malformed frames are reported without closing the connection
+	if err := websocket.Message.Send(ws, "not json"); err != nil {
+		t.Fatal(err)
+	}
+	if frame = receiveFrame(t, ws); frame.Type != wsErrorFrame {
+		t.Fatalf("expected an error frame, found %+v", frame)
+	}
+
+	// messages are no longer consumed once the consumer disconnects
+	ws.Close()
+	time.Sleep(100 * time.Millisecond)
+	next := domain.Message{Id: domain.NewUUID(10), Topic: "test"}
+	ingestTestMessages(t, buf, []domain.Message{next})
+	time.Sleep(100 * time.Millisecond)
+
+	resp := <-buf.Peek(&prefetch.GetItemsRequest{Namespace: "ns", Topic: "test"})
+	if len(resp.Messages) != 1 || resp.Messages[0].Id != next.Id {
+		t.Fatalf("expected message %s to stay in the buffer, found %d messages", next.Id.String(), len(resp.Messages))
+	}
+}
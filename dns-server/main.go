@@ -3,23 +3,49 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/mcastellin/golang-mastery/dns-server/pkg/dns"
 )
 
-var upstreamResolverAddr = "8.8.8.8:53"
+var upstreamResolverAddrs = []string{"8.8.8.8:53", "8.8.4.4:53"}
+
+var upstreamTLSResolverAddrs = []string{"8.8.8.8:853", "8.8.4.4:853"}
+
+var upstreamHTTPSResolverURLs = []string{"https://dns.google/dns-query"}
+
+var upstreamPoolSize = 4
 
 var dnsServePort = 53
 
+var blocklistFile = "blocklist.txt"
+
+// localZones contains the SOA records of the zones this server is authoritative for
+var localZones = map[string]dns.DNSSOA{
+	"acme.com.": {
+		MName:   []byte("ns1.acme.com."),
+		RName:   []byte("admin.acme.com."),
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: 300,
+	},
+}
+
 var docstring = fmt.Sprintf(`DNS playground
 WARN: THIS IS NOT A PRODUCTION GRADE APPLICATION!
 
 To test DNS lookup use the following command and should resolve 127.0.0.0:
 > dig @localhost blog.acme.com
 
+To query the SOA record of the local acme.com zone:
+> dig @localhost acme.com SOA
+
 serving UDP requests at port %d...`, dnsServePort)
 
 func main() {
@@ -28,13 +54,82 @@ func main() {
 		panic(err)
 	}
 
+	blocklist := dns.DNSBlocklist{}
+	if err := blocklist.FromFile(blocklistFile); err != nil {
+		panic(err)
+	}
+	// DNS_BLOCK_MODE selects the reply to blocked names: empty (default), nxdomain or nullip
+	blockMode := dns.BlockModeEmpty
+	if v := os.Getenv("DNS_BLOCK_MODE"); len(v) > 0 {
+		var err error
+		if blockMode, err = dns.ParseBlockMode(v); err != nil {
+			panic(err)
+		}
+	}
+
+	// DNS_UPSTREAM_PROTOCOL selects how queries are forwarded upstream: udp (default), tls or https
+	var fwd dns.Forwarder
+	switch v := os.Getenv("DNS_UPSTREAM_PROTOCOL"); v {
+	case "", "udp":
+		udp := &dns.DNSForwarder{Upstreams: upstreamResolverAddrs, PoolSize: upstreamPoolSize}
+		defer udp.Close()
+		fwd = udp
+	case "tls":
+		fwd = &dns.DoTForwarder{Upstreams: upstreamTLSResolverAddrs}
+	case "https":
+		doh := &dns.DoHForwarder{Upstreams: upstreamHTTPSResolverURLs}
+		defer doh.Close()
+		fwd = doh
+	default:
+		panic(fmt.Errorf("invalid DNS_UPSTREAM_PROTOCOL %q: should be udp, tls or https", v))
+	}
+
 	resolver := &dns.DNSResolver{
-		Fwd:     &dns.DNSForwarder{Upstream: upstreamResolverAddr},
+		Fwd:     fwd,
 		Records: store,
+		Zones:   localZones,
+
+		Blocklist: blocklist,
+		BlockMode: blockMode,
+	}
+
+	// DNS_RACE_UPSTREAM forwards recursive queries while local records are searched
+	if v := os.Getenv("DNS_RACE_UPSTREAM"); len(v) > 0 {
+		race, err := strconv.ParseBool(v)
+		if err != nil {
+			panic(fmt.Errorf("invalid DNS_RACE_UPSTREAM value %q: %w", v, err))
+		}
+		resolver.RaceUpstream = race
+	}
+
+	// DNS_QUERY_LOG enables the query log on stdout, in json or text format
+	switch v := os.Getenv("DNS_QUERY_LOG"); v {
+	case "":
+	case "json":
+		resolver.QueryLog = dns.NewSlogQueryLogger(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	case "text":
+		resolver.QueryLog = dns.NewSlogQueryLogger(slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	default:
+		panic(fmt.Errorf("invalid DNS_QUERY_LOG format %q: should be json or text", v))
 	}
 
 	srv := &DNSServer{Port: dnsServePort, Resolver: resolver}
 
+	// DNS_RATE_LIMIT limits the responses per second to every client, responses
+	// over the limit are truncated or dropped according to DNS_RATE_LIMIT_ACTION
+	if v := os.Getenv("DNS_RATE_LIMIT"); len(v) > 0 {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate <= 0 {
+			panic(fmt.Errorf("invalid DNS_RATE_LIMIT value %q: should be a positive number", v))
+		}
+		srv.RateLimiter = &dns.ResponseRateLimiter{Rate: rate}
+		if v := os.Getenv("DNS_RATE_LIMIT_ACTION"); len(v) > 0 {
+			if srv.RateLimiter.Action, err = dns.ParseRateLimitAction(v); err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
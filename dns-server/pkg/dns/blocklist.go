@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultBlockCategory is the category of blocklist entries that don't specify one
+const DefaultBlockCategory = "default"
+
+// BlockMode selects how the resolver replies to queries for blocked names.
+type BlockMode int
+
+const (
+	// BlockModeEmpty replies with no answers
+	BlockModeEmpty BlockMode = iota
+	// BlockModeNXDomain replies with a name error, as if the name didn't exist
+	BlockModeNXDomain
+	// BlockModeNullIP replies to A and AAAA queries with the unspecified
+	// address (0.0.0.0 or ::), and with no answers to other queries
+	BlockModeNullIP
+)
+
+// ParseBlockMode parses the name of a block mode: "empty", "nxdomain" or "nullip".
+func ParseBlockMode(s string) (BlockMode, error) {
+	switch strings.ToLower(s) {
+	case "empty":
+		return BlockModeEmpty, nil
+	case "nxdomain":
+		return BlockModeNXDomain, nil
+	case "nullip":
+		return BlockModeNullIP, nil
+	default:
+		return 0, fmt.Errorf("unknown block mode %q", s)
+	}
+}
+
+// DNSBlocklist contains the names the resolver refuses to resolve, keyed by
+// lowercase FQDN, along with the category they belong to (e.g. ads or tracking).
+//
+// Wildcard names like `*.ads.example.com.` block any subdomain of the name
+// following the leading `*.`, though not the name itself.
+type DNSBlocklist map[string]string
+
+// FromFile loads blocked names from a file.
+//
+// The file contains one name per line, optionally followed by its category:
+//
+// ; ad servers
+// *.ads.example.com.     ads
+// tracker.example.com.   tracking
+// malware.example.com.
+//
+// Lines that start with a `;` character are interpreted as comments and
+// blank lines are ignored. Names without a category belong to DefaultBlockCategory.
+func (bl DNSBlocklist) FromFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return bl.handleFromFile(file)
+}
+
+func (bl DNSBlocklist) handleFromFile(reader io.Reader) error {
+	scan := bufio.NewScanner(reader)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if strings.HasPrefix(line, ";") || len(line) == 0 {
+			continue
+		}
+		tokens := strings.Fields(line)
+		name := strings.ToLower(tokens[0])
+		switch len(tokens) {
+		case 1:
+			bl[name] = DefaultBlockCategory
+		case 2:
+			bl[name] = tokens[1]
+		default:
+			return fmt.Errorf("malformed blocklist entry %q. format should be 'ads.example.com.  [category]'", line)
+		}
+	}
+	return scan.Err()
+}
+
+// Lookup returns the category of the entry blocking name, matched
+// case-insensitively. Exact matches take precedence over wildcards, and the
+// most specific wildcard wins when several of them match the name.
+func (bl DNSBlocklist) Lookup(name string) (string, bool) {
+	return lookupName(bl, name)
+}
+
+// blockReply returns the reply to a query for a blocked name according to the block mode.
+func blockReply(req *DNS, q DNSQuestion, mode BlockMode) *DNS {
+	switch mode {
+	case BlockModeNXDomain:
+		reply := req.ReplyTo([]DNSResourceRecord{})
+		reply.ResponseCode = DNSResponseCodeNameError
+		return reply
+	case BlockModeNullIP:
+		switch q.Type {
+		case DNSTypeA:
+			return req.ReplyTo([]DNSResourceRecord{NewARecord(string(q.Name), net.IPv4zero, defaultAnswerTTL)})
+		case DNSTypeAAAA:
+			return req.ReplyTo([]DNSResourceRecord{NewAAAARecord(string(q.Name), net.IPv6zero, defaultAnswerTTL)})
+		}
+	}
+	return req.ReplyTo([]DNSResourceRecord{})
+}
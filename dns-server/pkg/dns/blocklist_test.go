@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// queryName resolves an A query for name
+func queryName(t *testing.T, resolver *DNSResolver, name string) []byte {
+	t.Helper()
+	req := getTestDNSRequest()
+	req.Questions[0].Name = []byte(name)
+	data, err := resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return data
+}
+
+// resolveName resolves an A query for name locally and decodes the reply
+func resolveName(t *testing.T, resolver *DNSResolver, name string) *DNS {
+	t.Helper()
+	reply := &DNS{}
+	if err := reply.Decode(queryName(t, resolver, name)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return reply
+}
+
+func TestBlocklistWildcardBlocksSubdomain(t *testing.T) {
+	bl := DNSBlocklist{}
+	if err := bl.handleFromFile(strings.NewReader(`; ad servers
+*.ads.example.com.   ads`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`tracker.ads.example.com.  10.0.0.1`))
+
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Records: *store, Blocklist: bl}
+
+	// the blocklist is consulted before local records
+	for _, name := range []string{"tracker.ads.example.com.", "a.b.ads.example.com."} {
+		reply := resolveName(t, resolver, name)
+		if len(reply.Answers) != 0 {
+			t.Fatalf("expected %s to be blocked, found answers %v", name, reply.Answers)
+		}
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+
+	// the wildcard doesn't match the parent domain, the request is forwarded
+	queryName(t, resolver, "ads.example.com.")
+	if mockFwd.NumCalled != 1 {
+		t.Fatalf("expected %d forwards, found %d", 1, mockFwd.NumCalled)
+	}
+}
+
+func TestBlockModes(t *testing.T) {
+	tests := []struct {
+		mode     BlockMode
+		rcode    DNSResponseCode
+		expected net.IP
+	}{
+		{BlockModeEmpty, DNSResponseCodeNoError, nil},
+		{BlockModeNXDomain, DNSResponseCodeNameError, nil},
+		{BlockModeNullIP, DNSResponseCodeNoError, net.IPv4zero},
+	}
+
+	for _, tt := range tests {
+		resolver := &DNSResolver{
+			Fwd:       &MockForwarder{},
+			Blocklist: DNSBlocklist{"ads.example.com.": DefaultBlockCategory},
+			BlockMode: tt.mode,
+		}
+
+		reply := resolveName(t, resolver, "ads.example.com.")
+		if reply.ResponseCode != tt.rcode {
+			t.Fatalf("mode %d: expected response code %d, found %d", tt.mode, tt.rcode, reply.ResponseCode)
+		}
+		if tt.expected == nil {
+			if len(reply.Answers) != 0 {
+				t.Fatalf("mode %d: expected no answers, found %v", tt.mode, reply.Answers)
+			}
+			continue
+		}
+		if len(reply.Answers) != 1 || !net.IP(reply.Answers[0].IP).Equal(tt.expected) {
+			t.Fatalf("mode %d: expected answer %s, found %v", tt.mode, tt.expected, reply.Answers)
+		}
+	}
+}
+
+func TestBlockModeAppliesToBlockedRecords(t *testing.T) {
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`ads.example.com.  BLOCK`))
+	resolver := &DNSResolver{Records: *store, BlockMode: BlockModeNXDomain}
+
+	if reply := resolveName(t, resolver, "ads.example.com."); reply.ResponseCode != DNSResponseCodeNameError {
+		t.Fatalf("expected response code %d, found %d", DNSResponseCodeNameError, reply.ResponseCode)
+	}
+}
+
+func TestBlockCategories(t *testing.T) {
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{
+		Fwd: mockFwd,
+		Blocklist: DNSBlocklist{
+			"ads.example.com.":     "ads",
+			"tracker.example.com.": "tracking",
+		},
+		BlockCategories: []string{"ads"},
+	}
+
+	resolveName(t, resolver, "ads.example.com.")
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+	// entries of categories that are not enforced are resolved
+	queryName(t, resolver, "tracker.example.com.")
+	if mockFwd.NumCalled != 1 {
+		t.Fatalf("expected %d forwards, found %d", 1, mockFwd.NumCalled)
+	}
+}
+
+func TestBlocklistIgnoresCase(t *testing.T) {
+	bl := DNSBlocklist{}
+	if err := bl.handleFromFile(strings.NewReader(`*.Ads.Example.COM.   ads
+Tracker.Example.com.  tracking`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := map[string]string{
+		"tracker.example.com.":    "tracking",
+		"TRACKER.EXAMPLE.COM.":    "tracking",
+		"banner.ads.example.com.": "ads",
+		"Banner.ADS.example.Com.": "ads",
+	}
+	for name, expected := range tests {
+		category, ok := bl.Lookup(name)
+		if !ok || category != expected {
+			t.Fatalf("expected %s to be blocked as %s, found %q", name, expected, category)
+		}
+	}
+
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Blocklist: bl}
+	if reply := resolveName(t, resolver, "Banner.Ads.Example.com."); len(reply.Answers) != 0 {
+		t.Fatalf("expected mixed-case name to be blocked, found answers %v", reply.Answers)
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+}
+
+func TestParseBlocklistRejectsMalformedEntries(t *testing.T) {
+	bl := DNSBlocklist{}
+	if err := bl.handleFromFile(strings.NewReader(`ads.example.com. ads extra`)); err == nil {
+		t.Fatal("expected error for malformed entry, found nil")
+	}
+}
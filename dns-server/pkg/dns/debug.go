@@ -0,0 +1,22 @@
+package dns
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// debugLogger receives debug messages from the package. Debug logging is off by default.
+var debugLogger atomic.Pointer[log.Logger]
+
+// SetDebugLogger enables debug logging of decoded messages to the given logger.
+// Passing a nil logger turns debug logging off.
+func SetDebugLogger(l *log.Logger) {
+	debugLogger.Store(l)
+}
+
+// debugf prints a debug message if debug logging is enabled.
+func debugf(format string, v ...any) {
+	if l := debugLogger.Load(); l != nil {
+		l.Printf(format, v...)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 )
 
@@ -17,12 +18,20 @@ import (
 // This package DOES NOT fully implement DNS specifications as it's
 // only meant to be used as part of this toy project and an opportunity
 // to learn how to read and send UDP datagrams.
-type DNSSOA struct{}
 type DNSSRV struct{}
-type DNSMX struct{}
 type DNSOPT struct{}
 type DNSURI struct{}
 
+const (
+	maxLabelLength = 63  // maximum length of a single name label
+	maxNameLength  = 255 // maximum length of an encoded name
+	maxTXTLength   = 255 // maximum length of a single TXT character-string
+
+	// maxPointerJumps is the maximum number of compression pointers
+	// followed while decoding a single name
+	maxPointerJumps = 16
+)
+
 type DNSOpCode uint8
 
 const (
@@ -62,6 +71,7 @@ const (
 	DNSTypeMINFO DNSType = 14 // mailbox or mail list information
 	DNSTypeMX    DNSType = 15 // mail exchange
 	DNSTypeTXT   DNSType = 16 // text strings
+	DNSTypeAAAA  DNSType = 28 // an IPv6 host address (RFC 3596)
 )
 
 type DNSClass uint16
@@ -105,26 +115,25 @@ func (q *DNSQuestion) Decode(data []byte, offset int) (int, error) {
 	}
 
 	roff := nameOff + offset
+	if roff+4 > len(data) {
+		return 0, errDNSPacketTooShort
+	}
 	q.Type = DNSType(unpackUint16(data, roff))
 	q.Class = DNSClass(unpackUint16(data, roff+2))
 
 	return nameOff + 4, nil
 }
 
-// Encode binary data from a DNSQuestion struct
-func (q *DNSQuestion) Encode(bytes []byte, offset int) int {
-	nameOff := encodeName(q.Name, bytes, offset)
-
-	roff := nameOff + offset
-	packUint16(bytes, roff, uint16(q.Type))
-	packUint16(bytes, roff+2, uint16(q.Class))
-
-	return nameOff + 4
-}
+// Encode appends the binary data of a DNSQuestion struct to the buffer
+func (q *DNSQuestion) Encode(b []byte) ([]byte, error) {
+	b, err := appendName(b, q.Name)
+	if err != nil {
+		return nil, err
+	}
 
-func (q *DNSQuestion) computeSize() int {
-	// Name len + name termination + dnsType + dnsClass
-	return len(q.Name) + 1 + 4
+	b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
+	b = binary.BigEndian.AppendUint16(b, uint16(q.Class))
+	return b, nil
 }
 
 // String representation of the DNSQuestion struct
@@ -138,6 +147,135 @@ func (q *DNSQuestion) String() string {
 	return buf.String()
 }
 
+// DNSSOA represents the RDATA of a SOA record, marking the start of a zone of authority
+//
+// 0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// /                     MNAME                     /
+// /                                               /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// /                     RNAME                     /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    SERIAL                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    REFRESH                    |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                     RETRY                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    EXPIRE                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    MINIMUM                    |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+type DNSSOA struct {
+	MName   []byte // primary name server of the zone
+	RName   []byte // mailbox of the person responsible for the zone
+	Serial  uint32 // version number of the zone
+	Refresh uint32 // seconds before the zone should be refreshed
+	Retry   uint32 // seconds before a failed refresh should be retried
+	Expire  uint32 // seconds before the zone is no longer authoritative
+	Minimum uint32 // minimum TTL for records of the zone
+}
+
+// Decode the DNSSOA struct from binary data.
+// Names are decoded from the whole datagram as they can use compression pointers.
+func (soa *DNSSOA) Decode(data []byte, offset int) (int, error) {
+	var err error
+	var mNameOff, rNameOff int
+	soa.MName, mNameOff, err = decodeName(data, offset)
+	if err != nil {
+		return 0, err
+	}
+	soa.RName, rNameOff, err = decodeName(data, offset+mNameOff)
+	if err != nil {
+		return 0, err
+	}
+
+	roff := offset + mNameOff + rNameOff
+	if roff+20 > len(data) {
+		return 0, errDNSPacketTooShort
+	}
+	soa.Serial = unpackUint32(data, roff)
+	soa.Refresh = unpackUint32(data, roff+4)
+	soa.Retry = unpackUint32(data, roff+8)
+	soa.Expire = unpackUint32(data, roff+12)
+	soa.Minimum = unpackUint32(data, roff+16)
+
+	return mNameOff + rNameOff + 20, nil
+}
+
+// Encode appends the binary data of a DNSSOA struct to the buffer
+func (soa *DNSSOA) Encode(b []byte) ([]byte, error) {
+	b, err := appendName(b, soa.MName)
+	if err != nil {
+		return nil, err
+	}
+	b, err = appendName(b, soa.RName)
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.BigEndian.AppendUint32(b, soa.Serial)
+	b = binary.BigEndian.AppendUint32(b, soa.Refresh)
+	b = binary.BigEndian.AppendUint32(b, soa.Retry)
+	b = binary.BigEndian.AppendUint32(b, soa.Expire)
+	b = binary.BigEndian.AppendUint32(b, soa.Minimum)
+	return b, nil
+}
+
+// String representation of the DNSSOA struct
+func (soa *DNSSOA) String() string {
+	return fmt.Sprintf("MName: %s RName: %s Serial: %d Refresh: %d Retry: %d Expire: %d Minimum: %d",
+		soa.MName, soa.RName, soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+}
+
+// DNSMX represents the RDATA of a MX record, naming a host willing to act as
+// a mail exchange for the owner name
+//
+// 0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                  PREFERENCE                   |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// /                   EXCHANGE                    /
+// /                                               /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+type DNSMX struct {
+	Preference uint16 // lower values are preferred among the exchanges of a name
+	Exchange   []byte // host acting as mail exchange
+}
+
+// Decode the DNSMX struct from binary data.
+// The exchange is decoded from the whole datagram as it can use compression pointers.
+func (mx *DNSMX) Decode(data []byte, offset int) (int, error) {
+	if offset+2 > len(data) {
+		return 0, errDNSPacketTooShort
+	}
+	mx.Preference = unpackUint16(data, offset)
+
+	var err error
+	var exchangeOff int
+	mx.Exchange, exchangeOff, err = decodeName(data, offset+2)
+	if err != nil {
+		return 0, err
+	}
+	return 2 + exchangeOff, nil
+}
+
+// Encode appends the binary data of a DNSMX struct to the buffer
+func (mx *DNSMX) Encode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, mx.Preference)
+	return appendName(b, mx.Exchange)
+}
+
+// String representation of the DNSMX struct
+func (mx *DNSMX) String() string {
+	return fmt.Sprintf("Preference: %d Exchange: %s", mx.Preference, mx.Exchange)
+}
+
 // DNSResourceRecord represents a RR in the datagram
 //
 // 0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
@@ -189,6 +327,9 @@ func (r *DNSResourceRecord) Decode(data []byte, offset int) (int, error) {
 		return 0, err
 	}
 	roff := nameOff + offset
+	if roff+10 > len(data) {
+		return 0, errDNSPacketTooShort
+	}
 
 	r.Type = DNSType(unpackUint16(data, roff))
 	r.Class = DNSClass(unpackUint16(data, roff+2))
@@ -196,58 +337,128 @@ func (r *DNSResourceRecord) Decode(data []byte, offset int) (int, error) {
 	r.RDLenght = unpackUint16(data, roff+8)
 
 	rdEnd := roff + 10 + int(r.RDLenght)
+	if rdEnd > len(data) {
+		return 0, errDNSPacketTooShort
+	}
 	r.RData = data[roff+10 : rdEnd]
-	if err := r.decodeRData(); err != nil {
+	if err := r.decodeRData(data, roff+10); err != nil {
 		return 0, err
 	}
 
 	return nameOff + 10 + int(r.RDLenght), nil
 }
 
-// decodeRData into struct properties
-func (r *DNSResourceRecord) decodeRData() error {
-	fmt.Println(r.Type)
+// decodeRData into struct properties.
+// The whole datagram is needed to decode compressed names, rdOffset is the
+// position of the RData in the datagram.
+func (r *DNSResourceRecord) decodeRData(data []byte, rdOffset int) error {
+	debugf("decoding rdata for record %s type %d", r.Name, r.Type)
 	switch r.Type {
-	// For the purpose of this project we only decode RData for A records
-	case DNSTypeA:
+	// For the purpose of this project we only decode RData for A, AAAA, NS, CNAME, TXT, SOA and MX records
+	case DNSTypeA, DNSTypeAAAA:
 		r.IP = r.RData
+	case DNSTypeNS, DNSTypeCNAME:
+		name, n, err := decodeName(data, rdOffset)
+		if err != nil {
+			return err
+		}
+		if n > int(r.RDLenght) {
+			return errRDataOverflow
+		}
+		if r.Type == DNSTypeNS {
+			r.NS = name
+		} else {
+			r.CNAME = name
+		}
+	case DNSTypeTXT:
+		r.TXTs = r.TXTs[:0]
+		for off := 0; off < len(r.RData); {
+			end := off + 1 + int(r.RData[off])
+			if end > len(r.RData) {
+				return errRDataOverflow
+			}
+			r.TXTs = append(r.TXTs, r.RData[off+1:end])
+			off = end
+		}
+	case DNSTypeSOA:
+		n, err := r.SOA.Decode(data, rdOffset)
+		if err != nil {
+			return err
+		}
+		if n > int(r.RDLenght) {
+			return errRDataOverflow
+		}
+	case DNSTypeMX:
+		n, err := r.MX.Decode(data, rdOffset)
+		if err != nil {
+			return err
+		}
+		if n > int(r.RDLenght) {
+			return errRDataOverflow
+		}
 	}
 	return nil
 }
 
-func (r *DNSResourceRecord) computeSize() int {
-	rSize := len(r.Name) + 1
+// Encode appends the binary data of a DNSResourceRecord struct to the buffer.
+// RDLENGTH is set to the size of the encoded RDATA.
+func (r *DNSResourceRecord) Encode(b []byte) ([]byte, error) {
+	b, err := appendName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Type))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Class))
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+	// RDLENGTH is filled in once RDATA is encoded
+	rdLengthOff := len(b)
+	b = append(b, 0x00, 0x00)
+	rdOff := len(b)
 
 	switch r.Type {
+	// For the purpose of this project we only encode RData for A, AAAA, NS, CNAME, TXT, SOA and MX records
 	case DNSTypeA:
-		// IP addr
-		rSize += 4
+		b = appendIP(b, r.IP.To4(), net.IPv4len)
+	case DNSTypeAAAA:
+		b = appendIP(b, r.IP.To16(), net.IPv6len)
+	case DNSTypeNS:
+		b, err = appendName(b, r.NS)
+	case DNSTypeCNAME:
+		b, err = appendName(b, r.CNAME)
+	case DNSTypeTXT:
+		for _, txt := range r.TXTs {
+			if len(txt) > maxTXTLength {
+				return nil, errTXTTooLong
+			}
+			b = append(b, byte(len(txt)))
+			b = append(b, txt...)
+		}
+	case DNSTypeSOA:
+		b, err = r.SOA.Encode(b)
+	case DNSTypeMX:
+		b, err = r.MX.Encode(b)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return rSize + 10
+	rdLength := len(b) - rdOff
+	if rdLength > math.MaxUint16 {
+		return nil, errRDataTooLong
+	}
+	r.RDLenght = uint16(rdLength)
+	binary.BigEndian.PutUint16(b[rdLengthOff:], r.RDLenght)
+	return b, nil
 }
 
-// Encode DNSResourceRecord struct into binary data for transport
-func (r *DNSResourceRecord) Encode(bytes []byte, offset int) int {
-	nameOff := encodeName(r.Name, bytes, offset)
-	roff := nameOff + offset
-
-	packUint16(bytes, roff, uint16(r.Type))
-	packUint16(bytes, roff+2, uint16(r.Class))
-	packUint32(bytes, roff+4, r.TTL)
-
-	switch r.Type {
-	case DNSTypeA:
-		copy(bytes[roff+10:], r.IP.To4())
-		r.RDLenght = uint16(4)
-		packUint16(bytes, roff+8, r.RDLenght)
-		return nameOff + 10 + 4
-	default:
-		// For the purpose of this project we only encode RData for A records
-		r.RDLenght = uint16(0)
-		packUint16(bytes, roff+8, r.RDLenght)
-		return nameOff + 10
+// appendIP appends the address to the buffer. Invalid addresses are
+// encoded as the unspecified address.
+func appendIP(b []byte, ip net.IP, size int) []byte {
+	if len(ip) != size {
+		return append(b, make([]byte, size)...)
 	}
+	return append(b, ip...)
 }
 
 // String representation of the DNSResourceRecord
@@ -256,7 +467,20 @@ func (r *DNSResourceRecord) String() string {
 	buf.WriteString(fmt.Sprintf("Name: %s ", r.Name))
 	buf.WriteString(fmt.Sprintf("Type: %d ", r.Type))
 	buf.WriteString(fmt.Sprintf("Class: %d ", r.Class))
-	buf.WriteString(fmt.Sprintf("IP: %s ", r.IP))
+	switch r.Type {
+	case DNSTypeNS:
+		buf.WriteString(fmt.Sprintf("NS: %s ", r.NS))
+	case DNSTypeCNAME:
+		buf.WriteString(fmt.Sprintf("CNAME: %s ", r.CNAME))
+	case DNSTypeTXT:
+		buf.WriteString(fmt.Sprintf("TXT: %q ", r.TXTs))
+	case DNSTypeSOA:
+		buf.WriteString(r.SOA.String())
+	case DNSTypeMX:
+		buf.WriteString(r.MX.String())
+	default:
+		buf.WriteString(fmt.Sprintf("IP: %s ", r.IP))
+	}
 	return buf.String()
 }
 
@@ -314,23 +538,18 @@ func (head *DNSHeader) Decode(data []byte) int {
 	return 12
 }
 
-// Encode DNSHeader struct into binary representation for transport
-func (head *DNSHeader) Encode(bytes []byte, offset int) int {
-
-	packUint16(bytes, 0, head.ID)
-	bytes[2] = b2i(head.QR)<<7 | uint8(head.Opcode<<3) | b2i(head.AA)<<2 | b2i(head.TC)<<1 | b2i(head.RD)
-	bytes[3] = b2i(head.RA)<<7 | head.Z<<4 | byte(head.ResponseCode)
-
-	packUint16(bytes, 4, head.QDCount)
-	packUint16(bytes, 6, head.ANCount)
-	packUint16(bytes, 8, head.NSCount)
-	packUint16(bytes, 10, head.ARCount)
-
-	return 12
-}
-
-func (head *DNSHeader) computeSize() int {
-	return 12
+// Encode appends the binary representation of the DNSHeader struct to the buffer
+func (head *DNSHeader) Encode(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, head.ID)
+	b = append(b,
+		b2i(head.QR)<<7|uint8(head.Opcode<<3)|b2i(head.AA)<<2|b2i(head.TC)<<1|b2i(head.RD),
+		b2i(head.RA)<<7|head.Z<<4|byte(head.ResponseCode))
+
+	b = binary.BigEndian.AppendUint16(b, head.QDCount)
+	b = binary.BigEndian.AppendUint16(b, head.ANCount)
+	b = binary.BigEndian.AppendUint16(b, head.NSCount)
+	b = binary.BigEndian.AppendUint16(b, head.ARCount)
+	return b
 }
 
 // DNS struct represents the whole DNS datagram as per RFC 1034 - RFC 1035 specifications.
@@ -396,39 +615,30 @@ func (d *DNS) Decode(data []byte) error {
 }
 
 // Serialize a DNS struct into binary data for transport.
-func (d *DNS) Serialize() []byte {
-	dgSize := d.DNSHeader.computeSize()
-
-	for _, q := range d.Questions {
-		// question + final byte + type + class
-		dgSize += len(q.Name) + 1 + 4
-	}
-
-	for _, rr := range d.Answers {
-		dgSize += rr.computeSize()
-	}
-	for _, rr := range d.Authorities {
-		dgSize += rr.computeSize()
-	}
-	dgSize += len(d.Additionals)
-
-	bytes := make([]byte, dgSize)
-	offset := d.DNSHeader.Encode(bytes, 0)
+// An error is returned if the struct contains names that can't be encoded.
+func (d *DNS) Serialize() ([]byte, error) {
+	// most datagrams fit in a single UDP packet, the buffer grows otherwise
+	b := make([]byte, 0, MaxDNSDatagramSize)
+	b = d.DNSHeader.Encode(b)
 
+	var err error
 	for _, q := range d.Questions {
-		offset += q.Encode(bytes, offset)
+		if b, err = q.Encode(b); err != nil {
+			return nil, err
+		}
 	}
-
 	for _, an := range d.Answers {
-		offset += an.Encode(bytes, offset)
+		if b, err = an.Encode(b); err != nil {
+			return nil, err
+		}
 	}
 	for _, ns := range d.Authorities {
-		offset += ns.Encode(bytes, offset)
+		if b, err = ns.Encode(b); err != nil {
+			return nil, err
+		}
 	}
 
-	copy(bytes[offset:], d.Additionals)
-
-	return bytes
+	return append(b, d.Additionals...), nil
 }
 
 // ReplyTo DNS request with resource records.
@@ -449,17 +659,30 @@ func (d *DNS) ReplyTo(rr []DNSResourceRecord) *DNS {
 
 	reply.ResponseCode = d.ResponseCode
 	reply.QDCount = d.QDCount
-	reply.ANCount = uint16(len(rr))
 	reply.NSCount = d.NSCount
 	reply.ARCount = d.ARCount
 
 	reply.Questions = d.Questions
-	reply.Answers = append(reply.Answers, rr...)
+	reply.AddAnswer(rr...)
 	reply.Authorities = d.Authorities
 	reply.Additionals = d.Additionals
 	return reply
 }
 
+// AddAnswer appends resource records to the answer section and updates
+// the header ANCount accordingly.
+func (d *DNS) AddAnswer(rr ...DNSResourceRecord) {
+	d.Answers = append(d.Answers, rr...)
+	d.ANCount = uint16(len(d.Answers))
+}
+
+// AddAuthority appends resource records to the authority section and updates
+// the header NSCount accordingly.
+func (d *DNS) AddAuthority(rr ...DNSResourceRecord) {
+	d.Authorities = append(d.Authorities, rr...)
+	d.NSCount = uint16(len(d.Authorities))
+}
+
 // String representation of the DNS struct
 func (d *DNS) String() string {
 	var buf bytes.Buffer
@@ -496,17 +719,32 @@ func (d *DNS) String() string {
 
 // decodeName decodes the dns record name from transport bytes and returns
 // the number of bytes consumed.
+// Compression pointers are followed up to maxPointerJumps times to protect
+// against crafted packets with pointer loops.
 func decodeName(data []byte, offset int) ([]byte, int, error) {
 	readOff := offset
+	// consumed is set when the first pointer is followed, as the bytes
+	// read after the jump don't belong to the current record.
+	consumed := -1
+	jumps := 0
 	var name []byte
 	for {
+		if readOff >= len(data) {
+			return nil, 0, errDNSPacketTooShort
+		}
 		switch data[readOff] & 0xc0 {
 		default:
 			// labels
 			length := int(data[readOff])
 			readOff++
 			if length == 0 {
-				return name, readOff - offset, nil
+				if consumed < 0 {
+					consumed = readOff - offset
+				}
+				return name, consumed, nil
+			}
+			if readOff+length > len(data) {
+				return nil, 0, errDNSPacketTooShort
 			}
 			name = append(name, data[readOff:readOff+length]...)
 			name = append(name, '.')
@@ -514,13 +752,17 @@ func decodeName(data []byte, offset int) ([]byte, int, error) {
 			readOff += length
 		case 0xc0:
 			// label pointer
-			ptr := unpackUint16(data, readOff) & 0x3fff
-			label, _, err := decodeName(data, int(ptr))
-			if err != nil {
-				return nil, 0, err
+			if readOff+2 > len(data) {
+				return nil, 0, errDNSPacketTooShort
+			}
+			if jumps == maxPointerJumps {
+				return nil, 0, errPointerLoop
 			}
-			name = append(name, label...)
-			return name, readOff - offset + 2, nil
+			jumps++
+			if consumed < 0 {
+				consumed = readOff - offset + 2
+			}
+			readOff = int(unpackUint16(data, readOff) & 0x3fff)
 		case 0x80:
 			return nil, 0, errReservedForFutureUse
 		case 0x40:
@@ -529,27 +771,27 @@ func decodeName(data []byte, offset int) ([]byte, int, error) {
 	}
 }
 
-// encodeName encodes the dns record name as bytes and returns the number
-// of bytes added to the buffer.
-func encodeName(name []byte, bytes []byte, offset int) int {
-	if len(name) == 0 {
-		bytes[offset] = 0x00
-		return 1
+// appendName appends the encoded dns record name to the buffer.
+// Names with labels longer than 63 bytes or longer than 255 bytes once encoded
+// are rejected, as per RFC 1035 section 2.3.4.
+func appendName(b []byte, name []byte) ([]byte, error) {
+	// names are fully qualified, the trailing dot is replaced by the
+	// terminating zero-length label
+	name = bytes.TrimSuffix(name, []byte("."))
+	if len(name)+2 > maxNameLength {
+		return nil, errNameTooLong
 	}
 
-	length := 0
-	for i := range name {
-		if name[i] == '.' {
-			bytes[offset+i-length] = byte(length)
-			length = 0
-		} else {
-			bytes[offset+i+1] = name[i]
-			length++
+	for len(name) > 0 {
+		label, rest, _ := bytes.Cut(name, []byte("."))
+		if len(label) > maxLabelLength {
+			return nil, errLabelTooLong
 		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+		name = rest
 	}
-
-	bytes[offset+len(name)+1] = 0x00
-	return len(name) + 1
+	return append(b, 0x00), nil
 }
 
 // convert boolean value to bit representation
@@ -584,17 +826,38 @@ func packUint16(bytes []byte, offset int, v uint16) {
 	binary.BigEndian.PutUint16(bytes[offset:], v)
 }
 
-// pack uint32 variable into byte slice
-func packUint32(bytes []byte, offset int, v uint32) {
-	if offset+4 > len(bytes) {
-		panic(errNotEnoughBytes)
-	}
-	binary.BigEndian.PutUint32(bytes[offset:], v)
-}
-
 var (
 	errNotImplemented       = errors.New("not implemented yet")
 	errDNSPacketTooShort    = errors.New("dns packet too short")
 	errNotEnoughBytes       = errors.New("not enough bytes to unpack")
 	errReservedForFutureUse = errors.New("reserved for future use")
+	errLabelTooLong         = errors.New("dns label exceeds 63 bytes")
+	errNameTooLong          = errors.New("dns name exceeds 255 bytes")
+	errPointerLoop          = errors.New("too many compression pointers in dns name")
+	errTXTTooLong           = errors.New("dns txt string exceeds 255 bytes")
+	errRDataOverflow        = errors.New("dns record data exceeds its declared length")
+	errRDataTooLong         = errors.New("dns record data exceeds 65535 bytes")
 )
+
+// truncateReply returns the header and questions of the reply with the TC bit set,
+// telling the client to retry over TCP.
+func truncateReply(reply []byte) ([]byte, error) {
+	if len(reply) < 12 {
+		return nil, errDNSPacketTooShort
+	}
+	head := &DNSHeader{}
+	offset := head.Decode(reply)
+	for i := 0; i < int(head.QDCount); i++ {
+		var q DNSQuestion
+		n, err := q.Decode(reply, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+
+	head.TC = true
+	head.ANCount, head.NSCount, head.ARCount = 0, 0, 0
+	truncated := head.Encode(make([]byte, 0, offset))
+	return append(truncated, reply[12:offset]...), nil
+}
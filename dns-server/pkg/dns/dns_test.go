@@ -1,7 +1,14 @@
 package dns
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -91,9 +98,257 @@ func TestEncodeRegression(t *testing.T) {
 		IP:    []byte{52, 94, 236, 248},
 	}
 
-	bytes := req.ReplyTo(answers).Serialize()
+	bytes, err := req.ReplyTo(answers).Serialize()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
 
 	if !slices.Equal(bytes, testEncodingRegression) {
 		t.Fatal("DNS packet encoding regression found.")
 	}
 }
+
+func TestSerializeMixedRecords(t *testing.T) {
+	req := getTestDNSRequest()
+	// TXT records larger than a UDP datagram make the buffer grow
+	txt := strings.Repeat("t", maxTXTLength)
+	reply := req.ReplyTo([]DNSResourceRecord{
+		NewARecord("www.acme.com.", net.ParseIP("10.0.0.1"), 60),
+		NewTXTRecord("www.acme.com.", 60, txt, txt, txt),
+		NewCNAMERecord("alias.acme.com.", "www.acme.com.", 60),
+		NewAAAARecord("www.acme.com.", net.ParseIP("2001:db8::1"), 60),
+	})
+	reply.AddAuthority(NewNSRecord("acme.com.", "ns1.acme.com.", 60))
+
+	data := serialize(t, reply)
+	if len(data) <= MaxDNSDatagramSize {
+		t.Fatalf("expected datagram larger than %d bytes, found %d", MaxDNSDatagramSize, len(data))
+	}
+
+	decoded := &DNS{}
+	if err := decoded.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Answers) != 4 || len(decoded.Authorities) != 1 {
+		t.Fatalf("expected %d answers and %d authorities, found %d and %d",
+			4, 1, len(decoded.Answers), len(decoded.Authorities))
+	}
+	if !net.IP(decoded.Answers[0].IP).Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected ip %s, found %s", "10.0.0.1", decoded.Answers[0].IP)
+	}
+	if txts := decoded.Answers[1].TXTs; len(txts) != 3 || string(txts[2]) != txt {
+		t.Fatalf("expected %d TXT strings, found %q", 3, txts)
+	}
+	if cname := string(decoded.Answers[2].CNAME); cname != "www.acme.com." {
+		t.Fatalf("expected cname %s, found %s", "www.acme.com.", cname)
+	}
+	if !net.IP(decoded.Answers[3].IP).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected ip %s, found %s", "2001:db8::1", decoded.Answers[3].IP)
+	}
+	if ns := string(decoded.Authorities[0].NS); ns != "ns1.acme.com." {
+		t.Fatalf("expected ns %s, found %s", "ns1.acme.com.", ns)
+	}
+}
+
+func TestEncodeRejectsLongLabel(t *testing.T) {
+	label := strings.Repeat("a", 64)
+	req := &DNS{}
+	req.QDCount = 1
+	req.Questions = []DNSQuestion{
+		{Name: []byte(label + ".com."), Type: DNSTypeA, Class: DNSClassIN},
+	}
+
+	_, err := req.Serialize()
+	if !errors.Is(err, errLabelTooLong) {
+		t.Fatalf("expected error %v, found %v", errLabelTooLong, err)
+	}
+
+	// labels of exactly 63 bytes are valid
+	req.Questions[0].Name = []byte(label[1:] + ".com.")
+	if _, err := req.Serialize(); err != nil {
+		t.Fatalf("unexpected error for 63 bytes label: %v", err)
+	}
+}
+
+func TestEncodeRejectsLongName(t *testing.T) {
+	// 5 labels of 50 bytes encode to 256 bytes with the terminating zero
+	name := strings.Repeat(strings.Repeat("a", 50)+".", 5)
+	req := &DNS{}
+	req.ANCount = 1
+	req.Answers = []DNSResourceRecord{
+		{Name: []byte(name), Type: DNSTypeA, Class: DNSClassIN, IP: []byte{127, 0, 0, 1}},
+	}
+
+	_, err := req.Serialize()
+	if !errors.Is(err, errNameTooLong) {
+		t.Fatalf("expected error %v, found %v", errNameTooLong, err)
+	}
+}
+
+func TestDecodeNameRejectsPointerLoop(t *testing.T) {
+	// header + question name pointing to itself
+	data := append(slices.Clone(testQuery[:12]), 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01)
+
+	result := &DNS{}
+	err := result.Decode(data)
+	if !errors.Is(err, errPointerLoop) {
+		t.Fatalf("expected error %v, found %v", errPointerLoop, err)
+	}
+}
+
+func TestDecodeNameRejectsTruncatedLabel(t *testing.T) {
+	// truncated in the middle of the "amazon" label
+	data := slices.Clone(testQuery[:16])
+
+	result := &DNS{}
+	err := result.Decode(data)
+	if !errors.Is(err, errDNSPacketTooShort) {
+		t.Fatalf("expected error %v, found %v", errDNSPacketTooShort, err)
+	}
+}
+
+func TestDecodeRejectsTruncatedPackets(t *testing.T) {
+	// the first answer of testQueryResponse starts at offset 28 with a 2-byte
+	// name pointer, its RDLENGTH is at offset 38 and its RDATA at offset 40
+	overflow := slices.Clone(testQueryResponse)
+	overflow[38], overflow[39] = 0x00, 0x40
+
+	testCases := map[string][]byte{
+		"after question name":      testQueryResponse[:24],
+		"inside question class":    testQueryResponse[:27],
+		"after answer name":        testQueryResponse[:30],
+		"inside answer header":     testQueryResponse[:34],
+		"inside answer rdata":      testQueryResponse[:42],
+		"rdlength past the packet": overflow,
+	}
+	for name, data := range testCases {
+		t.Run(name, func(t *testing.T) {
+			result := &DNS{}
+			if err := result.Decode(data); !errors.Is(err, errDNSPacketTooShort) {
+				t.Fatalf("expected error %v, found %v", errDNSPacketTooShort, err)
+			}
+		})
+	}
+}
+
+// testReply returns a serialized reply with an A record in the answer section.
+func testReply(t *testing.T) []byte {
+	t.Helper()
+	an := NewARecord("amazon.com.", net.ParseIP("127.0.0.1"), 60)
+	return serialize(t, getTestDNSRequest().ReplyTo([]DNSResourceRecord{an}))
+}
+
+func TestDecodeDoesNotPrint(t *testing.T) {
+	data := testReply(t)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	reply := &DNS{}
+	decodeErr := reply.Decode(data)
+	w.Close()
+	os.Stdout = stdout
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodeErr != nil {
+		t.Fatalf("%v", decodeErr)
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	if len(out) > 0 {
+		t.Fatalf("expected no output while decoding, found %q", out)
+	}
+}
+
+func TestDecodeDebugLogging(t *testing.T) {
+	var buf bytes.Buffer
+	SetDebugLogger(log.New(&buf, "", 0))
+	defer SetDebugLogger(nil)
+
+	reply := &DNS{}
+	if err := reply.Decode(testReply(t)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(buf.String(), "amazon.com.") {
+		t.Fatalf("expected debug log for decoded record, found %q", buf.String())
+	}
+}
+
+func TestSOARoundTrip(t *testing.T) {
+	soa := DNSSOA{
+		MName:   []byte("ns1.example.com."),
+		RName:   []byte("admin.example.com."),
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: 300,
+	}
+	an := DNSResourceRecord{
+		Name:  []byte("example.com."),
+		Type:  DNSTypeSOA,
+		Class: DNSClassIN,
+		TTL:   60,
+		SOA:   soa,
+	}
+	data := serialize(t, getTestDNSRequest().ReplyTo([]DNSResourceRecord{an}))
+
+	reply := &DNS{}
+	if err := reply.Decode(data); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	found := reply.Answers[0]
+	if found.Type != DNSTypeSOA {
+		t.Fatalf("expected record type %d, found %d", DNSTypeSOA, found.Type)
+	}
+	// names + name terminations + 5 uint32 values
+	rdLength := len(soa.MName) + 1 + len(soa.RName) + 1 + 20
+	if int(found.RDLenght) != rdLength {
+		t.Fatalf("expected rdata length %d, found %d", rdLength, found.RDLenght)
+	}
+	if found.SOA.String() != soa.String() {
+		t.Fatalf("expected SOA %s, found %s", soa.String(), found.SOA.String())
+	}
+}
+
+func TestSOADecodeCompressedNames(t *testing.T) {
+	// SOA rdata with names pointing to the question name (offset 12)
+	data := serialize(t, getTestDNSRequest())
+	rdata := []byte{0xc0, 0x0c, 0x05, 'a', 'd', 'm', 'i', 'n', 0xc0, 0x0c}
+	rdata = append(rdata, make([]byte, 20)...)
+	rdata[len(rdata)-1] = 60 // minimum
+
+	offset := len(data)
+	data = append(data, rdata...)
+
+	var soa DNSSOA
+	n, err := soa.Decode(data, offset)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n != len(rdata) {
+		t.Fatalf("expected %d bytes consumed, found %d", len(rdata), n)
+	}
+	if string(soa.MName) != "example.com." || string(soa.RName) != "admin.example.com." {
+		t.Fatalf("unexpected SOA names %s %s", soa.MName, soa.RName)
+	}
+	if soa.Minimum != 60 {
+		t.Fatalf("expected minimum %d, found %d", 60, soa.Minimum)
+	}
+
+	if _, err := soa.Decode(data[:len(data)-1], offset); !errors.Is(err, errDNSPacketTooShort) {
+		t.Fatalf("expected error %v, found %v", errDNSPacketTooShort, err)
+	}
+}
@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpClient is a persistent UDP connection to an upstream DNS server.
+//
+// Multiple queries can be in flight on the same connection at any time: every
+// query is sent with a random transaction ID that is unique among the pending
+// ones, and replies are matched to their query by ID. Replies that don't match
+// a pending query are discarded.
+type udpClient struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	closed  bool
+	done    chan struct{}
+}
+
+// dialUDPClient connects to the upstream server and starts receiving replies.
+func dialUDPClient(upstream string, timeout time.Duration) (*udpClient, error) {
+	conn, err := net.DialTimeout("udp", upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &udpClient{
+		conn:    conn,
+		pending: map[uint16]chan []byte{},
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop receives replies from the upstream server and delivers them to the
+// pending queries until the connection is closed.
+func (c *udpClient) readLoop() {
+	defer c.Close()
+
+	buf := make([]byte, MaxDNSDatagramSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 {
+			continue
+		}
+
+		id := unpackUint16(buf, 0)
+		c.mu.Lock()
+		replyCh, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if ok {
+			reply := make([]byte, n)
+			copy(reply, buf[:n])
+			// channels are buffered, this never blocks
+			replyCh <- reply
+		}
+	}
+}
+
+// register a new pending query and return its transaction ID.
+func (c *udpClient) register(replyCh chan []byte) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errClientClosed
+	}
+	for {
+		id, err := newTransactionID()
+		if err != nil {
+			return 0, err
+		}
+		if _, taken := c.pending[id]; !taken {
+			c.pending[id] = replyCh
+			return id, nil
+		}
+	}
+}
+
+func (c *udpClient) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// exchange sends the request upstream and waits for the matching reply, until
+// the timeout expires or ctx is cancelled.
+// The client's original transaction ID is restored in the reply.
+func (c *udpClient) exchange(ctx context.Context, req []byte, timeout time.Duration) ([]byte, error) {
+	replyCh := make(chan []byte, 1)
+	id, err := c.register(replyCh)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	if _, err := c.conn.Write(withTransactionID(req, id)); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replyCh:
+		packUint16(reply, 0, unpackUint16(req, 0))
+		return reply, nil
+	case <-c.done:
+		return nil, errClientClosed
+	case <-timer.C:
+		return nil, errUpstreamTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// isClosed returns true if the client connection is no longer usable.
+func (c *udpClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Close the client connection. Pending queries are failed immediately.
+func (c *udpClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return c.conn.Close()
+}
+
+// udpPool is a fixed-size pool of persistent connections to the same upstream server.
+// Queries are distributed over the connections in round-robin fashion and broken
+// connections are replaced on the next use.
+type udpPool struct {
+	upstream string
+	timeout  time.Duration
+	next     atomic.Uint32
+
+	mu      sync.Mutex
+	clients []*udpClient
+	closed  bool
+}
+
+func newUDPPool(upstream string, size int, timeout time.Duration) *udpPool {
+	return &udpPool{
+		upstream: upstream,
+		timeout:  timeout,
+		clients:  make([]*udpClient, size),
+	}
+}
+
+// client returns the next client in the pool, dialing a new connection if needed.
+func (p *udpPool) client() (*udpClient, error) {
+	i := int(p.next.Add(1)) % len(p.clients)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errClientClosed
+	}
+	if c := p.clients[i]; c != nil && !c.isClosed() {
+		return c, nil
+	}
+	c, err := dialUDPClient(p.upstream, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[i] = c
+	return c, nil
+}
+
+// exchange sends the request to the upstream server using one of the pooled connections.
+func (p *udpPool) exchange(ctx context.Context, req []byte) ([]byte, error) {
+	c, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, req, p.timeout)
+}
+
+// Close all connections in the pool.
+func (p *udpPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	var errs []error
+	for _, c := range p.clients {
+		if c != nil {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withTransactionID returns a copy of the request with a different transaction ID.
+func withTransactionID(req []byte, id uint16) []byte {
+	out := make([]byte, len(req))
+	copy(out, req)
+	packUint16(out, 0, id)
+	return out
+}
+
+var (
+	errClientClosed    = errors.New("upstream client closed")
+	errUpstreamTimeout = errors.New("timed out waiting for upstream reply")
+)
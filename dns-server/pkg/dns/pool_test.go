@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoUpstream starts a UDP server that echoes every request back to the sender
+// after the given delay.
+func startEchoUpstream(tb testing.TB, delay func() time.Duration) string {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			buf := make([]byte, MaxDNSDatagramSize)
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(delay())
+				conn.WriteToUDP(buf[:n], addr)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestPooledForwardMatchesReplies(t *testing.T) {
+	const numQueries = 50
+
+	addr := startEchoUpstream(t, func() time.Duration {
+		// replies are sent out of order
+		return time.Duration(rand.Intn(20)) * time.Millisecond
+	})
+	fwd := &DNSForwarder{Upstreams: []string{addr}, PoolSize: 2, DialTimeout: time.Second}
+	defer fwd.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numQueries)
+	for i := 0; i < numQueries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := getTestDNSRequest()
+			req.ID = uint16(i)
+			req.Questions[0].Name = []byte(fmt.Sprintf("host%d.example.com.", i))
+			data, err := req.Serialize()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			raw, err := fwd.Forward(data)
+			if err != nil {
+				errs <- err
+				return
+			}
+			reply := &DNS{}
+			if err := reply.Decode(raw); err != nil {
+				errs <- err
+				return
+			}
+			if reply.ID != req.ID || string(reply.Questions[0].Name) != string(req.Questions[0].Name) {
+				errs <- fmt.Errorf("query %d matched to reply %d for %s", i, reply.ID, reply.Questions[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPooledForwardTimeout(t *testing.T) {
+	fwd := &DNSForwarder{
+		Upstreams:   []string{startDeadUpstream(t)},
+		PoolSize:    1,
+		DialTimeout: 50 * time.Millisecond,
+	}
+	defer fwd.Close()
+
+	if _, err := fwd.Forward(serialize(t, getTestDNSRequest())); !errors.Is(err, errUpstreamTimeout) {
+		t.Fatalf("expected error %v, found %v", errUpstreamTimeout, err)
+	}
+}
+
+func BenchmarkForward(b *testing.B) {
+	addr := startEchoUpstream(b, func() time.Duration { return 0 })
+	req, err := getTestDNSRequest().Serialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, poolSize := range []int{0, 4} {
+		b.Run(fmt.Sprintf("PoolSize=%d", poolSize), func(b *testing.B) {
+			fwd := &DNSForwarder{Upstreams: []string{addr}, PoolSize: poolSize}
+			defer fwd.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := fwd.Forward(req); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// QuerySource is the way the resolver answered a query.
+type QuerySource int
+
+const (
+	// QueryLocal queries are answered from the local records or zones
+	QueryLocal QuerySource = iota
+	// QueryBlocked queries are for names blocked by the resolver
+	QueryBlocked
+	// QueryForwarded queries are answered by the upstream servers
+	QueryForwarded
+	// QueryUnresolved queries have no local answers and were not forwarded
+	QueryUnresolved
+)
+
+// String representation of the QuerySource
+func (s QuerySource) String() string {
+	switch s {
+	case QueryLocal:
+		return "local"
+	case QueryBlocked:
+		return "blocked"
+	case QueryForwarded:
+		return "forwarded"
+	case QueryUnresolved:
+		return "unresolved"
+	default:
+		return "unknown"
+	}
+}
+
+// QueryLogEntry describes the resolution of a single DNS query.
+//
+// Name and Type are those of the first question in the request. ResponseCode
+// and Answers are read from the reply, and are zero if resolution failed.
+type QueryLogEntry struct {
+	Client       net.Addr
+	Name         string
+	Type         DNSType
+	ResponseCode DNSResponseCode
+	Answers      int
+	Source       QuerySource
+	Latency      time.Duration
+	Err          error
+}
+
+// QueryLogger is called by the resolver for every query it resolves.
+// Loggers are called concurrently and must not block.
+type QueryLogger func(QueryLogEntry)
+
+// NewSlogQueryLogger returns a QueryLogger writing one structured record per query
+// to the slog logger. Failed resolutions are logged with the error level.
+func NewSlogQueryLogger(l *slog.Logger) QueryLogger {
+	return func(e QueryLogEntry) {
+		level := slog.LevelInfo
+		attrs := []slog.Attr{
+			slog.String("client", addrString(e.Client)),
+			slog.String("qname", e.Name),
+			slog.Int("qtype", int(e.Type)),
+			slog.Int("rcode", int(e.ResponseCode)),
+			slog.Int("answers", e.Answers),
+			slog.String("source", e.Source.String()),
+			slog.Duration("latency", e.Latency),
+		}
+		if e.Err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("error", e.Err.Error()))
+		}
+		l.LogAttrs(context.Background(), level, "dns query", attrs...)
+	}
+}
+
+// addrString returns the address of the client, or an empty string for
+// queries resolved without a client address.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// logQuery completes the entry with the question of the request and the latency
+// of the resolution, and reports it to the resolver's QueryLog.
+func (rr *DNSResolver) logQuery(e QueryLogEntry, req *DNS, start time.Time) {
+	e.Latency = time.Since(start)
+	if len(req.Questions) > 0 {
+		e.Name = string(req.Questions[0].Name)
+		e.Type = req.Questions[0].Type
+	}
+	rr.QueryLog(e)
+}
+
+// withReply sets the response code and number of answers of the entry from the
+// header of a serialized reply. Replies too short to hold a header are ignored.
+func (e QueryLogEntry) withReply(reply []byte) QueryLogEntry {
+	if len(reply) < 12 {
+		return e
+	}
+	head := &DNSHeader{}
+	head.Decode(reply)
+	e.ResponseCode = head.ResponseCode
+	e.Answers = int(head.ANCount)
+	return e
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+)
+
+// queryLogCapture records the entries passed to the query logger
+type queryLogCapture struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+}
+
+func (c *queryLogCapture) log(e QueryLogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, e)
+}
+
+// replyForwarder answers every request with a single A record
+type replyForwarder struct{}
+
+func (replyForwarder) Forward(req []byte) ([]byte, error) {
+	dnsReq := &DNS{}
+	if err := dnsReq.Decode(req); err != nil {
+		return nil, err
+	}
+	an := NewARecord(string(dnsReq.Questions[0].Name), net.ParseIP("93.184.216.34"), 60)
+	return dnsReq.ReplyTo([]DNSResourceRecord{an}).Serialize()
+}
+
+func TestQueryLog(t *testing.T) {
+	capture := &queryLogCapture{}
+	resolver := &DNSResolver{
+		Fwd: replyForwarder{},
+		Records: DNSLocalStore{
+			"acme.com.": DNSLocalRecord{Value: "127.0.0.1", TTL: defaultAnswerTTL},
+			"ads.com.":  DNSLocalRecord{Value: "BLOCK", TTL: defaultAnswerTTL},
+		},
+		BlockMode: BlockModeNXDomain,
+		QueryLog:  capture.log,
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 5353}
+
+	for _, name := range []string{"acme.com.", "example.com.", "ads.com."} {
+		req := getTestDNSRequest()
+		req.Questions[0].Name = []byte(name)
+		if _, err := resolver.ResolveFrom(client, serialize(t, req)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	expected := []QueryLogEntry{
+		{Name: "acme.com.", Type: DNSTypeA, ResponseCode: DNSResponseCodeNoError, Answers: 1, Source: QueryLocal},
+		{Name: "example.com.", Type: DNSTypeA, ResponseCode: DNSResponseCodeNoError, Answers: 1, Source: QueryForwarded},
+		{Name: "ads.com.", Type: DNSTypeA, ResponseCode: DNSResponseCodeNameError, Answers: 0, Source: QueryBlocked},
+	}
+	if len(capture.entries) != len(expected) {
+		t.Fatalf("expected %d log entries, found %d", len(expected), len(capture.entries))
+	}
+	for i, e := range capture.entries {
+		exp := expected[i]
+		if e.Client != client {
+			t.Fatalf("expected client %s, found %v", client, e.Client)
+		}
+		if e.Name != exp.Name || e.Type != exp.Type || e.ResponseCode != exp.ResponseCode ||
+			e.Answers != exp.Answers || e.Source != exp.Source {
+			t.Fatalf("expected log entry %+v, found %+v", exp, e)
+		}
+		if e.Latency < 0 || e.Err != nil {
+			t.Fatalf("unexpected latency %s and error %v for %s", e.Latency, e.Err, e.Name)
+		}
+	}
+}
+
+func TestSlogQueryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewSlogQueryLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	log(QueryLogEntry{
+		Client:  &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 5353},
+		Name:    "acme.com.",
+		Type:    DNSTypeMX,
+		Answers: 2,
+		Source:  QueryLocal,
+	})
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v", err)
+	}
+	fields := map[string]any{
+		"client":  "10.0.0.7:5353",
+		"qname":   "acme.com.",
+		"qtype":   float64(DNSTypeMX),
+		"rcode":   float64(0),
+		"answers": float64(2),
+		"source":  "local",
+	}
+	for k, v := range fields {
+		if record[k] != v {
+			t.Fatalf("expected %s=%v, found %v", k, v, record[k])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitWindow is the window of ResponseRateLimiter when not configured
+const DefaultRateLimitWindow = time.Second
+
+// RateLimitAction selects what the server does with responses over the rate limit.
+type RateLimitAction int
+
+const (
+	// RateLimitTruncate replies with the TC bit set and no records: legitimate
+	// clients retry over TCP, while spoofed victims receive a small datagram.
+	RateLimitTruncate RateLimitAction = iota
+	// RateLimitDrop doesn't reply at all
+	RateLimitDrop
+)
+
+// ParseRateLimitAction parses the name of a rate limit action: "truncate" or "drop".
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch strings.ToLower(s) {
+	case "truncate":
+		return RateLimitTruncate, nil
+	case "drop":
+		return RateLimitDrop, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit action %q", s)
+	}
+}
+
+// ResponseRateLimiter implements Response Rate Limiting (RRL) to blunt DNS
+// amplification attacks, where queries with the spoofed address of a victim make
+// the server flood it with large replies.
+//
+// Responses are counted per client IP address in a sliding window. Once a client
+// received Rate responses in the last Window, further responses are truncated or
+// dropped according to Action, until its rate goes back under the limit.
+// Responses over the limit are not counted.
+type ResponseRateLimiter struct {
+	// Rate is the number of responses a client receives in every window.
+	Rate int
+	// Window defaults to DefaultRateLimitWindow.
+	Window time.Duration
+	Action RateLimitAction
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*rateWindow
+	// lastSweep is the last time windows of idle clients were removed
+	lastSweep time.Time
+	// now returns the current time responses are counted at
+	now func() time.Time
+}
+
+// Limit returns the reply to send to the client: the reply itself when the client
+// is under the rate limit, a truncated reply or nil if the reply must be dropped.
+func (rl *ResponseRateLimiter) Limit(client *net.UDPAddr, reply []byte) []byte {
+	if rl.allow(client.AddrPort().Addr().Unmap()) {
+		return reply
+	}
+	debugf("rate limited response to %s", client)
+	if rl.Action == RateLimitDrop {
+		return nil
+	}
+	truncated, err := truncateReply(reply)
+	if err != nil {
+		return nil
+	}
+	return truncated
+}
+
+// allow counts a response to the client and returns false if it's over the limit.
+func (rl *ResponseRateLimiter) allow(client netip.Addr) bool {
+	window := rl.Window
+	if window <= 0 {
+		window = DefaultRateLimitWindow
+	}
+	now := time.Now()
+	if rl.now != nil {
+		now = rl.now()
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.clients == nil {
+		rl.clients = map[netip.Addr]*rateWindow{}
+		rl.lastSweep = now
+	}
+	// windows of clients idle for longer than a window don't hold any response
+	if now.Sub(rl.lastSweep) >= 2*window {
+		for addr, w := range rl.clients {
+			if now.Sub(w.start) >= 2*window {
+				delete(rl.clients, addr)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	w, ok := rl.clients[client]
+	if !ok {
+		w = &rateWindow{start: now}
+		rl.clients[client] = w
+	}
+	return w.allow(now, window, rl.Rate)
+}
+
+// rateWindow counts the responses to a client with a sliding window counter: the
+// responses in the last window are estimated from the counts of the current and
+// previous fixed windows, as if previous responses were evenly spread.
+type rateWindow struct {
+	// start of the current fixed window
+	start       time.Time
+	count, prev int
+}
+
+func (w *rateWindow) allow(now time.Time, window time.Duration, rate int) bool {
+	if elapsed := now.Sub(w.start); elapsed >= window {
+		w.prev = w.count
+		if elapsed >= 2*window {
+			w.prev = 0
+		}
+		w.count = 0
+		w.start = w.start.Add(elapsed.Truncate(window))
+	}
+
+	overlap := float64(window-now.Sub(w.start)) / float64(window)
+	if float64(w.prev)*overlap+float64(w.count) >= float64(rate) {
+		return false
+	}
+	w.count++
+	return true
+}
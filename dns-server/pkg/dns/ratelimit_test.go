@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResponseRateLimiter(t *testing.T) {
+	now := time.Date(2024, 3, 4, 16, 0, 0, 0, time.UTC)
+	rl := &ResponseRateLimiter{Rate: 5, Window: time.Second, now: func() time.Time { return now }}
+
+	req := getTestDNSRequest()
+	reply := answerA(t, serialize(t, req))
+	attacker := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+
+	// countFull fires queries from the client and counts the full replies
+	countFull := func(client *net.UDPAddr, queries int) int {
+		t.Helper()
+		full := 0
+		for i := 0; i < queries; i++ {
+			got := rl.Limit(client, reply)
+			if bytes.Equal(got, reply) {
+				full++
+				continue
+			}
+			truncated := &DNS{}
+			if err := truncated.Decode(got); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !truncated.TC || len(truncated.Answers) != 0 {
+				t.Fatalf("expected truncated reply with no answers, found %s", truncated.String())
+			}
+			if truncated.ID != req.ID || string(truncated.Questions[0].Name) != "example.com." {
+				t.Fatalf("expected reply to the request, found %s", truncated.String())
+			}
+		}
+		return full
+	}
+
+	if full := countFull(attacker, 50); full != rl.Rate {
+		t.Fatalf("expected %d full replies, found %d", rl.Rate, full)
+	}
+	// the limit is per client
+	if full := countFull(other, 3); full != 3 {
+		t.Fatalf("expected %d full replies to another client, found %d", 3, full)
+	}
+
+	// half of the responses of the previous window still count
+	now = now.Add(1500 * time.Millisecond)
+	if full := countFull(attacker, 50); full != 3 {
+		t.Fatalf("expected %d full replies after sliding the window, found %d", 3, full)
+	}
+	now = now.Add(2 * time.Second)
+	if full := countFull(attacker, 50); full != rl.Rate {
+		t.Fatalf("expected %d full replies after the window expired, found %d", rl.Rate, full)
+	}
+}
+
+func TestResponseRateLimiterDrop(t *testing.T) {
+	rl := &ResponseRateLimiter{Rate: 1, Action: RateLimitDrop}
+	reply := answerA(t, serialize(t, getTestDNSRequest()))
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+
+	if got := rl.Limit(client, reply); !bytes.Equal(got, reply) {
+		t.Fatalf("expected full reply, found %v", got)
+	}
+	if got := rl.Limit(client, reply); got != nil {
+		t.Fatalf("expected dropped reply, found %v", got)
+	}
+}
+
+func TestParseRateLimitAction(t *testing.T) {
+	for s, expected := range map[string]RateLimitAction{"truncate": RateLimitTruncate, "DROP": RateLimitDrop} {
+		action, err := ParseRateLimitAction(s)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if action != expected {
+			t.Fatalf("expected action %d for %q, found %d", expected, s, action)
+		}
+	}
+	if _, err := ParseRateLimitAction("slip"); err == nil {
+		t.Fatal("expected error parsing unknown action")
+	}
+}
@@ -0,0 +1,87 @@
+package dns
+
+import "net"
+
+// NewARecord returns an IN class A record resolving name to an IPv4 address.
+func NewARecord(name string, ip net.IP, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeA,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		IP:    ip,
+	}
+}
+
+// NewAAAARecord returns an IN class AAAA record resolving name to an IPv6 address.
+func NewAAAARecord(name string, ip net.IP, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeAAAA,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		IP:    ip,
+	}
+}
+
+// NewCNAMERecord returns an IN class CNAME record aliasing name to target.
+func NewCNAMERecord(name, target string, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeCNAME,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		CNAME: []byte(target),
+	}
+}
+
+// NewTXTRecord returns an IN class TXT record with one character-string
+// for each of the texts. Texts longer than 255 bytes fail to encode.
+func NewTXTRecord(name string, ttl uint32, texts ...string) DNSResourceRecord {
+	txts := make([][]byte, len(texts))
+	for i, txt := range texts {
+		txts[i] = []byte(txt)
+	}
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeTXT,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		TXTs:  txts,
+	}
+}
+
+// NewNSRecord returns an IN class NS record delegating the zone name to
+// the nameserver ns.
+func NewNSRecord(name, ns string, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeNS,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		NS:    []byte(ns),
+	}
+}
+
+// NewSOARecord returns an IN class SOA record for the zone name.
+func NewSOARecord(name string, soa DNSSOA, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeSOA,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		SOA:   soa,
+	}
+}
+
+// NewMXRecord returns an IN class MX record naming exchange as a mail
+// exchange for name with the given preference.
+func NewMXRecord(name string, preference uint16, exchange string, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{
+		Name:  []byte(name),
+		Type:  DNSTypeMX,
+		Class: DNSClassIN,
+		TTL:   ttl,
+		MX:    DNSMX{Preference: preference, Exchange: []byte(exchange)},
+	}
+}
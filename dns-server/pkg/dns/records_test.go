@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// roundTrip serializes a reply with the record as answer and decodes it back.
+func roundTrip(t *testing.T, rec DNSResourceRecord) DNSResourceRecord {
+	t.Helper()
+	data := serialize(t, getTestDNSRequest().ReplyTo([]DNSResourceRecord{rec}))
+
+	reply := &DNS{}
+	if err := reply.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	found := reply.Answers[0]
+	if string(found.Name) != string(rec.Name) || found.Type != rec.Type ||
+		found.Class != DNSClassIN || found.TTL != rec.TTL {
+		t.Fatalf("expected record %s, found %s", rec.String(), found.String())
+	}
+	return found
+}
+
+func TestNewARecord(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	found := roundTrip(t, NewARecord("www.acme.com.", ip, 60))
+	if !net.IP(found.IP).Equal(ip) {
+		t.Fatalf("expected ip %s, found %s", ip, found.IP)
+	}
+}
+
+func TestNewAAAARecord(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	found := roundTrip(t, NewAAAARecord("www.acme.com.", ip, 60))
+	if !net.IP(found.IP).Equal(ip) {
+		t.Fatalf("expected ip %s, found %s", ip, found.IP)
+	}
+}
+
+func TestNewCNAMERecord(t *testing.T) {
+	found := roundTrip(t, NewCNAMERecord("www.acme.com.", "web.acme.com.", 60))
+	if string(found.CNAME) != "web.acme.com." {
+		t.Fatalf("expected cname %s, found %s", "web.acme.com.", found.CNAME)
+	}
+}
+
+func TestNewTXTRecord(t *testing.T) {
+	texts := []string{"v=spf1 -all", "", "hello world"}
+	found := roundTrip(t, NewTXTRecord("acme.com.", 60, texts...))
+	if len(found.TXTs) != len(texts) {
+		t.Fatalf("expected %d txt strings, found %d", len(texts), len(found.TXTs))
+	}
+	for i, txt := range texts {
+		if string(found.TXTs[i]) != txt {
+			t.Fatalf("expected txt %q, found %q", txt, found.TXTs[i])
+		}
+	}
+}
+
+func TestNewTXTRecordRejectsLongStrings(t *testing.T) {
+	reply := getTestDNSRequest().ReplyTo([]DNSResourceRecord{
+		NewTXTRecord("acme.com.", 60, strings.Repeat("a", maxTXTLength+1)),
+	})
+	if _, err := reply.Serialize(); !errors.Is(err, errTXTTooLong) {
+		t.Fatalf("expected error %v, found %v", errTXTTooLong, err)
+	}
+}
+
+func TestNewNSRecord(t *testing.T) {
+	found := roundTrip(t, NewNSRecord("acme.com.", "ns1.acme.com.", 60))
+	if string(found.NS) != "ns1.acme.com." {
+		t.Fatalf("expected ns %s, found %s", "ns1.acme.com.", found.NS)
+	}
+}
+
+func TestNewSOARecord(t *testing.T) {
+	soa := DNSSOA{MName: []byte("ns1.acme.com."), RName: []byte("admin.acme.com."), Serial: 1}
+	found := roundTrip(t, NewSOARecord("acme.com.", soa, 60))
+	if string(found.SOA.MName) != "ns1.acme.com." || found.SOA.Serial != 1 {
+		t.Fatalf("expected soa %s, found %s", soa.String(), found.SOA.String())
+	}
+}
+
+func TestNewMXRecord(t *testing.T) {
+	found := roundTrip(t, NewMXRecord("acme.com.", 10, "mail.acme.com.", 60))
+	if found.MX.Preference != 10 || string(found.MX.Exchange) != "mail.acme.com." {
+		t.Fatalf("expected mx %s, found %s", "10 mail.acme.com.", found.MX.String())
+	}
+	// preference + exchange name + name termination
+	if rdLength := 2 + len("mail.acme.com.") + 1; int(found.RDLenght) != rdLength {
+		t.Fatalf("expected rdata length %d, found %d", rdLength, found.RDLenght)
+	}
+}
+
+func TestAddAnswerKeepsCountsInSync(t *testing.T) {
+	d := &DNS{}
+	d.AddAnswer(NewARecord("a.acme.com.", net.ParseIP("10.0.0.1"), 60))
+	d.AddAnswer(
+		NewCNAMERecord("b.acme.com.", "a.acme.com.", 60),
+		NewTXTRecord("a.acme.com.", 60, "hello"),
+	)
+	d.AddAuthority(NewNSRecord("acme.com.", "ns1.acme.com.", 60))
+
+	if d.ANCount != 3 {
+		t.Fatalf("expected ANCount %d, found %d", 3, d.ANCount)
+	}
+	if d.NSCount != 1 {
+		t.Fatalf("expected NSCount %d, found %d", 1, d.NSCount)
+	}
+
+	decoded := &DNS{}
+	if err := decoded.Decode(serialize(t, d)); err != nil {
+		t.Fatal(err)
+	}
+	types := []DNSType{}
+	for _, an := range decoded.Answers {
+		types = append(types, an.Type)
+	}
+	if !slices.Equal(types, []DNSType{DNSTypeA, DNSTypeCNAME, DNSTypeTXT}) {
+		t.Fatalf("unexpected answer types %v", types)
+	}
+	if len(decoded.Authorities) != 1 {
+		t.Fatalf("expected %d authorities, found %d", 1, len(decoded.Authorities))
+	}
+}
@@ -2,11 +2,18 @@ package dns
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,9 +29,44 @@ const MaxDNSDatagramSize = 512
 //
 // The keys in this datastore are the FQDNs and values are the
 // associated IP addresses. It is also possible to use `BLOCK` as
-// the resolved value for a fully qualified domain name to return
-// an empty response for queries on certain domains.
-type DNSLocalStore map[string]string
+// the resolved value for a fully qualified domain name to block
+// queries on certain domains, see DNSBlocklist for larger lists.
+//
+// DNS names are case-insensitive, so keys are stored in lowercase and
+// lookups match names regardless of their case.
+type DNSLocalStore map[string]DNSLocalRecord
+
+// DNSLocalRecord is a record value in the DNSLocalStore.
+//
+// Records are A records unless Type is DNSTypeNS, in which case Value holds
+// the space separated names of the nameservers the zone is delegated to, or
+// DNSTypeMX, in which case Value holds the space separated preference and
+// exchange pairs of the mail exchanges for the name.
+type DNSLocalRecord struct {
+	Value string
+	TTL   uint32
+	Type  DNSType
+}
+
+// Nameservers returns the nameservers of a NS record.
+func (r DNSLocalRecord) Nameservers() []string {
+	return strings.Fields(r.Value)
+}
+
+// MailExchanges returns the mail exchanges of a MX record sorted by preference.
+func (r DNSLocalRecord) MailExchanges() []DNSMX {
+	fields := strings.Fields(r.Value)
+	var exchanges []DNSMX
+	for i := 0; i+1 < len(fields); i += 2 {
+		// preferences are validated when records are loaded
+		preference, _ := strconv.ParseUint(fields[i], 10, 16)
+		exchanges = append(exchanges, DNSMX{Preference: uint16(preference), Exchange: []byte(fields[i+1])})
+	}
+	slices.SortStableFunc(exchanges, func(a, b DNSMX) int {
+		return int(a.Preference) - int(b.Preference)
+	})
+	return exchanges
+}
 
 // FromFile loads the datastore initial state from a file.
 //
@@ -38,6 +80,31 @@ type DNSLocalStore map[string]string
 //
 // Lines that start with a `;` character are interpreted as comments and
 // blank lines are ignored.
+//
+// Records can optionally specify the TTL in seconds of the answers between
+// the name and the value, otherwise the default TTL of 300 seconds is used:
+//
+// example.com.        60  10.0.0.3
+//
+// Wildcard records match any subdomain of the name following the leading `*.`,
+// though not the name itself:
+//
+// *.dev.example.com.  10.0.0.4
+//
+// Zones are delegated to other nameservers with NS records. Repeated NS records
+// for the same name add nameservers to the delegation:
+//
+// sub.example.com.    NS  ns1.provider.com.
+// sub.example.com.    NS  ns2.provider.com.
+//
+// Mail exchanges for a name are set with MX records, specifying the preference
+// of the exchange. Repeated MX records for the same name add exchanges:
+//
+// example.com.        MX  10  mail.example.com.
+// example.com.        MX  20  backup.example.com.
+//
+// A name holds a single kind of record: A, NS and MX records for the same name
+// replace each other.
 func (store *DNSLocalStore) FromFile(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -45,8 +112,7 @@ func (store *DNSLocalStore) FromFile(path string) error {
 	}
 	defer file.Close()
 
-	store.handleFromFile(file)
-	return nil
+	return store.handleFromFile(file)
 }
 
 func (store *DNSLocalStore) handleFromFile(reader io.Reader) error {
@@ -61,71 +127,372 @@ func (store *DNSLocalStore) handleFromFile(reader io.Reader) error {
 		if err != nil {
 			return err
 		}
+		k = strings.ToLower(k)
+		if prev, ok := (*store)[k]; ok && prev.Type == v.Type && (v.Type == DNSTypeNS || v.Type == DNSTypeMX) {
+			v.Value = prev.Value + " " + v.Value
+		}
 		(*store)[k] = v
 	}
 
 	return nil
 }
 
-func parseLine(line string) (string, string, error) {
-	tokens := strings.SplitN(line, " ", 2)
-	if len(tokens) != 2 {
-		return "", "", fmt.Errorf("malformed DNS record. format should be 'example.com  10.0.1.55'")
+// Lookup the value stored for the FQDN name.
+// Exact matches take precedence over wildcard records, and the most specific
+// wildcard wins when several of them match the name.
+func (store DNSLocalStore) Lookup(name string) (DNSLocalRecord, bool) {
+	return lookupName(store, name)
+}
+
+// lookupName finds the entry for name in a map keyed by lowercase FQDN, where
+// wildcard keys like `*.example.com.` match any subdomain of the name following
+// the leading `*.`. The name is matched case-insensitively. Exact matches take
+// precedence over wildcards, and the most specific wildcard wins.
+func lookupName[V any](entries map[string]V, name string) (V, bool) {
+	name = strings.ToLower(name)
+	if v, ok := entries[name]; ok {
+		return v, true
 	}
 
-	k, v := strings.Trim(tokens[0], " "), strings.Trim(tokens[1], " ")
-	return k, v, nil
+	// walk up the domain tree, dropping one label at a time
+	for parent := name; ; {
+		_, rest, found := strings.Cut(parent, ".")
+		if !found || len(rest) == 0 {
+			var zero V
+			return zero, false
+		}
+		if v, ok := entries["*."+rest]; ok {
+			return v, true
+		}
+		parent = rest
+	}
+}
+
+// Delegation returns the closest zone enclosing name that is delegated with a
+// NS record, along with the record itself. The zone is returned in lowercase.
+func (store DNSLocalStore) Delegation(name string) (string, DNSLocalRecord, bool) {
+	name = strings.ToLower(name)
+	for zone := name; len(zone) > 0; {
+		if v, ok := store[zone]; ok && v.Type == DNSTypeNS {
+			return zone, v, true
+		}
+		_, rest, found := strings.Cut(zone, ".")
+		if !found {
+			break
+		}
+		zone = rest
+	}
+	return "", DNSLocalRecord{}, false
+}
+
+func parseLine(line string) (string, DNSLocalRecord, error) {
+	tokens := strings.Fields(line)
+
+	var recordType DNSType
+	if n := len(tokens); n >= 3 && tokens[n-2] == "NS" {
+		if !strings.HasSuffix(tokens[n-1], ".") {
+			return "", DNSLocalRecord{}, fmt.Errorf("malformed NS record. nameserver %q should be a FQDN", tokens[n-1])
+		}
+		recordType = DNSTypeNS
+		tokens = append(tokens[:n-2], tokens[n-1])
+	} else if n >= 4 && tokens[n-3] == "MX" {
+		if _, err := strconv.ParseUint(tokens[n-2], 10, 16); err != nil {
+			return "", DNSLocalRecord{}, fmt.Errorf("malformed MX record preference %q: %w", tokens[n-2], err)
+		}
+		if !strings.HasSuffix(tokens[n-1], ".") {
+			return "", DNSLocalRecord{}, fmt.Errorf("malformed MX record. exchange %q should be a FQDN", tokens[n-1])
+		}
+		recordType = DNSTypeMX
+		tokens = append(tokens[:n-3], tokens[n-2]+" "+tokens[n-1])
+	}
+
+	switch len(tokens) {
+	case 2:
+		return tokens[0], DNSLocalRecord{Value: tokens[1], TTL: defaultAnswerTTL, Type: recordType}, nil
+	case 3:
+		ttl, err := strconv.ParseUint(tokens[1], 10, 32)
+		if err != nil {
+			return "", DNSLocalRecord{}, fmt.Errorf("malformed DNS record TTL %q: %w", tokens[1], err)
+		}
+		return tokens[0], DNSLocalRecord{Value: tokens[2], TTL: uint32(ttl), Type: recordType}, nil
+	default:
+		return "", DNSLocalRecord{}, fmt.Errorf("malformed DNS record. format should be 'example.com  [ttl]  10.0.1.55'")
+	}
 }
 
 // DNSResolver replies to DNS queries by either finding matching A records
 // in the local storage or forwarding requests to upstream servers.
+//
+// Zones contains the SOA records of the zones this resolver is authoritative
+// for, keyed by the zone FQDN. SOA queries for a zone name, in any case, are
+// answered with its SOA record.
+//
+// Names in the Blocklist, and local records with the `BLOCK` value, are never
+// resolved: queries for them are answered according to the BlockMode. When
+// BlockCategories is set, only blocklist entries of those categories are enforced.
+//
+// When RaceUpstream is set, recursive queries are forwarded upstream while the
+// local storage is searched, instead of forwarding them only once the local
+// lookup missed. Local answers win the race: the upstream reply isn't awaited
+// and the forward is cancelled if Fwd is a ContextForwarder.
+//
+// When QueryLog is set, it is called for every resolved query.
 type DNSResolver struct {
-	Fwd     Forwarder
-	Records DNSLocalStore
+	Fwd          Forwarder
+	Records      DNSLocalStore
+	Zones        map[string]DNSSOA
+	RaceUpstream bool
+
+	Blocklist       DNSBlocklist
+	BlockMode       BlockMode
+	BlockCategories []string
+
+	QueryLog QueryLogger
 }
 
 // Resolve DNS answers for the incoming request.
 func (rr *DNSResolver) Resolve(req []byte) ([]byte, error) {
-	var err error
-	dnsReq := &DNS{}
+	return rr.ResolveFrom(nil, req)
+}
 
-	if err = dnsReq.Decode(req); err != nil {
+// ResolveFrom resolves DNS answers for the incoming request of the client.
+// The client address is only used for query logging.
+func (rr *DNSResolver) ResolveFrom(client net.Addr, req []byte) ([]byte, error) {
+	start := time.Now()
+	dnsReq := &DNS{}
+	if err := dnsReq.Decode(req); err != nil {
 		return nil, err
 	}
 
-	for _, q := range dnsReq.Questions {
-		if resolved, ok := rr.Records[string(q.Name)]; ok {
-			var answers []DNSResourceRecord
-			switch resolved {
-			default:
-				an := DNSResourceRecord{}
-				an.Name = q.Name
-				an.Type = DNSTypeA
-				an.Class = DNSClassIN
-				an.IP = net.ParseIP(resolved)
-				an.TTL = defaultAnswerTTL
-				answers = []DNSResourceRecord{an}
-			case "BLOCK":
-				answers = []DNSResourceRecord{}
-			}
+	var (
+		reply  []byte
+		err    error
+		source QuerySource
+	)
+	// the raw request is proxied as-is, no need to encode it again
+	pending := rr.startForward(dnsReq, req)
+	if local, src, ok := rr.resolveLocal(dnsReq); ok {
+		pending.abandon()
+		source = src
+		reply, err = local.Serialize()
+	} else if rr.forwards(dnsReq) {
+		source = QueryForwarded
+		reply, err = rr.forward(pending, req)
+	} else {
+		source = QueryUnresolved
+		reply, err = dnsReq.ReplyTo([]DNSResourceRecord{}).Serialize()
+	}
 
-			reply := dnsReq.ReplyTo(answers).Serialize()
-			return reply, nil
+	if rr.QueryLog != nil {
+		e := QueryLogEntry{Client: client, Source: source, Err: err}
+		rr.logQuery(e.withReply(reply), dnsReq, start)
+	}
+	return reply, err
+}
+
+// ResolveParsed resolves DNS answers for a request that was already decoded.
+// Local answers are returned without going through the wire format, the request
+// is only serialized when it needs to be forwarded upstream.
+func (rr *DNSResolver) ResolveParsed(req *DNS) (*DNS, error) {
+	start := time.Now()
+	reply, source, err := rr.resolveParsed(req)
+	if rr.QueryLog != nil {
+		e := QueryLogEntry{Source: source, Err: err}
+		if reply != nil {
+			e.ResponseCode = reply.ResponseCode
+			e.Answers = len(reply.Answers)
 		}
+		rr.logQuery(e, req, start)
 	}
+	return reply, err
+}
 
-	// If DNS recursion desired (RD) flag is set and forward server is available,
-	// proxy the DNS request.
-	if dnsReq.RD && rr.Fwd != nil {
-		reply, err := rr.Fwd.Forward(req)
+func (rr *DNSResolver) resolveParsed(req *DNS) (*DNS, QuerySource, error) {
+	var pending *pendingForward
+	if rr.RaceUpstream && rr.forwards(req) {
+		// serialization errors are reported below, once the local lookup missed
+		if data, err := req.Serialize(); err == nil {
+			pending = rr.startForward(req, data)
+		}
+	}
+	if reply, source, ok := rr.resolveLocal(req); ok {
+		pending.abandon()
+		return reply, source, nil
+	}
+	if rr.forwards(req) {
+		data, err := req.Serialize()
 		if err != nil {
-			return nil, err
+			return nil, QueryForwarded, err
+		}
+		raw, err := rr.forward(pending, data)
+		if err != nil {
+			return nil, QueryForwarded, err
+		}
+		reply := &DNS{}
+		if err := reply.Decode(raw); err != nil {
+			return nil, QueryForwarded, err
+		}
+		return reply, QueryForwarded, nil
+	}
+	return req.ReplyTo([]DNSResourceRecord{}), QueryUnresolved, nil
+}
+
+// resolveLocal replies to the request with the first question that has a
+// matching record in the local storage, and reports whether the name was blocked.
+func (rr *DNSResolver) resolveLocal(req *DNS) (*DNS, QuerySource, bool) {
+	for _, q := range req.Questions {
+		if rr.blocked(string(q.Name)) {
+			return blockReply(req, q, rr.BlockMode), QueryBlocked, true
+		}
+		if reply, ok := rr.resolveSOA(req, q); ok {
+			return reply, QueryLocal, true
+		}
+		if reply, ok := rr.resolveDelegation(req, q); ok {
+			return reply, QueryLocal, true
+		}
+		if resolved, ok := rr.Records.Lookup(string(q.Name)); ok {
+			if resolved.Value == "BLOCK" {
+				return blockReply(req, q, rr.BlockMode), QueryBlocked, true
+			}
+			if resolved.Type == DNSTypeMX {
+				return rr.resolveMX(req, q, resolved), QueryLocal, true
+			}
+			an := NewARecord(string(q.Name), net.ParseIP(resolved.Value), resolved.TTL)
+			return req.ReplyTo([]DNSResourceRecord{an}), QueryLocal, true
 		}
-		return reply, nil
+	}
+	return nil, 0, false
+}
+
+// blocked returns true if the name is blocked by an enforced blocklist entry.
+func (rr *DNSResolver) blocked(name string) bool {
+	category, ok := rr.Blocklist.Lookup(name)
+	if !ok {
+		return false
+	}
+	return len(rr.BlockCategories) == 0 || slices.Contains(rr.BlockCategories, category)
+}
+
+// resolveSOA replies with the SOA record of the zone if the question is a
+// SOA query for one of the resolver's zones.
+func (rr *DNSResolver) resolveSOA(req *DNS, q DNSQuestion) (*DNS, bool) {
+	if q.Type != DNSTypeSOA {
+		return nil, false
+	}
+	soa, ok := rr.zone(string(q.Name))
+	if !ok {
+		return nil, false
 	}
 
-	empty := dnsReq.ReplyTo([]DNSResourceRecord{}).Serialize()
-	return empty, nil
+	an := NewSOARecord(string(q.Name), soa, defaultAnswerTTL)
+	reply := req.ReplyTo([]DNSResourceRecord{an})
+	reply.AA = true // authoritative answer
+	return reply, true
+}
+
+// zone returns the SOA record of the zone name, matched case-insensitively.
+func (rr *DNSResolver) zone(name string) (DNSSOA, bool) {
+	if soa, ok := rr.Zones[name]; ok {
+		return soa, true
+	}
+	for zone, soa := range rr.Zones {
+		if strings.EqualFold(zone, name) {
+			return soa, true
+		}
+	}
+	return DNSSOA{}, false
+}
+
+// resolveMX replies to MX queries with the mail exchanges of the record sorted
+// by preference. Other queries for the name get no answers.
+func (rr *DNSResolver) resolveMX(req *DNS, q DNSQuestion, record DNSLocalRecord) *DNS {
+	if q.Type != DNSTypeMX {
+		return req.ReplyTo([]DNSResourceRecord{})
+	}
+	var answers []DNSResourceRecord
+	for _, mx := range record.MailExchanges() {
+		answers = append(answers, NewMXRecord(string(q.Name), mx.Preference, string(mx.Exchange), record.TTL))
+	}
+	return req.ReplyTo(answers)
+}
+
+// resolveDelegation replies with the NS records of the delegated zone enclosing
+// the question name. NS queries for the delegated zone are answered with the
+// records, queries for other names get a referral with the records in the
+// authority section.
+func (rr *DNSResolver) resolveDelegation(req *DNS, q DNSQuestion) (*DNS, bool) {
+	zone, delegation, ok := rr.Records.Delegation(string(q.Name))
+	if !ok {
+		return nil, false
+	}
+
+	var records []DNSResourceRecord
+	for _, ns := range delegation.Nameservers() {
+		records = append(records, NewNSRecord(zone, ns, delegation.TTL))
+	}
+
+	if q.Type == DNSTypeNS && strings.EqualFold(string(q.Name), zone) {
+		return req.ReplyTo(records), true
+	}
+	reply := req.ReplyTo([]DNSResourceRecord{})
+	// the referral replaces any authority records copied from the request
+	reply.Authorities = nil
+	reply.AddAuthority(records...)
+	return reply, true
+}
+
+// forwards returns true if the request should be proxied upstream: the DNS recursion
+// desired (RD) flag is set and a forward server is available.
+// Resolvers with a nil Fwd only reply from the local storage.
+func (rr *DNSResolver) forwards(req *DNS) bool {
+	return req.RD && rr.Fwd != nil
+}
+
+// pendingForward is a request forwarded upstream in the background while the
+// resolver searches the local storage.
+type pendingForward struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	reply  []byte
+	err    error
+}
+
+// startForward forwards the raw request upstream in the background when the
+// resolver races local lookups against upstreams. It returns nil otherwise.
+func (rr *DNSResolver) startForward(req *DNS, raw []byte) *pendingForward {
+	if !rr.RaceUpstream || !rr.forwards(req) {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pendingForward{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		if fwd, ok := rr.Fwd.(ContextForwarder); ok {
+			p.reply, p.err = fwd.ForwardContext(ctx, raw)
+		} else {
+			p.reply, p.err = rr.Fwd.Forward(raw)
+		}
+	}()
+	return p
+}
+
+// abandon cancels the pending forward without waiting for its reply.
+func (p *pendingForward) abandon() {
+	if p != nil {
+		p.cancel()
+	}
+}
+
+// forward returns the reply of the pending forward, or forwards the raw request
+// upstream if there's none.
+func (rr *DNSResolver) forward(p *pendingForward, raw []byte) ([]byte, error) {
+	if p == nil {
+		return rr.Fwd.Forward(raw)
+	}
+	<-p.done
+	p.cancel()
+	return p.reply, p.err
 }
 
 // Forwarder is the interface implemented by DNS request forwarders.
@@ -133,36 +500,196 @@ type Forwarder interface {
 	Forward(req []byte) ([]byte, error)
 }
 
+// ContextForwarder is implemented by forwarders that can abandon a request
+// when the context is cancelled.
+type ContextForwarder interface {
+	Forwarder
+	ForwardContext(ctx context.Context, req []byte) ([]byte, error)
+}
+
 // DNSForwarder implements logic to forward raw DNS requests to upstream
 // DNS servers when recursion is requested.
+//
+// Upstreams are tried in order until one of them replies. When Parallel is set
+// the request is sent to all upstreams at once and the fastest reply wins.
+// DialTimeout applies to every attempt.
+//
+// When PoolSize is greater than zero, queries are multiplexed over a pool of
+// persistent connections to every upstream instead of dialing a new socket for
+// each request. Pooled forwarders must be closed to release their connections.
 type DNSForwarder struct {
-	Upstream    string
+	Upstreams   []string
+	Parallel    bool
 	DialTimeout time.Duration
+	PoolSize    int
+
+	mu    sync.Mutex
+	pools map[string]*udpPool
 }
 
-// Forward the raw DNS request to upstream server.
+// Forward the raw DNS request to upstream servers.
+// If all upstreams fail, the returned error combines the errors of every attempt.
 func (ff *DNSForwarder) Forward(req []byte) ([]byte, error) {
+	return ff.ForwardContext(context.Background(), req)
+}
+
+// ForwardContext forwards the raw DNS request to upstream servers, giving up
+// as soon as ctx is cancelled.
+func (ff *DNSForwarder) ForwardContext(ctx context.Context, req []byte) ([]byte, error) {
+	if len(req) < 2 {
+		return nil, errDNSPacketTooShort
+	}
+	if len(ff.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	if ff.Parallel {
+		return ff.forwardParallel(ctx, req)
+	}
+
+	return forwardInOrder(ctx, ff.Upstreams, req, ff.exchange)
+}
+
+// forwardInOrder tries the upstreams in order with the exchange function until
+// one of them replies. If all upstreams fail, the returned error combines the
+// errors of every attempt.
+func forwardInOrder(ctx context.Context, upstreams []string, req []byte,
+	exchange func(ctx context.Context, upstream string, req []byte) ([]byte, error)) ([]byte, error) {
+
+	errs := make([]error, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		reply, err := exchange(ctx, upstream, req)
+		if err == nil {
+			return reply, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break // no point in trying the next upstreams
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// forwardParallel sends the request to all upstreams concurrently and returns
+// the first successful reply.
+func (ff *DNSForwarder) forwardParallel(ctx context.Context, req []byte) ([]byte, error) {
+	type result struct {
+		reply []byte
+		err   error
+	}
+	// buffered so that slower upstreams don't leak goroutines
+	results := make(chan result, len(ff.Upstreams))
+	for _, upstream := range ff.Upstreams {
+		go func(upstream string) {
+			reply, err := ff.exchange(ctx, upstream, req)
+			results <- result{reply, err}
+		}(upstream)
+	}
+
+	errs := make([]error, 0, len(ff.Upstreams))
+	for range ff.Upstreams {
+		res := <-results
+		if res.err == nil {
+			return res.reply, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// exchange sends the request to a single upstream server and waits for its reply,
+// until the dial timeout expires or ctx is cancelled.
+//
+// The request is sent upstream with a random transaction ID to make cache poisoning
+// harder. Replies with a different ID are dropped and the forwarder keeps waiting
+// for the genuine reply until the timeout, so that spoofed packets can't make the
+// exchange fail. The client's original ID is restored in the reply before returning it.
+func (ff *DNSForwarder) exchange(ctx context.Context, upstream string, req []byte) ([]byte, error) {
 	timeout := defaultDialTimeout
 	if ff.DialTimeout != 0 {
 		timeout = ff.DialTimeout
 	}
 
-	var err error
+	if ff.PoolSize > 0 {
+		return ff.pool(upstream, timeout).exchange(ctx, req)
+	}
+
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	clientID := unpackUint16(req, 0)
+	upstreamReq := withTransactionID(req, id)
+
 	var conn net.Conn
-	if conn, err = net.DialTimeout("udp", ff.Upstream, timeout); err != nil {
+	if conn, err = net.DialTimeout("udp", upstream, timeout); err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// expiring the deadline unblocks the read below when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
 
-	if _, err = conn.Write(req); err != nil {
+	if _, err = conn.Write(upstreamReq); err != nil {
 		return nil, err
 	}
 
 	buf := make([]byte, MaxDNSDatagramSize)
-	var n int
-	if n, err = conn.Read(buf); err != nil {
-		return nil, err
+	for {
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if n < 2 || unpackUint16(buf, 0) != id {
+			debugf("dropping upstream reply from %s with unexpected transaction id", upstream)
+			continue
+		}
+		packUint16(buf, 0, clientID)
+
+		return buf[:n], nil
+	}
+}
+
+// pool returns the connection pool for the upstream server, creating it on first use.
+func (ff *DNSForwarder) pool(upstream string, timeout time.Duration) *udpPool {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	if ff.pools == nil {
+		ff.pools = map[string]*udpPool{}
+	}
+	p, ok := ff.pools[upstream]
+	if !ok {
+		p = newUDPPool(upstream, ff.PoolSize, timeout)
+		ff.pools[upstream] = p
+	}
+	return p
+}
+
+// Close the pooled upstream connections, if any.
+func (ff *DNSForwarder) Close() error {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	var errs []error
+	for upstream, p := range ff.pools {
+		errs = append(errs, p.Close())
+		delete(ff.pools, upstream)
 	}
+	return errors.Join(errs...)
+}
 
-	return buf[:n], nil
+// newTransactionID returns a cryptographically random DNS transaction ID.
+func newTransactionID() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
 }
+
+var errNoUpstreams = errors.New("no upstream servers configured")
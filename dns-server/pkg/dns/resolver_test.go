@@ -1,9 +1,14 @@
 package dns
 
 import (
+	"context"
+	"errors"
+	"net"
+	"os"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockForwarder struct {
@@ -25,7 +30,7 @@ func TestShouldForwardRequest(t *testing.T) {
 
 	req := getTestDNSRequest()
 
-	_, err := resolver.Resolve(req.Serialize())
+	_, err := resolver.Resolve(serialize(t, req))
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -44,7 +49,7 @@ func TestShouldNotForwardIfNotDesired(t *testing.T) {
 
 	req := getTestDNSRequest()
 	req.RD = false // no recursion
-	_, err := resolver.Resolve(req.Serialize())
+	_, err := resolver.Resolve(serialize(t, req))
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -66,7 +71,7 @@ example.com.  127.0.0.1`))
 	}
 
 	req := getTestDNSRequest()
-	bytes, err := resolver.Resolve(req.Serialize())
+	bytes, err := resolver.Resolve(serialize(t, req))
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -91,6 +96,422 @@ example.com.  127.0.0.1`))
 	}
 }
 
+func TestShouldReplyWithZoneSOA(t *testing.T) {
+	mockFwd := &MockForwarder{}
+	soa := DNSSOA{
+		MName:   []byte("ns1.example.com."),
+		RName:   []byte("admin.example.com."),
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: 300,
+	}
+	resolver := &DNSResolver{
+		Fwd:     mockFwd,
+		Records: DNSLocalStore{"example.com.": {Value: "127.0.0.1", TTL: 60}},
+		Zones:   map[string]DNSSOA{"example.com.": soa},
+	}
+
+	req := getTestDNSRequest()
+	req.Questions[0].Type = DNSTypeSOA
+	bytes, err := resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+
+	reply := &DNS{}
+	if err := reply.Decode(bytes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reply.AA {
+		t.Fatal("expected authoritative answer")
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	an := reply.Answers[0]
+	if an.Type != DNSTypeSOA || an.SOA.String() != soa.String() {
+		t.Fatalf("expected SOA answer %s, found %s", soa.String(), an.String())
+	}
+
+	// A queries for the zone name are still answered from the local records
+	req.Questions[0].Type = DNSTypeA
+	reply, err = resolver.ResolveParsed(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].Type != DNSTypeA {
+		t.Fatalf("expected A answer, found %v", reply.Answers)
+	}
+
+	// zone names are matched case-insensitively
+	req.Questions[0].Type = DNSTypeSOA
+	req.Questions[0].Name = []byte("Example.COM.")
+	reply, err = resolver.ResolveParsed(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].Type != DNSTypeSOA {
+		t.Fatalf("expected SOA answer for mixed-case zone name, found %v", reply.Answers)
+	}
+
+	// SOA queries for other zones are forwarded
+	req.Questions[0].Name = []byte("other.com.")
+	if _, err := resolver.Resolve(serialize(t, req)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if mockFwd.NumCalled != 1 {
+		t.Fatalf("expected %d forwards, found %d", 1, mockFwd.NumCalled)
+	}
+}
+
+func TestShouldReplyWithDelegatedNameservers(t *testing.T) {
+	store := &DNSLocalStore{}
+	if err := store.handleFromFile(strings.NewReader(`acme.com.  127.0.0.1
+*.acme.com.  127.0.0.2
+sub.acme.com.  60  NS  ns1.provider.com.
+sub.acme.com.  60  NS  ns2.provider.com.`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Records: *store}
+	expected := []string{"ns1.provider.com.", "ns2.provider.com."}
+
+	req := getTestDNSRequest()
+	req.Questions[0].Name = []byte("sub.acme.com.")
+	req.Questions[0].Type = DNSTypeNS
+	bytes, err := resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reply := &DNS{}
+	if err := reply.Decode(bytes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != len(expected) {
+		t.Fatalf("expected %d answers, found %d", len(expected), len(reply.Answers))
+	}
+	for i, an := range reply.Answers {
+		if an.Type != DNSTypeNS || string(an.NS) != expected[i] || an.TTL != 60 {
+			t.Fatalf("expected NS answer %s, found %s", expected[i], an.String())
+		}
+	}
+
+	// names in the delegated zone get a referral
+	req.Questions[0].Name = []byte("www.sub.acme.com.")
+	req.Questions[0].Type = DNSTypeA
+	bytes, err = resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reply = &DNS{}
+	if err := reply.Decode(bytes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 0 {
+		t.Fatalf("expected %d answers, found %d", 0, len(reply.Answers))
+	}
+	if len(reply.Authorities) != len(expected) {
+		t.Fatalf("expected %d authorities, found %d", len(expected), len(reply.Authorities))
+	}
+	for i, ns := range reply.Authorities {
+		if string(ns.Name) != "sub.acme.com." || string(ns.NS) != expected[i] {
+			t.Fatalf("expected authority %s, found %s", expected[i], ns.String())
+		}
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+
+	// names outside of the delegated zone are still resolved locally
+	req.Questions[0].Name = []byte("www.acme.com.")
+	reply, err = resolver.ResolveParsed(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 || !reply.Answers[0].IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("expected A answer for %s, found %v", "www.acme.com.", reply.Answers)
+	}
+}
+
+func TestShouldReplyWithMailExchanges(t *testing.T) {
+	store := &DNSLocalStore{}
+	if err := store.handleFromFile(strings.NewReader(`acme.com.  60  MX  20  backup.acme.com.
+acme.com.  60  MX  10  mail.acme.com.
+mail.acme.com.  127.0.0.1`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Records: *store}
+	expected := []string{"mail.acme.com.", "backup.acme.com."}
+
+	req := getTestDNSRequest()
+	req.Questions[0].Name = []byte("acme.com.")
+	req.Questions[0].Type = DNSTypeMX
+	bytes, err := resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reply := &DNS{}
+	if err := reply.Decode(bytes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != len(expected) {
+		t.Fatalf("expected %d answers, found %d", len(expected), len(reply.Answers))
+	}
+	// answers are sorted by preference
+	for i, an := range reply.Answers {
+		if an.Type != DNSTypeMX || string(an.MX.Exchange) != expected[i] || an.TTL != 60 {
+			t.Fatalf("expected MX answer %s, found %s", expected[i], an.String())
+		}
+	}
+
+	// the name has no A record
+	req.Questions[0].Type = DNSTypeA
+	reply, err = resolver.ResolveParsed(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 0 {
+		t.Fatalf("expected %d answers, found %d", 0, len(reply.Answers))
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+}
+
+func TestParseLineTTL(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected DNSLocalRecord
+	}{
+		{"example.com.  127.0.0.1", DNSLocalRecord{Value: "127.0.0.1", TTL: defaultAnswerTTL}},
+		{"example.com.  60  127.0.0.1", DNSLocalRecord{Value: "127.0.0.1", TTL: 60}},
+		{"example.com. 0 BLOCK", DNSLocalRecord{Value: "BLOCK", TTL: 0}},
+		{"example.com. NS ns1.example.net.", DNSLocalRecord{Value: "ns1.example.net.", TTL: defaultAnswerTTL, Type: DNSTypeNS}},
+		{"example.com. 60 NS ns1.example.net.", DNSLocalRecord{Value: "ns1.example.net.", TTL: 60, Type: DNSTypeNS}},
+		{"example.com. MX 10 mail.example.com.", DNSLocalRecord{Value: "10 mail.example.com.", TTL: defaultAnswerTTL, Type: DNSTypeMX}},
+		{"example.com. 60 MX 10 mail.example.com.", DNSLocalRecord{Value: "10 mail.example.com.", TTL: 60, Type: DNSTypeMX}},
+	}
+	for _, tt := range tests {
+		k, v, err := parseLine(tt.line)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if k != "example.com." || v != tt.expected {
+			t.Fatalf("parse %q: expected %+v, found %s %+v", tt.line, tt.expected, k, v)
+		}
+	}
+
+	for _, line := range []string{"example.com.", "example.com. -1 127.0.0.1", "example.com. 1 2 3",
+		"example.com. NS ns1.example.net", "example.com. 1 2 NS ns1.example.net.",
+		"example.com. MX 70000 mail.example.com.", "example.com. MX 10 mail.example.com"} {
+		if _, _, err := parseLine(line); err == nil {
+			t.Fatalf("expected error parsing %q, found nil", line)
+		}
+	}
+}
+
+func TestShouldReplyWithRecordTTL(t *testing.T) {
+	store := &DNSLocalStore{}
+	if err := store.handleFromFile(strings.NewReader(`example.com.  60  127.0.0.1
+www.example.com.  127.0.0.1`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	resolver := &DNSResolver{Records: *store}
+
+	for name, ttl := range map[string]uint32{"example.com.": 60, "www.example.com.": defaultAnswerTTL} {
+		req := getTestDNSRequest()
+		req.Questions[0].Name = []byte(name)
+		bytes, err := resolver.Resolve(serialize(t, req))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		reply := &DNS{}
+		if err := reply.Decode(bytes); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(reply.Answers) != 1 {
+			t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+		}
+		if reply.Answers[0].TTL != ttl {
+			t.Fatalf("expected TTL %d for %s, found %d", ttl, name, reply.Answers[0].TTL)
+		}
+	}
+}
+
+func TestLookupWildcardRecords(t *testing.T) {
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`*.acme.com.  10.0.0.1
+*.dev.acme.com.  10.0.0.2
+dev.acme.com.  10.0.0.3
+api.dev.acme.com.  10.0.0.4`))
+
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"foo.dev.acme.com.", "10.0.0.2", true},
+		{"bar.foo.dev.acme.com.", "10.0.0.2", true},
+		{"api.dev.acme.com.", "10.0.0.4", true},
+		{"dev.acme.com.", "10.0.0.3", true},
+		{"www.acme.com.", "10.0.0.1", true},
+		{"acme.com.", "", false},
+		{"example.com.", "", false},
+	}
+	for _, tt := range tests {
+		v, ok := store.Lookup(tt.name)
+		if ok != tt.found || v.Value != tt.expected {
+			t.Fatalf("lookup %s: expected (%s, %t), found (%s, %t)", tt.name, tt.expected, tt.found, v.Value, ok)
+		}
+	}
+}
+
+func TestShouldReplyFromWildcardRecord(t *testing.T) {
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`*.dev.acme.com.  127.0.0.2`))
+
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Records: *store}
+
+	req := getTestDNSRequest()
+	req.Questions[0].Name = []byte("foo.dev.acme.com.")
+	bytes, err := resolver.Resolve(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	reply := &DNS{}
+	if err := reply.Decode(bytes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	if an := reply.Answers[0]; string(an.Name) != "foo.dev.acme.com." || !slices.Equal(an.IP, []byte{127, 0, 0, 2}) {
+		t.Fatalf("unexpected answer %s", an.String())
+	}
+
+	// the wildcard doesn't match the parent domain, the request is forwarded
+	req.Questions[0].Name = []byte("dev.acme.com.")
+	if _, err := resolver.Resolve(serialize(t, req)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if mockFwd.NumCalled != 1 {
+		t.Fatalf("expected %d forwards, found %d", 1, mockFwd.NumCalled)
+	}
+}
+
+func TestShouldReplyFromLocalStorageIgnoringCase(t *testing.T) {
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`Example.com.  127.0.0.1
+*.DEV.acme.com.  127.0.0.2`))
+
+	mockFwd := &MockForwarder{}
+	resolver := &DNSResolver{Fwd: mockFwd, Records: *store}
+
+	tests := []struct {
+		name string
+		ip   []byte
+	}{
+		{"Example.COM.", []byte{127, 0, 0, 1}},
+		{"example.com.", []byte{127, 0, 0, 1}},
+		{"Foo.Dev.ACME.com.", []byte{127, 0, 0, 2}},
+	}
+	for _, tt := range tests {
+		req := getTestDNSRequest()
+		req.Questions[0].Name = []byte(tt.name)
+		bytes, err := resolver.Resolve(serialize(t, req))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		reply := &DNS{}
+		if err := reply.Decode(bytes); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(reply.Answers) != 1 {
+			t.Fatalf("query %s: expected %d answers, found %d", tt.name, 1, len(reply.Answers))
+		}
+		// the question and answer keep the case of the query
+		if q := reply.Questions[0]; string(q.Name) != tt.name {
+			t.Fatalf("expected question for name %s, found %s", tt.name, string(q.Name))
+		}
+		if an := reply.Answers[0]; string(an.Name) != tt.name || !slices.Equal(an.IP, tt.ip) {
+			t.Fatalf("query %s: unexpected answer %s", tt.name, an.String())
+		}
+	}
+	if mockFwd.NumCalled != 0 {
+		t.Fatalf("expected %d forwards, found %d", 0, mockFwd.NumCalled)
+	}
+}
+
+func TestResolveParsedMatchesResolve(t *testing.T) {
+	store := &DNSLocalStore{}
+	if err := store.handleFromFile(strings.NewReader(`example.com.  60  127.0.0.1
+*.acme.com.  10.0.0.1
+ads.example.com.  BLOCK`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// pure local resolution, without a forwarder
+	resolver := &DNSResolver{Records: *store}
+
+	for _, name := range []string{"example.com.", "www.acme.com.", "ads.example.com.", "unknown.com."} {
+		req := getTestDNSRequest()
+		req.Questions[0].Name = []byte(name)
+
+		expected, err := resolver.Resolve(serialize(t, req))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		reply, err := resolver.ResolveParsed(req)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if found := serialize(t, reply); !slices.Equal(expected, found) {
+			t.Fatalf("reply mismatch for %s: expected %v, found %v", name, expected, found)
+		}
+	}
+}
+
+func BenchmarkResolveParsed(b *testing.B) {
+	store := &DNSLocalStore{}
+	if err := store.handleFromFile(strings.NewReader(`example.com.  127.0.0.1
+*.acme.com.  10.0.0.1`)); err != nil {
+		b.Fatal(err)
+	}
+	resolver := &DNSResolver{Records: *store}
+
+	for _, name := range []string{"example.com.", "www.acme.com.", "unknown.com."} {
+		b.Run(name, func(b *testing.B) {
+			req := getTestDNSRequest()
+			req.Questions[0].Name = []byte(name)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := resolver.ResolveParsed(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func serialize(t *testing.T, d *DNS) []byte {
+	t.Helper()
+	data, err := d.Serialize()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return data
+}
+
 func getTestDNSRequest() *DNS {
 	req := &DNS{}
 	req.ID = 1
@@ -106,3 +527,243 @@ func getTestDNSRequest() *DNS {
 	}
 	return req
 }
+
+// startTestUpstream starts a UDP server that replies to a single request with
+// the result of the reply function.
+func startTestUpstream(t *testing.T, reply func(req []byte) []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxDNSDatagramSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteToUDP(reply(buf[:n]), addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestForwardRandomizesTransactionID(t *testing.T) {
+	upstreamIDs := make(chan uint16, 1)
+	addr := startTestUpstream(t, func(req []byte) []byte {
+		upstreamIDs <- unpackUint16(req, 0)
+		return req
+	})
+
+	req := getTestDNSRequest()
+	req.ID = 0x7b65
+	fwd := &DNSForwarder{Upstreams: []string{addr}, DialTimeout: time.Second}
+	reply, err := fwd.Forward(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if upstreamID := <-upstreamIDs; upstreamID == req.ID {
+		t.Fatalf("expected random upstream transaction id, found client id %d", upstreamID)
+	}
+	if id := unpackUint16(reply, 0); id != req.ID {
+		t.Fatalf("expected reply with id %d, found %d", req.ID, id)
+	}
+}
+
+func TestForwardDropsMismatchedID(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// a spoofed reply with the wrong transaction id arrives before the genuine one
+	go func() {
+		buf := make([]byte, MaxDNSDatagramSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		spoofed := withTransactionID(buf[:n], unpackUint16(buf, 0)+1)
+		conn.WriteToUDP(spoofed, addr)
+		conn.WriteToUDP(buf[:n], addr)
+	}()
+
+	req := getTestDNSRequest()
+	fwd := &DNSForwarder{Upstreams: []string{conn.LocalAddr().String()}, DialTimeout: time.Second}
+	reply, err := fwd.Forward(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if id := unpackUint16(reply, 0); id != req.ID {
+		t.Fatalf("expected reply with id %d, found %d", req.ID, id)
+	}
+}
+
+func TestForwardMismatchedIDTimesOut(t *testing.T) {
+	addr := startTestUpstream(t, func(req []byte) []byte {
+		packUint16(req, 0, unpackUint16(req, 0)+1)
+		return req
+	})
+
+	fwd := &DNSForwarder{Upstreams: []string{addr}, DialTimeout: 100 * time.Millisecond}
+	_, err := fwd.Forward(serialize(t, getTestDNSRequest()))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected error %v, found %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+// startDeadUpstream starts a UDP server that never replies to requests.
+func startDeadUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestForwardFailover(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		dead := startDeadUpstream(t)
+		live := startTestUpstream(t, func(req []byte) []byte { return req })
+
+		fwd := &DNSForwarder{
+			Upstreams:   []string{dead, live},
+			Parallel:    parallel,
+			DialTimeout: 100 * time.Millisecond,
+		}
+		req := getTestDNSRequest()
+		reply, err := fwd.Forward(serialize(t, req))
+		if err != nil {
+			t.Fatalf("parallel=%t: %v", parallel, err)
+		}
+		if id := unpackUint16(reply, 0); id != req.ID {
+			t.Fatalf("parallel=%t: expected reply with id %d, found %d", parallel, req.ID, id)
+		}
+	}
+}
+
+func TestForwardAllUpstreamsFail(t *testing.T) {
+	mismatched := startTestUpstream(t, func(req []byte) []byte {
+		packUint16(req, 0, unpackUint16(req, 0)+1)
+		return req
+	})
+	fwd := &DNSForwarder{
+		Upstreams:   []string{startDeadUpstream(t), mismatched},
+		DialTimeout: 100 * time.Millisecond,
+	}
+
+	_, err := fwd.Forward(serialize(t, getTestDNSRequest()))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected error %v, found %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+// blockingForwarder holds forwarded requests until their context is cancelled
+type blockingForwarder struct {
+	cancelled chan struct{}
+}
+
+func (f *blockingForwarder) Forward(req []byte) ([]byte, error) {
+	return f.ForwardContext(context.Background(), req)
+}
+
+func (f *blockingForwarder) ForwardContext(ctx context.Context, req []byte) ([]byte, error) {
+	<-ctx.Done()
+	close(f.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestRaceUpstreamCancelsForwardOnLocalAnswer(t *testing.T) {
+	store := &DNSLocalStore{}
+	store.handleFromFile(strings.NewReader(`example.com.  127.0.0.1`))
+
+	resolvers := map[string]func(*DNSResolver) (*DNS, error){
+		"Resolve": func(rr *DNSResolver) (*DNS, error) {
+			raw, err := rr.Resolve(serialize(t, getTestDNSRequest()))
+			if err != nil {
+				return nil, err
+			}
+			reply := &DNS{}
+			return reply, reply.Decode(raw)
+		},
+		"ResolveParsed": func(rr *DNSResolver) (*DNS, error) {
+			return rr.ResolveParsed(getTestDNSRequest())
+		},
+	}
+	for name, resolve := range resolvers {
+		fwd := &blockingForwarder{cancelled: make(chan struct{})}
+		resolver := &DNSResolver{Fwd: fwd, Records: *store, RaceUpstream: true}
+
+		// the upstream never replies, resolving only completes if it's not awaited
+		replies := make(chan *DNS, 1)
+		go func() {
+			reply, err := resolve(resolver)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			replies <- reply
+		}()
+
+		select {
+		case reply := <-replies:
+			if reply == nil || len(reply.Answers) != 1 || !net.IP(reply.Answers[0].IP).Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Fatalf("%s: expected local answer, found %v", name, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: local answer should not wait for the upstream reply", name)
+		}
+		select {
+		case <-fwd.cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: upstream forward should be cancelled", name)
+		}
+	}
+}
+
+func TestRaceUpstreamRepliesFromUpstream(t *testing.T) {
+	resolver := &DNSResolver{Fwd: replyForwarder{}, Records: DNSLocalStore{}, RaceUpstream: true}
+
+	reply, err := resolver.ResolveParsed(getTestDNSRequest())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 1 || !net.IP(reply.Answers[0].IP).Equal(net.IPv4(93, 184, 216, 34)) {
+		t.Fatalf("expected upstream answer, found %v", reply.Answers)
+	}
+
+	// requests without recursion desired are not forwarded
+	req := getTestDNSRequest()
+	req.RD = false
+	if reply, err = resolver.ResolveParsed(req); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(reply.Answers) != 0 {
+		t.Fatalf("expected %d answers, found %d", 0, len(reply.Answers))
+	}
+}
+
+func TestForwardContextCancellation(t *testing.T) {
+	for _, poolSize := range []int{0, 1} {
+		fwd := &DNSForwarder{
+			Upstreams:   []string{startDeadUpstream(t), startDeadUpstream(t)},
+			DialTimeout: 5 * time.Second,
+			PoolSize:    poolSize,
+		}
+		defer fwd.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err := fwd.ForwardContext(ctx, serialize(t, getTestDNSRequest()))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("poolSize=%d: expected error %v, found %v", poolSize, context.DeadlineExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("poolSize=%d: forward should stop when the context is done, took %s", poolSize, elapsed)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// mimeDNSMessage is the media type of DNS messages sent over HTTPS
+const mimeDNSMessage = "application/dns-message"
+
+// maxDNSMessageSize is the maximum size of DNS messages sent over streams,
+// whose length is limited by the 2-byte length prefix.
+const maxDNSMessageSize = 65535
+
+// DoTForwarder forwards raw DNS requests to upstream servers over DNS-over-TLS
+// (RFC 7858), so that queries can't be read or tampered with on their way.
+// Replies larger than MaxDNSDatagramSize are truncated with the TC bit set.
+//
+// Upstreams are host:port addresses, usually on port 853, and are tried in
+// order until one of them replies. A new TLS connection is dialed for every
+// request. DialTimeout applies to every attempt, including the TLS handshake.
+type DoTForwarder struct {
+	Upstreams   []string
+	DialTimeout time.Duration
+	// TLSConfig configures the connections to the upstreams. When ServerName
+	// is not set, the certificates are verified against the upstream host.
+	TLSConfig *tls.Config
+}
+
+// Forward the raw DNS request to upstream servers.
+// If all upstreams fail, the returned error combines the errors of every attempt.
+func (ff *DoTForwarder) Forward(req []byte) ([]byte, error) {
+	return ff.ForwardContext(context.Background(), req)
+}
+
+// ForwardContext forwards the raw DNS request to upstream servers, giving up
+// as soon as ctx is cancelled.
+func (ff *DoTForwarder) ForwardContext(ctx context.Context, req []byte) ([]byte, error) {
+	if len(req) < 2 {
+		return nil, errDNSPacketTooShort
+	}
+	if len(ff.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	return forwardInOrder(ctx, ff.Upstreams, req, ff.exchange)
+}
+
+// exchange sends the length-prefixed request to a single upstream server over a
+// new TLS connection and waits for its reply, until the dial timeout expires or
+// ctx is cancelled.
+//
+// As with plain DNS, the request is sent with a random transaction ID and the
+// client's original ID is restored in the reply.
+func (ff *DoTForwarder) exchange(ctx context.Context, upstream string, req []byte) ([]byte, error) {
+	timeout := defaultDialTimeout
+	if ff.DialTimeout != 0 {
+		timeout = ff.DialTimeout
+	}
+
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	clientID := unpackUint16(req, 0)
+	msg := make([]byte, 2, 2+len(req))
+	packUint16(msg, 0, uint16(len(req)))
+	msg = append(msg, withTransactionID(req, id)...)
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: ff.TLSConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// expiring the deadline unblocks the read below when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var prefix [2]byte
+	if _, err = io.ReadFull(conn, prefix[:]); err == nil {
+		reply := make([]byte, unpackUint16(prefix[:], 0))
+		if _, err = io.ReadFull(conn, reply); err == nil {
+			// replies can't be spoofed over TLS: a mismatch is an upstream error
+			if len(reply) < 2 || unpackUint16(reply, 0) != id {
+				return nil, fmt.Errorf("%w from %s", errUnexpectedTransactionID, upstream)
+			}
+			packUint16(reply, 0, clientID)
+			return fitDatagram(reply)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, err
+}
+
+// DoHForwarder forwards raw DNS requests to upstream servers over DNS-over-HTTPS
+// (RFC 8484), so that queries can't be read or tampered with on their way.
+// Replies larger than MaxDNSDatagramSize are truncated with the TC bit set.
+//
+// Upstreams are the URLs of the DoH endpoints, like https://dns.google/dns-query,
+// and are tried in order until one of them replies. Requests are POSTed to the
+// endpoints over persistent HTTP connections, that must be released with Close.
+// DialTimeout applies to every attempt, including reading the reply.
+type DoHForwarder struct {
+	Upstreams   []string
+	DialTimeout time.Duration
+	// TLSConfig configures the connections to the upstreams.
+	TLSConfig *tls.Config
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+// Forward the raw DNS request to upstream servers.
+// If all upstreams fail, the returned error combines the errors of every attempt.
+func (ff *DoHForwarder) Forward(req []byte) ([]byte, error) {
+	return ff.ForwardContext(context.Background(), req)
+}
+
+// ForwardContext forwards the raw DNS request to upstream servers, giving up
+// as soon as ctx is cancelled.
+func (ff *DoHForwarder) ForwardContext(ctx context.Context, req []byte) ([]byte, error) {
+	if len(req) < 2 {
+		return nil, errDNSPacketTooShort
+	}
+	if len(ff.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	return forwardInOrder(ctx, ff.Upstreams, req, ff.exchange)
+}
+
+// exchange POSTs the request to a single upstream endpoint and waits for its
+// reply, until the dial timeout expires or ctx is cancelled.
+//
+// The request is sent with transaction ID 0, as recommended for HTTP caches to
+// share replies, and the client's original ID is restored in the reply.
+func (ff *DoHForwarder) exchange(ctx context.Context, upstream string, req []byte) ([]byte, error) {
+	timeout := defaultDialTimeout
+	if ff.DialTimeout != 0 {
+		timeout = ff.DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	clientID := unpackUint16(req, 0)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream,
+		bytes.NewReader(withTransactionID(req, 0)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", mimeDNSMessage)
+	httpReq.Header.Set("Accept", mimeDNSMessage)
+
+	resp, err := ff.httpClient().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream %s replied with status %s", upstream, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != mimeDNSMessage {
+		return nil, fmt.Errorf("upstream %s replied with content type %q", upstream, ct)
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 {
+		return nil, errDNSPacketTooShort
+	}
+	packUint16(reply, 0, clientID)
+	return fitDatagram(reply)
+}
+
+// httpClient returns the client used to reach the upstreams, creating it on first use.
+func (ff *DoHForwarder) httpClient() *http.Client {
+	ff.clientOnce.Do(func() {
+		ff.client = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   ff.TLSConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+	})
+	return ff.client
+}
+
+// Close the idle connections to the upstreams.
+func (ff *DoHForwarder) Close() error {
+	ff.httpClient().CloseIdleConnections()
+	return nil
+}
+
+// fitDatagram truncates replies received over streams that don't fit in a UDP
+// datagram, keeping the header and questions with the TC bit set. Clients are
+// served over UDP and retry over TCP when the reply is truncated.
+func fitDatagram(reply []byte) ([]byte, error) {
+	if len(reply) <= MaxDNSDatagramSize {
+		return reply, nil
+	}
+	debugf("truncating upstream reply of %d bytes", len(reply))
+	return truncateReply(reply)
+}
+
+var errUnexpectedTransactionID = errors.New("unexpected transaction id in upstream reply")
@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns the certificate of the httptest servers, valid for
+// 127.0.0.1, along with a pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return srv.TLS.Certificates[0], roots
+}
+
+// answerA replies to the request with an A record for 127.0.0.1.
+func answerA(t *testing.T, raw []byte) []byte {
+	req := &DNS{}
+	if err := req.Decode(raw); err != nil {
+		t.Errorf("upstream received malformed request: %v", err)
+		return nil
+	}
+	reply := req.ReplyTo([]DNSResourceRecord{{
+		Name:  req.Questions[0].Name,
+		Type:  DNSTypeA,
+		Class: DNSClassIN,
+		TTL:   defaultAnswerTTL,
+		IP:    net.IPv4(127, 0, 0, 1).To4(),
+	}})
+	data, err := reply.Serialize()
+	if err != nil {
+		t.Errorf("%v", err)
+		return nil
+	}
+	return data
+}
+
+// answerLargeTXT replies to the request with TXT records that don't fit in a
+// UDP datagram.
+func answerLargeTXT(t *testing.T, raw []byte) []byte {
+	req := &DNS{}
+	if err := req.Decode(raw); err != nil {
+		t.Errorf("upstream received malformed request: %v", err)
+		return nil
+	}
+	txt := strings.Repeat("t", maxTXTLength)
+	reply := req.ReplyTo([]DNSResourceRecord{NewTXTRecord(string(req.Questions[0].Name), 60, txt, txt, txt)})
+	data, err := reply.Serialize()
+	if err != nil {
+		t.Errorf("%v", err)
+		return nil
+	}
+	return data
+}
+
+// startTLSUpstream starts a DNS-over-TLS server that answers a single request
+// with the reply of answer.
+func startTLSUpstream(t *testing.T, cert tls.Certificate, answer func(*testing.T, []byte) []byte) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		var prefix [2]byte
+		if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+			return
+		}
+		req := make([]byte, unpackUint16(prefix[:], 0))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		reply := answer(t, req)
+		msg := make([]byte, 2, 2+len(reply))
+		packUint16(msg, 0, uint16(len(reply)))
+		conn.Write(append(msg, reply...))
+	}()
+	return ln.Addr().String()
+}
+
+// assertAnswerA checks that the raw reply answers the request with 127.0.0.1.
+func assertAnswerA(t *testing.T, req *DNS, raw []byte) {
+	t.Helper()
+	reply := &DNS{}
+	if err := reply.Decode(raw); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if reply.ID != req.ID {
+		t.Fatalf("expected reply with id %d, found %d", req.ID, reply.ID)
+	}
+	if len(reply.Answers) != 1 {
+		t.Fatalf("expected %d answers, found %d", 1, len(reply.Answers))
+	}
+	if an := reply.Answers[0]; !slices.Equal(an.IP, []byte{127, 0, 0, 1}) {
+		t.Fatalf("expected answer with IP addr %s, found %v", "127.0.0.1", an.IP)
+	}
+}
+
+func TestDoTForward(t *testing.T) {
+	cert, roots := testCertificate(t)
+	addr := startTLSUpstream(t, cert, answerA)
+
+	fwd := &DoTForwarder{
+		Upstreams:   []string{addr},
+		DialTimeout: time.Second,
+		TLSConfig:   &tls.Config{RootCAs: roots},
+	}
+	req := getTestDNSRequest()
+	req.ID = 0x7b65
+	reply, err := fwd.Forward(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	assertAnswerA(t, req, reply)
+}
+
+func TestDoTForwardRejectsUntrustedUpstream(t *testing.T) {
+	cert, _ := testCertificate(t)
+	addr := startTLSUpstream(t, cert, answerA)
+
+	fwd := &DoTForwarder{Upstreams: []string{addr}, DialTimeout: time.Second}
+	var certErr *tls.CertificateVerificationError
+	if _, err := fwd.Forward(serialize(t, getTestDNSRequest())); !errors.As(err, &certErr) {
+		t.Fatalf("expected certificate verification error, found %v", err)
+	}
+}
+
+func TestDoHForward(t *testing.T) {
+	var contentType string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		req, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", mimeDNSMessage)
+		w.Write(answerA(t, req))
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	fwd := &DoHForwarder{
+		Upstreams:   []string{srv.URL + "/dns-query"},
+		DialTimeout: time.Second,
+		TLSConfig:   &tls.Config{RootCAs: roots},
+	}
+	defer fwd.Close()
+
+	req := getTestDNSRequest()
+	req.ID = 0x7b65
+	reply, err := fwd.Forward(serialize(t, req))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if contentType != mimeDNSMessage {
+		t.Fatalf("expected request with content type %q, found %q", mimeDNSMessage, contentType)
+	}
+	assertAnswerA(t, req, reply)
+}
+
+func TestSecureForwardersTruncateLargeReplies(t *testing.T) {
+	cert, roots := testCertificate(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", mimeDNSMessage)
+		w.Write(answerLargeTXT(t, req))
+	}))
+	defer srv.Close()
+	dohRoots := x509.NewCertPool()
+	dohRoots.AddCert(srv.Certificate())
+	doh := &DoHForwarder{
+		Upstreams:   []string{srv.URL + "/dns-query"},
+		DialTimeout: time.Second,
+		TLSConfig:   &tls.Config{RootCAs: dohRoots},
+	}
+	defer doh.Close()
+
+	forwarders := map[string]Forwarder{
+		"dot": &DoTForwarder{
+			Upstreams:   []string{startTLSUpstream(t, cert, answerLargeTXT)},
+			DialTimeout: time.Second,
+			TLSConfig:   &tls.Config{RootCAs: roots},
+		},
+		"doh": doh,
+	}
+	for name, fwd := range forwarders {
+		req := getTestDNSRequest()
+		req.ID = 0x7b65
+		raw, err := fwd.Forward(serialize(t, req))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(raw) > MaxDNSDatagramSize {
+			t.Fatalf("%s: expected reply of at most %d bytes, found %d", name, MaxDNSDatagramSize, len(raw))
+		}
+
+		reply := &DNS{}
+		if err := reply.Decode(raw); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reply.TC || len(reply.Answers) != 0 {
+			t.Fatalf("%s: expected truncated reply with no answers, found %s", name, reply.String())
+		}
+		if reply.ID != req.ID || len(reply.Questions) != 1 || string(reply.Questions[0].Name) != "example.com." {
+			t.Fatalf("%s: expected reply to the request, found %s", name, reply.String())
+		}
+	}
+}
@@ -8,16 +8,20 @@ import (
 	"github.com/mcastellin/golang-mastery/dns-server/pkg/dns"
 )
 
-// Resolver is the interface implemented by DNS resolvers
+// Resolver is the interface implemented by DNS resolvers.
+// The client address is passed along with the request for query logging.
 type Resolver interface {
-	Resolve([]byte) ([]byte, error)
+	ResolveFrom(net.Addr, []byte) ([]byte, error)
 }
 
 // DNSServer is a web server implementation that can handle DNS requests via UDP.
 type DNSServer struct {
 	Port     int
 	Resolver Resolver
-	shutdown bool
+	// RateLimiter limits the responses sent to every client.
+	// Responses are not rate limited when nil.
+	RateLimiter *dns.ResponseRateLimiter
+	shutdown    bool
 }
 
 // Serve UDP requests and block current program execution flow until the context
@@ -67,11 +71,16 @@ func (srv *DNSServer) serveLoop(ctx context.Context, conn *net.UDPConn) {
 	serveFn := func(data []byte, addr *net.UDPAddr) {
 		var reply []byte
 		var err error
-		if reply, err = srv.Resolver.Resolve(data); err != nil {
+		if reply, err = srv.Resolver.ResolveFrom(addr, data); err != nil {
 			if recoverable := srv.handleErr(err); !recoverable {
 				return
 			}
 		}
+		if srv.RateLimiter != nil {
+			if reply = srv.RateLimiter.Limit(addr, reply); reply == nil {
+				return
+			}
+		}
 
 		if _, err := conn.WriteToUDP(reply, addr); err != nil {
 			if recoverable := srv.handleErr(err); !recoverable {
@@ -9,7 +9,8 @@ import (
 
 const (
 	seedAddrPattern = "localhost:98%02d"
-	nodeAddrPattern = "localhost:99%02d"
+	// regular nodes listen on ephemeral ports
+	nodeBindAddr = "localhost:0"
 )
 
 func main() {
@@ -36,8 +37,7 @@ func main() {
 	fmt.Printf("Starting %d regular cluster nodes.\n", regularNodes)
 	nodes := make([]*gossip.Gossiper, regularNodes)
 	for i := 0; i < regularNodes; i++ {
-		addr := fmt.Sprintf(nodeAddrPattern, i)
-		si := gossip.NewGossiper(addr, false, seeds)
+		si := gossip.NewGossiper(nodeBindAddr, false, seeds)
 		if err := si.Serve(); err != nil {
 			panic(err)
 		}
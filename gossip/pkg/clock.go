@@ -0,0 +1,33 @@
+package gossip
+
+import (
+	"context"
+	"time"
+)
+
+// Clock provides the current time and tickers to the gossip protocol.
+// Gossipers use the real clock by default, tests can inject a fake clock to drive
+// heart beats and gossip rounds deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Tick sends the current time on the returned channel at every interval
+	// until the context is done.
+	Tick(ctx context.Context, d time.Duration) <-chan time.Time
+}
+
+// realClock implements the Clock interface with the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Tick(ctx context.Context, d time.Duration) <-chan time.Time {
+	ticker := time.NewTicker(d)
+	go func() {
+		<-ctx.Done()
+		ticker.Stop()
+	}()
+	return ticker.C
+}
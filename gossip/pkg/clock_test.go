@@ -0,0 +1,153 @@
+package gossip
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves forward when advanced manually.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending Tick channel, rescheduled every time it fires.
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	ctx    context.Context
+	ch     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Tick(ctx context.Context, d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{at: c.now.Add(d), period: d, ctx: ctx, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w.ch
+}
+
+// Advance moves the clock forward and fires the waiters that are due.
+// Like time.Ticker, ticks are dropped if the receiver isn't keeping up.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.ctx.Err() != nil {
+			continue
+		}
+		for !w.at.After(c.now) {
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+			w.at = w.at.Add(w.period)
+		}
+		pending = append(pending, w)
+	}
+	c.waiters = pending
+}
+
+// waitForWaiters blocks until at least n channels are waiting on the clock.
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clock waiters, found %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGenerationUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	clock.Advance(5 * time.Second)
+
+	g := NewGossiperWithClock("a", true, nil, clock)
+	if expected := uint64(5 * time.Second / time.Microsecond); g.Generation != expected {
+		t.Fatalf("expected generation %d, found %d", expected, g.Generation)
+	}
+}
+
+func TestHeartBeatOncePerInterval(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGossiperWithClock("a", true, nil, clock)
+	g.initState()
+
+	version := func() uint64 {
+		return g.store.Peers(false)["a"].HeartBeat.Version
+	}
+	waitForVersion := func(expected uint64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for version() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected heart beat version %d, found %d", expected, version())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.heartBeatLoop(ctx)
+	clock.waitForWaiters(t, 1)
+
+	initial := version()
+	clock.Advance(heartBeatInterval / 2)
+	time.Sleep(20 * time.Millisecond)
+	if v := version(); v != initial {
+		t.Fatalf("expected no heart beat before the interval elapsed, found version %d", v)
+	}
+
+	clock.Advance(heartBeatInterval / 2)
+	waitForVersion(initial + 1)
+	for i := uint64(2); i <= 5; i++ {
+		clock.Advance(heartBeatInterval)
+		waitForVersion(initial + i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if v := version(); v != initial+5 {
+		t.Fatalf("expected heart beat version %d, found %d", initial+5, v)
+	}
+}
+
+func TestContactedUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStateMachine()
+	store.setClock(clock)
+
+	store.Contacted("a")
+	clock.Advance(maxPeerStaleness / 2)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if s := store.staleness("a", store.now()); s != maxPeerStaleness/2 {
+		t.Fatalf("expected staleness %s, found %s", maxPeerStaleness/2, s)
+	}
+}
@@ -4,9 +4,14 @@ package gossip
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/rpc"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,24 +25,86 @@ const (
 	heartBeatInterval = time.Second
 	// Registered name of the gossip receiver
 	gossipReceiverRPC = "GossReceiver"
+	// The number of peers asked to probe a node we failed to connect to.
+	numIndirectProbes = 2
+	// Maximum time to wait for a connection to a peer.
+	dialTimeout = 500 * time.Millisecond
+	// Maximum time to wait for an indirect probe reply, including the time
+	// the peer needs to probe the target.
+	indirectProbeTimeout = 2 * dialTimeout
 )
 
 // NewGossiper creates a new Gossiper.
 func NewGossiper(bind string, seed bool, seedAddrs []string) *Gossiper {
-	store := &StateMachine{store: map[NodeAddr]EndpointState{}}
+	return NewGossiperWithClock(bind, seed, seedAddrs, realClock{})
+}
+
+// NewGossiperWithClock creates a new Gossiper that uses the clock for its
+// generation number, heart beats and gossip rounds.
+func NewGossiperWithClock(bind string, seed bool, seedAddrs []string, clock Clock) *Gossiper {
+	store := NewStateMachine()
 
 	engine := rpc.NewServer()
 	rcvr := NewReceiver(store)
+	rcvr.clock = clock
 	engine.RegisterName(gossipReceiverRPC, rcvr)
 	return &Gossiper{
 		BindAddr:      bind,
 		IsSeed:        seed,
 		SeedDialAddrs: seedAddrs,
-		Generation:    uint64(time.Now().UnixNano() / 1000),
+		Generation:    uint64(clock.Now().UnixNano() / 1000),
+		Clock:         clock,
 		closing:       make(chan chan error),
 		engine:        engine,
+		rcvr:          rcvr,
 		store:         store,
+		dial:          dialPeer,
+	}
+}
+
+// NewGossiperWithTLS creates a new Gossiper that secures the peer transport with
+// mutual TLS: connections are only established with peers presenting a certificate
+// issued by a trusted CA.
+//
+// cfg contains the node certificate, used both to serve and to dial peers, and the CA
+// pools peers are verified with: RootCAs verifies the peers the node dials, ClientCAs
+// the peers dialing the node and defaults to RootCAs.
+func NewGossiperWithTLS(bind string, seed bool, seedAddrs []string, cfg *tls.Config) *Gossiper {
+	g := NewGossiper(bind, seed, seedAddrs)
+	g.tlsConfig = cfg.Clone()
+	g.dial = g.dialTLS
+	// probing with a TLS handshake checks the target is a trusted member too
+	g.rcvr.probe = func(addr NodeAddr) error {
+		conn, err := g.dialTLS(addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return g
+}
+
+// dialTLS opens a TLS connection to the peer, completing the handshake
+// within the dialTimeout.
+func (s *Gossiper) dialTLS(addr NodeAddr) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", string(addr), s.tlsConfig)
+}
+
+// serverTLSConfig returns the TLS configuration of the gossiper listener,
+// requiring peers to present a valid certificate.
+func (s *Gossiper) serverTLSConfig() *tls.Config {
+	cfg := s.tlsConfig.Clone()
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.ClientCAs == nil {
+		cfg.ClientCAs = cfg.RootCAs
 	}
+	return cfg
+}
+
+// dialPeer opens a connection to the peer.
+func dialPeer(addr NodeAddr) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(addr), dialTimeout)
 }
 
 // Gossiper is a naive implementation of the Gossip protocol (https://en.wikipedia.org/wiki/Gossip_protocol)
@@ -58,57 +125,217 @@ type Gossiper struct {
 	IsSeed        bool
 	SeedDialAddrs []string
 	Generation    uint64
+	// Clock drives heart beats and gossip rounds
+	Clock Clock
+	// AppState is advertised to the cluster with the node heart beat.
+	// It must be set before calling Serve.
+	AppState map[string]string
+	// StateFile is the path where the cluster membership is saved on Shutdown
+	// and restored from on Serve, so that a restarted node rejoins the cluster
+	// without learning it again from the seeds. Membership is not persisted
+	// when empty.
+	StateFile string
+	// PhiThreshold enables the phi accrual failure detector when positive: peers
+	// are considered dead once their suspicion level phi reaches the threshold,
+	// rather than after a fixed number of taints. Higher thresholds detect failures
+	// later, with fewer mistakes: a threshold of 8 is a common choice.
+	// It must be set before calling Serve.
+	PhiThreshold float64
 
 	Port int
 
-	closing    chan chan error
-	engine     *rpc.Server
-	store      *StateMachine
-	shutdown   bool
-	muShutdown sync.RWMutex
+	closing chan chan error
+	engine  *rpc.Server
+	rcvr    *Receiver
+	store   *StateMachine
+	dial    func(NodeAddr) (net.Conn, error)
+	// tlsConfig secures the peer transport with mutual TLS when set
+	tlsConfig *tls.Config
+
+	// mu serializes Serve and Shutdown calls
+	mu      sync.Mutex
+	serving bool
+	served  bool
+	// cancel stops the heart beat and gossip loops, loops waits for them to exit
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	stats gossipStats
 }
 
 // Serve the Gossiper RPC (Remote Procedure Call) endpoint and spawn subroutines that handle gossip rounds and heart beats.
+//
+// The BindAddr can use port 0 to listen on an ephemeral port: once the listener is open,
+// BindAddr is updated with the resolved address, which is used as the node identity in
+// the cluster and for peers to dial the node.
+//
+// Serve returns an error if the Gossiper is already serving. A Gossiper can serve again
+// after Shutdown, like a restarted node: it gets a new Generation so that its heart beats
+// supersede the state peers recorded while it was down.
+//
+// When a StateFile is configured, the membership saved by a previous Shutdown is
+// restored before serving.
 func (s *Gossiper) Serve() error {
-	s.initState()
-
-	s.muShutdown.Lock()
-	s.shutdown = false
-	s.muShutdown.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.serving {
+		return errAlreadyServing
+	}
+	if err := s.restoreState(); err != nil {
+		return err
+	}
 
 	l, err := net.Listen("tcp", s.BindAddr)
 	if err != nil {
 		return err
 	}
-	s.Port = l.Addr().(*net.TCPAddr).Port
+	tcpAddr := l.Addr().(*net.TCPAddr)
+	s.Port = tcpAddr.Port
+	s.BindAddr = resolvedBindAddr(s.BindAddr, tcpAddr)
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.serverTLSConfig())
+	}
+
+	if s.served {
+		s.Generation = uint64(s.Clock.Now().UnixNano() / 1000)
+	}
+	s.initState()
+	s.serving, s.served = true, true
 
 	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.loops.Add(2)
 	go s.serveLoop(l, cancel)
-	go s.heartBeatLoop(ctx)
-	go s.gossipRound(ctx)
+	go func() {
+		defer s.loops.Done()
+		s.heartBeatLoop(ctx)
+	}()
+	go func() {
+		defer s.loops.Done()
+		s.gossipRound(ctx)
+	}()
 
 	return nil
 }
 
+// resolvedBindAddr returns the dial address of the listener bound to the bind address.
+// The host of the bind address is preserved, so nodes keep the identity they were
+// configured with, while the port is replaced with the one actually bound.
+// Listeners on all interfaces are reachable through localhost.
+func resolvedBindAddr(bind string, addr *net.TCPAddr) string {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil || len(host) == 0 || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+		if !addr.IP.IsUnspecified() {
+			host = addr.IP.String()
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// Stats returns a snapshot of the gossip protocol counters.
+func (s *Gossiper) Stats() GossipStats {
+	return GossipStats{
+		Rounds:         s.stats.rounds.Load(),
+		PeersContacted: s.stats.peersContacted.Load(),
+		FailedDials:    s.stats.failedDials.Load(),
+		BytesSent:      s.stats.bytesSent.Load(),
+		BytesReceived:  s.stats.bytesReceived.Load(),
+		UpdatesApplied: s.store.Updates(),
+		StatesRejected: s.rcvr.Rejected(),
+	}
+}
+
+// connect opens an RPC connection to the peer. Traffic on the connection is
+// counted in the gossiper stats.
+// When timeout is positive, calls on the connection fail once it has elapsed.
+func (s *Gossiper) connect(peer NodeAddr, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := s.dial(peer)
+	if err != nil {
+		s.stats.failedDials.Add(1)
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rpc.NewClient(&countingConn{Conn: conn, stats: &s.stats}), nil
+}
+
 // Shutdown the Gossiper RPC (Remote Procedure Call) service by sending termination signals to goroutines
-// and waiting for acknowledgment.
+// and waiting for them to exit.
+// Shutdown returns an error if the Gossiper is not serving.
+// When a StateFile is configured, the cluster membership is saved once the
+// goroutines have exited.
 func (s *Gossiper) Shutdown() error {
-	s.muShutdown.RLock()
-	shutdown := s.shutdown
-	s.muShutdown.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.serving {
+		return errNotServing
+	}
+
+	errch := make(chan error)
+	s.closing <- errch
+	err := <-errch
+	s.cancel()
+	s.loops.Wait()
+	s.serving = false
+	if saveErr := s.saveState(); saveErr != nil {
+		err = errors.Join(err, saveErr)
+	}
+	return err
+}
 
-	if !shutdown {
-		s.muShutdown.Lock()
-		s.shutdown = true
-		s.muShutdown.Unlock()
+// restoreState loads the cluster membership saved in the StateFile, if any.
+func (s *Gossiper) restoreState() error {
+	if len(s.StateFile) == 0 {
+		return nil
+	}
+	f, err := os.Open(s.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.store.setClock(s.Clock)
+	if err := s.store.Load(f); err != nil {
+		return fmt.Errorf("restoring membership from %s: %w", s.StateFile, err)
+	}
+	return nil
+}
 
-		errch := make(chan error)
-		s.closing <- errch
-		return <-errch
+// saveState writes the cluster membership to the StateFile. The file is replaced
+// atomically, so a failed save never corrupts the previously saved membership.
+func (s *Gossiper) saveState() error {
+	if len(s.StateFile) == 0 {
+		return nil
+	}
+	tmp := s.StateFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("server already shutdown")
+	if err := s.store.Save(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("saving membership to %s: %w", s.StateFile, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.StateFile)
 }
 
+var (
+	errAlreadyServing = errors.New("gossiper already serving")
+	errNotServing     = errors.New("gossiper not serving")
+)
+
 // Nodes returns the current local view of cluster memberships.
 func (s *Gossiper) Nodes() []NodeAddr {
 	onlinePeers := s.store.Peers(true)
@@ -121,14 +348,29 @@ func (s *Gossiper) Nodes() []NodeAddr {
 	return nodes
 }
 
+// States returns the current local view of online cluster members, including
+// the application state they advertise.
+func (s *Gossiper) States() map[NodeAddr]EndpointState {
+	return s.store.Peers(true)
+}
+
 // initState initializes the internal storage with knowledge of the node itself with its current version,
 // plus knowledge of the seed nodes as available peers. Seed nodes are initialized with both Generation and
 // Version = 0 to indicate that we don't know anything about these nodes yet other than they exist.
 func (s *Gossiper) initState() {
+	s.store.setClock(s.Clock)
+	s.store.setPhiThreshold(s.PhiThreshold)
+
 	selfAddr := NodeAddr(s.BindAddr)
+	// the state of a previous run may have been restored: the new generation
+	// must supersede it for peers to accept the node heart beats
+	if self, ok := s.store.Peers(false)[selfAddr]; ok && self.HeartBeat.Generation >= s.Generation {
+		s.Generation = self.HeartBeat.Generation + 1
+	}
 	states := []EndpointState{{
 		NodeAddr:  selfAddr,
 		HeartBeat: HeartBeatState{Generation: s.Generation, Version: 0},
+		AppState:  maps.Clone(s.AppState),
 	}}
 	for _, seed := range s.SeedDialAddrs {
 		states = append(states, EndpointState{
@@ -146,9 +388,10 @@ func (s *Gossiper) initState() {
 // heartBeatLoop is responsible for heart-beating of the node itself at a regular intervals.
 // Termination is handled with a simple context cancellation as we don't need to report errors.
 func (s *Gossiper) heartBeatLoop(ctx context.Context) {
+	tick := s.Clock.Tick(ctx, heartBeatInterval)
 	for {
 		select {
-		case <-time.After(heartBeatInterval):
+		case <-tick:
 			s.store.Beat(NodeAddr(s.BindAddr))
 		case <-ctx.Done():
 			return
@@ -159,11 +402,13 @@ func (s *Gossiper) heartBeatLoop(ctx context.Context) {
 // gossipRound periodically exchanges information about the cluster state with randomly selected peers.
 // Gossip interactions with other peers exchange information via Remote Procedure Calls.
 func (s *Gossiper) gossipRound(ctx context.Context) {
+	tick := s.Clock.Tick(ctx, gossipRoundInterval)
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(gossipRoundInterval):
+		case <-tick:
+			s.stats.rounds.Add(1)
 			selfAddr := NodeAddr(s.BindAddr)
 			gossPeers := s.store.RandomPeers(numGossipRoundPeers, []NodeAddr{selfAddr})
 			if len(gossPeers) <= 0 {
@@ -173,10 +418,10 @@ func (s *Gossiper) gossipRound(ctx context.Context) {
 
 			for _, peer := range gossPeers {
 
-				client, err := rpc.Dial("tcp", string(peer))
+				client, err := s.connect(peer, 0)
 				if err != nil {
 					fmt.Println(err.Error())
-					s.store.Taint(peer)
+					s.handleUnreachable(peer)
 					continue
 				}
 
@@ -203,12 +448,58 @@ func (s *Gossiper) gossipRound(ctx context.Context) {
 				for _, state := range reply.States {
 					s.store.Update(state)
 				}
+				s.store.Contacted(peer)
+				s.stats.peersContacted.Add(1)
 				once.Do(func() { client.Close() })
 			}
 		}
 	}
 }
 
+// handleUnreachable is called when the node fails to connect to a peer.
+// Following the SWIM protocol, other peers are asked to probe the unreachable node
+// before tainting it: if any of them can reach it, the failure is considered a
+// transient issue between the two nodes and any suspicion is cleared. Otherwise the
+// node is tainted and becomes suspect, until it is declared dead after the
+// taintedThreshold is reached.
+//
+// Indirect probes run in parallel and each of them is bounded by the
+// indirectProbeTimeout, so an unresponsive peer can't stall the gossip round.
+func (s *Gossiper) handleUnreachable(peer NodeAddr) {
+	selfAddr := NodeAddr(s.BindAddr)
+	vias := s.store.RandomPeers(numIndirectProbes, []NodeAddr{selfAddr, peer})
+
+	results := make(chan bool, len(vias))
+	for _, via := range vias {
+		go func(via NodeAddr) {
+			results <- s.probeVia(via, peer)
+		}(via)
+	}
+	for range vias {
+		if <-results {
+			s.store.Confirm(peer)
+			return
+		}
+	}
+	s.store.Taint(peer)
+}
+
+// probeVia asks the via peer to probe the target node on our behalf.
+func (s *Gossiper) probeVia(via, target NodeAddr) bool {
+	client, err := s.connect(via, indirectProbeTimeout)
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+
+	var alive bool
+	serviceMethod := fmt.Sprintf("%s.Probe", gossipReceiverRPC)
+	if err := client.Call(serviceMethod, &target, &alive); err != nil {
+		return false
+	}
+	return alive
+}
+
 // serveLoop is the goroutine responsible for handling incoming RPC calls.
 // The loop is implemented using channels for inter-process communication. Accepting and serving
 // requests are handled by two separate cases and in its own goroutine to allow for immediate
@@ -236,11 +527,13 @@ func (s *Gossiper) serveLoop(l net.Listener, cancel context.CancelFunc) {
 				// channel closed
 				return
 			}
-			go s.engine.ServeConn(conn)
+			go s.engine.ServeConn(&countingConn{Conn: conn, stats: &s.stats})
 			accepting <- struct{}{}
 
 		case errch := <-s.closing:
-			errch <- nil
+			// the listener is closed before acknowledging, so that the
+			// address can be bound again as soon as Shutdown returns
+			errch <- l.Close()
 			return
 		}
 	}
@@ -0,0 +1,490 @@
+package gossip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pipeDialer returns a dial function that connects to in-memory RPC servers
+// by address. Dialing unknown addresses fails.
+func pipeDialer(servers map[NodeAddr]*rpc.Server) func(NodeAddr) (net.Conn, error) {
+	return func(addr NodeAddr) (net.Conn, error) {
+		srv, ok := servers[addr]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		clientConn, serverConn := net.Pipe()
+		go srv.ServeConn(serverConn)
+		return clientConn, nil
+	}
+}
+
+func TestTransientFailureConfirmedByPeer(t *testing.T) {
+	// peer "b" can reach "c", while "a" cannot
+	peerReachable := true
+	rcvr := NewReceiver(initTestStore([]EndpointState{{NodeAddr: "c"}}))
+	rcvr.probe = func(NodeAddr) error {
+		if !peerReachable {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	srv := rpc.NewServer()
+	srv.RegisterName(gossipReceiverRPC, rcvr)
+
+	g := NewGossiper("a", false, nil)
+	g.dial = pipeDialer(map[NodeAddr]*rpc.Server{"b": srv})
+	for _, addr := range []NodeAddr{"a", "b", "c"} {
+		g.store.Update(EndpointState{NodeAddr: addr})
+	}
+	status := func() NodeStatus {
+		hb := g.store.Peers(false)["c"].HeartBeat
+		return hb.Status()
+	}
+
+	for i := 0; i < taintedThreshold+1; i++ {
+		g.handleUnreachable("c")
+	}
+	if status() != NodeAlive {
+		t.Fatalf("node confirmed by peer expected status %s, found %s", NodeAlive, status())
+	}
+
+	// "c" is now down for every peer
+	peerReachable = false
+	g.handleUnreachable("c")
+	if status() != NodeSuspect {
+		t.Fatalf("unreachable node expected status %s, found %s", NodeSuspect, status())
+	}
+	for i := 1; i < taintedThreshold; i++ {
+		g.handleUnreachable("c")
+	}
+	if status() != NodeDead {
+		t.Fatalf("unreachable node expected status %s, found %s", NodeDead, status())
+	}
+}
+
+func TestProbeRejectsUnknownTargets(t *testing.T) {
+	rcvr := NewReceiver(initTestStore([]EndpointState{{NodeAddr: "c"}}))
+	probed := []NodeAddr{}
+	rcvr.probe = func(addr NodeAddr) error {
+		probed = append(probed, addr)
+		return nil
+	}
+
+	var alive bool
+	target := NodeAddr("169.254.169.254:80")
+	if err := rcvr.Probe(&target, &alive); err == nil {
+		t.Fatalf("expected error probing unknown target %s", target)
+	}
+	if alive || len(probed) != 0 {
+		t.Fatalf("unknown target should not be probed, probed %v", probed)
+	}
+
+	target = "c"
+	if err := rcvr.Probe(&target, &alive); err != nil {
+		t.Fatal(err)
+	}
+	if !alive {
+		t.Fatalf("expected known target %s to be reachable", target)
+	}
+}
+
+// probeServer returns an RPC server whose receiver probes with the function
+func probeServer(probe func(NodeAddr) error) *rpc.Server {
+	rcvr := NewReceiver(initTestStore([]EndpointState{{NodeAddr: "c"}}))
+	rcvr.probe = probe
+	srv := rpc.NewServer()
+	srv.RegisterName(gossipReceiverRPC, rcvr)
+	return srv
+}
+
+func TestIndirectProbesAreBounded(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hanging := probeServer(func(NodeAddr) error {
+		<-release
+		return nil
+	})
+	reachable := probeServer(func(NodeAddr) error { return nil })
+
+	newGossiper := func(servers map[NodeAddr]*rpc.Server) *Gossiper {
+		g := NewGossiper("a", false, nil)
+		g.dial = pipeDialer(servers)
+		for _, addr := range []NodeAddr{"a", "b", "c", "d"} {
+			g.store.Update(EndpointState{NodeAddr: addr})
+		}
+		g.store.Taint("c")
+		return g
+	}
+	tainted := func(g *Gossiper) uint64 {
+		return g.store.Peers(false)["c"].HeartBeat.Tainted
+	}
+
+	// probes run in parallel: a hanging peer doesn't delay the confirmation
+	g := newGossiper(map[NodeAddr]*rpc.Server{"b": hanging, "d": reachable})
+	start := time.Now()
+	g.handleUnreachable("c")
+	if elapsed := time.Since(start); elapsed >= indirectProbeTimeout {
+		t.Fatalf("expected confirmation before the probe timeout, took %s", elapsed)
+	}
+	if n := tainted(g); n != 0 {
+		t.Fatalf("node confirmed by peer expected %d taints, found %d", 0, n)
+	}
+
+	// probes to unresponsive peers give up after the timeout
+	g = newGossiper(map[NodeAddr]*rpc.Server{"b": hanging, "d": hanging})
+	start = time.Now()
+	g.handleUnreachable("c")
+	if elapsed := time.Since(start); elapsed >= 2*indirectProbeTimeout {
+		t.Fatalf("expected probes to time out after %s, took %s", indirectProbeTimeout, elapsed)
+	}
+	if n := tainted(g); n != 2 {
+		t.Fatalf("unconfirmed node expected %d taints, found %d", 2, n)
+	}
+}
+
+func TestGossiperStats(t *testing.T) {
+	a := NewGossiper("a:7000", true, []string{"a:7000"})
+	b := NewGossiper("b:7000", false, []string{"a:7000"})
+	dial := pipeDialer(map[NodeAddr]*rpc.Server{"a:7000": a.engine, "b:7000": b.engine})
+	a.dial, b.dial = dial, dial
+
+	// gossip rounds run in-memory, without serving the RPC endpoints
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, g := range []*Gossiper{a, b} {
+		g.initState()
+	}
+	initialUpdates := a.Stats().UpdatesApplied
+	for _, g := range []*Gossiper{a, b} {
+		go g.heartBeatLoop(ctx)
+		go g.gossipRound(ctx)
+	}
+
+	var stats GossipStats
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats = b.Stats()
+		if stats.Rounds >= 2 && stats.PeersContacted >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gossip rounds did not advance: %+v", stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Fatalf("expected bytes exchanged with peers, found %+v", stats)
+	}
+	if stats.StatesRejected != 0 {
+		t.Fatalf("expected %d rejected states, found %d", 0, stats.StatesRejected)
+	}
+	if stats.FailedDials != 0 {
+		t.Fatalf("expected %d failed dials, found %d", 0, stats.FailedDials)
+	}
+	// "a" learns about "b" from the gossip rounds
+	if a.Stats().UpdatesApplied <= initialUpdates {
+		t.Fatalf("expected state updates from peer gossip, found %+v", a.Stats())
+	}
+	if _, ok := a.store.Peers(true)["b:7000"]; !ok {
+		t.Fatal("node a should know about node b")
+	}
+}
+
+func TestAppStateSpreadsWithHeartBeats(t *testing.T) {
+	a := NewGossiper("a:7000", true, []string{"a:7000"})
+	b := NewGossiper("b:7000", false, []string{"a:7000"})
+	b.AppState = map[string]string{"service": "db:5432"}
+	dial := pipeDialer(map[NodeAddr]*rpc.Server{"a:7000": a.engine, "b:7000": b.engine})
+	a.dial, b.dial = dial, dial
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, g := range []*Gossiper{a, b} {
+		g.initState()
+		go g.heartBeatLoop(ctx)
+		go g.gossipRound(ctx)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.States()["b:7000"].AppState["service"] != "db:5432" {
+		if time.Now().After(deadline) {
+			t.Fatalf("app state of node b not received: %+v", a.States())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestResolvedBindAddr(t *testing.T) {
+	testCases := []struct {
+		Bind     string
+		Addr     *net.TCPAddr
+		Expected string
+	}{
+		{Bind: "localhost:0", Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4100}, Expected: "localhost:4100"},
+		{Bind: ":0", Addr: &net.TCPAddr{IP: net.IPv6unspecified, Port: 4100}, Expected: "localhost:4100"},
+		{Bind: "0.0.0.0:0", Addr: &net.TCPAddr{IP: net.IPv4zero, Port: 4100}, Expected: "localhost:4100"},
+		{Bind: "127.0.0.1:9900", Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9900}, Expected: "127.0.0.1:9900"},
+	}
+	for _, test := range testCases {
+		if addr := resolvedBindAddr(test.Bind, test.Addr); addr != test.Expected {
+			t.Fatalf("bind %s: expected address %s, found %s", test.Bind, test.Expected, addr)
+		}
+	}
+}
+
+func TestGossipersOnEphemeralPorts(t *testing.T) {
+	seed := NewGossiper("localhost:0", true, nil)
+	if err := seed.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Shutdown()
+	if seed.BindAddr == "localhost:0" {
+		t.Fatal("expected bind address to be resolved")
+	}
+
+	node := NewGossiper("localhost:0", false, []string{seed.BindAddr})
+	if err := node.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown()
+
+	knows := func(g *Gossiper, addr string) bool {
+		return slices.Contains(g.Nodes(), NodeAddr(addr))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !knows(seed, node.BindAddr) || !knows(node, seed.BindAddr) {
+		if time.Now().After(deadline) {
+			t.Fatalf("gossipers did not discover each other: seed knows %v, node knows %v",
+				seed.Nodes(), node.Nodes())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	g := NewGossiper("localhost:0", true, nil)
+	if err := g.Shutdown(); !errors.Is(err, errNotServing) {
+		t.Fatalf("expected error %v, found %v", errNotServing, err)
+	}
+
+	if err := g.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Serve(); !errors.Is(err, errAlreadyServing) {
+		t.Fatalf("expected error %v, found %v", errAlreadyServing, err)
+	}
+	generation := g.Generation
+	if err := g.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Shutdown(); !errors.Is(err, errNotServing) {
+		t.Fatalf("expected error %v, found %v", errNotServing, err)
+	}
+
+	// the node comes back on the same address with a new generation
+	addr := g.BindAddr
+	if err := g.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+	if g.BindAddr != addr {
+		t.Fatalf("expected node to serve on %s, found %s", addr, g.BindAddr)
+	}
+	if g.Generation <= generation {
+		t.Fatalf("expected generation greater than %d, found %d", generation, g.Generation)
+	}
+	if state := g.States()[NodeAddr(addr)]; state.HeartBeat.Generation != g.Generation {
+		t.Fatalf("expected own state with generation %d, found %d", g.Generation, state.HeartBeat.Generation)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("node should accept connections after restart: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMembershipRestoredAfterRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "members.json")
+	g := NewGossiper("localhost:0", true, nil)
+	g.StateFile = stateFile
+	if err := g.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	addr := g.BindAddr
+	peer := EndpointState{
+		NodeAddr:  "localhost:9800",
+		HeartBeat: HeartBeatState{Generation: g.Generation, Version: 42},
+		AppState:  map[string]string{"http": "localhost:8080"},
+	}
+	g.store.Update(peer)
+	if err := g.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	saved := g.store.Peers(false)[NodeAddr(addr)].HeartBeat.Generation
+
+	// a new process for the same node restores the membership from the file,
+	// even if its clock produces the same generation as the previous run
+	clock := &fakeClock{now: time.UnixMicro(int64(saved))}
+	restarted := NewGossiperWithClock(addr, true, nil, clock)
+	restarted.StateFile = stateFile
+	if err := restarted.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Shutdown()
+
+	found, ok := restarted.States()[peer.NodeAddr]
+	if !ok {
+		t.Fatalf("expected peer %s to be restored, found %v", peer.NodeAddr, restarted.Nodes())
+	}
+	if found.HeartBeat != peer.HeartBeat || found.AppState["http"] != "localhost:8080" {
+		t.Fatalf("expected restored state %+v, found %+v", peer, found)
+	}
+	if restarted.Generation <= saved {
+		t.Fatalf("expected generation greater than %d, found %d", saved, restarted.Generation)
+	}
+	if self := restarted.States()[NodeAddr(addr)]; self.HeartBeat.Generation != restarted.Generation {
+		t.Fatalf("expected own state with generation %d, found %d", restarted.Generation, self.HeartBeat.Generation)
+	}
+}
+
+// testCA is a self-signed certificate authority issuing peer certificates for localhost.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gossip test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// peerConfig issues a peer certificate and returns the TLS configuration
+// of a node trusting the CA.
+func (ca *testCA) peerConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "gossip peer"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+	}
+}
+
+func TestGossipersOverTLS(t *testing.T) {
+	ca := newTestCA(t)
+
+	seed := NewGossiperWithTLS("localhost:0", true, nil, ca.peerConfig(t))
+	if err := seed.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Shutdown()
+
+	node := NewGossiperWithTLS("localhost:0", false, []string{seed.BindAddr}, ca.peerConfig(t))
+	if err := node.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown()
+
+	knows := func(g *Gossiper, addr string) bool {
+		return slices.Contains(g.Nodes(), NodeAddr(addr))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !knows(seed, node.BindAddr) || !knows(node, seed.BindAddr) {
+		if time.Now().After(deadline) {
+			t.Fatalf("gossipers did not discover each other: seed knows %v, node knows %v",
+				seed.Nodes(), node.Nodes())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// peers without a certificate issued by the CA can't gossip with the seed
+	untrusted := newTestCA(t).peerConfig(t)
+	untrusted.RootCAs = ca.pool
+	noCert := &tls.Config{RootCAs: ca.pool}
+	dialers := map[string]func() (net.Conn, error){
+		"plain tcp": func() (net.Conn, error) {
+			return net.DialTimeout("tcp", seed.BindAddr, dialTimeout)
+		},
+		"no certificate": func() (net.Conn, error) {
+			return tls.Dial("tcp", seed.BindAddr, noCert)
+		},
+		"untrusted certificate": func() (net.Conn, error) {
+			return tls.Dial("tcp", seed.BindAddr, untrusted)
+		},
+	}
+	intruder := EndpointState{NodeAddr: "localhost:1", HeartBeat: HeartBeatState{Generation: 1}}
+	for name, dial := range dialers {
+		conn, err := dial()
+		if err != nil {
+			// rejected during the handshake
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		client := rpc.NewClient(conn)
+		var reply Envelope
+		err = client.Call(gossipReceiverRPC+".Gossip", &Envelope{States: []EndpointState{intruder}}, &reply)
+		client.Close()
+		if err == nil {
+			t.Fatalf("%s: expected gossip to be rejected, found nil", name)
+		}
+	}
+	if knows(seed, string(intruder.NodeAddr)) {
+		t.Fatal("state from untrusted peer should not be merged")
+	}
+}
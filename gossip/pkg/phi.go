@@ -0,0 +1,133 @@
+package gossip
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// phiWindowSize is the number of heart beat inter-arrival times kept for every node.
+	phiWindowSize = 100
+	// phiMinStdDev bounds the deviation of inter-arrival times, so that perfectly
+	// regular heart beats don't make small delays look like failures.
+	phiMinStdDev = 100 * time.Millisecond
+	// phiBootstrapInterval is the inter-arrival time assumed for nodes we received
+	// a single heart beat from.
+	phiBootstrapInterval = heartBeatInterval
+)
+
+// PhiAccrualDetector implements the phi accrual failure detector (Hayashibara et al.).
+// Rather than a binary verdict, it computes the suspicion level phi that a node has
+// failed from the time elapsed since its last heart beat, compared with the history
+// of the times between its previous heart beats. As the history tracks the network
+// conditions, slow or jittery heart beats raise the suspicion more slowly.
+//
+// Phi is the negated base 10 logarithm of the probability that a heart beat is still
+// going to arrive: a phi of 1 means the node is wrongly suspected with a 10% chance,
+// a phi of 2 with a 1% chance, and so on.
+type PhiAccrualDetector struct {
+	mu    sync.Mutex
+	nodes map[NodeAddr]*arrivalWindow
+}
+
+// NewPhiAccrualDetector creates a PhiAccrualDetector without heart beat history.
+func NewPhiAccrualDetector() *PhiAccrualDetector {
+	return &PhiAccrualDetector{nodes: map[NodeAddr]*arrivalWindow{}}
+}
+
+// Heartbeat records the arrival of a heart beat of the node at time t.
+func (d *PhiAccrualDetector) Heartbeat(node NodeAddr, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.nodes[node]
+	if !ok {
+		w = newArrivalWindow()
+		d.nodes[node] = w
+		// the first interval is unknown: the history starts with an estimate
+		w.add(phiBootstrapInterval - phiBootstrapInterval/4)
+		w.add(phiBootstrapInterval + phiBootstrapInterval/4)
+	} else {
+		w.add(t.Sub(w.last))
+	}
+	w.last = t
+}
+
+// Reset forgets the heart beat history of the node, like when it restarts.
+func (d *PhiAccrualDetector) Reset(node NodeAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, node)
+}
+
+// Phi returns the suspicion level of the node at time t.
+// Nodes without heart beats are not suspected and have a phi of zero.
+func (d *PhiAccrualDetector) Phi(node NodeAddr, t time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.nodes[node]
+	if !ok {
+		return 0
+	}
+	return phi(t.Sub(w.last), w.mean(), max(w.stdDev(), phiMinStdDev))
+}
+
+// phi returns the suspicion level after elapsed time without heart beats, with the
+// normal distribution of inter-arrival times of the given mean and deviation.
+// The distribution function is computed with a logistic approximation.
+func phi(elapsed, mean, stdDev time.Duration) float64 {
+	y := (elapsed - mean).Seconds() / stdDev.Seconds()
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// arrivalWindow is the history of the latest inter-arrival times of a node heart beats.
+type arrivalWindow struct {
+	intervals []time.Duration
+	// next is the position of the next interval once the window is full
+	next int
+	// sum and sumSquares of the intervals in seconds
+	sum, sumSquares float64
+	// last is the arrival time of the last heart beat
+	last time.Time
+}
+
+func newArrivalWindow() *arrivalWindow {
+	return &arrivalWindow{intervals: make([]time.Duration, 0, phiWindowSize)}
+}
+
+// add records an interval, replacing the oldest one when the window is full.
+func (w *arrivalWindow) add(interval time.Duration) {
+	if len(w.intervals) == phiWindowSize {
+		old := w.intervals[w.next].Seconds()
+		w.sum -= old
+		w.sumSquares -= old * old
+		w.intervals[w.next] = interval
+		w.next = (w.next + 1) % phiWindowSize
+	} else {
+		w.intervals = append(w.intervals, interval)
+	}
+	w.sum += interval.Seconds()
+	w.sumSquares += interval.Seconds() * interval.Seconds()
+}
+
+func (w *arrivalWindow) mean() time.Duration {
+	return seconds(w.sum / float64(len(w.intervals)))
+}
+
+func (w *arrivalWindow) stdDev() time.Duration {
+	n := float64(len(w.intervals))
+	mean := w.sum / n
+	// rounding errors can make the variance slightly negative
+	return seconds(math.Sqrt(max(w.sumSquares/n-mean*mean, 0)))
+}
+
+// seconds converts a number of seconds to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// detectionTime feeds the heart beats arriving after the intervals to a detector
+// and returns the time after the last heart beat when phi reaches the threshold,
+// checking that phi stays below it while heart beats keep arriving.
+func detectionTime(t *testing.T, intervals []time.Duration, threshold float64) time.Duration {
+	t.Helper()
+	d := NewPhiAccrualDetector()
+	now := time.Unix(0, 0)
+	d.Heartbeat("test", now)
+	for i, interval := range intervals {
+		if p := d.Phi("test", now.Add(interval)); p >= threshold {
+			t.Fatalf("heart beat %d suspected with phi %.2f before arriving", i+1, p)
+		}
+		now = now.Add(interval)
+		d.Heartbeat("test", now)
+	}
+
+	const step = 10 * time.Millisecond
+	for elapsed := step; elapsed < time.Minute; elapsed += step {
+		if d.Phi("test", now.Add(elapsed)) >= threshold {
+			return elapsed
+		}
+	}
+	t.Fatal("phi never reached the threshold")
+	return 0
+}
+
+func TestPhiCrossesThreshold(t *testing.T) {
+	const threshold = 8
+
+	regular := make([]time.Duration, 30)
+	for i := range regular {
+		regular[i] = time.Second
+	}
+	// with a mean of 1s and the minimum deviation of 100ms, phi reaches 8 about
+	// 5.2 deviations after the expected heart beat
+	detected := detectionTime(t, regular, threshold)
+	if detected < 1500*time.Millisecond || detected > 1550*time.Millisecond {
+		t.Fatalf("expected regular heart beats to be suspected after about %s, found %s", 1520*time.Millisecond, detected)
+	}
+
+	// jittery heart beats are suspected later
+	jittery := make([]time.Duration, 30)
+	for i := range jittery {
+		jittery[i] = time.Second + time.Duration(i%2*2-1)*400*time.Millisecond
+	}
+	if d := detectionTime(t, jittery, threshold); d < detected+time.Second {
+		t.Fatalf("expected jittery heart beats to be suspected after %s, found %s", detected+time.Second, d)
+	}
+}
+
+func TestPhiOfUnknownNode(t *testing.T) {
+	d := NewPhiAccrualDetector()
+	if p := d.Phi("test", time.Now()); p != 0 {
+		t.Fatalf("expected phi %d for node without heart beats, found %.2f", 0, p)
+	}
+}
+
+func TestPeersWithPhiThreshold(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStateMachine()
+	store.setClock(clock)
+	store.setPhiThreshold(8)
+
+	state := EndpointState{NodeAddr: "test", HeartBeat: HeartBeatState{Generation: 1}}
+	online := func() bool {
+		_, ok := store.Peers(true)["test"]
+		return ok
+	}
+	for i := 0; i < 10; i++ {
+		store.Update(state)
+		state.HeartBeat.Version++
+		clock.Advance(time.Second)
+		if !online() {
+			t.Fatalf("node with regular heart beats offline after %d heart beats", i+1)
+		}
+	}
+
+	// taints don't count as heart beats
+	state.HeartBeat.Tainted = 1
+	store.Update(state)
+	clock.Advance(time.Second)
+	if online() {
+		t.Fatal("expected node without heart beats to be offline")
+	}
+
+	// a restarted node is online again
+	store.Update(EndpointState{NodeAddr: "test", HeartBeat: HeartBeatState{Generation: 2}})
+	if !online() {
+		t.Fatal("expected restarted node to be online")
+	}
+}
@@ -7,22 +7,53 @@ import "math/rand"
 // The items parameter represents the number of items to randomize from,
 // and generate parameter represents requested number of random indexes.
 //
+// Returned indexes are distinct and within the [0, items) range.
 // In case the number of items is smaller than the requested
 // generated items, this function will return only up-to the number of
 // available items.
 func randIndexes(items int, generate int) []int {
+	num := max(0, min(generate, items))
+	if num == 0 {
+		return []int{}
+	}
+	return rand.Perm(items)[:num]
+}
 
-	num := generate
-	if generate > items {
-		num = items
+// weightedRandIndexes is an internal function to generate random index values
+// where the probability of selecting an index is proportional to its weight.
+// Indexes are selected without repetition, up-to the number of available weights.
+func weightedRandIndexes(weights []float64, generate int) []int {
+	num := max(0, min(generate, len(weights)))
 
+	remaining := make([]float64, len(weights))
+	copy(remaining, weights)
+	total := 0.0
+	for _, w := range remaining {
+		total += w
 	}
-	randIdxs := make([]int, num)
 
-	for i := 0; i < num; i++ {
-		idx := rand.Intn(num)
-		randIdxs[i] = idx
-	}
+	randIdxs := make([]int, 0, num)
+	for len(randIdxs) < num {
+		target := rand.Float64() * total
+		idx := -1
+		for i, w := range remaining {
+			if w <= 0 {
+				continue
+			}
+			idx = i
+			if target < w {
+				break
+			}
+			target -= w
+		}
+		if idx < 0 {
+			// only indexes without weight left
+			break
+		}
 
+		randIdxs = append(randIdxs, idx)
+		total -= remaining[idx]
+		remaining[idx] = 0
+	}
 	return randIdxs
 }
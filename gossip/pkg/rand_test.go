@@ -0,0 +1,79 @@
+package gossip
+
+import "testing"
+
+// assertDistinctIndexes fails the test if indexes contain duplicates or
+// values outside the [0, items) range
+func assertDistinctIndexes(t *testing.T, indexes []int, items int) {
+	t.Helper()
+	seen := map[int]bool{}
+	for _, idx := range indexes {
+		if idx < 0 || idx >= items {
+			t.Fatalf("index %d out of range [0, %d)", idx, items)
+		}
+		if seen[idx] {
+			t.Fatalf("duplicate index %d in %v", idx, indexes)
+		}
+		seen[idx] = true
+	}
+}
+
+func TestRandIndexes(t *testing.T) {
+	testCases := []struct {
+		Items, Generate, Expected int
+	}{
+		{Items: 10, Generate: 3, Expected: 3},
+		{Items: 3, Generate: 10, Expected: 3},
+		{Items: 0, Generate: 2, Expected: 0},
+		{Items: 5, Generate: 0, Expected: 0},
+		{Items: 5, Generate: -1, Expected: 0},
+	}
+
+	for _, test := range testCases {
+		for i := 0; i < 100; i++ {
+			indexes := randIndexes(test.Items, test.Generate)
+			if len(indexes) != test.Expected {
+				t.Fatalf("case %v: expected %d indexes, found %d", test, test.Expected, len(indexes))
+			}
+			assertDistinctIndexes(t, indexes, test.Items)
+		}
+	}
+}
+
+func TestWeightedRandIndexes(t *testing.T) {
+	weights := []float64{1, 5, 0.5, 2}
+	for i := 0; i < 100; i++ {
+		indexes := weightedRandIndexes(weights, 10)
+		if len(indexes) != len(weights) {
+			t.Fatalf("expected %d indexes, found %d", len(weights), len(indexes))
+		}
+		assertDistinctIndexes(t, indexes, len(weights))
+	}
+
+	if indexes := weightedRandIndexes(nil, 2); len(indexes) != 0 {
+		t.Fatalf("expected no indexes without weights, found %v", indexes)
+	}
+}
+
+func TestRandomPeersEdgeCases(t *testing.T) {
+	empty := NewStateMachine()
+	if peers := empty.RandomPeers(2, nil); len(peers) != 0 {
+		t.Fatalf("expected no peers from an empty store, found %v", peers)
+	}
+
+	store := initTestStore([]EndpointState{
+		{NodeAddr: "self"}, {NodeAddr: "a"}, {NodeAddr: "b"},
+	})
+	peers := store.RandomPeers(10, []NodeAddr{"self"})
+	if len(peers) != 2 {
+		t.Fatalf("expected %d peers, found %d", 2, len(peers))
+	}
+	if peers[0] == peers[1] {
+		t.Fatalf("duplicate peer %s returned", peers[0])
+	}
+	for _, p := range peers {
+		if p == "self" {
+			t.Fatal("excluded peer returned")
+		}
+	}
+}
@@ -1,13 +1,54 @@
 package gossip
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxEnvelopeStates caps the number of states merged from a single envelope,
+	// so a peer can't flood the local store with a huge membership list.
+	maxEnvelopeStates = 1024
+
+	// maxGenerationDrift is how far in the future, according to the local clock,
+	// a generation number is accepted. Generations are derived from the node start
+	// time, a state from the far future would supersede all the following ones.
+	maxGenerationDrift = 24 * time.Hour
+
+	// maxAppStateEntries and maxAppStateValueSize limit the application state
+	// a node can advertise.
+	maxAppStateEntries   = 64
+	maxAppStateValueSize = 1024
+)
+
 // NewReceiver creates a new RPC gossip receiver.
 func NewReceiver(store *StateMachine) *Receiver {
-	return &Receiver{store: store}
+	return &Receiver{store: store, probe: probePeer, clock: realClock{}}
 }
 
 // Receiver represents an RPC receiver for the gossip protocol implementation.
 type Receiver struct {
 	store *StateMachine
+	// probe checks whether a peer is reachable
+	probe func(NodeAddr) error
+	// clock is used to validate the generation of received states
+	clock Clock
+	// rejected counts the states dropped from received envelopes
+	rejected atomic.Uint64
+}
+
+// probePeer checks the peer is reachable by opening a connection to its RPC endpoint.
+func probePeer(addr NodeAddr) error {
+	conn, err := net.DialTimeout("tcp", string(addr), dialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
 
 // Envelope represents a message exchanged during a gossip round.
@@ -26,7 +67,15 @@ func (s *Receiver) Gossip(req *Envelope, reply *Envelope) error {
 	// Update cluster memberships in local store and append updates to reply if
 	// newer version is known
 	reply.States = []EndpointState{}
-	for _, state := range req.States {
+	for i, state := range req.States {
+		if i >= maxEnvelopeStates {
+			s.rejected.Add(uint64(len(req.States) - i))
+			break
+		}
+		if err := validateState(state, s.clock.Now()); err != nil {
+			s.rejected.Add(1)
+			continue
+		}
 		newer := s.store.Update(state)
 		if newer != nil {
 			reply.States = append(reply.States, *newer)
@@ -41,3 +90,58 @@ func (s *Receiver) Gossip(req *Envelope, reply *Envelope) error {
 
 	return nil
 }
+
+// Rejected returns the number of states dropped from received envelopes because
+// they were malformed or exceeded the maxEnvelopeStates.
+func (s *Receiver) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+// validateState checks the state received from a peer is well-formed: the node
+// address is a valid dial address and the heart beat counters are in range.
+func validateState(state EndpointState, now time.Time) error {
+	host, port, err := net.SplitHostPort(string(state.NodeAddr))
+	if err != nil {
+		return fmt.Errorf("invalid node address %q: %w", state.NodeAddr, err)
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("invalid node address %q: missing host", state.NodeAddr)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid node address %q: bad port", state.NodeAddr)
+	}
+
+	hb := state.HeartBeat
+	maxGeneration := uint64(now.Add(maxGenerationDrift).UnixNano() / 1000)
+	if hb.Generation > maxGeneration {
+		return fmt.Errorf("generation %d of %s is in the future", hb.Generation, state.NodeAddr)
+	}
+	// counters are incremented locally when beating and tainting nodes
+	if hb.Version == math.MaxUint64 || hb.Tainted == math.MaxUint64 {
+		return errors.New("heart beat counters out of range")
+	}
+
+	if len(state.AppState) > maxAppStateEntries {
+		return fmt.Errorf("%s advertises %d app state entries", state.NodeAddr, len(state.AppState))
+	}
+	for k, v := range state.AppState {
+		if len(k) > maxAppStateValueSize || len(v) > maxAppStateValueSize {
+			return fmt.Errorf("app state %q of %s is too large", k, state.NodeAddr)
+		}
+	}
+	return nil
+}
+
+// Probe is an indirect probe request: a peer that could not reach the target node
+// asks the receiver to try on its behalf, to tell a node failure from a transient
+// network issue between the two nodes.
+// The reply is true if the receiver could reach the target.
+// Only cluster members can be probed, so the receiver can't be used to open
+// connections to arbitrary addresses.
+func (s *Receiver) Probe(target *NodeAddr, reply *bool) error {
+	if !s.store.Known(*target) {
+		return fmt.Errorf("cannot probe %s: not a cluster member", *target)
+	}
+	*reply = s.probe(*target) == nil
+	return nil
+}
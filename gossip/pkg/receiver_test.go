@@ -1,6 +1,12 @@
 package gossip
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestReceiver(t *testing.T) {
 	receiverState := []EndpointState{
@@ -58,3 +64,48 @@ func TestReceiver(t *testing.T) {
 		t.Fatal("store information was not updated")
 	}
 }
+
+func TestReceiverRejectsInvalidStates(t *testing.T) {
+	store := initTestStore([]EndpointState{
+		{NodeAddr: "localhost:8080", HeartBeat: HeartBeatState{Generation: 1, Version: 1}},
+	})
+	rcvr := NewReceiver(store)
+
+	future := uint64(time.Now().Add(48*time.Hour).UnixNano() / 1000)
+	invalid := []EndpointState{
+		{NodeAddr: "not-an-address", HeartBeat: HeartBeatState{Generation: 1}},
+		{NodeAddr: ":8081", HeartBeat: HeartBeatState{Generation: 1}},
+		{NodeAddr: "localhost:http", HeartBeat: HeartBeatState{Generation: 1}},
+		{NodeAddr: "localhost:8082", HeartBeat: HeartBeatState{Generation: future}},
+		{NodeAddr: "localhost:8083", HeartBeat: HeartBeatState{Generation: 1, Version: math.MaxUint64}},
+		{NodeAddr: "localhost:8084", HeartBeat: HeartBeatState{Generation: 1},
+			AppState: map[string]string{"k": strings.Repeat("v", maxAppStateValueSize+1)}},
+	}
+	states := append([]EndpointState{}, invalid...)
+	for i := 0; i < maxEnvelopeStates; i++ {
+		states = append(states, EndpointState{
+			NodeAddr:  NodeAddr(fmt.Sprintf("10.0.%d.%d:7000", i/256, i%256)),
+			HeartBeat: HeartBeatState{Generation: 1, Version: 1},
+		})
+	}
+
+	var reply Envelope
+	if err := rcvr.Gossip(&Envelope{States: states}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := store.Peers(false)
+	for _, state := range invalid {
+		if _, ok := peers[state.NodeAddr]; ok {
+			t.Fatalf("invalid state for %q should not be merged", state.NodeAddr)
+		}
+	}
+	// the local state plus the valid states within the envelope cap
+	expectedPeers := 1 + maxEnvelopeStates - len(invalid)
+	if len(peers) != expectedPeers {
+		t.Fatalf("expected %d peers, found %d", expectedPeers, len(peers))
+	}
+	if rejected := rcvr.Rejected(); rejected != uint64(2*len(invalid)) {
+		t.Fatalf("expected %d rejected states, found %d", 2*len(invalid), rejected)
+	}
+}
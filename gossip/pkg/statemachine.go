@@ -1,13 +1,26 @@
 package gossip
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// taintedThreshold represents the number of taints received for a certain NodeAddr
-// after which we consider the node to be inactive.
-const taintedThreshold = 3
+const (
+	// taintedThreshold represents the number of taints received for a certain NodeAddr
+	// after which we consider the node to be inactive.
+	taintedThreshold = 3
+
+	// maxPeerStaleness caps the time since the last contact used to weight peer
+	// selection, so a single stale peer cannot monopolize gossip rounds.
+	// Peers we never gossiped with are considered as stale as the cap.
+	maxPeerStaleness = 10 * gossipRoundInterval
+)
 
 // NodeAddr represents a cluster node tcp dial address.
 type NodeAddr string
@@ -16,6 +29,10 @@ type NodeAddr string
 type EndpointState struct {
 	NodeAddr  NodeAddr
 	HeartBeat HeartBeatState
+	// AppState is application information advertised by the node, like the
+	// endpoints of the services it runs. It travels with the node heart beat
+	// and is replaced as a whole by fresher states, so it must not be modified.
+	AppState map[string]string
 }
 
 // HeartBeatState represents the heartbeat of a node.
@@ -25,6 +42,48 @@ type HeartBeatState struct {
 	Generation, Version, Tainted uint64
 }
 
+// NodeStatus represents the liveness of a node as seen by the local node.
+type NodeStatus int
+
+const (
+	// NodeAlive nodes are reachable
+	NodeAlive NodeStatus = iota
+	// NodeSuspect nodes failed to respond, both directly and to indirect probes
+	// from other peers, but have not reached the taintedThreshold yet
+	NodeSuspect
+	// NodeDead nodes are considered inactive
+	NodeDead
+)
+
+// String representation of the NodeStatus
+func (ns NodeStatus) String() string {
+	switch ns {
+	case NodeAlive:
+		return "alive"
+	case NodeSuspect:
+		return "suspect"
+	case NodeDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// Status returns the liveness of the node derived from the number of taints received.
+// A node transitions from alive to suspect with the first taint, and from suspect to
+// dead when reaching the taintedThreshold. A new heart beat from the node itself, or
+// a liveness confirmation from a peer, brings it back alive.
+func (hb *HeartBeatState) Status() NodeStatus {
+	switch {
+	case hb.Tainted >= taintedThreshold:
+		return NodeDead
+	case hb.Tainted > 0:
+		return NodeSuspect
+	default:
+		return NodeAlive
+	}
+}
+
 // Active tells whether a node is active or not.
 // A HeartBeatState is marked as inactive when the number of taints received is bigger than the taintedThreshold.
 func (hb *HeartBeatState) Active() bool {
@@ -33,26 +92,104 @@ func (hb *HeartBeatState) Active() bool {
 
 // NewStateMachine creates a new StateMachine object to hold node membership information for the cluster.
 func NewStateMachine() *StateMachine {
-	return &StateMachine{store: map[NodeAddr]EndpointState{}}
+	return &StateMachine{
+		store:       map[NodeAddr]EndpointState{},
+		lastContact: map[NodeAddr]time.Time{},
+		clock:       realClock{},
+	}
 }
 
 // StateMachine is an internal type that wraps node membership information for the cluster.
 type StateMachine struct {
 	mu    sync.RWMutex
 	store map[NodeAddr]EndpointState
+	// lastContact is the time of the last successful gossip exchange with a peer.
+	// This information is local to the node and never shared with peers.
+	lastContact map[NodeAddr]time.Time
+	// updates counts the states changed by Update
+	updates atomic.Uint64
+	clock   Clock
+	// phi decides the liveness of nodes instead of their taints when set:
+	// nodes are considered inactive once their phi reaches phiThreshold
+	phi          *PhiAccrualDetector
+	phiThreshold float64
+}
+
+// setPhiThreshold enables the phi accrual failure detector with the threshold.
+// The detector is disabled when the threshold is not positive.
+func (s *StateMachine) setPhiThreshold(threshold float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if threshold <= 0 {
+		s.phi, s.phiThreshold = nil, 0
+		return
+	}
+	if s.phi == nil {
+		s.phi = NewPhiAccrualDetector()
+		// the nodes already known are heard from now on
+		for addr := range s.store {
+			s.phi.Heartbeat(addr, s.now())
+		}
+	}
+	s.phiThreshold = threshold
+}
+
+// heartbeat records the arrival of a heart beat of the node in the failure
+// detector, if enabled. Callers must hold the lock.
+func (s *StateMachine) heartbeat(node NodeAddr, prev, next HeartBeatState) {
+	if s.phi == nil {
+		return
+	}
+	if prev.Generation != next.Generation {
+		// intervals of the previous run of the node don't tell anything about the new one
+		s.phi.Reset(node)
+	}
+	// versions increased by taints are not heart beats of the node
+	if next.Tainted == 0 {
+		s.phi.Heartbeat(node, s.now())
+	}
+}
+
+// active tells whether the node is active: when the failure detector is enabled
+// the node is active until its phi reaches the threshold, otherwise until the
+// taintedThreshold is reached. Callers must hold the lock.
+func (s *StateMachine) active(node NodeAddr, hb HeartBeatState, now time.Time) bool {
+	if s.phi != nil {
+		return s.phi.Phi(node, now) < s.phiThreshold
+	}
+	return hb.Active()
+}
+
+// setClock replaces the clock used to track contacts with peers.
+func (s *StateMachine) setClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+// now returns the current time of the state machine clock.
+// Callers must hold the lock.
+func (s *StateMachine) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
 }
 
 // Peers returns the list of EndpointStates found in local storage.
 // When the onlineOnly flag is true, this function only returns the list of active
-// peers, the ones that have not been tainted after several broken connection attempts.
+// peers, the ones that have not been tainted after several broken connection attempts
+// or, when the phi accrual failure detector is enabled, that are not suspected of failure.
 func (s *StateMachine) Peers(onlineOnly bool) map[NodeAddr]EndpointState {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	now := s.now()
 	out := map[NodeAddr]EndpointState{}
 	for k, v := range s.store {
 		if onlineOnly {
-			if v.HeartBeat.Active() {
+			if s.active(k, v.HeartBeat, now) {
 				out[k] = v
 			}
 		} else {
@@ -65,6 +202,10 @@ func (s *StateMachine) Peers(onlineOnly bool) map[NodeAddr]EndpointState {
 // RandomPeers returns a randomized list of known peers NodeAddr.
 // This function is used by the gossiper server to randomize the list of peers
 // to gossip with on every round.
+//
+// Selection is weighted by the time since the last contact with every peer, so
+// that nodes we haven't heard from recently are favoured and their updates
+// propagate faster.
 func (s *StateMachine) RandomPeers(num int, exclude []NodeAddr) []NodeAddr {
 	allPeers := s.Peers(true)
 
@@ -78,7 +219,12 @@ func (s *StateMachine) RandomPeers(num int, exclude []NodeAddr) []NodeAddr {
 		}
 	}
 
-	indexes := randIndexes(len(validPeers), num)
+	now := s.now()
+	weights := make([]float64, len(validPeers))
+	for i, addr := range validPeers {
+		weights[i] = float64(s.staleness(addr, now))
+	}
+	indexes := weightedRandIndexes(weights, num)
 
 	out := make([]NodeAddr, len(indexes))
 	for i, idx := range indexes {
@@ -87,6 +233,38 @@ func (s *StateMachine) RandomPeers(num int, exclude []NodeAddr) []NodeAddr {
 	return out
 }
 
+// staleness returns the time elapsed since the last contact with the peer,
+// bound by maxPeerStaleness. Every peer has a minimum staleness of one gossip
+// round, so recently contacted peers can still be selected.
+func (s *StateMachine) staleness(node NodeAddr, now time.Time) time.Duration {
+	last, ok := s.lastContact[node]
+	if !ok {
+		return maxPeerStaleness
+	}
+	return min(max(now.Sub(last), gossipRoundInterval), maxPeerStaleness)
+}
+
+// Known returns true if the node is a member of the cluster according to the
+// local store.
+func (s *StateMachine) Known(node NodeAddr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.store[node]
+	return exists
+}
+
+// Contacted records a successful gossip exchange with the peer.
+func (s *StateMachine) Contacted(node NodeAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastContact == nil {
+		s.lastContact = map[NodeAddr]time.Time{}
+	}
+	s.lastContact[node] = s.now()
+}
+
 // Beat Version number of the specified NodeAddr.
 // This function is solely useful to the Gossiper itself to increase its own heartbeats and
 // reset Taint values.
@@ -98,9 +276,11 @@ func (s *StateMachine) Beat(node NodeAddr) {
 	if !exists {
 		return
 	}
+	prev := elem.HeartBeat
 	elem.HeartBeat.Version++
 	elem.HeartBeat.Tainted = 0
 	s.store[node] = elem
+	s.heartbeat(node, prev, elem.HeartBeat)
 }
 
 // Taint the cluster membership for node with the specified NodeAddr.
@@ -119,6 +299,23 @@ func (s *StateMachine) Taint(node NodeAddr) {
 	s.store[node] = elem
 }
 
+// Confirm the node is alive, clearing any suspicion raised by previous taints.
+// Version is incremented so the information will be shared in the next gossip round.
+func (s *StateMachine) Confirm(node NodeAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.store[node]
+	if !exists || elem.HeartBeat.Tainted == 0 {
+		return
+	}
+	prev := elem.HeartBeat
+	elem.HeartBeat.Version++
+	elem.HeartBeat.Tainted = 0
+	s.store[node] = elem
+	s.heartbeat(node, prev, elem.HeartBeat)
+}
+
 // Update cluster membership information in local storage.
 // This function only updates the local storage if the state received as a parameter
 // is more recent than what the current node has. Data freshness is validated using
@@ -135,6 +332,8 @@ func (s *StateMachine) Update(state EndpointState) *EndpointState {
 	elem, exists := s.store[key]
 	if !exists {
 		s.store[key] = state
+		s.updates.Add(1)
+		s.heartbeat(key, state.HeartBeat, state.HeartBeat)
 		return nil
 	}
 
@@ -146,12 +345,62 @@ func (s *StateMachine) Update(state EndpointState) *EndpointState {
 	case elem.HeartBeat.Generation < state.HeartBeat.Generation:
 		// I have an old generation. Updating mine
 		s.store[key] = state
+		s.updates.Add(1)
+		s.heartbeat(key, elem.HeartBeat, state.HeartBeat)
 		return nil
 	}
 	if elem.HeartBeat.Version <= state.HeartBeat.Version {
+		if elem.HeartBeat != state.HeartBeat {
+			s.updates.Add(1)
+		}
+		if elem.HeartBeat.Version < state.HeartBeat.Version {
+			s.heartbeat(key, elem.HeartBeat, state.HeartBeat)
+		}
 		s.store[key] = state
 		return nil
 	}
 	out := elem
 	return &out
 }
+
+// Updates returns the number of membership states changed in the local store
+// by gossip updates.
+func (s *StateMachine) Updates() uint64 {
+	return s.updates.Load()
+}
+
+// Save writes the membership states of the local store to w, so that they can
+// be restored with Load. Contacts with peers are local to the running node and
+// are not saved.
+func (s *StateMachine) Save(w io.Writer) error {
+	peers := s.Peers(false)
+	states := make([]EndpointState, 0, len(peers))
+	for _, state := range peers {
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b EndpointState) int {
+		return cmp.Compare(a.NodeAddr, b.NodeAddr)
+	})
+	return json.NewEncoder(w).Encode(states)
+}
+
+// Load merges the membership states written by Save into the local store.
+// States are merged like gossip updates, so fresher states already in the store
+// are kept, and states that fail validation are discarded.
+func (s *StateMachine) Load(r io.Reader) error {
+	var states []EndpointState
+	if err := json.NewDecoder(r).Decode(&states); err != nil {
+		return fmt.Errorf("decoding membership states: %w", err)
+	}
+
+	s.mu.RLock()
+	now := s.now()
+	s.mu.RUnlock()
+	for _, state := range states {
+		if validateState(state, now) != nil {
+			continue
+		}
+		s.Update(state)
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package gossip
 
 import (
+	"bytes"
+	"maps"
 	"testing"
+	"time"
 )
 
 func initTestStore(initial []EndpointState) *StateMachine {
@@ -69,3 +72,116 @@ func TestUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestRandomPeersFavourStalePeers(t *testing.T) {
+	store := initTestStore([]EndpointState{
+		{NodeAddr: "fresh-1"}, {NodeAddr: "fresh-2"},
+		{NodeAddr: "stale-1"}, {NodeAddr: "stale-2"},
+	})
+	now := time.Now()
+	store.lastContact["fresh-1"] = now
+	store.lastContact["fresh-2"] = now
+	store.lastContact["stale-1"] = now.Add(-maxPeerStaleness)
+	// stale-2 was never contacted
+
+	selected := map[NodeAddr]int{}
+	for i := 0; i < 2000; i++ {
+		for _, addr := range store.RandomPeers(1, nil) {
+			selected[addr]++
+		}
+	}
+
+	fresh := selected["fresh-1"] + selected["fresh-2"]
+	stale := selected["stale-1"] + selected["stale-2"]
+	if stale < 3*fresh {
+		t.Fatalf("stale peers should be selected more often: stale %d, fresh %d", stale, fresh)
+	}
+	if fresh == 0 {
+		t.Fatal("fresh peers should still be selected occasionally")
+	}
+}
+
+func TestHeartBeatStatusTransitions(t *testing.T) {
+	store := initTestStore([]EndpointState{{NodeAddr: "test"}})
+	status := func() NodeStatus {
+		hb := store.Peers(false)["test"].HeartBeat
+		return hb.Status()
+	}
+
+	expected := []NodeStatus{NodeSuspect, NodeSuspect, NodeDead}
+	for i, exp := range expected {
+		store.Taint("test")
+		if status() != exp {
+			t.Fatalf("after %d taints expected status %s, found %s", i+1, exp, status())
+		}
+	}
+
+	store.Confirm("test")
+	if status() != NodeAlive {
+		t.Fatalf("confirmed node expected status %s, found %s", NodeAlive, status())
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	generation := uint64(time.Now().UnixNano() / 1000)
+	states := []EndpointState{
+		{NodeAddr: "localhost:9800", HeartBeat: HeartBeatState{Generation: generation, Version: 12}},
+		{NodeAddr: "localhost:9801", HeartBeat: HeartBeatState{Generation: generation, Version: 3, Tainted: 1},
+			AppState: map[string]string{"http": "localhost:8080"}},
+		{NodeAddr: "localhost:9802", HeartBeat: HeartBeatState{Generation: generation + 1, Version: 7, Tainted: 3}},
+	}
+	store := initTestStore(states)
+	store.Contacted("localhost:9800")
+
+	var buf bytes.Buffer
+	if err := store.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewStateMachine()
+	if err := restored.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	peers := restored.Peers(false)
+	if len(peers) != len(states) {
+		t.Fatalf("expected %d restored peers, found %d", len(states), len(peers))
+	}
+	for _, state := range states {
+		found := peers[state.NodeAddr]
+		if found.HeartBeat != state.HeartBeat {
+			t.Fatalf("expected %s heart beat %+v, found %+v", state.NodeAddr, state.HeartBeat, found.HeartBeat)
+		}
+		if !maps.Equal(found.AppState, state.AppState) {
+			t.Fatalf("expected %s app state %v, found %v", state.NodeAddr, state.AppState, found.AppState)
+		}
+	}
+	if len(restored.lastContact) != 0 {
+		t.Fatal("contacts with peers should not be restored")
+	}
+
+	// fresher states in the store are not replaced when loading
+	buf.Reset()
+	store.Save(&buf)
+	fresher := initTestStore([]EndpointState{
+		{NodeAddr: "localhost:9800", HeartBeat: HeartBeatState{Generation: generation, Version: 20}},
+	})
+	if err := fresher.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v := fresher.Peers(false)["localhost:9800"].HeartBeat.Version; v != 20 {
+		t.Fatalf("expected fresher version %d to be kept, found %d", 20, v)
+	}
+
+	// invalid states are discarded
+	invalid := `[{"NodeAddr":"no-port","HeartBeat":{"Generation":1}},{"NodeAddr":"localhost:9803"}]`
+	if err := fresher.Load(bytes.NewBufferString(invalid)); err != nil {
+		t.Fatal(err)
+	}
+	if fresher.Known("no-port") || !fresher.Known("localhost:9803") {
+		t.Fatalf("expected only valid states to be loaded, found %v", fresher.Peers(false))
+	}
+
+	if err := fresher.Load(bytes.NewBufferString("not json")); err == nil {
+		t.Fatal("expected error loading malformed states")
+	}
+}
@@ -0,0 +1,52 @@
+package gossip
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// GossipStats is a snapshot of the gossip protocol counters of a Gossiper.
+type GossipStats struct {
+	// Rounds is the number of gossip rounds executed
+	Rounds uint64
+	// PeersContacted is the number of successful gossip exchanges with peers
+	PeersContacted uint64
+	// FailedDials is the number of failed connection attempts to peers
+	FailedDials uint64
+	// BytesSent and BytesReceived count the RPC traffic of the node, both as
+	// initiator of gossip rounds and as receiver
+	BytesSent     uint64
+	BytesReceived uint64
+	// UpdatesApplied is the number of membership states updated in the local store
+	UpdatesApplied uint64
+	// StatesRejected is the number of malformed or excess states dropped from
+	// envelopes received from peers
+	StatesRejected uint64
+}
+
+// gossipStats holds the counters updated by the Gossiper.
+type gossipStats struct {
+	rounds         atomic.Uint64
+	peersContacted atomic.Uint64
+	failedDials    atomic.Uint64
+	bytesSent      atomic.Uint64
+	bytesReceived  atomic.Uint64
+}
+
+// countingConn is a net.Conn that counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	stats *gossipStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesSent.Add(uint64(n))
+	return n, err
+}
@@ -2,6 +2,7 @@ package objcache
 
 import (
 	"container/heap"
+	"hash/maphash"
 	"sync"
 	"time"
 )
@@ -11,89 +12,436 @@ type CacheItem struct {
 	Key        string
 	Value      any
 	ExpiryTime time.Time
+
+	// index of the item in the eviction heap
+	index int
+	// size is the estimated size of the value in bytes, when the cache
+	// is bound by a byte budget
+	size int
 }
 
+// defaultMaxShards is the maximum number of shards of caches created with
+// NewObjectsCache. minShardItems is the minimum capacity of every shard, so
+// that small caches keep evicting items in expiry order across all keys.
+const (
+	defaultMaxShards = 16
+	minShardItems    = 64
+)
+
 // NewObjectsCache creates a new ObjectsCache instance
+//
+// Large caches are split into shards to reduce lock contention, see
+// NewShardedObjectsCache.
 func NewObjectsCache(maxItems int, ttl time.Duration) *ObjectsCache {
-	itemsEvictionHeap := make(cacheItemHeap, 0)
-	heap.Init(&itemsEvictionHeap)
+	shards := min(defaultMaxShards, maxItems/minShardItems)
+	return NewShardedObjectsCache(shards, maxItems, ttl)
+}
 
-	return &ObjectsCache{
-		maxItems:     maxItems,
-		itemsTTL:     ttl,
-		items:        map[string]*CacheItem{},
-		evictionHeap: itemsEvictionHeap,
+// NewShardedObjectsCache creates a new ObjectsCache split into the given number
+// of shards, each guarded by its own lock. Keys are assigned to shards by hash,
+// so that concurrent operations on different keys rarely contend on the same lock.
+//
+// The maxItems capacity is split among the shards: when a shard is full its
+// item closest to expiry is evicted, even if other shards hold items expiring sooner.
+func NewShardedObjectsCache(shards int, maxItems int, ttl time.Duration) *ObjectsCache {
+	if shards < 1 {
+		shards = 1
+	}
+	if maxItems > 0 && shards > maxItems {
+		// every shard holds at least one item
+		shards = maxItems
+	}
+	c := &ObjectsCache{
+		shards: make([]*cacheShard, shards),
+		seed:   maphash.MakeSeed(),
+	}
+	for i := range c.shards {
+		// the first shards take the remainder of the capacity
+		capacity := maxItems / shards
+		if i < maxItems%shards {
+			capacity++
+		}
+		c.shards[i] = newCacheShard(capacity, ttl)
 	}
+	return c
+}
+
+// NewSlidingObjectsCache creates a new ObjectsCache with sliding expiration:
+// every Get or MGet of a live item extends its expiry time to ttl from the
+// access, so that items stay in the cache as long as they are used.
+func NewSlidingObjectsCache(maxItems int, ttl time.Duration) *ObjectsCache {
+	c := NewObjectsCache(maxItems, ttl)
+	for _, s := range c.shards {
+		s.sliding = true
+	}
+	return c
+}
+
+// NewObjectsCacheWithBudget creates a new ObjectsCache bound by the estimated
+// size of its items rather than their number.
+// sizeOf returns the approximate size in bytes of a cached value: items are
+// evicted, starting from the ones closest to expiry, until the total estimated
+// size of the cache is within maxBytes.
+//
+// Caches bound by a byte budget are not sharded, as a single item could
+// exceed the share of the budget of its shard.
+func NewObjectsCacheWithBudget(maxBytes int, ttl time.Duration, sizeOf func(any) int) *ObjectsCache {
+	c := NewShardedObjectsCache(1, 0, ttl)
+	c.shards[0].maxBytes = maxBytes
+	c.shards[0].sizeOf = sizeOf
+	return c
 }
 
 // ObjectsCache is used to store any object in-memory for fast retrieval.
 type ObjectsCache struct {
+	// OnEvict is called with the key and value of items dropped from the cache,
+	// either to make room for new items or because they expired.
+	// It is not called for items removed with Delete or replaced by Put.
+	// The callback runs outside of the cache lock, so it can use the cache.
+	// OnEvict must be set before the cache is used.
+	OnEvict func(key string, value any)
+
+	shards []*cacheShard
+	seed   maphash.Seed
+
+	// loads tracks the in-flight GetOrLoad calls by key
+	loads  map[string]*loadCall
+	loadMu sync.Mutex
+}
+
+// cacheShard is a partition of the ObjectsCache keys with its own lock,
+// capacity and eviction heap.
+type cacheShard struct {
 	maxItems int
 	itemsTTL time.Duration
+	// sliding extends the expiry time of items when they are accessed
+	sliding bool
+
+	// maxBytes is the byte budget of the shard, used instead of maxItems
+	// when sizeOf is set. usedBytes is the total estimated size of the items.
+	maxBytes  int
+	usedBytes int
+	sizeOf    func(any) int
 
 	items        map[string]*CacheItem
 	evictionHeap cacheItemHeap
 	mu           sync.RWMutex
 }
 
+func newCacheShard(maxItems int, ttl time.Duration) *cacheShard {
+	itemsEvictionHeap := make(cacheItemHeap, 0)
+	heap.Init(&itemsEvictionHeap)
+
+	return &cacheShard{
+		maxItems:     maxItems,
+		itemsTTL:     ttl,
+		items:        map[string]*CacheItem{},
+		evictionHeap: itemsEvictionHeap,
+	}
+}
+
+// shard returns the shard storing the key
+func (c *ObjectsCache) shard(k string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.String(c.seed, k)%uint64(len(c.shards))]
+}
+
 // Put a new item into the ObjectsCache
+//
+// If the key is already in the cache its value and expiry time are updated in place.
 func (c *ObjectsCache) Put(k string, v any) *CacheItem {
-	c.Delete(k)
+	item, evicted := c.shard(k).put(k, v)
+	c.notifyEvicted(evicted)
+	return item
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (s *cacheShard) put(k string, v any) (*CacheItem, []*CacheItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(c.items) >= c.maxItems {
-		c.evict(1)
-	}
+	return s.putLocked(k, v)
+}
+
+// putLocked stores the item and returns the items evicted to make room for it.
+// Callers must hold the lock.
+func (s *cacheShard) putLocked(k string, v any) (*CacheItem, []*CacheItem) {
 	item := &CacheItem{
 		Key:        k,
 		Value:      v,
-		ExpiryTime: time.Now().Add(c.itemsTTL),
+		ExpiryTime: time.Now().Add(s.itemsTTL),
+	}
+	if s.sizeOf != nil {
+		item.size = s.sizeOf(v)
 	}
-	c.items[k] = item
-	heap.Push(&c.evictionHeap, item)
 
-	return item
+	if old, ok := s.items[k]; ok {
+		// items returned to callers are never modified: the new item
+		// takes the place of the old one in the heap before fixing its position.
+		item.index = old.index
+		s.evictionHeap[item.index] = item
+		s.items[k] = item
+		heap.Fix(&s.evictionHeap, item.index)
+		s.usedBytes += item.size - old.size
+		return item, s.evictOverBudget()
+	}
+
+	var evicted []*CacheItem
+	if s.sizeOf == nil && len(s.items) >= s.maxItems {
+		evicted = s.evict(1)
+	}
+	s.items[k] = item
+	heap.Push(&s.evictionHeap, item)
+	s.usedBytes += item.size
+
+	return item, append(evicted, s.evictOverBudget()...)
+}
+
+// evictOverBudget evicts items until the shard is within its byte budget and
+// returns them. An item larger than the whole budget is evicted as soon as it's stored.
+// Callers must hold the lock.
+func (s *cacheShard) evictOverBudget() []*CacheItem {
+	if s.sizeOf == nil {
+		return nil
+	}
+	var evicted []*CacheItem
+	for s.usedBytes > s.maxBytes && len(s.evictionHeap) > 0 {
+		evicted = append(evicted, s.evict(1)...)
+	}
+	return evicted
+}
+
+// MPut stores multiple items into the ObjectsCache acquiring the lock of every
+// shard once.
+//
+// Keys already in the cache are updated in place as with Put. When the batch
+// holds more items than the cache capacity, the first items stored are evicted.
+func (c *ObjectsCache) MPut(items map[string]any) {
+	batches := make(map[*cacheShard][]string, len(c.shards))
+	for k := range items {
+		s := c.shard(k)
+		batches[s] = append(batches[s], k)
+	}
+
+	var evicted []*CacheItem
+	for s, keys := range batches {
+		s.mu.Lock()
+		for _, k := range keys {
+			_, ev := s.putLocked(k, items[k])
+			evicted = append(evicted, ev...)
+		}
+		s.mu.Unlock()
+	}
+
+	c.notifyEvicted(evicted)
+}
+
+// evict removes up to n items from the shard, starting from the ones closest
+// to expiry, and returns them. Callers must hold the lock.
+func (s *cacheShard) evict(n int) []*CacheItem {
+	var evicted []*CacheItem
+	for i := 0; i < n && len(s.evictionHeap) > 0; i++ {
+		item := heap.Pop(&s.evictionHeap).(*CacheItem)
+		delete(s.items, item.Key)
+		s.usedBytes -= item.size
+		evicted = append(evicted, item)
+	}
+	return evicted
 }
 
-func (c *ObjectsCache) evict(n int) {
-	for i := 0; i < n && len(c.evictionHeap) > 0; i++ {
-		evicted := heap.Pop(&c.evictionHeap)
-		delete(c.items, evicted.(*CacheItem).Key)
+// notifyEvicted calls the OnEvict callback for every evicted item.
+// It must be called without holding the lock.
+func (c *ObjectsCache) notifyEvicted(evicted []*CacheItem) {
+	if c.OnEvict == nil {
+		return
+	}
+	for _, item := range evicted {
+		c.OnEvict(item.Key, item.Value)
 	}
 }
 
 // Delete an item from the cache
 func (c *ObjectsCache) Delete(k string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	delete(c.items, k)
-	for i := 0; i < len(c.evictionHeap); i++ {
-		if c.evictionHeap[i].Key == k {
-			heap.Remove(&c.evictionHeap, i)
-			return
-		}
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[k]
+	if !ok {
+		return
 	}
+	delete(s.items, k)
+	heap.Remove(&s.evictionHeap, item.index)
+	s.usedBytes -= item.size
 }
 
 // Get an item from the cache. If we're past the item's expiryTime
-// return nil.
+// the item is removed from the cache and Get returns nil.
+//
+// With sliding expiration the returned item replaces the cached one with an
+// extended expiry time.
 func (c *ObjectsCache) Get(k string) *CacheItem {
-	c.mu.RLock()
-	item, ok := c.items[k]
-	c.mu.RUnlock()
+	s := c.shard(k)
+	s.mu.RLock()
+	item, ok := s.items[k]
+	s.mu.RUnlock()
 	if !ok {
 		return nil
 	}
 
 	if time.Now().After(item.ExpiryTime) {
+		if s.expire(item) {
+			c.notifyEvicted([]*CacheItem{item})
+		}
 		return nil
 	}
+	if s.sliding {
+		return s.touch(item)
+	}
 	return item
 }
 
+// MGet returns the items found in the cache for the given keys, acquiring the
+// lock of every shard once.
+// Keys that are missing or expired are not included in the result, expired
+// items are removed from the cache as with Get.
+func (c *ObjectsCache) MGet(keys []string) map[string]*CacheItem {
+	batches := make(map[*cacheShard][]string, len(c.shards))
+	for _, k := range keys {
+		s := c.shard(k)
+		batches[s] = append(batches[s], k)
+	}
+
+	now := time.Now()
+	found := make(map[string]*CacheItem, len(keys))
+	var evicted []*CacheItem
+	for s, keys := range batches {
+		var expired []*CacheItem
+
+		s.mu.RLock()
+		for _, k := range keys {
+			item, ok := s.items[k]
+			if !ok {
+				continue
+			}
+			if now.After(item.ExpiryTime) {
+				expired = append(expired, item)
+				continue
+			}
+			found[k] = item
+		}
+		s.mu.RUnlock()
+
+		if s.sliding {
+			s.touchAll(keys, found)
+		}
+		if len(expired) > 0 {
+			evicted = append(evicted, s.expireAll(expired)...)
+		}
+	}
+
+	c.notifyEvicted(evicted)
+	return found
+}
+
+// touch extends the expiry time of the item and returns the item replacing it.
+// The item is returned unchanged if it was replaced or removed concurrently.
+func (s *cacheShard) touch(item *CacheItem) *CacheItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.touchLocked(item, time.Now())
+}
+
+// touchAll extends the expiry time of the items found for the keys, replacing
+// them in the found map.
+func (s *cacheShard) touchAll(keys []string, found map[string]*CacheItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		if item, ok := found[k]; ok {
+			found[k] = s.touchLocked(item, now)
+		}
+	}
+}
+
+// touchLocked is touch for callers already holding the lock.
+func (s *cacheShard) touchLocked(item *CacheItem, now time.Time) *CacheItem {
+	if s.items[item.Key] != item {
+		return item
+	}
+	// items returned to callers are never modified: a copy with the new
+	// expiry time takes the place of the item in the heap.
+	touched := *item
+	touched.ExpiryTime = now.Add(s.itemsTTL)
+	s.evictionHeap[touched.index] = &touched
+	s.items[touched.Key] = &touched
+	heap.Fix(&s.evictionHeap, touched.index)
+	return &touched
+}
+
+// Clear removes all items from the cache.
+// As with Delete, the OnEvict callback is not called for the removed items.
+func (c *ObjectsCache) Clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = map[string]*CacheItem{}
+		s.evictionHeap = make(cacheItemHeap, 0)
+		s.usedBytes = 0
+		s.mu.Unlock()
+	}
+}
+
+// UsedBytes returns the total estimated size of the items in the cache.
+// It is always zero for caches bound by item count.
+func (c *ObjectsCache) UsedBytes() int {
+	used := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		used += s.usedBytes
+		s.mu.RUnlock()
+	}
+	return used
+}
+
+// expireAll removes the expired items from the shard and returns the ones that
+// were removed, skipping those replaced or removed concurrently.
+func (s *cacheShard) expireAll(items []*CacheItem) []*CacheItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []*CacheItem
+	for _, item := range items {
+		if s.expireLocked(item) {
+			removed = append(removed, item)
+		}
+	}
+	return removed
+}
+
+// expire removes the expired item from the shard and reports whether it was
+// removed. The item is left alone if it was replaced or removed concurrently.
+func (s *cacheShard) expire(item *CacheItem) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.expireLocked(item)
+}
+
+// expireLocked is expire for callers already holding the lock.
+func (s *cacheShard) expireLocked(item *CacheItem) bool {
+	if s.items[item.Key] != item {
+		return false
+	}
+	delete(s.items, item.Key)
+	heap.Remove(&s.evictionHeap, item.index)
+	s.usedBytes -= item.size
+	return true
+}
+
 // cacheItemHeap implements the heap.Interface
 type cacheItemHeap []*CacheItem
 
@@ -107,10 +455,13 @@ func (h cacheItemHeap) Less(i, j int) bool {
 
 func (h cacheItemHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
 }
 
 func (h *cacheItemHeap) Push(v any) {
 	item := v.(*CacheItem)
+	item.index = len(*h)
 	*h = append(*h, item)
 }
 
@@ -2,6 +2,8 @@ package objcache
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -14,6 +16,24 @@ type mockItem struct {
 	Payload int
 }
 
+// numItems returns the number of items stored in all the cache shards
+func (c *ObjectsCache) numItems() int {
+	n := 0
+	for _, s := range c.shards {
+		n += len(s.items)
+	}
+	return n
+}
+
+// heapSize returns the number of items in the eviction heaps of all the cache shards
+func (c *ObjectsCache) heapSize() int {
+	n := 0
+	for _, s := range c.shards {
+		n += len(s.evictionHeap)
+	}
+	return n
+}
+
 func TestCacheOperations(t *testing.T) {
 
 	maxItems := 10
@@ -24,11 +44,11 @@ func TestCacheOperations(t *testing.T) {
 		cache.Put(getKey(i), mockItem{i})
 	}
 
-	if len(cache.items) != maxItems {
-		t.Fatalf("cache exceeded the maximum allowed size: found %d", len(cache.items))
+	if cache.numItems() != maxItems {
+		t.Fatalf("cache exceeded the maximum allowed size: found %d", cache.numItems())
 	}
 
-	fmt.Println(cache.items)
+	fmt.Println(cache.shards[0].items)
 
 	n := numItems - 3
 	item := cache.Get(getKey(n))
@@ -49,7 +69,7 @@ func TestCacheOperations(t *testing.T) {
 		t.Fatal("item was not deleted from cache.")
 	}
 
-	if len(cache.evictionHeap) != len(cache.items) {
+	if cache.heapSize() != cache.numItems() {
 		t.Fatal("sync between objects store and eviction heap was not maintained")
 	}
 }
@@ -68,8 +88,434 @@ func TestEmptyStore(t *testing.T) {
 		cache.Delete(getKey(i))
 	}
 
-	if len(cache.evictionHeap) != len(cache.items) {
+	if cache.heapSize() != cache.numItems() {
 		t.Fatal("sync between objects store and eviction heap was not maintained")
 	}
 
 }
+
+func TestPutUpdatesExistingKey(t *testing.T) {
+	cache := NewObjectsCache(10, time.Second)
+
+	for i := 0; i < 5; i++ {
+		cache.Put(getKey(i), mockItem{i})
+	}
+	first := cache.Put("updated", mockItem{1})
+	time.Sleep(10 * time.Millisecond)
+	second := cache.Put("updated", mockItem{2})
+
+	if cache.numItems() != 6 || cache.heapSize() != 6 {
+		t.Fatalf("sync between objects store and eviction heap was not maintained: %d items, %d in heap",
+			cache.numItems(), cache.heapSize())
+	}
+
+	item := cache.Get("updated")
+	if item == nil {
+		t.Fatal("returned nil item")
+	}
+	if item.Value.(mockItem).Payload != 2 {
+		t.Fatalf("wrong value returned: expected %d, found %d", 2, item.Value.(mockItem).Payload)
+	}
+	if !item.ExpiryTime.After(first.ExpiryTime) || !item.ExpiryTime.Equal(second.ExpiryTime) {
+		t.Fatalf("expiry time was not updated: %s, first put %s", item.ExpiryTime, first.ExpiryTime)
+	}
+	if first.Value.(mockItem).Payload != 1 {
+		t.Fatal("items returned by previous calls should not be modified")
+	}
+
+	// the updated key is now the last to expire
+	cache.shards[0].evict(5)
+	if cache.Get("updated") == nil {
+		t.Fatal("updated item should be evicted last")
+	}
+}
+
+func TestMPutAndMGet(t *testing.T) {
+	cache := NewObjectsCache(10, time.Minute)
+	cache.Put(getKey(0), mockItem{0})
+
+	cache.MPut(map[string]any{
+		getKey(0): mockItem{10},
+		getKey(1): mockItem{1},
+		getKey(2): mockItem{2},
+	})
+	if cache.numItems() != 3 || cache.heapSize() != 3 {
+		t.Fatalf("sync between objects store and eviction heap was not maintained: %d items, %d in heap",
+			cache.numItems(), cache.heapSize())
+	}
+
+	items := cache.MGet([]string{getKey(0), getKey(1), getKey(2), "missing"})
+	if len(items) != 3 {
+		t.Fatalf("expected %d items, found %d", 3, len(items))
+	}
+	if _, ok := items["missing"]; ok {
+		t.Fatal("missing keys should not be returned")
+	}
+	expected := map[string]int{getKey(0): 10, getKey(1): 1, getKey(2): 2}
+	for k, payload := range expected {
+		if v := items[k].Value.(mockItem).Payload; v != payload {
+			t.Fatalf("wrong value for %s: expected %d, found %d", k, payload, v)
+		}
+	}
+}
+
+func TestMPutEvictsOverCapacity(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	cache := NewObjectsCache(2, time.Minute)
+	cache.OnEvict = evicted.onEvict
+
+	batch := map[string]any{}
+	for i := 0; i < 5; i++ {
+		batch[getKey(i)] = mockItem{i}
+	}
+	cache.MPut(batch)
+
+	if cache.numItems() != 2 || cache.heapSize() != 2 {
+		t.Fatalf("cache exceeded the maximum allowed size: %d items, %d in heap",
+			cache.numItems(), cache.heapSize())
+	}
+	if len(evicted.items) != 3 {
+		t.Fatalf("expected %d evictions, found %d", 3, len(evicted.items))
+	}
+}
+
+func TestMGetRemovesExpiredItems(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	cache := NewObjectsCache(10, 10*time.Millisecond)
+	cache.OnEvict = evicted.onEvict
+
+	cache.MPut(map[string]any{getKey(0): mockItem{0}, getKey(1): mockItem{1}})
+	time.Sleep(20 * time.Millisecond)
+
+	if items := cache.MGet([]string{getKey(0), getKey(1)}); len(items) != 0 {
+		t.Fatalf("expected expired items to be skipped, found %d", len(items))
+	}
+	if len(evicted.items) != 2 {
+		t.Fatalf("expected %d evictions, found %d", 2, len(evicted.items))
+	}
+	if cache.numItems() != 0 || cache.heapSize() != 0 {
+		t.Fatal("expired items should be removed from the cache")
+	}
+}
+
+func TestClear(t *testing.T) {
+	cache := NewObjectsCache(10, time.Minute)
+	for i := 0; i < 5; i++ {
+		cache.Put(getKey(i), mockItem{i})
+	}
+
+	cache.Clear()
+	if cache.numItems() != 0 || cache.heapSize() != 0 {
+		t.Fatalf("expected empty cache, found %d items, %d in heap",
+			cache.numItems(), cache.heapSize())
+	}
+	if cache.Get(getKey(0)) != nil {
+		t.Fatal("cleared items should not be returned")
+	}
+
+	// the cache is usable after being cleared
+	cache.Put(getKey(0), mockItem{0})
+	if cache.numItems() != 1 || cache.heapSize() != 1 {
+		t.Fatal("sync between objects store and eviction heap was not maintained")
+	}
+}
+
+func BenchmarkPutSameKey(b *testing.B) {
+	cache := NewObjectsCache(1000, time.Minute)
+	for i := 0; i < 1000; i++ {
+		cache.Put(getKey(i), mockItem{i})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Put(getKey(500), mockItem{i})
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	maxItems := 800
+	cache := NewShardedObjectsCache(8, maxItems, time.Minute)
+	cache.OnEvict = evicted.onEvict
+
+	// keys are not evenly distributed, half of the capacity leaves room in every shard
+	numItems := maxItems / 2
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < numItems; i += 8 {
+				cache.Put(getKey(i), mockItem{i})
+				cache.Get(getKey(i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if n := cache.numItems(); n != numItems {
+		t.Fatalf("expected %d items, found %d", numItems, n)
+	}
+	for i, s := range cache.shards {
+		if len(s.items) != len(s.evictionHeap) {
+			t.Fatalf("sync between objects store and eviction heap of shard %d was not maintained", i)
+		}
+		if len(s.items) == numItems {
+			t.Fatalf("all keys were stored in shard %d", i)
+		}
+	}
+
+	keys := make([]string, numItems)
+	for i := range keys {
+		keys[i] = getKey(i)
+	}
+	items := cache.MGet(keys)
+	if len(items) != numItems {
+		t.Fatalf("expected %d items, found %d", numItems, len(items))
+	}
+	for i, k := range keys {
+		if v := items[k].Value.(mockItem).Payload; v != i {
+			t.Fatalf("wrong value for %s: expected %d, found %d", k, i, v)
+		}
+	}
+
+	// keys of every shard are deleted from the right shard
+	for i := 0; i < numItems; i += 2 {
+		cache.Delete(getKey(i))
+	}
+	if n, h := cache.numItems(), cache.heapSize(); n != numItems/2 || h != numItems/2 {
+		t.Fatalf("expected %d items, found %d items, %d in heap", numItems/2, n, h)
+	}
+
+	// shards evict their own items when full
+	batch := map[string]any{}
+	for i := maxItems; i < 3*maxItems; i++ {
+		batch[getKey(i)] = mockItem{i}
+	}
+	cache.MPut(batch)
+	if n := cache.numItems(); n > maxItems {
+		t.Fatalf("cache exceeded the maximum allowed size: found %d", n)
+	}
+	if n := cache.numItems() + len(evicted.items); n != numItems/2+len(batch) {
+		t.Fatalf("expected %d stored or evicted items, found %d", numItems/2+len(batch), n)
+	}
+
+	cache.Clear()
+	if n, h := cache.numItems(), cache.heapSize(); n != 0 || h != 0 {
+		t.Fatalf("expected empty cache, found %d items, %d in heap", n, h)
+	}
+}
+
+func TestNewObjectsCacheShards(t *testing.T) {
+	testCases := []struct {
+		maxItems int
+		shards   int
+	}{
+		{maxItems: 10, shards: 1},
+		{maxItems: 500, shards: 7},
+		{maxItems: 100000, shards: defaultMaxShards},
+	}
+	for _, tc := range testCases {
+		cache := NewObjectsCache(tc.maxItems, time.Minute)
+		if len(cache.shards) != tc.shards {
+			t.Fatalf("expected %d shards for %d items, found %d", tc.shards, tc.maxItems, len(cache.shards))
+		}
+		capacity := 0
+		for _, s := range cache.shards {
+			capacity += s.maxItems
+		}
+		if capacity != tc.maxItems {
+			t.Fatalf("expected total capacity %d, found %d", tc.maxItems, capacity)
+		}
+	}
+}
+
+func BenchmarkConcurrentAccess(b *testing.B) {
+	for _, shards := range []int{1, defaultMaxShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewShardedObjectsCache(shards, 4096, time.Minute)
+			for i := 0; i < 4096; i++ {
+				cache.Put(getKey(i), mockItem{i})
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1000))
+				for pb.Next() {
+					k := getKey(i % 4096)
+					// one write every ten reads
+					if i%10 == 0 {
+						cache.Put(k, mockItem{i})
+					} else {
+						cache.Get(k)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// evictions records the items passed to the OnEvict callback
+type evictions struct {
+	mu    sync.Mutex
+	items map[string]any
+}
+
+func (e *evictions) onEvict(key string, value any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.items[key] = value
+}
+
+func (e *evictions) get(key string) (any, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v, ok := e.items[key]
+	return v, ok
+}
+
+func TestOnEvictCapacity(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	cache := NewObjectsCache(2, time.Minute)
+	cache.OnEvict = evicted.onEvict
+
+	cache.Put(getKey(0), mockItem{0})
+	cache.Put(getKey(1), mockItem{1})
+	// replacing a value is not an eviction
+	cache.Put(getKey(1), mockItem{10})
+	cache.Put(getKey(2), mockItem{2})
+
+	v, ok := evicted.get(getKey(0))
+	if !ok {
+		t.Fatalf("expected eviction callback for %s", getKey(0))
+	}
+	if v.(mockItem).Payload != 0 {
+		t.Fatalf("expected evicted value %d, found %d", 0, v.(mockItem).Payload)
+	}
+	if len(evicted.items) != 1 {
+		t.Fatalf("expected %d evictions, found %d", 1, len(evicted.items))
+	}
+}
+
+func TestOnEvictExpiry(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	cache := NewObjectsCache(10, 10*time.Millisecond)
+	cache.OnEvict = evicted.onEvict
+
+	cache.Put(getKey(0), mockItem{0})
+	time.Sleep(20 * time.Millisecond)
+
+	if item := cache.Get(getKey(0)); item != nil {
+		t.Fatal("expected expired item to be nil")
+	}
+	v, ok := evicted.get(getKey(0))
+	if !ok || v.(mockItem).Payload != 0 {
+		t.Fatalf("expected eviction callback for %s with value %d, found %v", getKey(0), 0, v)
+	}
+	if cache.numItems() != 0 || cache.heapSize() != 0 {
+		t.Fatal("expired item should be removed from the cache")
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	cache := NewSlidingObjectsCache(10, 50*time.Millisecond)
+	original := cache.Put(getKey(0), mockItem{0})
+	cache.Put(getKey(1), mockItem{1})
+
+	// accessed items outlive their original TTL
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if item := cache.Get(getKey(0)); item == nil {
+			t.Fatalf("expected item %s to be alive after %d accesses", getKey(0), i)
+		}
+		if found := cache.MGet([]string{getKey(1)}); len(found) != 1 {
+			t.Fatalf("expected item %s to be alive after %d accesses", getKey(1), i)
+		}
+	}
+	if item := cache.Get(getKey(0)); !item.ExpiryTime.After(original.ExpiryTime) {
+		t.Fatalf("expected expiry time after %s, found %s", original.ExpiryTime, item.ExpiryTime)
+	}
+
+	// items expire once they are no longer accessed
+	time.Sleep(70 * time.Millisecond)
+	if item := cache.Get(getKey(0)); item != nil {
+		t.Fatal("expected expired item to be nil")
+	}
+	if cache.numItems() != 1 || cache.heapSize() != 1 {
+		t.Fatal("expired item should be removed from the cache")
+	}
+}
+
+func TestOnEvictCanUseCache(t *testing.T) {
+	cache := NewObjectsCache(1, time.Minute)
+	cache.OnEvict = func(key string, value any) {
+		// would deadlock if the callback ran under the cache lock
+		cache.Get(key)
+		cache.Delete(key)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Put(getKey(0), mockItem{0})
+		cache.Put(getKey(1), mockItem{1})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("eviction callback deadlocked")
+	}
+}
+
+func TestByteBudgetEviction(t *testing.T) {
+	evicted := &evictions{items: map[string]any{}}
+	budget := 100
+	cache := NewObjectsCacheWithBudget(budget, time.Minute, func(v any) int {
+		return len(v.([]byte))
+	})
+	cache.OnEvict = evicted.onEvict
+
+	sizes := []int{10, 40, 30, 5, 50, 20}
+	for i, size := range sizes {
+		cache.Put(getKey(i), make([]byte, size))
+		if used := cache.UsedBytes(); used > budget {
+			t.Fatalf("cache exceeded the byte budget after %d items: %d bytes", i+1, used)
+		}
+	}
+
+	// 10, 40 and 30 bytes items are evicted to make room for the last two
+	if used := cache.UsedBytes(); used != 75 {
+		t.Fatalf("expected %d bytes in use, found %d", 75, used)
+	}
+	if len(evicted.items) != 3 {
+		t.Fatalf("expected %d evictions, found %d", 3, len(evicted.items))
+	}
+	for i := 3; i < len(sizes); i++ {
+		if cache.Get(getKey(i)) == nil {
+			t.Fatalf("expected %s to be in the cache", getKey(i))
+		}
+	}
+
+	// growing an existing item evicts the others
+	cache.Put(getKey(5), make([]byte, 90))
+	if used := cache.UsedBytes(); used != 90 {
+		t.Fatalf("expected %d bytes in use, found %d", 90, used)
+	}
+
+	// items larger than the budget are not retained
+	cache.Put(getKey(6), make([]byte, budget+1))
+	if cache.Get(getKey(6)) != nil {
+		t.Fatal("item larger than the budget should not be cached")
+	}
+	if used := cache.UsedBytes(); used != 0 {
+		t.Fatalf("expected %d bytes in use, found %d", 0, used)
+	}
+
+	cache.Put(getKey(7), make([]byte, 10))
+	cache.Delete(getKey(7))
+	if used := cache.UsedBytes(); used != 0 {
+		t.Fatalf("expected %d bytes in use after delete, found %d", 0, used)
+	}
+}
@@ -1,5 +1,14 @@
 package objcache
 
+import (
+	"errors"
+	"sync"
+)
+
+// ErrLoaderPanicked is returned to the callers waiting on a GetOrLoad call
+// whose loader function panicked.
+var ErrLoaderPanicked = errors.New("objcache: loader panicked")
+
 // ItemGetterFn type is the signature of the function that can be used
 // by the GetCachedResource wrapper to fetch information if missing
 // from the cache.
@@ -22,3 +31,63 @@ func GetCachedResource(c *ObjectsCache, key string, f ItemGetterFn) (*CacheItem,
 
 	return item, nil
 }
+
+// loadCall is an in-flight or completed GetOrLoad call
+type loadCall struct {
+	wg  sync.WaitGroup
+	val any
+	err error
+
+	// dups is the number of callers waiting for the result
+	dups int
+}
+
+// GetOrLoad returns the value cached for the key, or loads it using the loader
+// function if missing.
+//
+// Concurrent calls for the same missing key are deduplicated: only one loader runs
+// while the other callers wait for and share its result. Loaded values are cached,
+// nil values included, while errors are returned to all waiting callers without
+// being cached. If the loader panics, waiting callers receive ErrLoaderPanicked.
+func (c *ObjectsCache) GetOrLoad(key string, loader func() (any, error)) (any, error) {
+	if item := c.Get(key); item != nil {
+		return item.Value, nil
+	}
+
+	c.loadMu.Lock()
+	if call, ok := c.loads[key]; ok {
+		call.dups++
+		c.loadMu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	// the item could have been loaded since the first lookup
+	if item := c.Get(key); item != nil {
+		c.loadMu.Unlock()
+		return item.Value, nil
+	}
+	if c.loads == nil {
+		c.loads = map[string]*loadCall{}
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	c.loads[key] = call
+	c.loadMu.Unlock()
+
+	// release the waiting callers even if the loader panics, in which case
+	// they receive ErrLoaderPanicked while the panic propagates to this caller
+	call.err = ErrLoaderPanicked
+	defer func() {
+		c.loadMu.Lock()
+		delete(c.loads, key)
+		c.loadMu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.err = loader()
+	if call.err == nil {
+		c.Put(key, call.val)
+	}
+
+	return call.val, call.err
+}
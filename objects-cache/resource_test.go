@@ -1,7 +1,10 @@
 package objcache
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,3 +40,139 @@ func TestGetCachedResource(t *testing.T) {
 		t.Fatal("operation took too long to complete")
 	}
 }
+
+func TestGetOrLoadRunsLoaderOnce(t *testing.T) {
+	c := NewObjectsCache(10, time.Second)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func() (any, error) {
+		calls.Add(1)
+		<-release
+		return mockResourceGetter("missing"), nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad("missing", loader)
+			if err != nil {
+				errs <- err
+			} else if v.(string) != "missing-value" {
+				errs <- fmt.Errorf("wrong value returned from the cache: %s", v.(string))
+			}
+		}()
+	}
+	// release the loader only once all the other callers wait for its result
+	waitForDups(t, c, "missing", 99)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("loader should run once: expected %d calls, found %d", 1, n)
+	}
+}
+
+// waitForDups waits until n callers are waiting for the in-flight load of the key
+func waitForDups(t *testing.T, c *ObjectsCache, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.loadMu.Lock()
+		call, ok := c.loads[key]
+		dups := 0
+		if ok {
+			dups = call.dups
+		}
+		c.loadMu.Unlock()
+		if dups == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d callers waiting for key %s", n, key)
+}
+
+func TestGetOrLoadReleasesWaitersWhenLoaderPanics(t *testing.T) {
+	c := NewObjectsCache(10, time.Second)
+
+	release := make(chan struct{})
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.GetOrLoad("key", func() (any, error) {
+			<-release
+			panic("loader failed")
+		})
+	}()
+
+	// wait for the panicking load to be in-flight before joining it
+	waitForLoad(t, c, "key")
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrLoad("key", func() (any, error) { return "value", nil })
+		result <- err
+	}()
+	waitForDups(t, c, "key", 1)
+	close(release)
+
+	if r := <-panicked; r == nil {
+		t.Fatal("expected the loader panic to propagate to the caller")
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrLoaderPanicked) {
+			t.Fatalf("expected error %v, found %v", ErrLoaderPanicked, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting caller was not released after the loader panicked")
+	}
+
+	// the key can be loaded again after the panic
+	v, err := c.GetOrLoad("key", func() (any, error) { return "value", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.(string) != "value" {
+		t.Fatalf("wrong value returned from the cache: %s", v.(string))
+	}
+}
+
+// waitForLoad waits until a load for the key is in-flight
+func waitForLoad(t *testing.T, c *ObjectsCache, key string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.loadMu.Lock()
+		_, ok := c.loads[key]
+		c.loadMu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected an in-flight load for key %s", key)
+}
+
+func TestGetOrLoadDoesNotCacheErrors(t *testing.T) {
+	c := NewObjectsCache(10, time.Second)
+
+	if _, err := c.GetOrLoad("key", func() (any, error) { return nil, errors.New("failed") }); err == nil {
+		t.Fatal("expected loader error, found nil")
+	}
+
+	v, err := c.GetOrLoad("key", func() (any, error) { return "value", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.(string) != "value" {
+		t.Fatalf("wrong value returned from the cache: %s", v.(string))
+	}
+}
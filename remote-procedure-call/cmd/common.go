@@ -35,15 +35,38 @@ func pluginCall(command pluginCommandType, args []string) {
 	}
 	defer server.Shutdown()
 
-	plugName := args[0]
-
-	inArgs := &extensions.Input{Args: args[1:]}
-	reply := &extensions.Reply{}
-	err = client.Call(fmt.Sprintf("%s.%s", plugName, command), inArgs, reply)
+	out, err := callPlugin(client, command, args[0], args[1:])
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println(reply.Message)
+	fmt.Println(out)
+}
+
+type rpcCaller interface {
+	Call(name string, args any, reply any) error
+}
+
+// callPlugin calls the plugin command via RPC and returns the reply message.
+// Plugins that describe their arguments have them validated before the call,
+// and their spec is appended to the documentation.
+func callPlugin(client rpcCaller, command pluginCommandType, plugName string, args []string) (string, error) {
+	p, found := extensions.Lookup(plugName)
+	if found && command == callPluginCommand {
+		if err := extensions.ValidateArgs(p, args); err != nil {
+			return "", err
+		}
+	}
+
+	inArgs := &extensions.Input{Args: args}
+	reply := &extensions.Reply{}
+	if err := client.Call(fmt.Sprintf("%s.%s", plugName, command), inArgs, reply); err != nil {
+		return "", err
+	}
+
+	if d, ok := p.(extensions.Describer); ok && command == docPluginCommand {
+		return fmt.Sprintf("%s\n%s", reply.Message, d.Describe().Doc()), nil
+	}
+	return reply.Message, nil
 }
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mcastellin/golang-mastery/remote-procedure-call/extensions"
+)
+
+// fakeCaller records the RPC calls and replies with a fixed message
+type fakeCaller struct {
+	calls []string
+}
+
+func (f *fakeCaller) Call(name string, _ any, reply any) error {
+	f.calls = append(f.calls, name)
+	reply.(*extensions.Reply).Message = "reply"
+	return nil
+}
+
+func TestCallPluginValidatesArgs(t *testing.T) {
+	client := &fakeCaller{}
+
+	_, err := callPlugin(client, callPluginCommand, "Curtime", []string{"2006", "extra"})
+	var usageErr *extensions.UsageError
+	if !errors.As(err, &usageErr) {
+		t.Fatalf("expected usage error, found %v", err)
+	}
+	if len(client.calls) != 0 {
+		t.Fatalf("plugin should not be called with invalid arguments, found calls %v", client.calls)
+	}
+
+	if _, err := callPlugin(client, callPluginCommand, "Curtime", []string{"2006"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.calls) != 1 || client.calls[0] != "Curtime.Do" {
+		t.Fatalf("expected call to %s, found %v", "Curtime.Do", client.calls)
+	}
+}
+
+func TestDocPrintsPluginSpec(t *testing.T) {
+	out, err := callPlugin(&fakeCaller{}, docPluginCommand, "Curtime", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "reply\n") || !strings.Contains(out, "Usage: Curtime [format]") {
+		t.Fatalf("doc output is missing the plugin spec:\n%s", out)
+	}
+}
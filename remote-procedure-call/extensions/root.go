@@ -1,6 +1,10 @@
 package extensions
 
-import "sync"
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
 
 var modOnce sync.Once
 var mods []Plugin
@@ -12,6 +16,91 @@ type Plugin interface {
 	Docs(*Input, *Reply) error
 }
 
+// Describer is implemented by plugins that describe the arguments they expect.
+// Calls to these plugins are validated against their spec before reaching the plugin.
+type Describer interface {
+	Describe() PluginSpec
+}
+
+// PluginSpec describes the arguments accepted by a plugin.
+// Required arguments are listed before the optional ones.
+type PluginSpec struct {
+	Name string
+	Args []ArgSpec
+}
+
+// ArgSpec describes a single plugin argument.
+type ArgSpec struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Usage returns the command line usage of the plugin, like "Name <required> [optional]".
+func (spec PluginSpec) Usage() string {
+	parts := []string{spec.Name}
+	for _, arg := range spec.Args {
+		if arg.Required {
+			parts = append(parts, fmt.Sprintf("<%s>", arg.Name))
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s]", arg.Name))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Doc renders the usage and the description of every argument.
+func (spec PluginSpec) Doc() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage: %s", spec.Usage())
+	if len(spec.Args) > 0 {
+		b.WriteString("\nArgs:")
+	}
+	for _, arg := range spec.Args {
+		kind := "optional"
+		if arg.Required {
+			kind = "required"
+		}
+		fmt.Fprintf(&b, "\n  - %s (%s): %s", arg.Name, kind, arg.Description)
+	}
+	return b.String()
+}
+
+// Validate checks the number of arguments matches the spec.
+func (spec PluginSpec) Validate(args []string) error {
+	for i, arg := range spec.Args {
+		if arg.Required && i >= len(args) {
+			return &UsageError{Spec: spec, Msg: fmt.Sprintf("missing required argument %q", arg.Name)}
+		}
+	}
+	if len(args) > len(spec.Args) {
+		return &UsageError{Spec: spec, Msg: fmt.Sprintf(
+			"too many arguments: expected at most %d, found %d", len(spec.Args), len(args))}
+	}
+	return nil
+}
+
+// UsageError is returned when a plugin is called with arguments that don't
+// match its spec.
+type UsageError struct {
+	Spec PluginSpec
+	Msg  string
+}
+
+func (e *UsageError) Error() string {
+	return fmt.Sprintf("%s\nusage: %s", e.Msg, e.Spec.Usage())
+}
+
+// ValidateArgs validates the arguments of a call to the plugin, if the plugin
+// describes its arguments with a spec.
+func ValidateArgs(p Plugin, args []string) error {
+	d, ok := p.(Describer)
+	if !ok {
+		return nil
+	}
+	return d.Describe().Validate(args)
+}
+
 // Input represents the RPC input structure for plugins
 type Input struct {
 	Args []string
@@ -22,6 +111,16 @@ type Reply struct {
 	Message string
 }
 
+// Lookup returns the registered plugin with the name.
+func Lookup(name string) (Plugin, bool) {
+	for _, p := range GetModules() {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
 // GetModules returns a list of all registered modules
 func GetModules() []Plugin {
 	modOnce.Do(func() {
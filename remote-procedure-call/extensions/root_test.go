@@ -0,0 +1,59 @@
+package extensions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// pair is a test plugin that requires two arguments
+type pair struct{}
+
+func (p *pair) Name() string                  { return "Pair" }
+func (p *pair) Do(_ *Input, _ *Reply) error   { return nil }
+func (p *pair) Docs(_ *Input, _ *Reply) error { return nil }
+
+func (p *pair) Describe() PluginSpec {
+	return PluginSpec{
+		Name: p.Name(),
+		Args: []ArgSpec{
+			{Name: "first", Description: "the first item", Required: true},
+			{Name: "second", Description: "the second item", Required: true},
+		},
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	p := &pair{}
+
+	err := ValidateArgs(p, []string{"one"})
+	var usageErr *UsageError
+	if !errors.As(err, &usageErr) {
+		t.Fatalf("expected usage error, found %v", err)
+	}
+	expected := "missing required argument \"second\"\nusage: Pair <first> <second>"
+	if err.Error() != expected {
+		t.Fatalf("wrong usage error message: expected %q, found %q", expected, err.Error())
+	}
+
+	if err := ValidateArgs(p, []string{"one", "two"}); err != nil {
+		t.Fatalf("unexpected error for valid arguments: %v", err)
+	}
+	if err := ValidateArgs(p, []string{"one", "two", "three"}); !errors.As(err, &usageErr) {
+		t.Fatalf("expected usage error for too many arguments, found %v", err)
+	}
+
+	// plugins without a spec accept any argument
+	if err := ValidateArgs(&greeter{}, []string{"one", "two", "three"}); err != nil {
+		t.Fatalf("unexpected error for plugin without spec: %v", err)
+	}
+}
+
+func TestPluginSpecDoc(t *testing.T) {
+	doc := (&pair{}).Describe().Doc()
+	for _, expected := range []string{"Usage: Pair <first> <second>", "first (required): the first item"} {
+		if !strings.Contains(doc, expected) {
+			t.Fatalf("plugin doc is missing %q:\n%s", expected, doc)
+		}
+	}
+}
@@ -24,15 +24,24 @@ func (p *curtime) Do(args *Input, reply *Reply) error {
 	return nil
 }
 
+// Describes the arguments accepted by the curtime plugin
+func (p *curtime) Describe() PluginSpec {
+	return PluginSpec{
+		Name: p.Name(),
+		Args: []ArgSpec{{
+			Name:        "format",
+			Description: "the date format expressed as a Golang time layout string. Example: Curtime 2006-1-2",
+		}},
+	}
+}
+
 // Renders docstring for curtime plugin
 func (p *curtime) Docs(_ *Input, reply *Reply) error {
 	reply.Message = `Curtime plugin
 
 A plugin to render the current timestamp and send it back to the user.
 
-Name: Curtime
-Args: Curtime [format]
-  - format: the date format expressed as a Golang time layout string. Example: Curtime 2006-1-2`
+Name: Curtime`
 
 	return nil
 }